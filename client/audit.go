@@ -0,0 +1,60 @@
+package main
+
+import (
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// runAuditCommand prints the audit entries matching the flags, one per line,
+// or as JSON with -json.
+func runAuditCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("audit", flag.ContinueOnError)
+	user := flagSet.String("user", "", "only requests of this token name or ID")
+	file := flagSet.String("file", "", "only requests touching this file or directory")
+	tenant := flagSet.String("tenant", "", "only requests of tokens of this tenant")
+	since := flagSet.String("since", "", "only requests after this RFC 3339 time, or this long ago, e.g. 24h")
+	until := flagSet.String("until", "", "only requests before this RFC 3339 time, or this long ago")
+	limit := flagSet.String("limit", "", "most entries to show, the newest (default 1000)")
+	asJSON := flagSet.Bool("json", false, "print the entries as JSON")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	query := url.Values{}
+	for name, value := range map[string]string{"user": *user, "file": *file, "tenant": *tenant, "since": *since, "until": *until, "limit": *limit} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	target := serviceURL(remoteURL, "/v1/audit")
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var list common.AuditEntryList
+	if err := doJSONRequest(client, http.MethodGet, target, nil, &list); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(out, list)
+	}
+	for _, entry := range list.Entries {
+		user := entry.User
+		if user == "" {
+			user = "-"
+		}
+		if entry.Tenant != "" {
+			user = entry.Tenant + ":" + user
+		}
+		operation := entry.Method
+		if entry.Path != "" {
+			operation += " " + entry.Path
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), user, entry.RemoteAddr,
+			entry.Protocol, operation, entry.Status, strings.Join(entry.Files, ","))
+	}
+	return nil
+}
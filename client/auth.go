@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// clientConfig is the client config file, by default
+// $XDG_CONFIG_HOME/store/config.json (STORE_CONFIG names another one).
+type clientConfig struct {
+	Token string `json:"token"`
+}
+
+// clientConfigPath returns the path of the config file, or "" when there is
+// no config directory.
+func clientConfigPath() string {
+	if path := os.Getenv("STORE_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "store", "config.json")
+}
+
+// loadToken returns the API token from STORE_TOKEN or the config file, or ""
+// when neither has one.
+func loadToken() (string, error) {
+	if token := os.Getenv("STORE_TOKEN"); token != "" {
+		return token, nil
+	}
+	path := clientConfigPath()
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var config clientConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return strings.TrimSpace(config.Token), nil
+}
+
+// tokenTransport sends token as bearer token with every request.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
+
+// tokenCredentials sends the token with every gRPC call. The server may run
+// without TLS, so it is allowed over plain connections.
+type tokenCredentials string
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(c)}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// grantsFlag collects repeated -grant PREFIX=ROLE flags.
+type grantsFlag []common.Grant
+
+func (g *grantsFlag) String() string {
+	return fmt.Sprint(*g)
+}
+
+func (g *grantsFlag) Set(value string) error {
+	prefix, role, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("grant %q is not PREFIX=ROLE", value)
+	}
+	*g = append(*g, common.Grant{Prefix: prefix, Role: role})
+	return nil
+}
+
+func runTokenCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	usage := "usage: store token create NAME [-ttl DURATION] [-admin] [-grant PREFIX=ROLE]... [-tenant NAME] [-client-cn CN] [-rate-limit N]\n" +
+		"       store token ls\n" +
+		"       store token revoke ID"
+	if len(args) < 1 {
+		return fmt.Errorf("%s", usage)
+	}
+	switch strings.ToLower(args[0]) {
+	case "create":
+		flagSet := flag.NewFlagSet("token create", flag.ContinueOnError)
+		ttl := flagSet.String("ttl", "", "how long the token is valid, e.g. 720h (default 90 days)")
+		admin := flagSet.Bool("admin", false, "allow the token to manage tokens")
+		var grants grantsFlag
+		flagSet.Var(&grants, "grant", "give ROLE (reader, writer or admin) on the files under PREFIX, repeatable")
+		tenant := flagSet.String("tenant", "", "limit the token to the files of this tenant")
+		clientCN := flagSet.String("client-cn", "", "also authenticate clients presenting a certificate with this common name")
+		rateLimit := flagSet.Float64("rate-limit", 0, "requests per second allowed to the token (default the server's limit)")
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		if err := flagSet.Parse(args[2:]); err != nil {
+			return err
+		}
+		var token common.APIToken
+		req := common.TokenRequest{Name: args[1], TTL: *ttl, Admin: *admin, Grants: grants, Tenant: *tenant, ClientCN: *clientCN, RateLimit: *rateLimit}
+		if err := doJSONRequest(client, http.MethodPost, serviceURL(remoteURL, "/v1/admin/tokens"), req, &token); err != nil {
+			return err
+		}
+		return printJSON(out, token)
+	case "ls":
+		var list common.APITokenList
+		if err := doJSONRequest(client, http.MethodGet, serviceURL(remoteURL, "/v1/admin/tokens"), nil, &list); err != nil {
+			return err
+		}
+		for _, token := range list.Tokens {
+			role := "writer"
+			if token.Admin {
+				role = "admin"
+			} else if len(token.Grants) > 0 {
+				roles := make([]string, 0, len(token.Grants))
+				for _, grant := range token.Grants {
+					roles = append(roles, grant.Prefix+"="+grant.Role)
+				}
+				role = strings.Join(roles, ",")
+			}
+			if token.Tenant != "" {
+				role = token.Tenant + ":" + role
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\texpires %s\n", token.ID, role, token.Name, token.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+		return nil
+	case "revoke":
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		return doJSONRequest(client, http.MethodDelete, serviceURL(remoteURL, "/v1/admin/tokens/"+args[1]), nil, nil)
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
+
+// doJSONRequest sends reqBody, unless nil, as JSON and decodes a successful
+// answer into respBody, unless nil.
+func doJSONRequest(client *http.Client, method string, url string, reqBody any, respBody any) error {
+	var body io.Reader = http.NoBody
+	if reqBody != nil {
+		data, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return responseError(res)
+	}
+	if respBody == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(respBody)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// batchLine is a line of a store batch file: an operation, or a put whose
+// content is read from the local File.
+type batchLine struct {
+	common.BatchOperation
+	File string `json:"file,omitempty"`
+}
+
+// runBatchCommand sends the operations of a JSON lines file as one batch and
+// prints a result per operation.
+func runBatchCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	usage := fmt.Errorf("usage: store batch FILE.jsonl [--atomic]")
+	flagSet := flag.NewFlagSet("batch", flag.ContinueOnError)
+	atomic := flagSet.Bool("atomic", false, "run all operations or none")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() < 1 {
+		return usage
+	}
+	batchFile := flagSet.Arg(0)
+	if err := flagSet.Parse(flagSet.Args()[1:]); err != nil {
+		return err
+	}
+	if flagSet.NArg() > 0 {
+		return usage
+	}
+
+	file, err := os.Open(batchFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	operations, err := readBatchFile(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", batchFile, err)
+	}
+	resp, err := batchOnServer(client, remoteURL, common.BatchRequest{Atomic: *atomic, Operations: operations})
+	if err != nil {
+		return err
+	}
+	for _, result := range resp.Results {
+		target := ""
+		if result.Index >= 0 && result.Index < len(operations) {
+			target = batchOperationTarget(operations[result.Index])
+		}
+		fmt.Fprintf(out, "%d. %s %s: %d %s\n", result.Index+1, result.Op, target,
+			result.Status, strings.ToLower(http.StatusText(result.Status)))
+		if result.Error != nil {
+			fmt.Fprintf(out, "   %s\n", result.Error.Message)
+		}
+	}
+	fmt.Fprintf(out, "%d succeeded, %d failed", resp.Succeeded, resp.Failed)
+	if resp.RolledBack {
+		fmt.Fprint(out, ", rolled back")
+	}
+	fmt.Fprintln(out)
+	if resp.Failed > 0 {
+		return fmt.Errorf("%d of %d operations failed", resp.Failed, len(resp.Results))
+	}
+	return nil
+}
+
+// readBatchFile parses one operation per line; empty lines and lines starting
+// with # are skipped.
+func readBatchFile(r io.Reader) ([]common.BatchOperation, error) {
+	operations := make([]common.BatchOperation, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var parsed batchLine
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&parsed); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if parsed.File != "" {
+			content, err := os.ReadFile(parsed.File)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			parsed.ContentBase64 = base64.StdEncoding.EncodeToString(content)
+		}
+		operations = append(operations, parsed.BatchOperation)
+	}
+	return operations, scanner.Err()
+}
+
+func batchOperationTarget(op common.BatchOperation) string {
+	if op.From != "" || op.To != "" {
+		return op.From + " -> " + op.To
+	}
+	return op.Path
+}
+
+func batchOnServer(client *http.Client, remoteURL string, batchRequest common.BatchRequest) (*common.BatchResponse, error) {
+	payload, err := json.Marshal(batchRequest)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, serviceURL(remoteURL, "/v1/batch"), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	var resp common.BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
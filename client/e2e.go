@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// End-to-end encryption encrypts files in the client, so the server only ever
+// stores ciphertext. Files are encrypted with AES-256-GCM in chunks of
+// e2eChunkSize bytes under a key derived from the SHA-256 of their plaintext
+// and the secret of the user. That makes the encryption convergent: the same
+// content uploaded with the same secret is the same ciphertext, so the hash
+// match of uploads still finds it, while the server cannot tell what a file
+// holds by hashing guesses. An encrypted file is laid out as
+//
+//	magic (8) | nonce (12) | file key wrapped with the secret (48) | chunks...
+//
+// and its chunks as in the server's encryption at rest, the last one being
+// the only one shorter than e2eChunkSize.
+
+const (
+	e2eMagic         = "FSE2E\x00\x00\x01"
+	e2eChunkSize     = 64 << 10
+	e2eChunkOverhead = 16
+	e2eHeaderSize    = len(e2eMagic) + 12 + 32 + 16
+	// e2eNamePrefix starts encrypted file names.
+	e2eNamePrefix = "e2e-"
+	// e2eSaltSize is the size of the random salts deriving secrets from
+	// passphrases.
+	e2eSaltSize = 16
+)
+
+var (
+	errNotE2EEncrypted = errors.New("not an end-to-end encrypted file")
+	errE2EDecrypt      = errors.New("cannot decrypt, the key is wrong or the file was changed")
+)
+
+// e2eKeys are the keys derived from the secret of the user.
+type e2eKeys struct {
+	file      []byte
+	wrapNonce []byte
+	wrap      cipher.AEAD
+	nameNonce []byte
+	name      cipher.AEAD
+}
+
+func newE2EKeys(secret []byte) (*e2eKeys, error) {
+	derive := func(label string) []byte {
+		return e2eMAC(secret, []byte("file store "+label))
+	}
+	wrap, err := newGCM(derive("wrap key"))
+	if err != nil {
+		return nil, err
+	}
+	name, err := newGCM(derive("name key"))
+	if err != nil {
+		return nil, err
+	}
+	return &e2eKeys{
+		file: derive("file key"), wrapNonce: derive("wrap nonce"), wrap: wrap,
+		nameNonce: derive("name nonce"), name: name,
+	}, nil
+}
+
+func e2eMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// e2eKeyFlags adds the flags choosing the secret to flagSet.
+func e2eKeyFlags(flagSet *flag.FlagSet) (keyFile *string, passphraseFile *string) {
+	keyFile = flagSet.String("key-file", "", "read the key from `FILE` (default STORE_KEY_FILE)")
+	passphraseFile = flagSet.String("passphrase-file", "", "derive the key from the passphrase in `FILE` (default STORE_PASSPHRASE)")
+	return keyFile, passphraseFile
+}
+
+// loadE2EKeys derives the keys from a key file, a base64 key of at least 32
+// bytes such as store encryption genkey prints, or from a passphrase and the
+// salt loadE2ESalt returns. Flags come before STORE_KEY_FILE, which comes
+// before STORE_PASSPHRASE.
+func loadE2EKeys(keyFile string, passphraseFile string) (*e2eKeys, error) {
+	if keyFile == "" && passphraseFile == "" {
+		keyFile = os.Getenv("STORE_KEY_FILE")
+	}
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(secret) < 32 {
+			return nil, fmt.Errorf("%s does not hold a base64 key of at least 32 bytes", keyFile)
+		}
+		return newE2EKeys(secret)
+	}
+	passphrase := os.Getenv("STORE_PASSPHRASE")
+	saltFile := ""
+	if configPath := clientConfigPath(); configPath != "" {
+		saltFile = filepath.Join(filepath.Dir(configPath), "e2e.salt")
+	}
+	if passphraseFile != "" {
+		saltFile = passphraseFile + ".salt"
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	if passphrase == "" {
+		return nil, errors.New("encryption needs a key: set STORE_KEY_FILE or STORE_PASSPHRASE, or use -key-file or -passphrase-file")
+	}
+	if saltFile == "" {
+		return nil, errors.New("no config directory to keep the passphrase salt in, use -passphrase-file")
+	}
+	salt, err := loadE2ESalt(saltFile)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newE2EKeys(secret)
+}
+
+// loadE2ESalt returns the base64 salt in the file at path, creating it with a
+// random one the first time. Passphrases thus derive different secrets for
+// different users, and the salt has to travel with the passphrase to decrypt
+// the files elsewhere.
+func loadE2ESalt(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if data, err = createE2ESalt(path); errors.Is(err, os.ErrExist) {
+			data, err = os.ReadFile(path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(salt) < e2eSaltSize {
+		return nil, fmt.Errorf("%s does not hold a base64 salt of at least %d bytes", path, e2eSaltSize)
+	}
+	return salt, nil
+}
+
+// createE2ESalt writes a random salt to a temporary file and links it to path,
+// so concurrent clients agree on one salt. It fails with os.ErrExist when path
+// already exists.
+func createE2ESalt(path string) ([]byte, error) {
+	salt := make([]byte, e2eSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	data := []byte(base64.StdEncoding.EncodeToString(salt) + "\n")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".e2e-salt-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func e2eChunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptFile writes the ciphertext of the local file at path to out.
+func (k *e2eKeys) encryptFile(path string, out io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	fileKey := e2eMAC(k.file, h.Sum(nil))
+	nonce := e2eMAC(k.wrapNonce, fileKey)[:12]
+	header := append([]byte(e2eMagic), nonce...)
+	if _, err := out.Write(k.wrap.Seal(header, nonce, fileKey, []byte(e2eMagic))); err != nil {
+		return err
+	}
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, e2eChunkSize)
+	sealed := make([]byte, 0, e2eChunkSize+e2eChunkOverhead)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(file, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		sealed = aead.Seal(sealed[:0], e2eChunkNonce(index, last), buf[:n], nil)
+		if _, err := out.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decrypt writes the plaintext of the encrypted file read from in to out.
+func (k *e2eKeys) decrypt(out io.Writer, in io.Reader) error {
+	header := make([]byte, e2eHeaderSize)
+	if _, err := io.ReadFull(in, header); err != nil || !bytes.HasPrefix(header, []byte(e2eMagic)) {
+		return errNotE2EEncrypted
+	}
+	nonce := header[len(e2eMagic) : len(e2eMagic)+12]
+	fileKey, err := k.wrap.Open(nil, nonce, header[len(e2eMagic)+12:], []byte(e2eMagic))
+	if err != nil {
+		return errE2EDecrypt
+	}
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(in)
+	buf := make([]byte, e2eChunkSize+e2eChunkOverhead)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err == nil {
+			// A full chunk is the last one when nothing follows it, which
+			// only happens to truncated files.
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		} else if !last {
+			return err
+		}
+		plain, err := aead.Open(buf[:0], e2eChunkNonce(index, last), buf[:n], nil)
+		if err != nil {
+			return errE2EDecrypt
+		}
+		if _, err := out.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// encryptName returns the stored name of name. It is deterministic, so the
+// same name always maps to the same stored file.
+func (k *e2eKeys) encryptName(name string) string {
+	nonce := e2eMAC(k.nameNonce, []byte(name))[:12]
+	return e2eNamePrefix + base64.RawURLEncoding.EncodeToString(k.name.Seal(nonce, nonce, []byte(name), nil))
+}
+
+// decryptName returns the name an encrypted stored name was made from.
+func (k *e2eKeys) decryptName(stored string) (string, bool) {
+	encoded, ok := strings.CutPrefix(stored, e2eNamePrefix)
+	if !ok {
+		return "", false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(data) < 12 {
+		return "", false
+	}
+	name, err := k.name.Open(nil, data[:12], data[12:], nil)
+	return string(name), err == nil
+}
+
+// parseLsCommand shows the stored names in names that were encrypted with
+// add -encrypt-names as they were given, with -decrypt-names.
+func parseLsCommand(args []string, names []string) ([]string, error) {
+	flagSet := flag.NewFlagSet("ls", flag.ContinueOnError)
+	decryptNames := flagSet.Bool("decrypt-names", false, "show encrypted names decrypted")
+	keyFile, passphraseFile := e2eKeyFlags(flagSet)
+	if err := flagSet.Parse(args); err != nil || !*decryptNames {
+		return names, err
+	}
+	keys, err := loadE2EKeys(*keyFile, *passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(names))
+	for _, name := range names {
+		if plain, ok := keys.decryptName(name); ok {
+			name = plain + " (encrypted)"
+		}
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+// uploadOptions say how store add and store update upload files. Without keys
+// files are uploaded as they are.
+type uploadOptions struct {
+	keys         *e2eKeys
+	encryptNames bool
+}
+
+// parseAddCommand splits the flags of store add and store update from the
+// files to upload.
+func parseAddCommand(args []string) (uploadOptions, []string, error) {
+	flagSet := flag.NewFlagSet("add", flag.ContinueOnError)
+	encrypt := flagSet.Bool("encrypt", false, "encrypt the files before uploading them")
+	encryptNames := flagSet.Bool("encrypt-names", false, "encrypt the names of the files too, implies -encrypt")
+	keyFile, passphraseFile := e2eKeyFlags(flagSet)
+	if err := flagSet.Parse(args); err != nil {
+		return uploadOptions{}, nil, err
+	}
+	opts := uploadOptions{encryptNames: *encryptNames}
+	if *encrypt || *encryptNames {
+		keys, err := loadE2EKeys(*keyFile, *passphraseFile)
+		if err != nil {
+			return uploadOptions{}, nil, err
+		}
+		opts.keys = keys
+	}
+	return opts, flagSet.Args(), nil
+}
+
+// storedName is the name a file is uploaded as.
+func (o uploadOptions) storedName(name string) string {
+	if o.encryptNames {
+		return o.keys.encryptName(name)
+	}
+	return name
+}
+
+// open returns what is uploaded of the local file at path.
+func (o uploadOptions) open(path string) (io.ReadCloser, error) {
+	if o.keys == nil {
+		return os.Open(path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(o.keys.encryptFile(path, pw))
+	}()
+	return pr, nil
+}
+
+// hash returns the SHA-256 of what is uploaded of the local file at path,
+// which the server matches against the stored files.
+func (o uploadOptions) hash(path string) (string, error) {
+	content, err := o.open(path)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"file_store/common"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// runEncryptionCommand generates master keys for encryption at rest and
+// rotates the data keys of the stored files to the active one.
+func runEncryptionCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	usage := "usage: store encryption genkey\n" +
+		"       store encryption rotate"
+	if len(args) != 1 {
+		return fmt.Errorf("%s", usage)
+	}
+	switch strings.ToLower(args[0]) {
+	case "genkey":
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, base64.StdEncoding.EncodeToString(key))
+		return nil
+	case "rotate":
+		var res common.KeyRotation
+		if err := doJSONRequest(client, http.MethodPost, serviceURL(remoteURL, "/v1/admin/encryption/rotate"), nil, &res); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "rewrapped %d files with master key %s, %d already were\n", res.Rewrapped, res.ActiveKey, res.Unchanged)
+		for _, failed := range res.Failed {
+			fmt.Fprintf(out, "failed %s: %s\n", failed.Item, failed.Message)
+		}
+		if len(res.Failed) > 0 {
+			return fmt.Errorf("%d files were not rewrapped", len(res.Failed))
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
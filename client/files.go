@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// runGetCommand downloads a stored file through the /v1 API, to stdout unless
+// -o names a local file.
+func runGetCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	return parseGetCommand(args, out, func(name string, out io.Writer) error {
+		return getFileFromServer(client, remoteURL, name, out)
+	})
+}
+
+// parseGetCommand handles the arguments of store get for any transport,
+// decrypting end-to-end encrypted files with -decrypt.
+func parseGetCommand(args []string, out io.Writer, get func(name string, out io.Writer) error) error {
+	flagSet := flag.NewFlagSet("get", flag.ContinueOnError)
+	output := flagSet.String("o", "", "write the file to `FILE` instead of stdout")
+	decrypt := flagSet.Bool("decrypt", false, "decrypt a file uploaded with add -encrypt")
+	encryptedName := flagSet.Bool("encrypted-name", false, "get a file uploaded with add -encrypt-names, implies -decrypt")
+	keyFile, passphraseFile := e2eKeyFlags(flagSet)
+	if len(args) < 1 {
+		return fmt.Errorf("usage: store get NAME [-o FILE] [-decrypt] [-encrypted-name] [-key-file FILE] [-passphrase-file FILE]")
+	}
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return err
+	}
+	name := args[0]
+	var keys *e2eKeys
+	if *decrypt || *encryptedName {
+		var err error
+		if keys, err = loadE2EKeys(*keyFile, *passphraseFile); err != nil {
+			return err
+		}
+	}
+	if *encryptedName {
+		name = keys.encryptName(name)
+	}
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if keys == nil {
+		return get(name, out)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := keys.decrypt(out, pr)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	getErr := get(name, pw)
+	pw.CloseWithError(getErr)
+	if err := <-done; getErr == nil {
+		return err
+	}
+	return getErr
+}
+
+func getFileFromServer(client *http.Client, remoteURL string, name string, out io.Writer) error {
+	elements := strings.Split(name, "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	res, err := client.Get(serviceURL(remoteURL, "/v1/files/"+strings.Join(elements, "/")))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	_, err = io.Copy(out, res.Body)
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func runFreqDiffCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("freq-diff", flag.ContinueOnError)
+	top := flagSet.Int("top", 10, "number of words to show per section")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 2 {
+		return fmt.Errorf("usage: store freq-diff [-top NUM] A B\n" +
+			"A and B are a file name, prefix:PREFIX, store, snapshot:NAME or @TIME")
+	}
+	res, err := freqDiffOnServer(client, remoteURL, flagSet.Arg(0), flagSet.Arg(1), *top)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s: %d words, %s: %d words\n", res.A, res.TotalA, res.B, res.TotalB)
+	sections := []struct {
+		title  string
+		deltas []common.WordCountDelta
+	}{
+		{"Gained", res.Gained},
+		{"Lost", res.Lost},
+		{"Changed", res.Changed},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(out, "\n%s:\n", section.title)
+		for _, delta := range section.deltas {
+			fmt.Fprintf(out, "%+d. %s (%d -> %d)\n", delta.Delta, delta.Word, delta.CountA, delta.CountB)
+		}
+	}
+	printFileNotes(res.Notes)
+	return nil
+}
+
+func freqDiffOnServer(
+	client *http.Client, url string, specA string, specB string, top int,
+) (*common.FreqDiffResponse, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("action", "freq-diff")
+	q.Add("a", specA)
+	q.Add("b", specB)
+	q.Add("top", strconv.Itoa(top))
+	req.URL.RawQuery = q.Encode()
+	var res common.FreqDiffResponse
+	if err := doJobRequest(client, req, http.StatusOK, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func runFreqSnapshotCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	req, err := http.NewRequest("POST", remoteURL, nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("action", "freq-snapshot")
+	if len(args) > 0 {
+		q.Add("name", args[0])
+	}
+	req.URL.RawQuery = q.Encode()
+	var info common.FreqSnapshotInfo
+	if err := doJobRequest(client, req, http.StatusCreated, &info); err != nil {
+		return err
+	}
+	data, err := json.Marshal(info.Files)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "snapshot %s taken at %s over %s\n", info.Name, info.CreatedAt.Format("2006-01-02 15:04:05"), data)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+type grepFlags struct {
+	ignoreCase  bool
+	invertMatch bool
+	after       int
+	before      int
+	context     int
+	maxMatches  int
+}
+
+func runGrepCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("grep", flag.ContinueOnError)
+	var opts grepFlags
+	flagSet.BoolVar(&opts.ignoreCase, "i", false, "ignore case distinctions")
+	flagSet.BoolVar(&opts.invertMatch, "v", false, "select non-matching lines")
+	flagSet.IntVar(&opts.after, "A", 0, "print NUM lines of trailing context")
+	flagSet.IntVar(&opts.before, "B", 0, "print NUM lines of leading context")
+	flagSet.IntVar(&opts.context, "C", 0, "print NUM lines of output context")
+	flagSet.IntVar(&opts.maxMatches, "m", 0, "stop after NUM matching lines")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() < 1 {
+		return fmt.Errorf("usage: store grep [-i] [-v] [-A NUM] [-B NUM] [-C NUM] [-m NUM] PATTERN [FILES...]")
+	}
+	withContext := opts.after > 0 || opts.before > 0 || opts.context > 0
+
+	lastFile := ""
+	lastLine := 0
+	return grepOnServer(client, remoteURL, flagSet.Arg(0), flagSet.Args()[1:], opts, func(line common.GrepLine) {
+		if line.ErrorMsg != "" {
+			fmt.Fprintf(out, "store grep: %s: %s\n", line.FileName, line.ErrorMsg)
+			return
+		}
+		if line.Note != "" {
+			fmt.Fprintf(out, "store grep: %s: %s\n", line.FileName, line.Note)
+			return
+		}
+		if withContext && lastFile != "" && (line.FileName != lastFile || line.LineNumber != lastLine+1) {
+			fmt.Fprintln(out, "--")
+		}
+		separator := "-"
+		if line.Match {
+			separator = ":"
+		}
+		fmt.Fprintf(out, "%s%s%d%s%s\n", line.FileName, separator, line.LineNumber, separator, line.Text)
+		lastFile = line.FileName
+		lastLine = line.LineNumber
+	})
+}
+
+func grepOnServer(
+	client *http.Client, url string, pattern string, files []string, opts grepFlags, onLine func(common.GrepLine),
+) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("action", "grep")
+	q.Add("pattern", pattern)
+	for _, file := range files {
+		q.Add("file", file)
+	}
+	if opts.ignoreCase {
+		q.Add("i", "true")
+	}
+	if opts.invertMatch {
+		q.Add("v", "true")
+	}
+	for name, value := range map[string]int{"A": opts.after, "B": opts.before, "C": opts.context, "max": opts.maxMatches} {
+		if value > 0 {
+			q.Add(name, strconv.Itoa(value))
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	for scanner.Scan() {
+		var line common.GrepLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return err
+		}
+		onLine(line)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"file_store/common"
+	"file_store/storepb"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcUploadChunkSize is the size of the content chunks sent by uploads.
+const grpcUploadChunkSize = 64 * 1024
+
+// grpcCommands are the commands CliHandler runs over gRPC when STORE_GRPC_ADDR
+// is set; everything else keeps using HTTP.
+var grpcCommands = []string{"add", "update", "ls", "get", "rm", "wc", "freq-words"}
+
+func dialGRPC(addr string) (*grpc.ClientConn, error) {
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && strings.HasPrefix(os.Getenv("STORE_URL"), "https://") {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	transportCredentials := insecure.NewCredentials()
+	if tlsConfig != nil {
+		transportCredentials = credentials.NewTLS(tlsConfig)
+	}
+	options := []grpc.DialOption{grpc.WithTransportCredentials(transportCredentials)}
+	token, err := loadToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(tokenCredentials(token)))
+	}
+	return grpc.NewClient(addr, options...)
+}
+
+func runGRPCCommand(client storepb.FileStoreClient, command string, args []string, out io.Writer) error {
+	ctx := context.Background()
+	switch command {
+	case "add", "update":
+		opts, fileNames, err := parseAddCommand(args)
+		if err != nil {
+			return err
+		}
+		return uploadFilesGRPC(ctx, client, fileNames, opts, out)
+	case "ls":
+		res, err := client.List(ctx, &storepb.ListRequest{})
+		if err != nil {
+			return err
+		}
+		for i, file := range res.Files {
+			fmt.Fprintf(out, "%d. %s\n", i+1, file.Name)
+		}
+	case "get":
+		return parseGetCommand(args, out, func(name string, out io.Writer) error {
+			return downloadFileGRPC(ctx, client, name, out)
+		})
+	case "rm":
+		failed := 0
+		for _, name := range args {
+			if _, err := client.Delete(ctx, &storepb.DeleteRequest{Name: name}); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d files could not be deleted", failed, len(args))
+		}
+		fmt.Fprintf(out, "Deleting files done")
+	case "wc":
+		res, err := client.WordCount(ctx, &storepb.WordCountRequest{})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, res.Count)
+	case "freq-words":
+		res, err := client.FrequentWords(ctx, &storepb.FrequentWordsRequest{})
+		if err != nil {
+			return err
+		}
+		for _, word := range res.Words {
+			fmt.Fprintf(out, "%d. %s\n", word.Count, word.Word)
+		}
+		notes := make([]common.FileNote, 0, len(res.Notes))
+		for _, note := range res.Notes {
+			notes = append(notes, common.FileNote{
+				FileName: note.FileName, Source: note.Source, Action: note.Action, Reason: note.Reason,
+			})
+		}
+		printFileNotes(notes)
+	default:
+		return fmt.Errorf("%s is not available over gRPC", command)
+	}
+	return nil
+}
+
+// uploadFilesGRPC uploads local files under their base names, skipping the
+// ones the server can create from a stored file with the same content.
+func uploadFilesGRPC(ctx context.Context, client storepb.FileStoreClient, fileNames []string, opts uploadOptions, out io.Writer) error {
+	req := &storepb.MatchHashesRequest{}
+	for _, fileName := range fileNames {
+		hash, err := opts.hash(fileName)
+		if err != nil {
+			return err
+		}
+		req.Files = append(req.Files, &storepb.FileHash{Name: opts.storedName(filepath.Base(fileName)), Sha256: hash})
+	}
+	res, err := client.MatchHashes(ctx, req)
+	if err != nil {
+		return err
+	}
+	unmatched := make([]string, 0, len(res.Unmatched))
+	for _, file := range res.Unmatched {
+		unmatched = append(unmatched, file.Name)
+	}
+	for _, fileName := range fileNames {
+		name := opts.storedName(filepath.Base(fileName))
+		if !slices.Contains(unmatched, name) {
+			continue
+		}
+		if err := uploadFileGRPC(ctx, client, fileName, name, opts); err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+	}
+	fmt.Fprintf(out, "Uploading files done")
+	return nil
+}
+
+func uploadFileGRPC(ctx context.Context, client storepb.FileStoreClient, localPath string, name string, opts uploadOptions) error {
+	file, err := opts.open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&storepb.UploadRequest{Part: &storepb.UploadRequest_Header{Header: &storepb.UploadHeader{Name: name}}})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, grpcUploadChunkSize)
+	for {
+		n, readErr := file.Read(buf)
+		if n > 0 {
+			err := stream.Send(&storepb.UploadRequest{Part: &storepb.UploadRequest_Chunk{Chunk: buf[:n]}})
+			if errors.Is(err, io.EOF) {
+				// The server ended the stream; CloseAndRecv returns why.
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func downloadFileGRPC(ctx context.Context, client storepb.FileStoreClient, name string, out io.Writer) error {
+	stream, err := client.Download(ctx, &storepb.DownloadRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := out.Write(res.Chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// useGRPC tells whether command goes over gRPC.
+func useGRPC(command string) (string, bool) {
+	addr := os.Getenv("STORE_GRPC_ADDR")
+	return addr, addr != "" && slices.Contains(grpcCommands, strings.ToLower(command))
+}
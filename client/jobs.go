@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const jobPollInterval = time.Second
+
+// serviceURL turns the /files URL the client is configured with into the URL
+// of another route on the same server.
+func serviceURL(remoteURL string, path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(remoteURL, "/"), "/files") + path
+}
+
+func runJobCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	usage := "usage: store job submit KIND [-wait] [NAME=VALUE...]\n" +
+		"       store job status ID\n" +
+		"       store job wait ID\n" +
+		"       store job cancel ID\n" +
+		"       store job ls"
+	if len(args) < 1 {
+		return fmt.Errorf("%s", usage)
+	}
+	switch strings.ToLower(args[0]) {
+	case "submit":
+		flagSet := flag.NewFlagSet("job submit", flag.ContinueOnError)
+		waitForJob := flagSet.Bool("wait", false, "wait for the job and print its result")
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		if err := flagSet.Parse(args[2:]); err != nil {
+			return err
+		}
+		params := make(map[string][]string)
+		for _, param := range flagSet.Args() {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok {
+				return fmt.Errorf("parameter %q is not NAME=VALUE", param)
+			}
+			params[name] = append(params[name], value)
+		}
+		status, err := submitJobOnServer(client, remoteURL, common.JobRequest{Kind: args[1], Params: params})
+		if err != nil {
+			return err
+		}
+		if !*waitForJob {
+			fmt.Fprintln(out, status.ID)
+			return nil
+		}
+		return waitAndPrintJob(client, remoteURL, status.ID, out)
+	case "status":
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		status, err := getJobFromServer(client, remoteURL, http.MethodGet, args[1])
+		if err != nil {
+			return err
+		}
+		return printJSON(out, status)
+	case "wait":
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		return waitAndPrintJob(client, remoteURL, args[1], out)
+	case "cancel":
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		status, err := getJobFromServer(client, remoteURL, http.MethodDelete, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s %s\n", status.ID, status.State)
+		return nil
+	case "ls":
+		jobs, err := listJobsOnServer(client, remoteURL)
+		if err != nil {
+			return err
+		}
+		for _, status := range jobs.Jobs {
+			fmt.Fprintf(out, "%s %-14s %-9s %d/%d\n",
+				status.ID, status.Kind, status.State, status.Progress.Done, status.Progress.Total)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
+
+func printJSON(out io.Writer, value any) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// waitAndPrintJob polls the job until it finishes, showing progress on stderr,
+// and prints its result.
+func waitAndPrintJob(client *http.Client, remoteURL string, id string, out io.Writer) error {
+	for {
+		status, err := getJobFromServer(client, remoteURL, http.MethodGet, id)
+		if err != nil {
+			return err
+		}
+		if status.Finished() {
+			fmt.Fprintln(os.Stderr)
+			switch status.State {
+			case common.JobSucceeded:
+				var indented bytes.Buffer
+				if err := json.Indent(&indented, status.Result, "", "  "); err != nil {
+					return err
+				}
+				fmt.Fprintln(out, indented.String())
+				return nil
+			case common.JobFailed:
+				return fmt.Errorf("job %s failed: %s", id, status.ErrorMsg)
+			default:
+				return fmt.Errorf("job %s was %s", id, status.State)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "\rjob %s %s %d/%d", id, status.State, status.Progress.Done, status.Progress.Total)
+		time.Sleep(jobPollInterval)
+	}
+}
+
+func submitJobOnServer(client *http.Client, remoteURL string, jobRequest common.JobRequest) (*common.JobStatus, error) {
+	payloadBuf := new(bytes.Buffer)
+	err := json.NewEncoder(payloadBuf).Encode(jobRequest)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, serviceURL(remoteURL, "/jobs"), payloadBuf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var status common.JobStatus
+	if err := doJobRequest(client, req, http.StatusAccepted, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func getJobFromServer(client *http.Client, remoteURL string, method string, id string) (*common.JobStatus, error) {
+	req, err := http.NewRequest(method, serviceURL(remoteURL, "/jobs/"+id), nil)
+	if err != nil {
+		return nil, err
+	}
+	expectedStatus := http.StatusOK
+	if method == http.MethodDelete {
+		expectedStatus = http.StatusAccepted
+	}
+	var status common.JobStatus
+	if err := doJobRequest(client, req, expectedStatus, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func listJobsOnServer(client *http.Client, remoteURL string) (*common.JobList, error) {
+	req, err := http.NewRequest(http.MethodGet, serviceURL(remoteURL, "/jobs"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var jobs common.JobList
+	if err := doJobRequest(client, req, http.StatusOK, &jobs); err != nil {
+		return nil, err
+	}
+	return &jobs, nil
+}
+
+func doJobRequest(client *http.Client, req *http.Request, expectedStatus int, respBody any) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expectedStatus {
+		return responseError(res)
+	}
+	return json.NewDecoder(res.Body).Decode(respBody)
+}
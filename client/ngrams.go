@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func runNgramsCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("ngrams", flag.ContinueOnError)
+	n := flagSet.Int("n", 2, "number of words per n-gram")
+	top := flagSet.Int("top", 10, "number of n-grams to show")
+	sortBy := flagSet.String("sort", "count", "rank by \"count\" or by collocation strength \"pmi\"")
+	minCount := flagSet.Int("min-count", -1, "ignore n-grams seen fewer times than this")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	resp, err := returnMostFrequentNgrams(client, remoteURL, *n, *top, *sortBy, *minCount, flagSet.Args())
+	if err != nil {
+		return err
+	}
+	for _, pair := range resp.NgramCountPairs {
+		if *sortBy == "pmi" {
+			fmt.Fprintf(out, "%d. %s (pmi %.3f)\n", pair.Count, pair.Ngram, pair.Score)
+		} else {
+			fmt.Fprintf(out, "%d. %s\n", pair.Count, pair.Ngram)
+		}
+	}
+	printFileNotes(resp.Notes)
+	return nil
+}
+
+func returnMostFrequentNgrams(
+	client *http.Client, url string, n int, top int, sortBy string, minCount int, files []string,
+) (*common.NgramCountServerResponse, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("action", "ngrams")
+	q.Add("n", strconv.Itoa(n))
+	q.Add("top", strconv.Itoa(top))
+	q.Add("sort", sortBy)
+	if minCount >= 0 {
+		q.Add("min_count", strconv.Itoa(minCount))
+	}
+	for _, file := range files {
+		q.Add("file", file)
+	}
+	req.URL.RawQuery = q.Encode()
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	resp := common.NgramCountServerResponse{NgramCountPairs: make([]common.NgramCountPair, 0)}
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
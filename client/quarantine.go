@@ -0,0 +1,55 @@
+package main
+
+import (
+	"file_store/common"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// runQuarantineCommand lists the uploads the virus scanner quarantined, and
+// releases or drops them.
+func runQuarantineCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	usage := "usage: store quarantine ls\n" +
+		"       store quarantine release ID\n" +
+		"       store quarantine rm ID"
+	if len(args) < 1 {
+		return fmt.Errorf("%s", usage)
+	}
+	switch strings.ToLower(args[0]) {
+	case "ls":
+		var list common.QuarantineList
+		if err := doJSONRequest(client, http.MethodGet, serviceURL(remoteURL, "/v1/admin/quarantine"), nil, &list); err != nil {
+			return err
+		}
+		for _, file := range list.Files {
+			name := file.Name
+			if file.Tenant != "" {
+				name = file.Tenant + ":" + name
+			}
+			fmt.Fprintf(out, "%s\t%s\t%d\t%s\t%s\n", file.ID, file.QuarantinedAt.Local().Format("2006-01-02 15:04"),
+				file.Size, file.Signature, name)
+		}
+		return nil
+	case "release":
+		if len(args) != 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		var info common.FileInfo
+		target := serviceURL(remoteURL, "/v1/admin/quarantine/"+url.PathEscape(args[1])+"/release")
+		if err := doJSONRequest(client, http.MethodPost, target, nil, &info); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "released %s (%d bytes)\n", info.Name, info.Size)
+		return nil
+	case "rm":
+		if len(args) != 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		return doJSONRequest(client, http.MethodDelete, serviceURL(remoteURL, "/v1/admin/quarantine/"+url.PathEscape(args[1])), nil, nil)
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
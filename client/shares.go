@@ -0,0 +1,72 @@
+package main
+
+import (
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// runShareCommand creates share links, printing their URL, and lists and
+// revokes them. "ls" and "revoke" are commands, so files with those names
+// cannot be shared from the client.
+func runShareCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	usage := "usage: store share NAME [-expires DURATION] [-max-downloads NUM]\n" +
+		"       store share PREFIX -upload [-expires DURATION] [-max-uploads NUM]\n" +
+		"       store share ls\n" +
+		"       store share revoke ID"
+	if len(args) < 1 {
+		return fmt.Errorf("%s", usage)
+	}
+	switch strings.ToLower(args[0]) {
+	case "ls":
+		var list common.ShareLinkList
+		if err := doJSONRequest(client, http.MethodGet, serviceURL(remoteURL, "/v1/shares"), nil, &list); err != nil {
+			return err
+		}
+		for _, link := range list.Links {
+			uses := fmt.Sprint(link.Uses)
+			if link.MaxUses > 0 {
+				uses += fmt.Sprintf(" of %d", link.MaxUses)
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s uses\texpires %s\n", link.ID, link.Mode, link.Name, uses, link.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+		return nil
+	case "revoke":
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		return doJSONRequest(client, http.MethodDelete, serviceURL(remoteURL, "/v1/shares/"+args[1]), nil, nil)
+	}
+
+	flagSet := flag.NewFlagSet("share", flag.ContinueOnError)
+	expires := flagSet.String("expires", "24h", "how long the link works")
+	upload := flagSet.Bool("upload", false, "let the link upload new files below PREFIX instead of downloading NAME")
+	maxDownloads := flagSet.Int("max-downloads", 0, "how often the file can be downloaded, 0 for unlimited")
+	maxUploads := flagSet.Int("max-uploads", 0, "how many files can be uploaded, 0 for unlimited")
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return err
+	}
+	req := common.ShareRequest{Name: args[0], Mode: common.ShareDownload, Expires: *expires, MaxUses: *maxDownloads}
+	if *upload {
+		if *maxDownloads != 0 {
+			return fmt.Errorf("-max-downloads is for download links, use -max-uploads")
+		}
+		req.Mode, req.MaxUses = common.ShareUpload, *maxUploads
+	} else if *maxUploads != 0 {
+		return fmt.Errorf("-max-uploads needs -upload")
+	}
+	var link common.ShareLink
+	if err := doJSONRequest(client, http.MethodPost, serviceURL(remoteURL, "/v1/shares"), req, &link); err != nil {
+		return err
+	}
+	if link.Mode == common.ShareUpload {
+		fmt.Fprintf(out, "upload with: curl -T FILE '%s'\n", strings.Replace(link.URL, "?", "/FILE?", 1))
+	} else {
+		fmt.Fprintln(out, link.URL)
+	}
+	fmt.Fprintf(out, "expires %s\n", link.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	return nil
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"file_store/common"
+	"file_store/storepb"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 )
@@ -18,8 +20,19 @@ func main() {
 
 	var client *http.Client
 	var remoteURL string
-	remoteURL = "http://localhost:8080/files"
-	client = &http.Client{}
+	remoteURL = serverURL()
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	client = &http.Client{Transport: newTransport(tlsConfig)}
+	token, err := loadToken()
+	if err != nil {
+		panic(err)
+	}
+	if token != "" {
+		client.Transport = &tokenTransport{token: token, base: client.Transport}
+	}
 	//{
 	//
 	//	//setup a mocked http client.
@@ -39,18 +52,44 @@ func main() {
 }
 
 func CliHandler(client *http.Client, remoteURL string) {
-	usageStr := "Usage: store_client add [FILE1] [FILE2]\n" +
-		"or     store_client update [FILE1] [FILE2]\n" +
-		"or     store_client ls\n" +
+	usageStr := "Usage: store_client add [-encrypt] [-encrypt-names] [FILE1] [FILE2]\n" +
+		"or     store_client update [-encrypt] [-encrypt-names] [FILE1] [FILE2]\n" +
+		"or     store_client ls [-decrypt-names]\n" +
+		"or     store_client get NAME [-o FILE] [-decrypt] [-encrypted-name]\n" +
 		"or     store_client wc\n" +
 		"or     store_client rm\n" +
-		"or     store_client freq-words\n"
+		"or     store_client freq-words\n" +
+		"or     store_client grep [-i] [-v] [-A NUM] [-B NUM] [-C NUM] [-m NUM] PATTERN [FILE1] [FILE2]\n" +
+		"or     store_client ngrams [-n NUM] [-top NUM] [-sort count|pmi] [-min-count NUM] [FILE1] [FILE2]\n" +
+		"or     store_client job submit|status|wait|cancel|ls ...\n" +
+		"or     store_client freq-diff [-top NUM] A B\n" +
+		"or     store_client freq-snapshot [NAME]\n" +
+		"or     store_client watch [PREFIX] [--json] [--exec COMMAND]\n" +
+		"or     store_client batch FILE.jsonl [--atomic]\n" +
+		"or     store_client token create|ls|revoke ...\n" +
+		"or     store_client tenant set|ls ...\n" +
+		"or     store_client usage\n" +
+		"or     store_client share NAME|ls|revoke ...\n" +
+		"or     store_client audit [-user NAME] [-file NAME] [-since TIME] [-until TIME] [-limit NUM] [-json]\n" +
+		"or     store_client encryption genkey|rotate\n" +
+		"or     store_client quarantine ls|release|rm ...\n"
 	if len(os.Args) < 2 {
 		fmt.Println(usageStr)
 	}
+	if addr, ok := useGRPC(os.Args[1]); ok {
+		conn, err := dialGRPC(addr)
+		if err != nil {
+			panic(err)
+		}
+		defer conn.Close()
+		if err := runGRPCCommand(storepb.NewFileStoreClient(conn), strings.ToLower(os.Args[1]), os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+		return
+	}
 	switch strings.ToLower(os.Args[1]) {
 	case "add":
-		if err := UploadFiles(client, remoteURL, os.Args[2:]); err != nil {
+		if err := runAddCommand(client, remoteURL, os.Args[2:]); err != nil {
 			panic(err)
 		} else {
 			fmt.Printf("Uploading files done")
@@ -60,9 +99,16 @@ func CliHandler(client *http.Client, remoteURL string) {
 		if err != nil {
 			panic(err)
 		}
+		if listOfFiles.Files, err = parseLsCommand(os.Args[2:], listOfFiles.Files); err != nil {
+			panic(err)
+		}
 		for i, fileName := range listOfFiles.Files {
 			fmt.Printf("%d. %s\n", i+1, fileName)
 		}
+	case "get":
+		if err := runGetCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
 	case "rm":
 		if unSuccessful, err := removeFilesFromServer(client, remoteURL, os.Args[2:]); err != nil {
 			panic(err)
@@ -75,7 +121,7 @@ func CliHandler(client *http.Client, remoteURL string) {
 			fmt.Printf("Deleting files done")
 		}
 	case "update":
-		if err := UploadFiles(client, remoteURL, os.Args[2:]); err != nil {
+		if err := runAddCommand(client, remoteURL, os.Args[2:]); err != nil {
 			panic(err)
 		} else {
 			fmt.Printf("Uploading files done")
@@ -85,7 +131,8 @@ func CliHandler(client *http.Client, remoteURL string) {
 		if err != nil {
 			panic(err)
 		} else {
-			fmt.Println(ret)
+			fmt.Println(ret.Count)
+			printFileNotes(ret.Notes)
 		}
 	case "freq-words":
 		wcCountResp, err := returnMostFrequentWords(client, remoteURL)
@@ -104,12 +151,94 @@ func CliHandler(client *http.Client, remoteURL string) {
 			for _, pair := range (*wcCountResp).WordCountPairs {
 				fmt.Printf("%d. %s\n", pair.Count, pair.Word)
 			}
+			printFileNotes(wcCountResp.Notes)
+		}
+	case "grep":
+		if err := runGrepCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "ngrams":
+		if err := runNgramsCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "job":
+		if err := runJobCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "freq-diff":
+		if err := runFreqDiffCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "freq-snapshot":
+		if err := runFreqSnapshotCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "watch":
+		if err := runWatchCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "token":
+		if err := runTokenCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "batch":
+		if err := runBatchCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "tenant":
+		if err := runTenantCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "usage":
+		if err := runUsageCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "share":
+		if err := runShareCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "audit":
+		if err := runAuditCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "encryption":
+		if err := runEncryptionCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
+		}
+	case "quarantine":
+		if err := runQuarantineCommand(client, remoteURL, os.Args[2:], os.Stdout); err != nil {
+			panic(err)
 		}
 	default:
 		fmt.Fprintln(os.Stderr, usageStr)
 	}
 }
 
+// printFileNotes reports parts of stored files the server skipped or had to
+// transform for analytics.
+func printFileNotes(notes []common.FileNote) {
+	for _, note := range notes {
+		if note.Action == common.FileNoteSkipped || note.Action == common.FileNoteTruncated {
+			fmt.Fprintf(os.Stderr, "%s: %s (%s)\n", note.Source, note.Action, note.Reason)
+		}
+	}
+}
+
+// responseError turns an error response into a *common.ErrorResponse. Bodies
+// that are not in that shape, e.g. from a proxy, become its message.
+func responseError(res *http.Response) error {
+	body, _ := io.ReadAll(res.Body)
+	var errResp common.ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Code == "" {
+		errResp = common.ErrorResponse{
+			Status:  res.StatusCode,
+			Code:    strings.ReplaceAll(strings.ToLower(http.StatusText(res.StatusCode)), " ", "_"),
+			Message: strings.TrimSpace(string(body)),
+		}
+	}
+	return &errResp
+}
+
 func returnMostFrequentWords(client *http.Client, url string) (*common.WcCountServerResponse, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -123,7 +252,7 @@ func returnMostFrequentWords(client *http.Client, url string) (*common.WcCountSe
 		return nil, err
 	}
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad status: %s", res.Status)
+		return nil, responseError(res)
 	}
 	resp := common.WcCountServerResponse{WordCountPairs: make([]common.WordCountPair, 0)}
 	err = json.NewDecoder(res.Body).Decode(&resp)
@@ -133,23 +262,26 @@ func returnMostFrequentWords(client *http.Client, url string) (*common.WcCountSe
 	return &resp, nil
 }
 
-func countNumberOfWordInAllServerFiles(client *http.Client, url string) (string, error) {
+func countNumberOfWordInAllServerFiles(client *http.Client, url string) (*common.WordCountServerResponse, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	q := req.URL.Query()
 	q.Add("action", "wc")
 	req.URL.RawQuery = q.Encode()
 	res, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad status: %s", res.Status)
+		return nil, responseError(res)
+	}
+	var resp common.WordCountServerResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
 	}
-	bodyBytes, err := io.ReadAll(res.Body)
-	return string(bodyBytes), nil
+	return &resp, nil
 }
 
 func removeFilesFromServer(
@@ -170,7 +302,7 @@ func removeFilesFromServer(
 		return nil, err
 	}
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad status: %s", res.Status)
+		return nil, responseError(res)
 	}
 	resp := common.FileDeletionResponse{UnsuccessfulFileNames: make([]common.FileNameErrorPair, 0)}
 	err = json.NewDecoder(res.Body).Decode(&resp)
@@ -190,8 +322,7 @@ func listFileOnServer(client *http.Client, url string) (*common.FileList, error)
 		return nil, err
 	}
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad status: %s", res.Status)
-		return nil, err
+		return nil, responseError(res)
 	}
 	var respBody common.FileList
 	err = json.NewDecoder(res.Body).Decode(&respBody)
@@ -201,9 +332,19 @@ func listFileOnServer(client *http.Client, url string) (*common.FileList, error)
 	return &respBody, nil
 }
 
-func UploadFiles(httpClient *http.Client, uploadUrl string, fileNames []string) error {
+// runAddCommand uploads the files named in args after the flags of
+// parseAddCommand.
+func runAddCommand(httpClient *http.Client, uploadUrl string, args []string) error {
+	opts, fileNames, err := parseAddCommand(args)
+	if err != nil {
+		return err
+	}
+	return UploadFiles(httpClient, uploadUrl, fileNames, opts)
+}
+
+func UploadFiles(httpClient *http.Client, uploadUrl string, fileNames []string, opts uploadOptions) error {
 	log.Printf("in UploadFiles")
-	fileNamesRest := tryWithSha256(httpClient, uploadUrl, fileNames)
+	fileNamesRest := tryWithSha256(httpClient, uploadUrl, fileNames, opts)
 	log.Printf("fileNamesRest %v", fileNamesRest)
 
 	if len(fileNamesRest) == 0 {
@@ -214,7 +355,7 @@ func UploadFiles(httpClient *http.Client, uploadUrl string, fileNames []string)
 	var multiPartFormBytes bytes.Buffer
 	multiPartFormWriter := multipart.NewWriter(&multiPartFormBytes)
 
-	errForFiles := buildMultiPartForm(fileNamesRest, multiPartFormWriter)
+	errForFiles := buildMultiPartForm(fileNamesRest, multiPartFormWriter, opts)
 
 	for fileName, err := range errForFiles {
 		if err != nil {
@@ -247,17 +388,17 @@ func UploadFiles(httpClient *http.Client, uploadUrl string, fileNames []string)
 		return err
 	}
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad status: %s", res.Status)
+		return responseError(res)
 	}
-	return err
+	return nil
 }
 
-func tryWithSha256(httpClient *http.Client, uploadUrl string, fileNames []string) []string {
+func tryWithSha256(httpClient *http.Client, uploadUrl string, fileNames []string, opts uploadOptions) []string {
 	log.Printf("tryWithSha256")
 	reqBody := common.TryWithSha256Request{FileSha256Pairs: make([]common.FileSha256Pair, 0)}
 	hashToFileMap := make(map[string][]string)
 	for _, name := range fileNames {
-		hash, errX := common.CalculateSha256ForFile(name)
+		hash, errX := opts.hash(name)
 		if errX != nil {
 			continue
 		}
@@ -270,7 +411,7 @@ func tryWithSha256(httpClient *http.Client, uploadUrl string, fileNames []string
 		}
 		reqBody.FileSha256Pairs = append(
 			reqBody.FileSha256Pairs,
-			common.FileSha256Pair{FileName: name, FileHash: hash},
+			common.FileSha256Pair{FileName: opts.storedName(name), FileHash: hash},
 		)
 	}
 
@@ -307,16 +448,16 @@ func tryWithSha256(httpClient *http.Client, uploadUrl string, fileNames []string
 	return rests
 }
 
-func buildMultiPartForm(fileNames []string, multiPartFormWriter *multipart.Writer) (errForFiles map[string]error) {
+func buildMultiPartForm(fileNames []string, multiPartFormWriter *multipart.Writer, opts uploadOptions) (errForFiles map[string]error) {
 	errForFiles = make(map[string]error)
 	for _, fileName := range fileNames {
 		errForFiles[fileName] = func() error {
-			file, err := os.Open(fileName)
-			defer file.Close()
+			file, err := opts.open(fileName)
 			if err != nil {
 				return err
 			}
-			fw, err := multiPartFormWriter.CreateFormFile(fileName, file.Name())
+			defer file.Close()
+			fw, err := multiPartFormWriter.CreateFormFile(fileName, opts.storedName(filepath.Base(fileName)))
 			if err != nil {
 				return err
 			}
@@ -326,7 +467,7 @@ func buildMultiPartForm(fileNames []string, multiPartFormWriter *multipart.Write
 			if err != nil {
 				return err
 			}
-			sha256Hash, err := common.CalculateSha256ForFile(fileName)
+			sha256Hash, err := opts.hash(fileName)
 			if err != nil {
 				return err
 			}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"file_store/common"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -22,6 +34,8 @@ func TestServerReq(t *testing.T) {
 					panic(err)
 				}
 				fmt.Printf("%s", b)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, "{}")
 			}))
 			defer ts.Close()
 			client = ts.Client()
@@ -36,3 +50,392 @@ func TestServerReq(t *testing.T) {
 		}
 	})
 }
+
+func TestResponseError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/json/") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"status":404,"code":"not_found","message":"a.txt: file not found","request_id":"abc"}`)
+			return
+		}
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	err := getFileFromServer(ts.Client(), ts.URL+"/json", "a.txt", io.Discard)
+	var errResp *common.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Code != "not_found" || errResp.RequestID != "abc" {
+		t.Errorf("got %v", err)
+	}
+	err = getFileFromServer(ts.Client(), ts.URL+"/plain", "a.txt", io.Discard)
+	if !errors.As(err, &errResp) || errResp.Status != http.StatusBadGateway || errResp.Message != "bad gateway" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/events" || r.Header.Get("Last-Event-ID") != "" {
+			t.Errorf("got %s with Last-Event-ID %q", r.URL.Path, r.Header.Get("Last-Event-ID"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "id: 1\nevent: created\ndata: {\"seq\":1,\"type\":\"created\",\"name\":\"docs/a.txt\",\"size\":5}\n\n")
+		fmt.Fprint(w, "id: 2\nevent: created\ndata: {\"seq\":2,\"type\":\"created\",\"name\":\"other/b.txt\",\"size\":4}\n\n")
+		fmt.Fprint(w, "id: 3\nevent: renamed\ndata: {\"seq\":3,\"type\":\"renamed\",\"name\":\"x.txt\",\"old_name\":\"docs/a.txt\",\"size\":5}\n\n")
+	}))
+	defer ts.Close()
+
+	opts, err := parseWatchCommand([]string{"docs/", "--json", "--exec", `echo "$STORE_EVENT_TYPE $STORE_EVENT_NAME"`})
+	if err != nil || opts.prefix != "docs/" || !opts.jsonOutput || opts.command == "" {
+		t.Fatalf("got %+v, %v", opts, err)
+	}
+	if _, err := parseWatchCommand([]string{"a", "b"}); err == nil {
+		t.Errorf("two prefixes accepted")
+	}
+
+	stream, err := openEventStream(context.Background(), ts.Client(), ts.URL+"/files", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var out strings.Builder
+	if err := readEvents(stream, func(event common.FileEvent) error {
+		return handleWatchEvent(opts, event, &out)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"seq":1,"type":"created","name":"docs/a.txt","size":5,"time":"0001-01-01T00:00:00Z"}` + "\n" +
+		"created docs/a.txt\n" +
+		`{"seq":3,"type":"renamed","name":"x.txt","old_name":"docs/a.txt","size":5,"time":"0001-01-01T00:00:00Z"}` + "\n" +
+		"renamed x.txt\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestToken(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"token": "st_from_file"}`), 0600)
+	t.Setenv("STORE_CONFIG", configPath)
+	t.Setenv("STORE_TOKEN", "")
+	if token, err := loadToken(); err != nil || token != "st_from_file" {
+		t.Errorf("got %q, %v from the config file", token, err)
+	}
+	t.Setenv("STORE_TOKEN", "st_from_env")
+	token, err := loadToken()
+	if err != nil || token != "st_from_env" {
+		t.Errorf("got %q, %v from STORE_TOKEN", token, err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer st_from_env" {
+			t.Errorf("got Authorization %q", r.Header.Get("Authorization"))
+		}
+		fmt.Fprint(w, `{"files": []}`)
+	}))
+	defer ts.Close()
+	client := &http.Client{Transport: &tokenTransport{token: token, base: http.DefaultTransport}}
+	if _, err := listFileOnServer(client, ts.URL+"/files"); err != nil {
+		t.Error(err)
+	}
+	var grants grantsFlag
+	if err := grants.Set("artifacts/=writer"); err != nil || len(grants) != 1 || grants[0] != (common.Grant{Prefix: "artifacts/", Role: "writer"}) {
+		t.Errorf("got %v, %v", grants, err)
+	}
+	if err := grants.Set("artifacts/"); err == nil {
+		t.Errorf("accepted a grant without a role")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/usage" {
+			t.Errorf("got %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"name": "red", "max_bytes": 100, "max_files": 0, "bytes": 42, "files": 3}`)
+	}))
+	defer ts.Close()
+	var out bytes.Buffer
+	if err := runUsageCommand(ts.Client(), ts.URL+"/files", nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "red\t42 of 100 bytes\t3 of unlimited files\n" {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"files": []}`)
+	}))
+	defer ts.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("STORE_URL", ts.URL+"/")
+	t.Setenv("STORE_CA_CERT", caFile)
+	if got := serverURL(); got != ts.URL+"/files" {
+		t.Errorf("got %s", got)
+	}
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listFileOnServer(&http.Client{Transport: newTransport(tlsConfig)}, serverURL()); err != nil {
+		t.Errorf("listing with the CA bundle: %v", err)
+	}
+	if _, err := listFileOnServer(&http.Client{}, serverURL()); err == nil {
+		t.Errorf("trusted the test server without the CA bundle")
+	}
+
+	t.Setenv("STORE_CLIENT_CERT", caFile)
+	if _, err := clientTLSConfig(); err == nil {
+		t.Errorf("accepted a client certificate without a key")
+	}
+}
+
+func TestShare(t *testing.T) {
+	var got common.ShareRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/shares" {
+			t.Errorf("got %s %s", r.Method, r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id": "ab12", "mode": %q, "url": "http://store/v1/shared/ab12?sig=cd34", "expires_at": "2030-01-02T03:04:05Z"}`, got.Mode)
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	if err := runShareCommand(ts.Client(), ts.URL+"/files", []string{"report.txt", "--expires", "48h", "--max-downloads", "3"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got != (common.ShareRequest{Name: "report.txt", Mode: common.ShareDownload, Expires: "48h", MaxUses: 3}) {
+		t.Errorf("sent %+v", got)
+	}
+	if !strings.HasPrefix(out.String(), "http://store/v1/shared/ab12?sig=cd34\n") {
+		t.Errorf("got %q", out.String())
+	}
+
+	out.Reset()
+	if err := runShareCommand(ts.Client(), ts.URL+"/files", []string{"inbox/acme", "-upload", "-max-uploads", "5"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode != common.ShareUpload || got.MaxUses != 5 || got.Expires != "24h" {
+		t.Errorf("sent %+v", got)
+	}
+	if !strings.Contains(out.String(), "curl -T FILE 'http://store/v1/shared/ab12/FILE?sig=cd34'") {
+		t.Errorf("got %q", out.String())
+	}
+	if err := runShareCommand(ts.Client(), ts.URL+"/files", []string{"report.txt", "-max-uploads", "1"}, &out); err == nil {
+		t.Errorf("accepted -max-uploads for a download link")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/audit" || r.URL.Query().Get("user") != "ci" || r.URL.Query().Get("since") != "24h" || r.URL.Query().Has("file") {
+			t.Errorf("got %s", r.URL)
+		}
+		fmt.Fprint(w, `{"entries": [{"time": "2030-01-02T03:04:05Z", "protocol": "http", "user": "ci", "remote_addr": "10.0.0.7:5123",
+			"method": "PUT", "path": "/v1/files/a.txt", "files": ["a.txt"], "status": 201}]}`)
+	}))
+	defer ts.Close()
+	var out bytes.Buffer
+	if err := runAuditCommand(ts.Client(), ts.URL+"/files", []string{"-user", "ci", "-since", "24h"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "\tci\t10.0.0.7:5123\thttp\tPUT /v1/files/a.txt\t201\ta.txt\n") {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/admin/encryption/rotate" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		fmt.Fprint(w, `{"active_key": "0a1b2c3d4e5f6a7b", "rewrapped": 3, "unchanged": 1, "failed": []}`)
+	}))
+	defer ts.Close()
+	var out bytes.Buffer
+	if err := runEncryptionCommand(ts.Client(), ts.URL+"/files", []string{"rotate"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "rewrapped 3 files with master key 0a1b2c3d4e5f6a7b, 1 already were\n" {
+		t.Errorf("got %q", out.String())
+	}
+	out.Reset()
+	if err := runEncryptionCommand(ts.Client(), ts.URL+"/files", []string{"genkey"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out.String())); err != nil || len(key) != 32 {
+		t.Errorf("generated %q", out.String())
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/admin/quarantine":
+			fmt.Fprint(w, `{"files": [{"id": "0a1b", "name": "docs/x.exe", "size": 68, "signature": "Eicar-Test-Signature",
+				"quarantined_at": "2024-05-01T10:00:00Z"}]}`)
+		case "POST /v1/admin/quarantine/0a1b/release":
+			fmt.Fprint(w, `{"name": "docs/x.exe", "size": 68}`)
+		default:
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+	var out bytes.Buffer
+	if err := runQuarantineCommand(ts.Client(), ts.URL+"/files", []string{"ls"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "0a1b\t") || !strings.HasSuffix(out.String(), "\t68\tEicar-Test-Signature\tdocs/x.exe\n") {
+		t.Errorf("got %q", out.String())
+	}
+	out.Reset()
+	if err := runQuarantineCommand(ts.Client(), ts.URL+"/files", []string{"release", "0a1b"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "released docs/x.exe (68 bytes)\n" {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestEndToEndEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "store.key")
+	os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))+"\n"), 0600)
+	t.Setenv("STORE_KEY_FILE", keyFile)
+	keys, err := loadE2EKeys("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("files", func(t *testing.T) {
+		for _, size := range []int{0, 5, e2eChunkSize, 2*e2eChunkSize + 3} {
+			plain := bytes.Repeat([]byte("secret "), size/7+1)[:size]
+			path := filepath.Join(dir, "plain")
+			os.WriteFile(path, plain, 0600)
+			var sealed, again bytes.Buffer
+			if err := keys.encryptFile(path, &sealed); err != nil {
+				t.Fatal(err)
+			}
+			keys.encryptFile(path, &again)
+			if !bytes.Equal(sealed.Bytes(), again.Bytes()) {
+				t.Errorf("size %d: encryption is not convergent", size)
+			}
+			if size > 0 && bytes.Contains(sealed.Bytes(), []byte("secret")) {
+				t.Errorf("size %d: plaintext in the ciphertext", size)
+			}
+			var out bytes.Buffer
+			if err := keys.decrypt(&out, bytes.NewReader(sealed.Bytes())); err != nil || !bytes.Equal(out.Bytes(), plain) {
+				t.Errorf("size %d: decrypted %d bytes, %v", size, out.Len(), err)
+			}
+			if size >= e2eChunkSize {
+				truncated := sealed.Bytes()[:e2eHeaderSize+e2eChunkSize+e2eChunkOverhead]
+				if err := keys.decrypt(io.Discard, bytes.NewReader(truncated)); !errors.Is(err, errE2EDecrypt) {
+					t.Errorf("size %d: decrypted a truncated file, %v", size, err)
+				}
+			}
+		}
+		other, _ := newE2EKeys(bytes.Repeat([]byte{8}, 32))
+		var sealed bytes.Buffer
+		keys.encryptFile(filepath.Join(dir, "plain"), &sealed)
+		if err := other.decrypt(io.Discard, &sealed); !errors.Is(err, errE2EDecrypt) {
+			t.Errorf("decrypted with another key, %v", err)
+		}
+		if err := keys.decrypt(io.Discard, strings.NewReader("plain text")); !errors.Is(err, errNotE2EEncrypted) {
+			t.Errorf("decrypted plaintext, %v", err)
+		}
+	})
+
+	t.Run("names", func(t *testing.T) {
+		stored := keys.encryptName("q3 report.pdf")
+		if stored != keys.encryptName("q3 report.pdf") || strings.Contains(stored, "report") || !strings.HasPrefix(stored, e2eNamePrefix) {
+			t.Errorf("encrypted to %q", stored)
+		}
+		if name, ok := keys.decryptName(stored); !ok || name != "q3 report.pdf" {
+			t.Errorf("decrypted to %q, %v", name, ok)
+		}
+	})
+
+	t.Run("passphrases", func(t *testing.T) {
+		passphraseFile := filepath.Join(dir, "passphrase")
+		os.WriteFile(passphraseFile, []byte("correct horse\n"), 0600)
+		first, err := loadE2EKeys("", passphraseFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := loadE2EKeys("", passphraseFile)
+		if _, err := os.Stat(passphraseFile + ".salt"); err != nil || first.encryptName("a") != again.encryptName("a") {
+			t.Errorf("the salt was not kept, %v", err)
+		}
+		// Another user with the same passphrase gets another salt.
+		t.Setenv("STORE_KEY_FILE", "")
+		t.Setenv("STORE_CONFIG", filepath.Join(dir, "config", "config.json"))
+		t.Setenv("STORE_PASSPHRASE", "correct horse")
+		other, err := loadE2EKeys("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "config", "e2e.salt")); err != nil || other.encryptName("a") == first.encryptName("a") {
+			t.Errorf("the same passphrase derived the same key, %v", err)
+		}
+		os.WriteFile(passphraseFile+".salt", []byte("short\n"), 0600)
+		if _, err := loadE2EKeys("", passphraseFile); err == nil {
+			t.Errorf("loaded a bad salt")
+		}
+	})
+
+	t.Run("add and get", func(t *testing.T) {
+		stored := make(map[string][]byte)
+		var matched []common.FileSha256Pair
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Query().Get("action") == "try_with_sha256":
+				var req common.TryWithSha256Request
+				json.NewDecoder(r.Body).Decode(&req)
+				matched = append(matched, req.FileSha256Pairs...)
+				json.NewEncoder(w).Encode(common.TryWithSha256Response{UnsuccessfulFileNames: req.FileSha256Pairs})
+			case r.Method == http.MethodPost:
+				r.ParseMultipartForm(1 << 20)
+				for _, headers := range r.MultipartForm.File {
+					file, _ := headers[0].Open()
+					stored[headers[0].Filename], _ = io.ReadAll(file)
+				}
+			default:
+				data, ok := stored[strings.TrimPrefix(r.URL.Path, "/v1/files/")]
+				if !ok {
+					http.NotFound(w, r)
+				}
+				w.Write(data)
+			}
+		}))
+		defer ts.Close()
+		path := filepath.Join(dir, "payroll.csv")
+		os.WriteFile(path, []byte("name,salary\nada,1\n"), 0600)
+		if err := runAddCommand(ts.Client(), ts.URL+"/files", []string{"--encrypt-names", path}); err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 1 || stored[keys.encryptName("payroll.csv")] == nil || bytes.Contains(stored[keys.encryptName("payroll.csv")], []byte("salary")) {
+			t.Fatalf("stored %q", stored)
+		}
+		sum := sha256.Sum256(stored[keys.encryptName("payroll.csv")])
+		if len(matched) != 1 || matched[0].FileHash != hex.EncodeToString(sum[:]) {
+			t.Errorf("matched %+v, not the hash of the ciphertext", matched)
+		}
+		var out bytes.Buffer
+		if err := runGetCommand(ts.Client(), ts.URL+"/files", []string{"payroll.csv", "-encrypted-name"}, &out); err != nil || out.String() != "name,salary\nada,1\n" {
+			t.Errorf("got %q, %v", out.String(), err)
+		}
+		if err := runGetCommand(ts.Client(), ts.URL+"/files", []string{"missing.csv", "-encrypted-name"}, io.Discard); err == nil || errors.Is(err, errNotE2EEncrypted) {
+			t.Errorf("got %v for a missing file", err)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// runUsageCommand prints what the tenant of the token stores against its
+// quotas.
+func runUsageCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	var usage common.TenantUsage
+	if err := doJSONRequest(client, http.MethodGet, serviceURL(remoteURL, "/v1/usage"), nil, &usage); err != nil {
+		return err
+	}
+	printTenantUsage(out, usage)
+	return nil
+}
+
+func printTenantUsage(out io.Writer, usage common.TenantUsage) {
+	limit := func(max int64) string {
+		if max == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(max)
+	}
+	name := usage.Name
+	if name == "" {
+		name = "(shared)"
+	}
+	fmt.Fprintf(out, "%s\t%d of %s bytes\t%d of %s files\n", name, usage.Bytes, limit(usage.MaxBytes), usage.Files, limit(usage.MaxFiles))
+}
+
+func runTenantCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	usage := "usage: store tenant set NAME [-max-bytes NUM] [-max-files NUM]\n" +
+		"       store tenant ls"
+	if len(args) < 1 {
+		return fmt.Errorf("%s", usage)
+	}
+	switch strings.ToLower(args[0]) {
+	case "set":
+		flagSet := flag.NewFlagSet("tenant set", flag.ContinueOnError)
+		maxBytes := flagSet.Int64("max-bytes", 0, "bytes the tenant may store, 0 for unlimited")
+		maxFiles := flagSet.Int64("max-files", 0, "files the tenant may store, 0 for unlimited")
+		if len(args) < 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		if err := flagSet.Parse(args[2:]); err != nil {
+			return err
+		}
+		var tenant common.Tenant
+		if err := doJSONRequest(client, http.MethodPut, serviceURL(remoteURL, "/v1/admin/tenants/"+args[1]),
+			common.Tenant{MaxBytes: *maxBytes, MaxFiles: *maxFiles}, &tenant); err != nil {
+			return err
+		}
+		return printJSON(out, tenant)
+	case "ls":
+		var list common.TenantList
+		if err := doJSONRequest(client, http.MethodGet, serviceURL(remoteURL, "/v1/admin/tenants"), nil, &list); err != nil {
+			return err
+		}
+		for _, usage := range list.Tenants {
+			printTenantUsage(out, usage)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultServerURL is where the client looks for the server unless STORE_URL
+// says otherwise.
+const defaultServerURL = "http://localhost:8080"
+
+// serverURL returns the URL of the legacy /files API from STORE_URL.
+func serverURL() string {
+	base := os.Getenv("STORE_URL")
+	if base == "" {
+		base = defaultServerURL
+	}
+	return strings.TrimSuffix(base, "/") + "/files"
+}
+
+// clientTLSConfig returns the TLS settings from STORE_CA_CERT, a CA bundle to
+// verify the server with instead of the system roots, and STORE_CLIENT_CERT
+// with STORE_CLIENT_KEY, a certificate for mutual TLS. It returns nil when
+// none is set.
+func clientTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("STORE_CA_CERT")
+	certFile, keyFile := os.Getenv("STORE_CLIENT_CERT"), os.Getenv("STORE_CLIENT_KEY")
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("STORE_CLIENT_CERT and STORE_CLIENT_KEY must be set together")
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newTransport returns the transport for HTTP requests, using tlsConfig for
+// HTTPS if set.
+func newTransport(tlsConfig *tls.Config) http.RoundTripper {
+	if tlsConfig == nil {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
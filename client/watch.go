@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	watchRetryInitial = time.Second
+	watchRetryMax     = 30 * time.Second
+)
+
+type watchFlags struct {
+	prefix     string
+	jsonOutput bool
+	command    string
+}
+
+// runWatchCommand prints the changes of the stored files under a prefix as
+// they happen, reconnecting to the change feed where it left off until it is
+// interrupted.
+func runWatchCommand(client *http.Client, remoteURL string, args []string, out io.Writer) error {
+	opts, err := parseWatchCommand(args)
+	if err != nil {
+		return err
+	}
+	lastEventID := ""
+	retry := watchRetryInitial
+	for attempt := 0; ; attempt++ {
+		stream, err := openEventStream(context.Background(), client, remoteURL, lastEventID)
+		var errResp *common.ErrorResponse
+		if attempt == 0 && err != nil || errors.As(err, &errResp) && errResp.Status < 500 {
+			// The server is not reachable, or does not offer the feed.
+			return err
+		}
+		if err == nil {
+			err = readEvents(stream, func(event common.FileEvent) error {
+				retry = watchRetryInitial
+				if event.Type != common.EventsTruncated {
+					lastEventID = strconv.FormatInt(event.Seq, 10)
+				}
+				return handleWatchEvent(opts, event, out)
+			})
+			stream.Close()
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		fmt.Fprintf(os.Stderr, "store watch: %v, reconnecting in %s\n", err, retry)
+		time.Sleep(retry)
+		retry = min(2*retry, watchRetryMax)
+	}
+}
+
+// parseWatchCommand takes the flags before or after the prefix.
+func parseWatchCommand(args []string) (watchFlags, error) {
+	usage := fmt.Errorf("usage: store watch [PREFIX] [--json] [--exec COMMAND]")
+	var opts watchFlags
+	flagSet := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flagSet.BoolVar(&opts.jsonOutput, "json", false, "print each event as a JSON line")
+	flagSet.StringVar(&opts.command, "exec", "", "run `COMMAND` with sh -c for each event")
+	if err := flagSet.Parse(args); err != nil {
+		return opts, err
+	}
+	if flagSet.NArg() > 0 {
+		opts.prefix = flagSet.Arg(0)
+		if err := flagSet.Parse(flagSet.Args()[1:]); err != nil {
+			return opts, err
+		}
+	}
+	if flagSet.NArg() > 0 {
+		return opts, usage
+	}
+	return opts, nil
+}
+
+// openEventStream connects to GET /v1/events, resuming after lastEventID
+// unless it is empty.
+func openEventStream(ctx context.Context, client *http.Client, remoteURL string, lastEventID string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serviceURL(remoteURL, "/v1/events"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, responseError(res)
+	}
+	return res.Body, nil
+}
+
+// readEvents calls handle for each server-sent event of stream until it ends.
+func readEvents(stream io.Reader, handle func(common.FileEvent) error) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				var event common.FileEvent
+				if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event); err != nil {
+					return fmt.Errorf("invalid event: %w", err)
+				}
+				if err := handle(event); err != nil {
+					return err
+				}
+			}
+			data = data[:0]
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		// id and event repeat what is in the data; lines starting with : are
+		// keep-alive comments.
+		if field == "data" {
+			data = append(data, value)
+		}
+	}
+	return scanner.Err()
+}
+
+func watchMatches(prefix string, event common.FileEvent) bool {
+	return event.Type == common.EventsTruncated ||
+		strings.HasPrefix(event.Name, prefix) ||
+		(event.OldName != "" && strings.HasPrefix(event.OldName, prefix))
+}
+
+func handleWatchEvent(opts watchFlags, event common.FileEvent, out io.Writer) error {
+	if !watchMatches(opts.prefix, event) {
+		return nil
+	}
+	if opts.jsonOutput {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", data)
+	} else {
+		fmt.Fprintln(out, formatWatchEvent(event))
+	}
+	if opts.command != "" {
+		if err := runWatchExec(opts.command, event, out); err != nil {
+			fmt.Fprintf(os.Stderr, "store watch: --exec for %s %s: %v\n", event.Type, event.Name, err)
+		}
+	}
+	return nil
+}
+
+func formatWatchEvent(event common.FileEvent) string {
+	timestamp := event.Time.Local().Format(time.DateTime)
+	switch event.Type {
+	case common.EventsTruncated:
+		return fmt.Sprintf("%s missed changes up to %d, list the store again", timestamp, event.Seq)
+	case common.FileDeleted:
+		return fmt.Sprintf("%s %-8s %s", timestamp, event.Type, event.Name)
+	case common.FileRenamed:
+		return fmt.Sprintf("%s %-8s %s -> %s", timestamp, event.Type, event.OldName, event.Name)
+	default:
+		return fmt.Sprintf("%s %-8s %s (%d bytes)", timestamp, event.Type, event.Name, event.Size)
+	}
+}
+
+// runWatchExec runs command for event, which it finds in STORE_EVENT_*
+// variables and as JSON on stdin. Events wait until the command is done.
+func runWatchExec(command string, event common.FileEvent, out io.Writer) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"STORE_EVENT_SEQ="+strconv.FormatInt(event.Seq, 10),
+		"STORE_EVENT_TYPE="+event.Type,
+		"STORE_EVENT_NAME="+event.Name,
+		"STORE_EVENT_OLD_NAME="+event.OldName,
+		"STORE_EVENT_SIZE="+strconv.FormatInt(event.Size, 10),
+		"STORE_EVENT_SHA256="+event.SHA256,
+	)
+	cmd.Stdin = strings.NewReader(string(data) + "\n")
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -3,18 +3,54 @@ package common
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 type WcCountServerResponse struct {
 	WordCountPairs []WordCountPair `json:"word_count_pairs"`
+	Notes          []FileNote      `json:"notes,omitempty"`
+}
+
+type WordCountServerResponse struct {
+	Count int        `json:"count"`
+	Notes []FileNote `json:"notes,omitempty"`
+}
+
+const (
+	FileNoteSkipped      = "skipped"
+	FileNoteDecompressed = "decompressed"
+	FileNoteExtracted    = "extracted"
+	FileNoteTruncated    = "truncated"
+)
+
+// FileNote tells what analytics did with (part of) a stored file that was not
+// plain text. Source names the stream inside the file, e.g. "logs.zip:app.log".
+type FileNote struct {
+	FileName string `json:"file_name"`
+	Source   string `json:"source"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
 }
 
 type FileList struct {
 	Files []string `json:"Files"`
 }
 
+// FileInfo describes a stored file. Name is its slash separated path in the store.
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type FileInfoList struct {
+	Files []FileInfo `json:"files"`
+}
+
 type FileNameErrorPair struct {
 	FileName string `json:"file_name"`
 	ErrorMsg string `json:"error_msg"`
@@ -40,6 +76,125 @@ type TryWithSha256Response struct {
 	UnsuccessfulFileNames []FileSha256Pair `json:"unsuccessful_file_names"`
 }
 
+type NgramCountServerResponse struct {
+	N               int              `json:"n"`
+	NgramCountPairs []NgramCountPair `json:"ngram_count_pairs"`
+	Notes           []FileNote       `json:"notes,omitempty"`
+}
+
+// NgramCountPair is the n-gram counterpart of WordCountPair. Score is the
+// pointwise mutual information of the words, used to rank collocations.
+type NgramCountPair struct {
+	Ngram string   `json:"Ngram"`
+	Words []string `json:"Words"`
+	Count int      `json:"Count"`
+	Score float64  `json:"Score,omitempty"`
+}
+
+// GrepLine is one line of a grep response stream. Context lines have Match set to
+// false; a line with only FileName and ErrorMsg set reports a file that could not
+// be searched, and one with Note set a part of a file that was skipped.
+type GrepLine struct {
+	FileName   string `json:"file_name"`
+	LineNumber int    `json:"line_number,omitempty"`
+	Text       string `json:"text,omitempty"`
+	Match      bool   `json:"match,omitempty"`
+	ErrorMsg   string `json:"error_msg,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// GrepResult is the result of a grep job: the lines the streaming grep would
+// send. Truncated is set when it stopped at its max matches.
+type GrepResult struct {
+	Lines     []GrepLine `json:"lines"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// WordCountDelta is how the count of a word differs between side A and side B
+// of a frequency diff.
+type WordCountDelta struct {
+	Word   string `json:"Word"`
+	CountA int    `json:"CountA"`
+	CountB int    `json:"CountB"`
+	Delta  int    `json:"Delta"`
+}
+
+type FreqDiffResponse struct {
+	A       string           `json:"a"`
+	B       string           `json:"b"`
+	TotalA  int              `json:"total_a"`
+	TotalB  int              `json:"total_b"`
+	Gained  []WordCountDelta `json:"gained"`
+	Lost    []WordCountDelta `json:"lost"`
+	Changed []WordCountDelta `json:"changed"`
+	Notes   []FileNote       `json:"notes,omitempty"`
+}
+
+type FreqSnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []string  `json:"files"`
+}
+
+// FreqSnapshot is the word frequency of the whole store at a point in time.
+type FreqSnapshot struct {
+	FreqSnapshotInfo
+	WordCounts map[string]int `json:"word_counts"`
+}
+
+type FreqSnapshotList struct {
+	Snapshots []FreqSnapshotInfo `json:"snapshots"`
+}
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// JobRequest submits a long running operation. Kind is one of "wc",
+// "freq-words", "ngrams", "freq-diff", "freq-snapshot", "integrity-scan" or "grep"; Params takes the same
+// query parameters as the matching /files action.
+type JobRequest struct {
+	Kind   string              `json:"kind"`
+	Params map[string][]string `json:"params,omitempty"`
+}
+
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// JobStatus describes a job. Result holds the same JSON the synchronous
+// action would have returned and is only set once the job succeeded.
+type JobStatus struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	State      string          `json:"state"`
+	Progress   JobProgress     `json:"progress"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	ErrorMsg   string          `json:"error_msg,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+func (s JobStatus) Finished() bool {
+	return s.State == JobSucceeded || s.State == JobFailed || s.State == JobCancelled
+}
+
+type JobList struct {
+	Jobs []JobStatus `json:"jobs"`
+}
+
+type IntegrityScanResponse struct {
+	FilesScanned    int                 `json:"files_scanned"`
+	UnreadableFiles []FileNameErrorPair `json:"unreadable_files"`
+	DuplicateGroups [][]string          `json:"duplicate_groups"`
+}
+
 func CalculateSha256ForFile(filepath string) (string, error) {
 	file, err := os.Open(filepath)
 	if err != nil {
@@ -54,3 +209,303 @@ func CalculateSha256ForFile(filepath string) (string, error) {
 
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
+
+// ErrorResponse is the body of every error response of the server. Code is a
+// machine readable form of the HTTP status, e.g. "not_found", and RequestID
+// matches the X-Request-ID header so a failure can be found in the server log.
+// Details lists the items of a request that failed, if there are several.
+type ErrorResponse struct {
+	Status    int           `json:"status"`
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	RequestID string        `json:"request_id,omitempty"`
+	Details   []ErrorDetail `json:"details,omitempty"`
+}
+
+type ErrorDetail struct {
+	Item    string `json:"item"`
+	Message string `json:"message"`
+}
+
+func (e *ErrorResponse) Error() string {
+	msg := fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request %s)", e.RequestID)
+	}
+	for _, detail := range e.Details {
+		msg += fmt.Sprintf("\n  %s: %s", detail.Item, detail.Message)
+	}
+	return msg
+}
+
+// FileEvent is a change of the store, as streamed by GET /v1/events. Seq
+// increases by one with every event. SHA256 is not set for deleted files.
+type FileEvent struct {
+	Seq     int64     `json:"seq"`
+	Type    string    `json:"type"`
+	Name    string    `json:"name"`
+	OldName string    `json:"old_name,omitempty"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Time    time.Time `json:"time"`
+	// Tenant is the tenant whose file changed, empty for the shared store.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+const (
+	FileCreated = "created"
+	FileUpdated = "updated"
+	FileDeleted = "deleted"
+	FileRenamed = "renamed"
+	// EventsTruncated tells a resuming client that events after its
+	// Last-Event-ID are no longer in the log, up to and including Seq.
+	EventsTruncated = "truncated"
+)
+
+// WebhookRequest registers a webhook. The server POSTs each FileEvent
+// matching Types and Prefix to URL, signed with Secret; empty filters match
+// every event and an empty Secret is generated.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Types  []string `json:"types,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+}
+
+// Webhook is a registered webhook. Secret is only returned on creation.
+type Webhook struct {
+	ID string `json:"id"`
+	WebhookRequest
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookList struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// WebhookDelivery is a webhook call that failed every attempt.
+type WebhookDelivery struct {
+	ID        string    `json:"id"`
+	WebhookID string    `json:"webhook_id"`
+	Event     FileEvent `json:"event"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+type WebhookDeliveryList struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// FileMetadata is the user metadata of a stored file, free form string pairs
+// kept by the server next to the content.
+type FileMetadata struct {
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// MetadataUpdate changes the metadata of a file: each key is set to its value,
+// or removed when the value is null. Other keys are kept.
+type MetadataUpdate struct {
+	Metadata map[string]*string `json:"metadata"`
+}
+
+const (
+	BatchPut         = "put"
+	BatchCopy        = "copy"
+	BatchMove        = "move"
+	BatchDelete      = "delete"
+	BatchSetMetadata = "set_metadata"
+)
+
+// BatchOperation is one operation of a BatchRequest. put stores Content (or
+// ContentBase64) under Path, copy and move go From To, delete removes Path and
+// set_metadata applies Metadata like a MetadataUpdate to Path.
+type BatchOperation struct {
+	Op            string             `json:"op"`
+	Path          string             `json:"path,omitempty"`
+	From          string             `json:"from,omitempty"`
+	To            string             `json:"to,omitempty"`
+	Overwrite     bool               `json:"overwrite,omitempty"`
+	Content       string             `json:"content,omitempty"`
+	ContentBase64 string             `json:"content_base64,omitempty"`
+	Metadata      map[string]*string `json:"metadata,omitempty"`
+}
+
+// BatchRequest runs Operations in order. With Atomic set, either all of them
+// succeed or the changes made so far are rolled back.
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic,omitempty"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult tells how the operation at Index went. Status is the HTTP status
+// the matching single request would have answered with.
+type BatchResult struct {
+	Index  int            `json:"index"`
+	Op     string         `json:"op"`
+	Status int            `json:"status"`
+	Error  *ErrorResponse `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results    []BatchResult `json:"results"`
+	Succeeded  int           `json:"succeeded"`
+	Failed     int           `json:"failed"`
+	RolledBack bool          `json:"rolled_back,omitempty"`
+}
+
+const (
+	RoleReader = "reader"
+	RoleWriter = "writer"
+	RoleAdmin  = "admin"
+)
+
+// Grant gives Role on the files whose path starts with Prefix; an empty
+// Prefix covers the whole store. Each role includes the ones before it:
+// readers list, download and analyse files, writers also change them, and
+// admins, only on the whole store, also manage tokens and webhooks.
+type Grant struct {
+	Prefix string `json:"prefix"`
+	Role   string `json:"role"`
+}
+
+// TokenRequest issues an API token. TTL is a Go duration such as "720h" and
+// defaults to 90 days. Admin is short for an admin grant on the whole store;
+// a token without grants may read and write every file. A token of a Tenant
+// only sees the files of that tenant and cannot be an admin. With ClientCN,
+// requests over mutual TLS with a client certificate of that common name are
+// made with the token too. RateLimit, in requests per second, replaces the
+// server's rate limit for the token; 0 keeps it.
+type TokenRequest struct {
+	Name      string  `json:"name"`
+	TTL       string  `json:"ttl,omitempty"`
+	Admin     bool    `json:"admin,omitempty"`
+	Grants    []Grant `json:"grants,omitempty"`
+	Tenant    string  `json:"tenant,omitempty"`
+	ClientCN  string  `json:"client_cn,omitempty"`
+	RateLimit float64 `json:"rate_limit,omitempty"`
+}
+
+// APIToken is an issued API token. Token, the bearer secret, is only returned
+// when the token is issued; the server keeps just its hash.
+type APIToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Admin     bool      `json:"admin"`
+	Grants    []Grant   `json:"grants,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	ClientCN  string    `json:"client_cn,omitempty"`
+	RateLimit float64   `json:"rate_limit,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type APITokenList struct {
+	Tokens []APIToken `json:"tokens"`
+}
+
+// Tenant is a team with its own storage root, limited to MaxBytes of content
+// in MaxFiles files. Zero means unlimited.
+type Tenant struct {
+	Name     string `json:"name"`
+	MaxBytes int64  `json:"max_bytes"`
+	MaxFiles int64  `json:"max_files"`
+}
+
+// TenantUsage is what a tenant stores against its quotas.
+type TenantUsage struct {
+	Tenant
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+type TenantList struct {
+	Tenants []TenantUsage `json:"tenants"`
+}
+
+const (
+	ShareDownload = "download"
+	ShareUpload   = "upload"
+)
+
+// ShareRequest creates a share link, usable without a token until it expires
+// after Expires (a duration, 24h by default) or has been used MaxUses times
+// (0 is unlimited). A download link gives out the file Name; an upload link
+// takes new files below the prefix Name.
+type ShareRequest struct {
+	Name    string `json:"name"`
+	Mode    string `json:"mode,omitempty"`
+	Expires string `json:"expires,omitempty"`
+	MaxUses int    `json:"max_uses,omitempty"`
+}
+
+// ShareLink is an issued share link. URL, which carries the signature, is only
+// returned when the link is created.
+type ShareLink struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Mode      string    `json:"mode"`
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ShareLinkList struct {
+	Links []ShareLink `json:"links"`
+}
+
+// AuditEntry records one request: who made it, from where, what it did to
+// which files and how it ended. Status is the HTTP status, or the gRPC code
+// for Protocol "grpc". User is the name of the token and UserID its ID.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Protocol   string    `json:"protocol"`
+	UserID     string    `json:"user_id,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path,omitempty"`
+	Files      []string  `json:"files,omitempty"`
+	Status     int       `json:"status"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type AuditEntryList struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// KeyRotation is the result of rewrapping the data keys of the encrypted
+// files with the active master key. Unchanged files were already wrapped with
+// it.
+type KeyRotation struct {
+	ActiveKey string        `json:"active_key"`
+	Rewrapped int           `json:"rewrapped"`
+	Unchanged int           `json:"unchanged"`
+	Failed    []ErrorDetail `json:"failed"`
+}
+
+// QuarantinedFile is an upload the virus scanner found infected and kept out
+// of the store.
+type QuarantinedFile struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Size          int64     `json:"size"`
+	Signature     string    `json:"signature"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+	// Tenant is the tenant the file was uploaded to, "" for the default store.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type QuarantineList struct {
+	Files []QuarantinedFile `json:"files"`
+}
@@ -1,3 +1,18 @@
 module file_store
 
 go 1.23.3
+
+require (
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/crypto v0.29.0
+	golang.org/x/net v0.29.0
+	google.golang.org/grpc v1.68.1
+	google.golang.org/protobuf v1.35.2
+	rsc.io/pdf v0.1.1
+)
+
+require (
+	golang.org/x/sys v0.27.0 // indirect
+	golang.org/x/text v0.20.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
+)
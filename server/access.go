@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var (
+	errPermissionDenied = errors.New("permission denied")
+	errInvalidGrant     = errors.New("invalid grant")
+)
+
+// roleRanks orders the roles; each includes the rights of lower ones.
+var roleRanks = map[string]int{
+	common.RoleReader: 1,
+	common.RoleWriter: 2,
+	common.RoleAdmin:  3,
+}
+
+// accessPolicy is what the caller of a request may do, from the grants of its
+// token. The storage functions check it, so every API enforces the same
+// rules. A nil policy, when authentication is off, allows everything.
+type accessPolicy struct {
+	tokenID string
+	grants  []common.Grant
+}
+
+func newAccessPolicy(token common.APIToken) *accessPolicy {
+	grants := token.Grants
+	if token.Admin {
+		grants = append(grants, common.Grant{Role: common.RoleAdmin})
+	}
+	if len(grants) == 0 {
+		grants = []common.Grant{{Role: common.RoleWriter}}
+	}
+	return &accessPolicy{tokenID: token.ID, grants: grants}
+}
+
+// validateGrants checks the grants of a token request.
+func validateGrants(grants []common.Grant) error {
+	for _, grant := range grants {
+		if _, ok := roleRanks[grant.Role]; !ok {
+			return fmt.Errorf("%w: unknown role %q", errInvalidGrant, grant.Role)
+		}
+		if grant.Role == common.RoleAdmin && grant.Prefix != "" {
+			return fmt.Errorf("%w: admin can only be granted on the whole store", errInvalidGrant)
+		}
+		if strings.HasPrefix(grant.Prefix, "/") {
+			return fmt.Errorf("%w: prefix %q starts with /", errInvalidGrant, grant.Prefix)
+		}
+	}
+	return nil
+}
+
+// rank returns the highest role granted on name.
+func (p *accessPolicy) rank(name string) int {
+	best := 0
+	for _, grant := range p.grants {
+		if strings.HasPrefix(name, grant.Prefix) {
+			best = max(best, roleRanks[grant.Role])
+		}
+	}
+	return best
+}
+
+func (p *accessPolicy) canRead(name string) bool {
+	return p == nil || p.rank(path.Clean(name)) >= roleRanks[common.RoleReader]
+}
+
+func (p *accessPolicy) checkRead(name string) error {
+	if !p.canRead(name) {
+		return fmt.Errorf("%s: %w", name, errPermissionDenied)
+	}
+	return nil
+}
+
+func (p *accessPolicy) checkWrite(name string) error {
+	if p != nil && p.rank(path.Clean(name)) < roleRanks[common.RoleWriter] {
+		return fmt.Errorf("%s: %w", name, errPermissionDenied)
+	}
+	return nil
+}
+
+// checkWriteDir is checkWrite for a directory: the caller must be able to
+// write every name below it.
+func (p *accessPolicy) checkWriteDir(name string) error {
+	if p != nil && p.rank(path.Clean(name)+"/") < roleRanks[common.RoleWriter] {
+		return fmt.Errorf("%s/: %w", name, errPermissionDenied)
+	}
+	return nil
+}
+
+// canSeeDir tells whether the directory name holds, or leads to, names the
+// caller may read.
+func (p *accessPolicy) canSeeDir(name string) bool {
+	if p == nil {
+		return true
+	}
+	dir := path.Clean(name) + "/"
+	for _, grant := range p.grants {
+		if roleRanks[grant.Role] >= roleRanks[common.RoleReader] &&
+			(strings.HasPrefix(dir, grant.Prefix) || strings.HasPrefix(grant.Prefix, dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReadAll is for results summarising the whole store, such as word
+// frequency snapshots.
+func (p *accessPolicy) checkReadAll() error {
+	if p != nil && p.rank("") < roleRanks[common.RoleReader] {
+		return fmt.Errorf("reading the whole store: %w", errPermissionDenied)
+	}
+	return nil
+}
+
+// canSeeEvent tells whether the caller may read a file an event is about.
+func (p *accessPolicy) canSeeEvent(event common.FileEvent) bool {
+	return event.Name == "" || p.canRead(event.Name) || event.OldName != "" && p.canRead(event.OldName)
+}
+
+func (p *accessPolicy) isAdmin() bool {
+	return p == nil || p.rank("") >= roleRanks[common.RoleAdmin]
+}
+
+// owns tells whether the caller may see what the token with ID owner made,
+// e.g. a job. Admins see everything.
+func (p *accessPolicy) owns(owner string) bool {
+	return p.isAdmin() || owner == p.tokenID
+}
+
+// id is the token ID the policy belongs to, "" without authentication.
+func (p *accessPolicy) id() string {
+	if p == nil {
+		return ""
+	}
+	return p.tokenID
+}
+
+// forContext returns config with the access policy, and the tenant, of the
+// token the request or call of ctx was authenticated with, and its audit
+// entry.
+func (config ServerConfig) forContext(ctx context.Context) ServerConfig {
+	config.auditEntry = auditEntryFrom(ctx)
+	if token, ok := callerToken(ctx); ok {
+		config.access = newAccessPolicy(token)
+		if token.Tenant != "" {
+			config = config.forTenant(token.Tenant)
+		}
+	}
+	return config
+}
+
+// adminOnly answers 403 unless the caller is an admin, for settings of the
+// whole store such as webhooks, which see every change.
+func adminOnly(
+	handler func(config ServerConfig, w http.ResponseWriter, r *http.Request),
+) func(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	return func(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+		if !config.access.isAdmin() {
+			writeError(w, http.StatusForbidden, "an admin token is required")
+			return
+		}
+		handler(config, w, r)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"file_store/common"
+	"file_store/storepb"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAccess(t *testing.T) {
+	storagePath := t.TempDir()
+	for name, content := range map[string]string{"notes.txt": "one two three", "artifacts/build.log": "four"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(storagePath, name)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(storagePath, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := ServerConfig{filesStoragePath: storagePath}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	server := BuildServer(config)
+
+	do := func(method string, target string, token string, body []byte) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, bytes.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	issue := func(t *testing.T, req common.TokenRequest) common.APIToken {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		response := do(http.MethodPost, "/v1/admin/tokens", "root-secret", body)
+		if response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var token common.APIToken
+		json.NewDecoder(response.Body).Decode(&token)
+		return token
+	}
+	ci := issue(t, common.TokenRequest{Name: "ci", Grants: []common.Grant{{Prefix: "artifacts/", Role: common.RoleWriter}}})
+	analyst := issue(t, common.TokenRequest{Name: "analyst", Grants: []common.Grant{{Role: common.RoleReader}}})
+
+	t.Run("invalid grants", func(t *testing.T) {
+		for _, grant := range []common.Grant{{Role: "owner"}, {Prefix: "artifacts/", Role: common.RoleAdmin}} {
+			body, _ := json.Marshal(common.TokenRequest{Name: "x", Grants: []common.Grant{grant}})
+			if response := do(http.MethodPost, "/v1/admin/tokens", "root-secret", body); response.Code != http.StatusBadRequest {
+				t.Errorf("got %d for %+v", response.Code, grant)
+			}
+		}
+	})
+
+	t.Run("writer on a prefix", func(t *testing.T) {
+		if response := do(http.MethodPut, "/v1/files/artifacts/app.bin", ci.Token, []byte("bits")); response.Code != http.StatusCreated {
+			t.Errorf("got %d writing under its prefix", response.Code)
+		}
+		for _, request := range []struct{ method, target string }{
+			{http.MethodPut, "/v1/files/notes.txt"},
+			{http.MethodGet, "/v1/files/notes.txt"},
+			{http.MethodDelete, "/v1/files/notes.txt"},
+		} {
+			if response := do(request.method, request.target, ci.Token, []byte("x")); response.Code != http.StatusForbidden {
+				t.Errorf("got %d on %s %s", response.Code, request.method, request.target)
+			}
+		}
+		var list common.FileInfoList
+		json.NewDecoder(do(http.MethodGet, "/v1/files", ci.Token, nil).Body).Decode(&list)
+		if len(list.Files) != 2 || list.Files[0].Name != "artifacts/app.bin" || list.Files[1].Name != "artifacts/build.log" {
+			t.Errorf("listed %+v", list.Files)
+		}
+		var count common.WordCountServerResponse
+		json.NewDecoder(do(http.MethodGet, "/v1/analytics/wordcount", ci.Token, nil).Body).Decode(&count)
+		if count.Count != 2 {
+			t.Errorf("counted %d words, want only the ones under artifacts/", count.Count)
+		}
+		var deletion common.FileDeletionResponse
+		body, _ := json.Marshal(common.FileList{Files: []string{"notes.txt"}})
+		json.NewDecoder(do(http.MethodDelete, "/files", ci.Token, body).Body).Decode(&deletion)
+		if len(deletion.UnsuccessfulFileNames) != 1 {
+			t.Errorf("legacy delete gave %+v", deletion)
+		}
+	})
+
+	t.Run("hash matching only sees readable files", func(t *testing.T) {
+		hash, _ := common.CalculateSha256ForFile(filepath.Join(storagePath, "notes.txt"))
+		body, _ := json.Marshal(common.TryWithSha256Request{FileSha256Pairs: []common.FileSha256Pair{{FileName: "artifacts/copy.txt", FileHash: hash}}})
+		var res common.TryWithSha256Response
+		json.NewDecoder(do(http.MethodPost, "/v1/dedupe/match", ci.Token, body).Body).Decode(&res)
+		if len(res.UnsuccessfulFileNames) != 1 {
+			t.Errorf("matched a file the token cannot read: %+v", res)
+		}
+		json.NewDecoder(do(http.MethodPost, "/v1/dedupe/match", analyst.Token, body).Body).Decode(&res)
+		if len(res.UnsuccessfulFileNames) != 1 {
+			t.Errorf("a reader created a file: %+v", res)
+		}
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		if response := do(http.MethodGet, "/v1/files/notes.txt", analyst.Token, nil); response.Code != http.StatusOK {
+			t.Errorf("got %d reading", response.Code)
+		}
+		if response := do(http.MethodPut, "/v1/files/artifacts/x", analyst.Token, []byte("x")); response.Code != http.StatusForbidden {
+			t.Errorf("got %d writing", response.Code)
+		}
+		if response := do(http.MethodGet, "/v1/webhooks", analyst.Token, nil); response.Code != http.StatusForbidden {
+			t.Errorf("got %d listing webhooks", response.Code)
+		}
+		if response := do(http.MethodPost, "/v1/analytics/freq-snapshots", analyst.Token, nil); response.Code != http.StatusCreated {
+			t.Errorf("got %d on a snapshot", response.Code)
+		}
+		if response := do(http.MethodGet, "/v1/analytics/freq-snapshots", ci.Token, nil); response.Code != http.StatusForbidden {
+			t.Errorf("got %d listing snapshots without reading the whole store", response.Code)
+		}
+	})
+
+	t.Run("jobs are private to their token", func(t *testing.T) {
+		var job common.JobStatus
+		json.NewDecoder(do(http.MethodGet, "/v1/analytics/wordcount?async=true", ci.Token, nil).Body).Decode(&job)
+		if response := do(http.MethodGet, "/v1/jobs/"+job.ID, analyst.Token, nil); response.Code != http.StatusNotFound {
+			t.Errorf("got %d for the job of another token", response.Code)
+		}
+		for _, token := range []string{ci.Token, "root-secret"} {
+			if response := do(http.MethodGet, "/v1/jobs/"+job.ID, token, nil); response.Code != http.StatusOK {
+				t.Errorf("got %d for the job", response.Code)
+			}
+		}
+		var list common.JobList
+		json.NewDecoder(do(http.MethodGet, "/v1/jobs", analyst.Token, nil).Body).Decode(&list)
+		if slices.ContainsFunc(list.Jobs, func(j common.JobStatus) bool { return j.ID == job.ID }) {
+			t.Errorf("listed the job of another token")
+		}
+	})
+
+	t.Run("gRPC", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), apiTokenKey{}, ci)
+		rpc := &grpcServer{config: config}
+		list, err := rpc.List(ctx, &storepb.ListRequest{})
+		if err != nil || len(list.Files) != 2 {
+			t.Errorf("got %v, %v", list, err)
+		}
+		if _, err := rpc.Delete(ctx, &storepb.DeleteRequest{Name: "notes.txt"}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("got %v deleting", err)
+		}
+	})
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxUploadBytes is the largest body accepted by /v1 uploads unless
+// STORE_MAX_UPLOAD_BYTES says otherwise.
+const defaultMaxUploadBytes = 1 << 30
+
+// registerV1Routes adds the versioned API. Files are resources under
+// /v1/files/{path}, analytics live under /v1/analytics. Requests with a method
+// a route does not support get 405 with an Allow header from the mux.
+func registerV1Routes(mux *http.ServeMux, config ServerConfig) {
+	for _, route := range v1Routes {
+		mux.Handle(route.method+" "+route.path, Log(withConfig(config, route.handler)))
+	}
+}
+
+// v1Routes is the single description of the /v1 API: the mux is built from it
+// and so is the OpenAPI document served at /openapi.json.
+var v1Routes = []apiRoute{
+	{
+		method: "GET", path: "/v1/files", id: "listFiles", summary: "List stored files",
+		handler: handleV1ListFiles,
+		params:  []apiParam{{name: "prefix", description: "only files whose path starts with this"}},
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.FileInfoList{})},
+		},
+	},
+	{
+		method: "POST", path: "/v1/files", id: "uploadFiles", summary: "Store the files of a multipart form under their file names",
+		handler: handleV1UploadFiles,
+		body:    &apiBody{contentType: "multipart/form-data"},
+		responses: []apiResponse{
+			{status: http.StatusCreated, body: jsonBody(common.FileInfoList{})},
+			{status: http.StatusRequestEntityTooLarge},
+			forbiddenResponse,
+			quotaResponse,
+			infectedResponse,
+			scanFailedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/files/{path...}", id: "getFile", summary: "Download a file",
+		handler: handleV1GetFile,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: &apiBody{contentType: "application/octet-stream"}},
+			{status: http.StatusNotFound},
+			forbiddenResponse,
+		},
+	},
+	{
+		method: "PUT", path: "/v1/files/{path...}", id: "putFile", summary: "Store the request body as a file",
+		handler: handleV1PutFile,
+		params:  []apiParam{{name: "If-None-Match", in: "header", description: "* to only create the file"}},
+		body:    &apiBody{contentType: "application/octet-stream"},
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "file created", body: jsonBody(common.FileInfo{})},
+			{status: http.StatusNoContent, description: "file replaced"},
+			{status: http.StatusConflict, description: "file exists and If-None-Match is *"},
+			{status: http.StatusRequestEntityTooLarge},
+			forbiddenResponse,
+			quotaResponse,
+			infectedResponse,
+			scanFailedResponse,
+		},
+	},
+	{
+		method: "DELETE", path: "/v1/files/{path...}", id: "deleteFile", summary: "Delete a file",
+		handler: handleV1DeleteFile,
+		responses: []apiResponse{
+			{status: http.StatusNoContent, description: "file deleted"},
+			{status: http.StatusNotFound},
+			forbiddenResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/metadata/{path...}", id: "getMetadata", summary: "Get the metadata of a file",
+		handler: handleGetMetadata,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.FileMetadata{})},
+			{status: http.StatusNotFound},
+			forbiddenResponse,
+		},
+	},
+	{
+		method: "PATCH", path: "/v1/metadata/{path...}", id: "updateMetadata", summary: "Set or remove metadata keys of a file",
+		handler: handleUpdateMetadata,
+		body:    jsonBody(common.MetadataUpdate{}),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.FileMetadata{})},
+			{status: http.StatusBadRequest},
+			{status: http.StatusNotFound},
+			forbiddenResponse,
+		},
+	},
+	{
+		method: "POST", path: "/v1/batch", id: "batch", summary: "Run several file operations, optionally all or nothing",
+		handler: handleV1Batch,
+		body:    jsonBody(common.BatchRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "a result per operation, failed or not", body: jsonBody(common.BatchResponse{})},
+			{status: http.StatusBadRequest},
+			{status: http.StatusRequestEntityTooLarge},
+		},
+	},
+	{
+		method: "POST", path: "/v1/dedupe/match", id: "dedupeMatch",
+		summary: "Create files from stored files with the same SHA-256, returning the ones to upload",
+		handler: handleV1DedupeMatch,
+		body:    jsonBody(common.TryWithSha256Request{}),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.TryWithSha256Response{})},
+		},
+	},
+	{
+		method: "GET", path: "/v1/analytics/wordcount", id: "wordCount", summary: "Count the words of all files",
+		handler: v1Analytics("wc", handleV1WordCount),
+		params:  []apiParam{asyncParam},
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.WordCountServerResponse{})},
+			jobAcceptedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/analytics/freq-words", id: "frequentWords", summary: "Most frequent words of all files",
+		handler: v1Analytics("freq-words", handleFrequentWordsAction),
+		params:  []apiParam{asyncParam},
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.WcCountServerResponse{})},
+			jobAcceptedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/analytics/ngrams", id: "ngrams", summary: "Most frequent n-grams",
+		handler: v1Analytics("ngrams", handleNgramsAction),
+		params: []apiParam{
+			{name: "n", schema: "integer", description: "words per n-gram, 1 to 5, default 2"},
+			{name: "top", schema: "integer", description: "number of n-grams, default 10"},
+			{name: "min_count", schema: "integer", description: "ignore rarer n-grams"},
+			{name: "sort", description: "count (default) or pmi"},
+			fileParam,
+			asyncParam,
+		},
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.NgramCountServerResponse{})},
+			jobAcceptedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/analytics/grep", id: "grep", summary: "Search files with a regular expression",
+		handler: v1Analytics("grep", handleGrepAction),
+		params: []apiParam{
+			{name: "pattern", required: true, description: "Go regular expression"},
+			fileParam,
+			{name: "A", schema: "integer", description: "lines of trailing context"},
+			{name: "B", schema: "integer", description: "lines of leading context"},
+			{name: "C", schema: "integer", description: "lines of context"},
+			{name: "i", schema: "boolean", description: "ignore case"},
+			{name: "v", schema: "boolean", description: "select non-matching lines"},
+			{name: "max", schema: "integer", description: "stop after this many matching lines, 10000 for a job"},
+			asyncParam,
+		},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "one GrepLine per line", body: &apiBody{contentType: "application/x-ndjson", schema: common.GrepLine{}}},
+			jobAcceptedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/analytics/freq-diff", id: "freqDiff", summary: "Compare word frequencies of two specs",
+		handler: v1Analytics("freq-diff", handleFreqDiffAction),
+		params: []apiParam{
+			{name: "a", required: true, description: "NAME, file:NAME, prefix:PREFIX, store, snapshot:NAME or @TIME"},
+			{name: "b", required: true, description: "same forms as a"},
+			{name: "top", schema: "integer", description: "entries per list, default 10"},
+			asyncParam,
+		},
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.FreqDiffResponse{})},
+			{status: http.StatusNotFound, description: "a file or snapshot does not exist"},
+			jobAcceptedResponse,
+			{status: http.StatusForbidden, description: "snapshots need read access to the whole store"},
+		},
+	},
+	{
+		method: "GET", path: "/v1/analytics/integrity-scan", id: "integrityScan", summary: "Find unreadable and duplicate files",
+		handler: v1Analytics("integrity-scan", handleIntegrityScanAction),
+		params:  []apiParam{asyncParam},
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.IntegrityScanResponse{})},
+			jobAcceptedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/analytics/freq-snapshots", id: "listFreqSnapshots", summary: "List word frequency snapshots",
+		handler: v1Analytics("", handleV1ListFreqSnapshots),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.FreqSnapshotList{})},
+			{status: http.StatusForbidden, description: "snapshots need read access to the whole store"},
+		},
+	},
+	{
+		method: "POST", path: "/v1/analytics/freq-snapshots", id: "createFreqSnapshot", summary: "Snapshot the word frequencies of the store",
+		handler: v1Analytics("freq-snapshot", handleFreqSnapshotAction),
+		params:  []apiParam{{name: "name", description: "defaults to the current time"}, asyncParam},
+		responses: []apiResponse{
+			{status: http.StatusCreated, body: jsonBody(common.FreqSnapshotInfo{})},
+			jobAcceptedResponse,
+			{status: http.StatusForbidden, description: "snapshots need read access to the whole store"},
+		},
+	},
+	{
+		method: "GET", path: "/v1/events", id: "streamEvents", summary: "Stream changes of the stored files as server-sent events",
+		handler: handleV1Events,
+		params: []apiParam{
+			{name: "Last-Event-ID", in: "header", description: "resume after this event"},
+			{name: "last_event_id", description: "resume after this event, for clients that cannot set headers"},
+		},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "an endless event stream, one FileEvent per event", body: &apiBody{contentType: "text/event-stream", schema: common.FileEvent{}}},
+		},
+	},
+	{
+		method: "GET", path: "/v1/webhooks", id: "listWebhooks", summary: "List webhooks",
+		handler: adminOnly(handleListWebhooks),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.WebhookList{})},
+			adminResponse,
+		},
+	},
+	{
+		method: "POST", path: "/v1/webhooks", id: "createWebhook", summary: "Register a webhook for changes of the store",
+		handler: adminOnly(handleCreateWebhook),
+		body:    jsonBody(common.WebhookRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "webhook created, including its secret", body: jsonBody(common.Webhook{})},
+			adminResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/webhooks/{id}", id: "getWebhook", summary: "Get a webhook",
+		handler: adminOnly(handleGetWebhook),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.Webhook{})},
+			{status: http.StatusNotFound},
+			adminResponse,
+		},
+	},
+	{
+		method: "DELETE", path: "/v1/webhooks/{id}", id: "deleteWebhook", summary: "Delete a webhook",
+		handler: adminOnly(handleDeleteWebhook),
+		responses: []apiResponse{
+			{status: http.StatusNoContent, description: "webhook deleted"},
+			{status: http.StatusNotFound},
+			adminResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/webhooks/dead-letters", id: "listWebhookDeadLetters", summary: "List webhook calls that failed every attempt",
+		handler: adminOnly(handleListWebhookDeadLetters),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.WebhookDeliveryList{})},
+			adminResponse,
+		},
+	},
+	{
+		method: "POST", path: "/v1/webhooks/dead-letters/{id}/redeliver", id: "redeliverWebhook", summary: "Retry a failed webhook call",
+		handler: adminOnly(handleRedeliverWebhook),
+		responses: []apiResponse{
+			{status: http.StatusAccepted, body: jsonBody(common.WebhookDelivery{})},
+			{status: http.StatusNotFound},
+			adminResponse,
+		},
+	},
+	{
+		method: "DELETE", path: "/v1/webhooks/dead-letters/{id}", id: "deleteWebhookDeadLetter", summary: "Drop a failed webhook call",
+		handler: adminOnly(handleDeleteWebhookDeadLetter),
+		responses: []apiResponse{
+			{status: http.StatusNoContent, description: "dead letter dropped"},
+			{status: http.StatusNotFound},
+			adminResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/admin/tokens", id: "listTokens", summary: "List API tokens, without their secrets",
+		handler: handleListTokens,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.APITokenList{})},
+			adminResponse,
+		},
+	},
+	{
+		method: "POST", path: "/v1/admin/tokens", id: "issueToken", summary: "Issue an API token",
+		handler: handleIssueToken,
+		body:    jsonBody(common.TokenRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "token issued, including its secret", body: jsonBody(common.APIToken{})},
+			{status: http.StatusBadRequest},
+			adminResponse,
+		},
+	},
+	{
+		method: "DELETE", path: "/v1/admin/tokens/{id}", id: "revokeToken", summary: "Revoke an API token",
+		handler: handleRevokeToken,
+		responses: []apiResponse{
+			{status: http.StatusNoContent, description: "token revoked"},
+			adminResponse,
+			{status: http.StatusNotFound},
+		},
+	},
+	{
+		method: "GET", path: "/v1/admin/tenants", id: "listTenants", summary: "List tenants with their quotas and usage",
+		handler: handleListTenants,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.TenantList{})},
+			adminResponse,
+		},
+	},
+	{
+		method: "PUT", path: "/v1/admin/tenants/{name}", id: "putTenant", summary: "Create a tenant or change its quotas",
+		handler: handlePutTenant,
+		body:    jsonBody(common.Tenant{}),
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "tenant created", body: jsonBody(common.Tenant{})},
+			{status: http.StatusOK, description: "quotas changed", body: jsonBody(common.Tenant{})},
+			{status: http.StatusBadRequest},
+			adminResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/usage", id: "getUsage", summary: "Usage and quotas of the tenant of the token",
+		handler: handleUsage,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.TenantUsage{})},
+		},
+	},
+	{
+		method: "POST", path: "/v1/shares", id: "createShare", summary: "Create a share link for a file, or for uploads below a prefix",
+		handler: handleCreateShare,
+		body:    jsonBody(common.ShareRequest{}),
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "link created, url is not shown again", body: jsonBody(common.ShareLink{})},
+			{status: http.StatusBadRequest},
+			{status: http.StatusNotFound},
+			forbiddenResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/shares", id: "listShares", summary: "List the share links of the token, or all for admins",
+		handler: handleListShares,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.ShareLinkList{})},
+		},
+	},
+	{
+		method: "DELETE", path: "/v1/shares/{id}", id: "revokeShare", summary: "Revoke a share link",
+		handler: handleRevokeShare,
+		responses: []apiResponse{
+			{status: http.StatusNoContent, description: "link revoked"},
+			{status: http.StatusNotFound},
+		},
+	},
+	{
+		method: "GET", path: "/v1/shared/{id}", id: "downloadShared", summary: "Download the file of a share link",
+		handler: handleSharedDownload,
+		params:  []apiParam{shareSignatureParam},
+		public:  true,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: &apiBody{contentType: "application/octet-stream"}},
+			{status: http.StatusNotFound, description: "no such link, or a wrong signature"},
+			{status: http.StatusGone, description: "link expired or used up"},
+			{status: http.StatusForbidden, description: "upload link"},
+		},
+	},
+	{
+		method: "PUT", path: "/v1/shared/{id}/{path...}", id: "uploadShared", summary: "Store a new file below the prefix of an upload link",
+		handler: handleSharedUpload,
+		params:  []apiParam{shareSignatureParam},
+		public:  true,
+		body:    &apiBody{contentType: "application/octet-stream"},
+		responses: []apiResponse{
+			{status: http.StatusCreated, body: jsonBody(common.FileInfo{})},
+			{status: http.StatusNotFound, description: "no such link, or a wrong signature"},
+			{status: http.StatusGone, description: "link expired or used up"},
+			{status: http.StatusForbidden, description: "download link"},
+			{status: http.StatusConflict, description: "file exists"},
+			{status: http.StatusRequestEntityTooLarge},
+			quotaResponse,
+			infectedResponse,
+			scanFailedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/audit", id: "queryAudit", summary: "Query the audit log, newest entries last",
+		handler: adminOnly(handleAudit),
+		params: []apiParam{
+			{name: "user", description: "name or ID of the token"},
+			{name: "file", description: "file, or directory, the request touched"},
+			{name: "tenant", description: "tenant of the token"},
+			{name: "since", description: "RFC 3339 time, or a duration back from now such as 24h"},
+			{name: "until", description: "RFC 3339 time, or a duration back from now"},
+			{name: "limit", schema: "integer", description: "most entries to return, 1000 by default"},
+		},
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.AuditEntryList{})},
+			{status: http.StatusBadRequest},
+			{status: http.StatusNotFound, description: "the audit log is disabled"},
+			adminResponse,
+		},
+	},
+	{
+		method: "POST", path: "/v1/admin/encryption/rotate", id: "rotateKeys",
+		summary: "Rewrap the data keys of the encrypted files with the active master key",
+		handler: adminOnly(handleRotateKeys),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.KeyRotation{})},
+			{status: http.StatusConflict, description: "encryption at rest is not enabled"},
+			adminResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/admin/quarantine", id: "listQuarantine", summary: "List the uploads quarantined as infected, oldest first",
+		handler: adminOnly(handleListQuarantine),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.QuarantineList{})},
+			adminResponse,
+		},
+	},
+	{
+		method: "POST", path: "/v1/admin/quarantine/{id}/release", id: "releaseQuarantined",
+		summary: "Store a quarantined upload under its name after all, without scanning it again",
+		handler: adminOnly(handleReleaseQuarantined),
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.FileInfo{})},
+			{status: http.StatusNotFound},
+			adminResponse,
+			quotaResponse,
+		},
+	},
+	{
+		method: "DELETE", path: "/v1/admin/quarantine/{id}", id: "deleteQuarantined", summary: "Drop a quarantined upload",
+		handler: adminOnly(handleDeleteQuarantined),
+		responses: []apiResponse{
+			{status: http.StatusNoContent, description: "quarantined upload dropped"},
+			{status: http.StatusNotFound},
+			adminResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/jobs", id: "listJobs", summary: "List jobs, newest first",
+		handler: handleListJobs,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.JobList{})},
+		},
+	},
+	{
+		method: "POST", path: "/v1/jobs", id: "submitJob",
+		summary: "Run analytics, an integrity scan or a search (grep) as a background job; there is no search reindex job, as the store keeps no search index",
+		handler: handleSubmitJob,
+		body:    jsonBody(common.JobRequest{}),
+		responses: []apiResponse{
+			jobAcceptedResponse,
+		},
+	},
+	{
+		method: "GET", path: "/v1/jobs/{id}", id: "getJob", summary: "State, progress and result of a job",
+		handler: handleGetJob,
+		responses: []apiResponse{
+			{status: http.StatusOK, body: jsonBody(common.JobStatus{})},
+			{status: http.StatusNotFound},
+		},
+	},
+	{
+		method: "DELETE", path: "/v1/jobs/{id}", id: "cancelJob", summary: "Cancel a job",
+		handler: handleCancelJob,
+		responses: []apiResponse{
+			{status: http.StatusAccepted, body: jsonBody(common.JobStatus{})},
+			{status: http.StatusNotFound},
+		},
+	},
+}
+
+var (
+	asyncParam = apiParam{name: "async", schema: "boolean", description: "run as a job and answer 202"}
+	fileParam  = apiParam{name: "file", repeated: true, description: "limit to these files, all files by default"}
+
+	shareSignatureParam = apiParam{name: "sig", required: true, description: "signature from the url of the link"}
+
+	forbiddenResponse = apiResponse{status: http.StatusForbidden, description: "the token has no role on this path allowing it"}
+	adminResponse     = apiResponse{status: http.StatusForbidden, description: "not an admin token"}
+	quotaResponse     = apiResponse{status: http.StatusInsufficientStorage, description: "the quota of the tenant is used up"}
+	infectedResponse  = apiResponse{status: http.StatusUnprocessableEntity, description: "the virus scanner found a file infected"}
+	// scanFailedResponse keeps files that could not be scanned out as well.
+	scanFailedResponse = apiResponse{status: http.StatusServiceUnavailable, description: "the virus scanner failed"}
+
+	jobAcceptedResponse = apiResponse{
+		status: http.StatusAccepted, description: "job submitted, see the Location header", body: jsonBody(common.JobStatus{}),
+	}
+)
+
+// v1Analytics parses the query of an analytics request and, for kinds that can
+// run as jobs, submits a job instead when async=true.
+func v1Analytics(
+	kind string, handler func(config ServerConfig, w http.ResponseWriter, r *http.Request),
+) func(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	return func(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Printf("Failure to parse form %v", err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if asyncJob(r, kind) {
+			submitJob(config, w, r, kind, r.Form)
+			return
+		}
+		handler(config, w, r)
+	}
+}
+
+// errInvalidMultipart is a multipart upload whose body is not a valid form.
+var errInvalidMultipart = errors.New("invalid multipart form")
+
+// uploadErrorStatus is storageErrorStatus plus 413 for bodies over the limit
+// and 400 for malformed forms.
+func uploadErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, errInvalidMultipart) {
+		return http.StatusBadRequest
+	}
+	return storageErrorStatus(err)
+}
+
+func handleV1ListFiles(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleV1ListFiles")
+	files, err := listStoredFiles(config, r.URL.Query().Get("prefix"))
+	if err != nil {
+		log.Printf("Error in handleV1ListFiles: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, common.FileInfoList{Files: files})
+}
+
+// handleV1UploadFiles stores the files of a multipart form, like the legacy
+// upload, and answers 201 with what was stored.
+func handleV1UploadFiles(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleV1UploadFiles")
+	r.Body = http.MaxBytesReader(w, r.Body, config.maxUploadBytes)
+	stored, err := storeFormFiles(config, r)
+	if err != nil {
+		log.Printf("Error in handleV1UploadFiles: %v", err)
+		writeError(w, uploadErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, common.FileInfoList{Files: stored})
+}
+
+func handleV1GetFile(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	log.Printf("In handleV1GetFile %s", name)
+	file, info, err := openStoredFile(config, name)
+	if err != nil {
+		log.Printf("Error in handleV1GetFile: %v", err)
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// handleV1PutFile stores the raw request body under the path. It answers 201
+// when the file is new and 204 when it replaced one. With "If-None-Match: *"
+// an existing file is left alone and the answer is 409.
+func handleV1PutFile(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	log.Printf("In handleV1PutFile %s", name)
+	cleaned, err := validateFilePath(name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.ContentLength > config.maxUploadBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+		if _, err := statStoredFile(config, cleaned); err == nil {
+			writeError(w, http.StatusConflict, cleaned+": "+errStoredFileExists.Error())
+			return
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, config.maxUploadBytes)
+	created, err := writeStoredFile(config, cleaned, r.Body)
+	if err != nil {
+		log.Printf("Error in handleV1PutFile: %v", err)
+		writeError(w, uploadErrorStatus(err), err.Error())
+		return
+	}
+	if !created {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	info, err := statStoredFile(config, cleaned)
+	if err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Location", "/v1/files/"+cleaned)
+	writeJSON(w, http.StatusCreated, common.FileInfo{Name: cleaned, Size: info.Size(), ModTime: info.ModTime().UTC()})
+}
+
+func handleV1DeleteFile(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	log.Printf("In handleV1DeleteFile %s", name)
+	if err := deleteStoredFile(config, name); err != nil {
+		log.Printf("Error in handleV1DeleteFile: %v", err)
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleV1DedupeMatch is the try_with_sha256 action of the legacy API.
+func handleV1DedupeMatch(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleV1DedupeMatch")
+	var reqBody common.TryWithSha256Request
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		log.Printf("handleV1DedupeMatch err json Decoder: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkFileCount(config, len(reqBody.FileSha256Pairs)); err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	res, err := matchFilesByHash(config, reqBody.FileSha256Pairs)
+	if err != nil {
+		log.Printf("Error in handleV1DedupeMatch: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func handleV1WordCount(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	handleWordCountAction(config, w, r)
+}
+
+func handleV1ListFreqSnapshots(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	handleListFreqSnapshotsAction(config, w)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"file_store/common"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestV1API(t *testing.T) {
+	storagePath := t.TempDir()
+	server := BuildServer(ServerConfig{filesStoragePath: storagePath, maxUploadBytes: 512})
+
+	do := func(method string, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+		if body == nil {
+			body = http.NoBody
+		}
+		request, _ := http.NewRequest(method, target, body)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("put creates then replaces nested files", func(t *testing.T) {
+		response := do(http.MethodPut, "/v1/files/docs/a.txt", strings.NewReader("alpha beta"), nil)
+		if response.Code != http.StatusCreated || response.Header().Get("Location") != "/v1/files/docs/a.txt" {
+			t.Fatalf("got %d %v", response.Code, response.Header())
+		}
+		response = do(http.MethodPut, "/v1/files/docs/a.txt", strings.NewReader("alpha beta gamma"), nil)
+		if response.Code != http.StatusNoContent {
+			t.Fatalf("got %d on replace", response.Code)
+		}
+		data, err := os.ReadFile(filepath.Join(storagePath, "docs", "a.txt"))
+		if err != nil || string(data) != "alpha beta gamma" {
+			t.Errorf("stored %q, %v", data, err)
+		}
+	})
+
+	t.Run("put with If-None-Match conflicts", func(t *testing.T) {
+		response := do(http.MethodPut, "/v1/files/docs/a.txt", strings.NewReader("x"), http.Header{"If-None-Match": {"*"}})
+		if response.Code != http.StatusConflict {
+			t.Errorf("got %d", response.Code)
+		}
+	})
+
+	t.Run("put over the limit", func(t *testing.T) {
+		response := do(http.MethodPut, "/v1/files/big.txt", strings.NewReader(strings.Repeat("x", 513)), nil)
+		if response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("got %d", response.Code)
+		}
+		if _, err := os.Stat(filepath.Join(storagePath, "big.txt")); err == nil {
+			t.Errorf("partial upload was stored")
+		}
+	})
+
+	t.Run("invalid paths", func(t *testing.T) {
+		for _, target := range []string{"/v1/files/.store_meta/x", "/v1/files/a/../../x"} {
+			response := do(http.MethodPut, target, strings.NewReader("x"), nil)
+			// The mux redirects paths with dot elements to their clean form.
+			if response.Code != http.StatusBadRequest && response.Code != http.StatusTemporaryRedirect {
+				t.Errorf("%s: got %d", target, response.Code)
+			}
+		}
+	})
+
+	t.Run("multipart upload", func(t *testing.T) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("file", "b.txt")
+		part.Write([]byte("beta"))
+		writer.Close()
+		response := do(http.MethodPost, "/v1/files", &body, http.Header{"Content-Type": {writer.FormDataContentType()}})
+		if response.Code != http.StatusCreated {
+			t.Fatalf("got %d: %s", response.Code, response.Body)
+		}
+	})
+
+	t.Run("list and get", func(t *testing.T) {
+		response := do(http.MethodGet, "/v1/files?prefix=docs/", nil, nil)
+		var list common.FileInfoList
+		if err := json.NewDecoder(response.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Files) != 1 || list.Files[0].Name != "docs/a.txt" || list.Files[0].Size != 16 {
+			t.Errorf("unexpected listing %+v", list)
+		}
+		response = do(http.MethodGet, "/v1/files/docs/a.txt", nil, nil)
+		if response.Code != http.StatusOK || response.Body.String() != "alpha beta gamma" {
+			t.Errorf("got %d %q", response.Code, response.Body)
+		}
+		response = do(http.MethodGet, "/v1/files/missing.txt", nil, nil)
+		if response.Code != http.StatusNotFound {
+			t.Errorf("got %d for missing file", response.Code)
+		}
+	})
+
+	t.Run("legacy listing keeps to the top level", func(t *testing.T) {
+		response := do(http.MethodGet, "/files", nil, nil)
+		var list common.FileList
+		if err := json.NewDecoder(response.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(list.Files, ",") != "b.txt" {
+			t.Errorf("got %v, want docs/a.txt left out", list.Files)
+		}
+		response = do(http.MethodGet, "/files?action=wc", nil, nil)
+		var legacy, v1 common.WordCountServerResponse
+		json.NewDecoder(response.Body).Decode(&legacy)
+		json.NewDecoder(do(http.MethodGet, "/v1/analytics/wordcount", nil, nil).Body).Decode(&v1)
+		if legacy.Count == 0 || legacy.Count >= v1.Count {
+			t.Errorf("legacy word count %d, /v1 %d", legacy.Count, v1.Count)
+		}
+	})
+
+	t.Run("word count", func(t *testing.T) {
+		response := do(http.MethodGet, "/v1/analytics/wordcount", nil, nil)
+		var res common.WordCountServerResponse
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Count != 4 {
+			t.Errorf("got count %d", res.Count)
+		}
+		response = do(http.MethodGet, "/v1/analytics/wordcount?async=true", nil, nil)
+		if response.Code != http.StatusAccepted || !strings.HasPrefix(response.Header().Get("Location"), "/v1/jobs/") {
+			t.Errorf("got %d %v", response.Code, response.Header())
+		}
+	})
+
+	t.Run("dedupe match", func(t *testing.T) {
+		hash, _ := common.CalculateSha256ForFile(filepath.Join(storagePath, "b.txt"))
+		body, _ := json.Marshal(common.TryWithSha256Request{FileSha256Pairs: []common.FileSha256Pair{
+			{FileName: "copies/b.txt", FileHash: hash},
+			{FileName: "c.txt", FileHash: "unknown"},
+		}})
+		response := do(http.MethodPost, "/v1/dedupe/match", bytes.NewReader(body), nil)
+		var res common.TryWithSha256Response
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.UnsuccessfulFileNames) != 1 || res.UnsuccessfulFileNames[0].FileName != "c.txt" {
+			t.Errorf("unexpected response %+v", res)
+		}
+		if data, _ := os.ReadFile(filepath.Join(storagePath, "copies", "b.txt")); string(data) != "beta" {
+			t.Errorf("copy has %q", data)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if response := do(http.MethodDelete, "/v1/files/copies/b.txt", nil, nil); response.Code != http.StatusNoContent {
+			t.Errorf("got %d", response.Code)
+		}
+		if _, err := os.Stat(filepath.Join(storagePath, "copies")); err == nil {
+			t.Errorf("empty parent directory was left behind")
+		}
+		if response := do(http.MethodDelete, "/v1/files/copies/b.txt", nil, nil); response.Code != http.StatusNotFound {
+			t.Errorf("got %d on second delete", response.Code)
+		}
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		response := do(http.MethodPatch, "/v1/files/docs/a.txt", nil, nil)
+		if response.Code != http.StatusMethodNotAllowed || response.Header().Get("Allow") == "" {
+			t.Errorf("got %d %v", response.Code, response.Header())
+		}
+		if response := do(http.MethodPatch, "/files", nil, nil); response.Code != http.StatusMethodNotAllowed {
+			t.Errorf("legacy route got %d", response.Code)
+		}
+	})
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	server := BuildServer(ServerConfig{filesStoragePath: t.TempDir()})
+	cases := []struct {
+		method string
+		target string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/v1/files/missing.txt", http.StatusNotFound, "not_found"},
+		{http.MethodPatch, "/v1/files/missing.txt", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.MethodGet, "/nowhere", http.StatusNotFound, "not_found"},
+		{http.MethodGet, "/files?action=nope", http.StatusBadRequest, "bad_request"},
+		{http.MethodGet, "/jobs/unknown", http.StatusNotFound, "not_found"},
+	}
+	for _, c := range cases {
+		request, _ := http.NewRequest(c.method, c.target, http.NoBody)
+		request.Header.Set("X-Request-ID", "req-1")
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+
+		var res common.ErrorResponse
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Errorf("%s %s: %v", c.method, c.target, err)
+			continue
+		}
+		if response.Code != c.status || res.Status != c.status || res.Code != c.code || res.Message == "" {
+			t.Errorf("%s %s: got %d %+v", c.method, c.target, response.Code, res)
+		}
+		if res.RequestID != "req-1" || response.Header().Get("X-Request-ID") != "req-1" {
+			t.Errorf("%s %s: request ID not passed through: %+v", c.method, c.target, res)
+		}
+		if response.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: content type %q", c.method, c.target, response.Header().Get("Content-Type"))
+		}
+	}
+
+	// Successes are JSON too, the legacy word count included.
+	request, _ := http.NewRequest(http.MethodGet, "/files?action=wc", http.NoBody)
+	response := httptest.NewRecorder()
+	server.Handler.ServeHTTP(response, request)
+	var count common.WordCountServerResponse
+	if err := json.NewDecoder(response.Body).Decode(&count); err != nil || response.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("word count: %v, content type %q", err, response.Header().Get("Content-Type"))
+	}
+}
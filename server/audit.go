@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	auditFileName = "audit.log"
+	// defaultAuditMaxBytes is the size at which the audit log is rotated,
+	// keeping defaultAuditKeep rotated files, unless STORE_AUDIT_MAX_BYTES and
+	// STORE_AUDIT_KEEP say otherwise.
+	defaultAuditMaxBytes = 64 << 20
+	defaultAuditKeep     = 10
+	// maxAuditFiles caps the files recorded for one request, e.g. a batch.
+	maxAuditFiles          = 100
+	defaultAuditQueryLimit = 1000
+	maxAuditQueryLimit     = 10000
+)
+
+var errInvalidAuditQuery = errors.New("invalid audit query")
+
+// auditLog appends an AuditEntry per request, as a JSON line, to path. When
+// the file would grow past maxBytes it becomes path.1, the older ones move up
+// and the oldest beyond keep are deleted. An empty path records nothing.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+func newAuditLog(path string, maxBytes int64, keep int) *auditLog {
+	return &auditLog{path: path, maxBytes: maxBytes, keep: max(keep, 1)}
+}
+
+func (l *auditLog) enabled() bool {
+	return l != nil && l.path != ""
+}
+
+func (l *auditLog) record(entry common.AuditEntry) {
+	if !l.enabled() {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("auditLog err encoding %+v: %v", entry, err)
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotateLocked(); err != nil {
+			log.Printf("auditLog err rotating %s: %v", l.path, err)
+		}
+	}
+	if l.file == nil {
+		if err := l.openLocked(); err != nil {
+			log.Printf("auditLog err opening %s: %v", l.path, err)
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("auditLog err writing %s: %v", l.path, err)
+	}
+}
+
+func (l *auditLog) openLocked() error {
+	if err := os.MkdirAll(path.Dir(l.path), 0777); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *auditLog) rotatedPath(i int) string {
+	if i == 0 {
+		return l.path
+	}
+	return l.path + "." + strconv.Itoa(i)
+}
+
+func (l *auditLog) rotateLocked() error {
+	l.file.Close()
+	l.file = nil
+	if err := os.Remove(l.rotatedPath(l.keep)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := l.keep - 1; i >= 0; i-- {
+		if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditLogFromEnv sets up the audit log from STORE_AUDIT_PATH,
+// STORE_AUDIT_MAX_BYTES and STORE_AUDIT_KEEP. STORE_AUDIT=off disables it.
+func auditLogFromEnv(metaPath string) *auditLog {
+	if os.Getenv("STORE_AUDIT") == "off" {
+		log.Printf("Audit log disabled by STORE_AUDIT=off")
+		return newAuditLog("", 0, 0)
+	}
+	auditPath := metaPath + "/" + auditFileName
+	if os.Getenv("STORE_AUDIT_PATH") != "" {
+		auditPath = os.Getenv("STORE_AUDIT_PATH")
+	}
+	maxBytes, keep := int64(defaultAuditMaxBytes), defaultAuditKeep
+	if value := os.Getenv("STORE_AUDIT_MAX_BYTES"); value != "" {
+		var err error
+		if maxBytes, err = strconv.ParseInt(value, 10, 64); err != nil || maxBytes < 1 {
+			log.Fatalf("invalid STORE_AUDIT_MAX_BYTES %q", value)
+		}
+	}
+	if value := os.Getenv("STORE_AUDIT_KEEP"); value != "" {
+		var err error
+		if keep, err = strconv.Atoi(value); err != nil || keep < 1 {
+			log.Fatalf("invalid STORE_AUDIT_KEEP %q", value)
+		}
+	}
+	return newAuditLog(auditPath, maxBytes, keep)
+}
+
+// auditFilter selects entries of the audit log. Empty fields match all.
+type auditFilter struct {
+	user   string
+	file   string
+	tenant string
+	since  time.Time
+	until  time.Time
+	limit  int
+}
+
+func (f auditFilter) matches(entry common.AuditEntry) bool {
+	if f.user != "" && entry.User != f.user && entry.UserID != f.user {
+		return false
+	}
+	if f.tenant != "" && entry.Tenant != f.tenant {
+		return false
+	}
+	if f.file != "" && !slices.ContainsFunc(entry.Files, func(name string) bool {
+		return name == f.file || strings.HasPrefix(name, strings.TrimSuffix(f.file, "/")+"/")
+	}) {
+		return false
+	}
+	return !entry.Time.Before(f.since) && (f.until.IsZero() || entry.Time.Before(f.until))
+}
+
+// query returns the newest entries matching filter, oldest first, from the
+// rotated files and the current one.
+func (l *auditLog) query(filter auditFilter) ([]common.AuditEntry, error) {
+	res := make([]common.AuditEntry, 0)
+	if !l.enabled() {
+		return res, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := l.keep; i >= 0; i-- {
+		file, err := os.Open(l.rotatedPath(i))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 4<<20)
+		for scanner.Scan() {
+			var entry common.AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if filter.matches(entry) {
+				res = append(res, entry)
+				if len(res) > filter.limit {
+					res = res[1:]
+				}
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// auditEntry is the entry of the request being served. The middleware and
+// interceptors start it and record it once the request is done; on the way
+// authentication adds the caller and the storage functions the files.
+type auditEntry struct {
+	mu    sync.Mutex
+	entry common.AuditEntry
+}
+
+type auditEntryKey struct{}
+
+func withAuditEntry(ctx context.Context, entry *auditEntry) context.Context {
+	return context.WithValue(ctx, auditEntryKey{}, entry)
+}
+
+// auditEntryFrom returns the entry of the request of ctx, nil if it is not
+// audited.
+func auditEntryFrom(ctx context.Context) *auditEntry {
+	entry, _ := ctx.Value(auditEntryKey{}).(*auditEntry)
+	return entry
+}
+
+func (e *auditEntry) setCaller(token common.APIToken) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.entry.UserID, e.entry.User, e.entry.Tenant = token.ID, token.Name, token.Tenant
+}
+
+func (e *auditEntry) addFile(name string) {
+	if e == nil {
+		return
+	}
+	name = path.Clean(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.entry.Files) < maxAuditFiles && !slices.Contains(e.entry.Files, name) {
+		e.entry.Files = append(e.entry.Files, name)
+	}
+}
+
+// finish records the entry with the outcome of the request.
+func (e *auditEntry) finish(l *auditLog, start time.Time, status int, bytesIn int64, bytesOut int64) {
+	e.mu.Lock()
+	e.entry.Status, e.entry.BytesIn, e.entry.BytesOut = status, bytesIn, bytesOut
+	entry := e.entry
+	entry.Files = slices.Clone(entry.Files)
+	e.mu.Unlock()
+	entry.Time = start.UTC()
+	entry.DurationMs = time.Since(start).Milliseconds()
+	l.record(entry)
+}
+
+// withAudit records every request to next in the audit log. WebDAV requests
+// are told apart by their path.
+func withAudit(l *auditLog, protocol string, next http.Handler) http.Handler {
+	if !l.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &auditEntry{entry: common.AuditEntry{
+			RequestID:  w.Header().Get(requestIDHeader),
+			Protocol:   protocol,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+		}}
+		if strings.HasPrefix(r.URL.Path, davPrefix+"/") {
+			entry.entry.Protocol = "webdav"
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		aw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(withAuditEntry(r.Context(), entry)))
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		entry.finish(l, start, aw.status, body.n, aw.n)
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// auditResponseWriter notes the status and size of a response.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func newGRPCAuditEntry(ctx context.Context, method string) *auditEntry {
+	entry := &auditEntry{entry: common.AuditEntry{Protocol: "grpc", Method: method}}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.entry.RemoteAddr = p.Addr.String()
+	}
+	return entry
+}
+
+func messageSize(m any) int64 {
+	if msg, ok := m.(proto.Message); ok {
+		return int64(proto.Size(msg))
+	}
+	return 0
+}
+
+func auditUnaryRPC(l *auditLog) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !l.enabled() {
+			return handler(ctx, req)
+		}
+		start := time.Now()
+		entry := newGRPCAuditEntry(ctx, info.FullMethod)
+		res, err := handler(withAuditEntry(ctx, entry), req)
+		entry.finish(l, start, int(status.Code(err)), messageSize(req), messageSize(res))
+		return res, err
+	}
+}
+
+func auditStreamRPC(l *auditLog) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !l.enabled() {
+			return handler(srv, stream)
+		}
+		start := time.Now()
+		entry := newGRPCAuditEntry(stream.Context(), info.FullMethod)
+		audited := &auditedStream{ServerStream: stream, ctx: withAuditEntry(stream.Context(), entry)}
+		err := handler(srv, audited)
+		entry.finish(l, start, int(status.Code(err)), audited.in, audited.out)
+		return err
+	}
+}
+
+// auditedStream carries the audit entry and counts the bytes of messages.
+type auditedStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	in, out int64
+}
+
+func (s *auditedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *auditedStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.in += messageSize(m)
+	}
+	return err
+}
+
+func (s *auditedStream) SendMsg(m any) error {
+	s.out += messageSize(m)
+	return s.ServerStream.SendMsg(m)
+}
+
+// parseAuditTime accepts a time in RFC 3339 or a duration back from now.
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: %q is neither an RFC 3339 time nor a duration", errInvalidAuditQuery, value)
+}
+
+func parseAuditFilter(query map[string][]string, now time.Time) (auditFilter, error) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	filter := auditFilter{user: get("user"), file: get("file"), tenant: get("tenant"), limit: defaultAuditQueryLimit}
+	var err error
+	if filter.since, err = parseAuditTime(get("since"), now); err != nil {
+		return filter, err
+	}
+	if filter.until, err = parseAuditTime(get("until"), now); err != nil {
+		return filter, err
+	}
+	if limit := get("limit"); limit != "" {
+		if filter.limit, err = strconv.Atoi(limit); err != nil || filter.limit < 1 || filter.limit > maxAuditQueryLimit {
+			return filter, fmt.Errorf("%w: limit %q is not between 1 and %d", errInvalidAuditQuery, limit, maxAuditQueryLimit)
+		}
+	}
+	return filter, nil
+}
+
+// handleAudit answers with the newest audit entries matching the query.
+func handleAudit(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleAudit")
+	filter, err := parseAuditFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !config.audit.enabled() {
+		writeError(w, http.StatusNotFound, "the audit log is disabled")
+		return
+	}
+	entries, err := config.audit.query(filter)
+	if err != nil {
+		log.Printf("Error in handleAudit: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, common.AuditEntryList{Entries: entries})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"file_store/common"
+	"file_store/storepb"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAudit(t *testing.T) {
+	config := ServerConfig{filesStoragePath: t.TempDir()}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	server := BuildServer(config)
+
+	do := func(method string, target string, token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	body, _ := json.Marshal(common.TokenRequest{Name: "ci", Grants: []common.Grant{{Prefix: "builds/", Role: common.RoleWriter}}})
+	var ci common.APIToken
+	json.NewDecoder(do(http.MethodPost, "/v1/admin/tokens", "root-secret", string(body)).Body).Decode(&ci)
+
+	do(http.MethodPut, "/v1/files/builds/app.bin", ci.Token, "0123456789")
+	do(http.MethodGet, "/v1/files/builds/app.bin", ci.Token, "")
+	do(http.MethodDelete, "/v1/files/secret.txt", ci.Token, "")
+	do(http.MethodGet, "/v1/files", "wrong", "")
+
+	query := func(t *testing.T, q string) []common.AuditEntry {
+		t.Helper()
+		response := do(http.MethodGet, "/v1/audit?"+q, "root-secret", "")
+		if response.Code != http.StatusOK {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var list common.AuditEntryList
+		json.NewDecoder(response.Body).Decode(&list)
+		return list.Entries
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		entries := query(t, "user=ci")
+		if len(entries) != 3 {
+			t.Fatalf("got %+v", entries)
+		}
+		put, get, del := entries[0], entries[1], entries[2]
+		if put.Method != http.MethodPut || put.UserID != ci.ID || put.Status != http.StatusCreated || put.BytesIn != 10 ||
+			len(put.Files) != 1 || put.Files[0] != "builds/app.bin" || put.Protocol != "http" || put.RemoteAddr == "" || put.RequestID == "" {
+			t.Errorf("put %+v", put)
+		}
+		if get.BytesOut != 10 || get.Status != http.StatusOK {
+			t.Errorf("get %+v", get)
+		}
+		if del.Status != http.StatusForbidden || len(del.Files) != 1 || del.Files[0] != "secret.txt" {
+			t.Errorf("denied delete %+v", del)
+		}
+		entries = query(t, "since=1h")
+		if unauthorized := entries[len(entries)-2]; unauthorized.User != "" || unauthorized.Status != http.StatusUnauthorized {
+			t.Errorf("unauthorized %+v", unauthorized)
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		if entries := query(t, "file=builds"); len(entries) != 2 {
+			t.Errorf("got %d entries for the directory", len(entries))
+		}
+		if entries := query(t, "user=ci&limit=1"); len(entries) != 1 || entries[0].Method != http.MethodDelete {
+			t.Errorf("got %+v, want the newest entry", entries)
+		}
+		if entries := query(t, "since="+time.Now().Add(time.Hour).Format(time.RFC3339)); len(entries) != 0 {
+			t.Errorf("got %d entries from the future", len(entries))
+		}
+		for _, q := range []string{"since=yesterday", "limit=0"} {
+			if response := do(http.MethodGet, "/v1/audit?"+q, "root-secret", ""); response.Code != http.StatusBadRequest {
+				t.Errorf("got %d for %s", response.Code, q)
+			}
+		}
+		if response := do(http.MethodGet, "/v1/audit", ci.Token, ""); response.Code != http.StatusForbidden {
+			t.Errorf("got %d querying without admin", response.Code)
+		}
+	})
+
+	t.Run("gRPC", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), apiTokenKey{}, ci)
+		handler := func(ctx context.Context, req any) (any, error) {
+			auditEntryFrom(ctx).setCaller(ci)
+			return (&grpcServer{config: config}).Delete(ctx, req.(*storepb.DeleteRequest))
+		}
+		_, err := auditUnaryRPC(config.audit)(ctx, &storepb.DeleteRequest{Name: "builds/app.bin"}, &grpc.UnaryServerInfo{FullMethod: "/store.v1.FileStore/Delete"}, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := query(t, "file=builds/app.bin")
+		last := entries[len(entries)-1]
+		if last.Protocol != "grpc" || last.Method != "/store.v1.FileStore/Delete" || last.Status != int(codes.OK) || last.User != "ci" {
+			t.Errorf("got %+v", last)
+		}
+		_, err = auditUnaryRPC(config.audit)(ctx, &storepb.DeleteRequest{Name: "x"}, &grpc.UnaryServerInfo{FullMethod: "/store.v1.FileStore/Delete"},
+			func(ctx context.Context, req any) (any, error) {
+				auditEntryFrom(ctx).setCaller(ci)
+				return nil, status.Error(codes.NotFound, "x")
+			})
+		entries = query(t, "user=ci")
+		if last := entries[len(entries)-1]; last.Status != int(codes.NotFound) {
+			t.Errorf("got %+v", last)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		dir := t.TempDir()
+		l := newAuditLog(filepath.Join(dir, auditFileName), 300, 2)
+		for i := 0; i < 20; i++ {
+			l.record(common.AuditEntry{Time: time.Now(), Method: "GET", Path: fmt.Sprintf("/v1/files/%02d", i)})
+		}
+		files, _ := os.ReadDir(dir)
+		if len(files) != 3 {
+			t.Errorf("got %d files, want the log and 2 rotated", len(files))
+		}
+		for _, file := range files {
+			if info, _ := file.Info(); info.Size() > 300 {
+				t.Errorf("%s has %d bytes", file.Name(), info.Size())
+			}
+		}
+		entries, err := l.query(auditFilter{limit: 100})
+		if err != nil || len(entries) == 0 || entries[len(entries)-1].Path != "/v1/files/19" {
+			t.Errorf("got %+v, %v", entries, err)
+		}
+	})
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	tokensFileName = "tokens.json"
+	// bootstrapTokenFileName is where the admin token created on a first
+	// start is saved, so it never appears in the log.
+	bootstrapTokenFileName = "bootstrap-admin-token"
+	tokenPrefix            = "st_"
+	defaultTokenTTL        = 90 * 24 * time.Hour
+)
+
+var (
+	errInvalidTokenRequest = errors.New("invalid token request")
+	errTokenNotFound       = errors.New("no such token")
+)
+
+// publicPaths are served without a token, so the API description stays
+// readable. Share links, under sharedPrefix, carry their own signature.
+var publicPaths = []string{"/openapi.json", "/docs"}
+
+// storedToken is an APIToken as kept in tokens.json: the hash of the secret
+// instead of the secret.
+type storedToken struct {
+	common.APIToken
+	Hash string `json:"hash"`
+}
+
+// tokenStore authenticates API requests with bearer tokens kept, hashed, in
+// metaPath/tokens.json. The file is read again when it changes, so replicas
+// sharing the meta directory see each other's tokens. adminHash is the hash of
+// the token set with STORE_ADMIN_TOKEN, which is never stored.
+type tokenStore struct {
+	mu        sync.Mutex
+	path      string
+	tokens    []storedToken
+	modTime   time.Time
+	adminHash string
+}
+
+func newTokenStore(metaPath string, adminToken string) *tokenStore {
+	s := &tokenStore{path: filepath.Join(metaPath, tokensFileName), tokens: make([]storedToken, 0)}
+	if adminToken != "" {
+		s.adminHash = hashToken(adminToken)
+	}
+	s.refreshLocked()
+	return s
+}
+
+// writeBootstrapToken saves token in metaPath, readable only by the user
+// running the server, and returns the path of the file.
+func writeBootstrapToken(metaPath string, token string) (string, error) {
+	path := filepath.Join(metaPath, bootstrapTokenFileName)
+	if err := os.MkdirAll(metaPath, 0777); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = file.Chmod(0600)
+	if err == nil {
+		_, err = file.WriteString(token + "\n")
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return path, err
+}
+
+// refreshLocked reads the file again if it changed since it was last read.
+func (s *tokenStore) refreshLocked() {
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	tokens := make([]storedToken, 0)
+	if err := readJSONFile(s.path, &tokens); err != nil {
+		log.Printf("tokenStore err reading %s: %v", s.path, err)
+		return
+	}
+	s.tokens = tokens
+	s.modTime = info.ModTime()
+}
+
+// writeLocked replaces the file and the tokens with tokens.
+func (s *tokenStore) writeLocked(tokens []storedToken) error {
+	if err := writeJSONFile(s.path, tokens); err != nil {
+		return err
+	}
+	s.tokens = tokens
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the unexpired token matching secret.
+func (s *tokenStore) authenticate(secret string, now time.Time) (common.APIToken, bool) {
+	hash := hashToken(secret)
+	if s.adminHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(s.adminHash)) == 1 {
+		return common.APIToken{ID: "admin", Name: "STORE_ADMIN_TOKEN", Admin: true}, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) == 1 && now.Before(token.ExpiresAt) {
+			return token.APIToken, true
+		}
+	}
+	return common.APIToken{}, false
+}
+
+// authenticateCert returns the unexpired token mapped to the verified client
+// certificate of a TLS connection.
+func (s *tokenStore) authenticateCert(state *tls.ConnectionState, now time.Time) (common.APIToken, bool) {
+	cn, ok := clientCertIdentity(state)
+	if !ok {
+		return common.APIToken{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	for _, token := range s.tokens {
+		if token.ClientCN == cn && now.Before(token.ExpiresAt) {
+			return token.APIToken, true
+		}
+	}
+	return common.APIToken{}, false
+}
+
+// issue creates a token for req, whose tenant must be one of tenants. The
+// returned token is the only place its secret appears. Expired tokens are
+// dropped on the way.
+func (s *tokenStore) issue(req common.TokenRequest, tenants *tenantStore, now time.Time) (common.APIToken, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return common.APIToken{}, fmt.Errorf("%w: name is empty", errInvalidTokenRequest)
+	}
+	ttl := defaultTokenTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return common.APIToken{}, fmt.Errorf("%w: ttl %q is not a positive duration", errInvalidTokenRequest, req.TTL)
+		}
+	}
+	if err := validateGrants(req.Grants); err != nil {
+		return common.APIToken{}, fmt.Errorf("%w: %w", errInvalidTokenRequest, err)
+	}
+	if req.RateLimit < 0 {
+		return common.APIToken{}, fmt.Errorf("%w: rate_limit is negative", errInvalidTokenRequest)
+	}
+	if req.Tenant != "" {
+		if _, ok := tenants.get(req.Tenant); !ok {
+			return common.APIToken{}, fmt.Errorf("%w: %w %q", errInvalidTokenRequest, errTenantNotFound, req.Tenant)
+		}
+		if req.Admin || slices.ContainsFunc(req.Grants, func(g common.Grant) bool { return g.Role == common.RoleAdmin }) {
+			return common.APIToken{}, fmt.Errorf("%w: tenant tokens cannot be admins", errInvalidTokenRequest)
+		}
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return common.APIToken{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return common.APIToken{}, err
+	}
+	token := common.APIToken{
+		ID:        hex.EncodeToString(id),
+		Name:      req.Name,
+		Admin:     req.Admin,
+		Grants:    req.Grants,
+		Tenant:    req.Tenant,
+		ClientCN:  req.ClientCN,
+		RateLimit: req.RateLimit,
+		CreatedAt: now.UTC(),
+		ExpiresAt: now.UTC().Add(ttl),
+	}
+	secretText := tokenPrefix + hex.EncodeToString(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	tokens := slices.DeleteFunc(slices.Clone(s.tokens), func(t storedToken) bool { return !now.Before(t.ExpiresAt) })
+	if req.ClientCN != "" && slices.ContainsFunc(tokens, func(t storedToken) bool { return t.ClientCN == req.ClientCN }) {
+		return common.APIToken{}, fmt.Errorf("%w: client_cn %q belongs to another token", errInvalidTokenRequest, req.ClientCN)
+	}
+	tokens = append(tokens, storedToken{APIToken: token, Hash: hashToken(secretText)})
+	if err := s.writeLocked(tokens); err != nil {
+		return common.APIToken{}, err
+	}
+	token.Token = secretText
+	return token, nil
+}
+
+func (s *tokenStore) list() []common.APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	res := make([]common.APIToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		res = append(res, token.APIToken)
+	}
+	return res
+}
+
+func (s *tokenStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	i := slices.IndexFunc(s.tokens, func(t storedToken) bool { return t.ID == id })
+	if i < 0 {
+		return fmt.Errorf("%w %q", errTokenNotFound, id)
+	}
+	return s.writeLocked(slices.Delete(slices.Clone(s.tokens), i, i+1))
+}
+
+// hasAdmin tells whether an unexpired admin token exists.
+func (s *tokenStore) hasAdmin(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	return slices.ContainsFunc(s.tokens, func(t storedToken) bool {
+		isAdmin := t.Admin || slices.Contains(t.Grants, common.Grant{Role: common.RoleAdmin})
+		return isAdmin && now.Before(t.ExpiresAt)
+	})
+}
+
+// requestToken extracts the token of a request: a bearer token, or the
+// password of basic auth for WebDAV clients, which cannot send anything else.
+func requestToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+type apiTokenKey struct{}
+
+// callerToken returns the token a request was authenticated with, if any.
+func callerToken(ctx context.Context) (common.APIToken, bool) {
+	token, ok := ctx.Value(apiTokenKey{}).(common.APIToken)
+	return token, ok
+}
+
+// Auth lets only requests with a valid token, or a client certificate mapped
+// to one, through to next. Without a token store, as in tests, everything is
+// let through.
+func Auth(config ServerConfig, next http.Handler) http.Handler {
+	if config.tokens == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(publicPaths, r.URL.Path) || strings.HasPrefix(r.URL.Path, sharedPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait, err := checkAuthFailures(config, r.RemoteAddr); err != nil {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		token, ok := config.tokens.authenticate(requestToken(r), time.Now())
+		if !ok {
+			token, ok = config.tokens.authenticateCert(r.TLS, time.Now())
+		}
+		if !ok {
+			recordAuthFailure(config, r.RemoteAddr)
+			log.Printf("[%s] [%s] [%s] unauthorized", r.Method, r.URL.Path, w.Header().Get(requestIDHeader))
+			if strings.HasPrefix(r.URL.Path, davPrefix+"/") {
+				w.Header().Set("WWW-Authenticate", `Basic realm="store"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="store"`)
+			}
+			writeError(w, http.StatusUnauthorized, "missing, invalid or expired API token")
+			return
+		}
+		auditEntryFrom(r.Context()).setCaller(token)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	})
+}
+
+// grpcAuthenticate checks the bearer token in the authorization metadata of
+// a call, or else the client certificate of its connection.
+func grpcAuthenticate(config ServerConfig, ctx context.Context) (context.Context, error) {
+	if config.tokens == nil {
+		return ctx, nil
+	}
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	if wait, err := checkAuthFailures(config, addr); err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "%v, retry after %ss", err, retryAfter(wait))
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		scheme, secret, _ := strings.Cut(value, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			continue
+		}
+		if token, ok := config.tokens.authenticate(strings.TrimSpace(secret), time.Now()); ok {
+			auditEntryFrom(ctx).setCaller(token)
+			return context.WithValue(ctx, apiTokenKey{}, token), nil
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if token, ok := config.tokens.authenticateCert(&info.State, time.Now()); ok {
+				auditEntryFrom(ctx).setCaller(token)
+				return context.WithValue(ctx, apiTokenKey{}, token), nil
+			}
+		}
+	}
+	recordAuthFailure(config, addr)
+	return nil, status.Error(codes.Unauthenticated, "missing, invalid or expired API token")
+}
+
+func authUnaryRPC(config ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := grpcAuthenticate(config, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStreamRPC(config ServerConfig) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := grpcAuthenticate(config, stream.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// requireAdmin answers 403 unless the request was made with an admin token.
+func requireAdmin(config ServerConfig, w http.ResponseWriter, r *http.Request) bool {
+	if config.tokens == nil {
+		writeError(w, http.StatusNotFound, "authentication is disabled")
+		return false
+	}
+	if !config.access.isAdmin() {
+		writeError(w, http.StatusForbidden, "an admin token is required")
+		return false
+	}
+	return true
+}
+
+func handleListTokens(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleListTokens")
+	if !requireAdmin(config, w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, common.APITokenList{Tokens: config.tokens.list()})
+}
+
+// handleIssueToken answers 201 with the new token, including its secret.
+func handleIssueToken(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleIssueToken")
+	if !requireAdmin(config, w, r) {
+		return
+	}
+	var req common.TokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	token, err := config.tokens.issue(req, config.tenants, time.Now())
+	if errors.Is(err, errInvalidTokenRequest) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Error in handleIssueToken: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("issued token %s (%s, admin: %v, grants: %v)", token.ID, token.Name, token.Admin, token.Grants)
+	w.Header().Set("Location", "/v1/admin/tokens/"+token.ID)
+	writeJSON(w, http.StatusCreated, token)
+}
+
+func handleRevokeToken(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	log.Printf("In handleRevokeToken %s", id)
+	if !requireAdmin(config, w, r) {
+		return
+	}
+	if err := config.tokens.revoke(id); errors.Is(err, errTokenNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Error in handleRevokeToken: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
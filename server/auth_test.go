@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuth(t *testing.T) {
+	config := ServerConfig{filesStoragePath: t.TempDir()}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	server := BuildServer(config)
+
+	do := func(method string, target string, token string, body any) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		request := httptest.NewRequest(method, target, bytes.NewReader(data))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	issue := func(t *testing.T, req common.TokenRequest) common.APIToken {
+		t.Helper()
+		response := do(http.MethodPost, "/v1/admin/tokens", "root-secret", req)
+		if response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var token common.APIToken
+		json.NewDecoder(response.Body).Decode(&token)
+		return token
+	}
+
+	t.Run("requests without a valid token", func(t *testing.T) {
+		for _, token := range []string{"", "wrong"} {
+			response := do(http.MethodGet, "/v1/files", token, nil)
+			if response.Code != http.StatusUnauthorized || !strings.HasPrefix(response.Header().Get("WWW-Authenticate"), "Bearer") {
+				t.Errorf("got %d %v with token %q", response.Code, response.Header(), token)
+			}
+		}
+		if response := do(http.MethodGet, "/files?action=wc", "", nil); response.Code != http.StatusUnauthorized {
+			t.Errorf("got %d on a legacy route", response.Code)
+		}
+		if response := do(http.MethodGet, "/openapi.json", "", nil); response.Code != http.StatusOK {
+			t.Errorf("got %d for the API description", response.Code)
+		}
+	})
+
+	token := issue(t, common.TokenRequest{Name: "ci", TTL: "1h"})
+	t.Run("issued tokens", func(t *testing.T) {
+		if !strings.HasPrefix(token.Token, tokenPrefix) || token.Admin || token.ExpiresAt.Sub(token.CreatedAt) != time.Hour {
+			t.Errorf("issued %+v", token)
+		}
+		request := httptest.NewRequest(http.MethodPut, "/v1/files/a.txt", strings.NewReader("alpha"))
+		request.Header.Set("Authorization", "Bearer "+token.Token)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		if response.Code != http.StatusCreated {
+			t.Errorf("got %d on put", response.Code)
+		}
+		request = httptest.NewRequest(http.MethodGet, "/dav/a.txt", http.NoBody)
+		request.SetBasicAuth("anyone", token.Token)
+		response = httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		if response.Code != http.StatusOK || response.Body.String() != "alpha" {
+			t.Errorf("got %d %q over WebDAV", response.Code, response.Body.String())
+		}
+		if response := do(http.MethodGet, "/v1/admin/tokens", token.Token, nil); response.Code != http.StatusForbidden {
+			t.Errorf("got %d listing tokens without admin", response.Code)
+		}
+		if response := do(http.MethodPost, "/v1/admin/tokens", "root-secret", common.TokenRequest{Name: "x", TTL: "-1h"}); response.Code != http.StatusBadRequest {
+			t.Errorf("got %d for a negative ttl", response.Code)
+		}
+	})
+
+	t.Run("tokens are stored hashed", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join(config.metaPath, tokensFileName))
+		if err != nil || strings.Contains(string(data), token.Token) || !strings.Contains(string(data), hashToken(token.Token)) {
+			t.Errorf("tokens.json %s, %v", data, err)
+		}
+		if _, ok := newTokenStore(config.metaPath, "").authenticate(token.Token, time.Now()); !ok {
+			t.Errorf("token not accepted after a reload")
+		}
+	})
+
+	t.Run("gRPC calls", func(t *testing.T) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token.Token))
+		if _, err := grpcAuthenticate(config, ctx); err != nil {
+			t.Errorf("got %v", err)
+		}
+		if _, err := grpcAuthenticate(config, context.Background()); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("got %v without a token", err)
+		}
+	})
+
+	t.Run("expired and revoked tokens", func(t *testing.T) {
+		shortLived := issue(t, common.TokenRequest{Name: "short", TTL: "1ms"})
+		time.Sleep(5 * time.Millisecond)
+		if response := do(http.MethodGet, "/v1/files", shortLived.Token, nil); response.Code != http.StatusUnauthorized {
+			t.Errorf("got %d with an expired token", response.Code)
+		}
+		if response := do(http.MethodDelete, "/v1/admin/tokens/"+token.ID, "root-secret", nil); response.Code != http.StatusNoContent {
+			t.Errorf("got %d on revoke", response.Code)
+		}
+		if response := do(http.MethodGet, "/v1/files", token.Token, nil); response.Code != http.StatusUnauthorized {
+			t.Errorf("got %d with a revoked token", response.Code)
+		}
+		if response := do(http.MethodDelete, "/v1/admin/tokens/"+token.ID, "root-secret", nil); response.Code != http.StatusNotFound {
+			t.Errorf("got %d revoking twice", response.Code)
+		}
+	})
+}
+
+func TestWriteBootstrapToken(t *testing.T) {
+	metaPath := filepath.Join(t.TempDir(), ".store_meta")
+	path, err := writeBootstrapToken(metaPath, "st_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path); string(data) != "st_secret\n" {
+		t.Errorf("got %q", data)
+	}
+}
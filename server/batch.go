@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// atomicBatchMu runs one atomic batch at a time, so two rollbacks never undo
+// each other's changes. Other writers are not held off.
+var atomicBatchMu sync.Mutex
+
+// batchUndo restores a file to how it was before an operation of an atomic
+// batch changed it.
+type batchUndo struct {
+	name     string
+	existed  bool
+	backup   string
+	metadata map[string]string
+}
+
+// batchJournal keeps copies of the files an atomic batch changes in a
+// directory of metaPath until the batch is done.
+type batchJournal struct {
+	config ServerConfig
+	dir    string
+	undo   []batchUndo
+}
+
+func newBatchJournal(config ServerConfig) (*batchJournal, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(config.metaPath, "batch-"+hex.EncodeToString(buf))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &batchJournal{config: config, dir: dir}, nil
+}
+
+// save records the state of name before it is changed.
+func (j *batchJournal) save(name string) error {
+	undo := batchUndo{name: name, metadata: j.config.metadata.get(name)}
+	src, _, err := openStoredFile(j.config, name)
+	if errors.Is(err, errStoredFileNotFound) {
+		j.undo = append(j.undo, undo)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	undo.existed = true
+	undo.backup = filepath.Join(j.dir, fmt.Sprint(len(j.undo)))
+	dst, err := os.Create(undo.backup)
+	if err != nil {
+		return err
+	}
+	sealed, err := j.config.encryption.seal(dst)
+	if err == nil {
+		_, err = io.Copy(sealed, src)
+	}
+	if err == nil {
+		err = sealed.Close()
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	j.undo = append(j.undo, undo)
+	return nil
+}
+
+// rollback restores the saved files, latest change first.
+func (j *batchJournal) rollback() error {
+	var errs []error
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		undo := j.undo[i]
+		if !undo.existed {
+			if _, err := statStoredFile(j.config, undo.name); err == nil {
+				errs = append(errs, deleteStoredFile(j.config, undo.name))
+			}
+			continue
+		}
+		backup, err := j.config.encryption.open(undo.backup)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		_, err = writeStoredFile(j.config, undo.name, backup)
+		backup.Close()
+		errs = append(errs, err, j.config.metadata.replace(undo.name, undo.metadata))
+	}
+	return errors.Join(errs...)
+}
+
+func (j *batchJournal) close() {
+	if err := os.RemoveAll(j.dir); err != nil {
+		log.Printf("batchJournal err removing %s: %v", j.dir, err)
+	}
+}
+
+func batchError(status int, message string) *common.ErrorResponse {
+	return &common.ErrorResponse{Status: status, Code: errorCode(status), Message: message}
+}
+
+// checkBatchOperation validates op and returns the content it stores.
+func checkBatchOperation(op common.BatchOperation) ([]byte, error) {
+	var names []string
+	switch op.Op {
+	case common.BatchPut:
+		names = []string{op.Path}
+	case common.BatchCopy, common.BatchMove:
+		names = []string{op.From, op.To}
+	case common.BatchDelete, common.BatchSetMetadata:
+		names = []string{op.Path}
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+	for _, name := range names {
+		if _, err := validateFilePath(name); err != nil {
+			return nil, err
+		}
+	}
+	if op.Op != common.BatchPut {
+		return nil, nil
+	}
+	if op.Content != "" && op.ContentBase64 != "" {
+		return nil, fmt.Errorf("content and content_base64 are exclusive")
+	}
+	if op.ContentBase64 != "" {
+		return base64.StdEncoding.DecodeString(op.ContentBase64)
+	}
+	return []byte(op.Content), nil
+}
+
+// batchTargets lists the files op changes.
+func batchTargets(op common.BatchOperation) []string {
+	switch op.Op {
+	case common.BatchCopy:
+		return []string{op.To}
+	case common.BatchMove:
+		return []string{op.From, op.To}
+	default:
+		return []string{op.Path}
+	}
+}
+
+// runBatchOperation runs op and returns the status the matching single request
+// answers with.
+func runBatchOperation(config ServerConfig, op common.BatchOperation, content []byte) (int, error) {
+	switch op.Op {
+	case common.BatchPut:
+		created, err := writeStoredFile(config, op.Path, bytes.NewReader(content))
+		if err != nil || !created {
+			return http.StatusNoContent, err
+		}
+		return http.StatusCreated, nil
+	case common.BatchCopy, common.BatchMove:
+		_, statErr := statStoredFile(config, op.To)
+		var err error
+		if op.Op == common.BatchCopy {
+			err = copyStoredFile(config, op.From, op.To, op.Overwrite)
+		} else {
+			err = renameStoredFile(config, op.From, op.To, op.Overwrite)
+		}
+		if err != nil || statErr == nil {
+			return http.StatusNoContent, err
+		}
+		return http.StatusCreated, nil
+	case common.BatchDelete:
+		return http.StatusNoContent, deleteStoredFile(config, op.Path)
+	default:
+		_, err := updateStoredMetadata(config, op.Path, op.Metadata)
+		return http.StatusOK, err
+	}
+}
+
+// runBatch runs the operations of req in order. A failed operation does not
+// stop the others unless the batch is atomic: then nothing runs if any
+// operation is invalid, and the first failure rolls back the changes before it.
+func runBatch(config ServerConfig, req common.BatchRequest) common.BatchResponse {
+	resp := common.BatchResponse{Results: make([]common.BatchResult, len(req.Operations))}
+	contents := make([][]byte, len(req.Operations))
+	failed := -1
+	for i, op := range req.Operations {
+		resp.Results[i] = common.BatchResult{Index: i, Op: op.Op}
+		content, err := checkBatchOperation(op)
+		if err != nil {
+			resp.Results[i].Status = http.StatusBadRequest
+			resp.Results[i].Error = batchError(http.StatusBadRequest, err.Error())
+			if failed < 0 {
+				failed = i
+			}
+		}
+		contents[i] = content
+	}
+
+	var journal *batchJournal
+	if req.Atomic && failed < 0 {
+		atomicBatchMu.Lock()
+		defer atomicBatchMu.Unlock()
+		var err error
+		if journal, err = newBatchJournal(config); err != nil {
+			log.Printf("runBatch err: %v", err)
+			failed = 0
+			resp.Results[0].Status = http.StatusInternalServerError
+			resp.Results[0].Error = batchError(http.StatusInternalServerError, err.Error())
+		} else {
+			defer journal.close()
+		}
+	}
+	for i, op := range req.Operations {
+		if resp.Results[i].Error != nil {
+			continue
+		}
+		if req.Atomic && failed >= 0 {
+			break
+		}
+		var err error
+		if journal != nil {
+			for _, name := range batchTargets(op) {
+				if err = journal.save(name); err != nil {
+					break
+				}
+			}
+		}
+		status := http.StatusInternalServerError
+		if err == nil {
+			status, err = runBatchOperation(config, op, contents[i])
+		}
+		if err != nil {
+			log.Printf("runBatch err in operation %d: %v", i, err)
+			status = storageErrorStatus(err)
+			resp.Results[i].Error = batchError(status, err.Error())
+			if failed < 0 {
+				failed = i
+			}
+		}
+		resp.Results[i].Status = status
+	}
+
+	if req.Atomic && failed >= 0 {
+		if journal != nil {
+			if err := journal.rollback(); err != nil {
+				log.Printf("runBatch err rolling back: %v", err)
+			} else {
+				resp.RolledBack = true
+			}
+		}
+		for i := range resp.Results {
+			if resp.Results[i].Error != nil {
+				continue
+			}
+			message := fmt.Sprintf("not run, operation %d failed", failed)
+			if journal != nil && i < failed && resp.RolledBack {
+				message = fmt.Sprintf("rolled back, operation %d failed", failed)
+			} else if journal != nil && i < failed {
+				message = fmt.Sprintf("operation %d failed and the rollback failed", failed)
+			}
+			resp.Results[i].Status = http.StatusFailedDependency
+			resp.Results[i].Error = batchError(http.StatusFailedDependency, message)
+		}
+	}
+	for _, result := range resp.Results {
+		if result.Error != nil {
+			resp.Failed++
+		} else {
+			resp.Succeeded++
+		}
+	}
+	return resp
+}
+
+// handleV1Batch runs a common.BatchRequest and answers 200 with a result per
+// operation, whether or not they succeeded.
+func handleV1Batch(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleV1Batch")
+	var req common.BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, config.maxUploadBytes)).Decode(&req); err != nil {
+		log.Printf("handleV1Batch err json Decoder: %v", err)
+		code := uploadErrorStatus(err)
+		if code == http.StatusInternalServerError {
+			code = http.StatusBadRequest
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	if len(req.Operations) == 0 {
+		writeError(w, http.StatusBadRequest, "a batch has at least one operation")
+		return
+	}
+	if err := checkFileCount(config, len(req.Operations)); err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, runBatch(config, req))
+}
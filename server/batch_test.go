@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	storagePath := t.TempDir()
+	server := BuildServer(ServerConfig{filesStoragePath: storagePath})
+
+	do := func(method string, target string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, httptest.NewRequest(method, target, bytes.NewReader(data)))
+		return response
+	}
+	batch := func(t *testing.T, req common.BatchRequest) common.BatchResponse {
+		t.Helper()
+		response := do(http.MethodPost, "/v1/batch", req)
+		if response.Code != http.StatusOK {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var resp common.BatchResponse
+		json.NewDecoder(response.Body).Decode(&resp)
+		return resp
+	}
+	statuses := func(resp common.BatchResponse) []int {
+		res := make([]int, 0, len(resp.Results))
+		for _, result := range resp.Results {
+			res = append(res, result.Status)
+		}
+		return res
+	}
+	value := func(s string) *string { return &s }
+	content := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(storagePath, name))
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+
+	t.Run("per operation results", func(t *testing.T) {
+		resp := batch(t, common.BatchRequest{Operations: []common.BatchOperation{
+			{Op: common.BatchPut, Path: "docs/a.txt", Content: "alpha"},
+			{Op: common.BatchPut, Path: "docs/b.bin", ContentBase64: "AAEC"},
+			{Op: common.BatchSetMetadata, Path: "docs/a.txt", Metadata: map[string]*string{"owner": value("ops")}},
+			{Op: common.BatchMove, From: "docs/a.txt", To: "docs/c.txt"},
+			{Op: common.BatchCopy, From: "docs/missing.txt", To: "docs/d.txt"},
+			{Op: common.BatchDelete, Path: "../x"},
+			{Op: "chmod", Path: "docs/b.bin"},
+		}})
+		want := []int{201, 201, 200, 201, 404, 400, 400}
+		if got := statuses(resp); !slices.Equal(got, want) || resp.Succeeded != 4 || resp.Failed != 3 {
+			t.Errorf("got %v, %d/%d, want %v", got, resp.Succeeded, resp.Failed, want)
+		}
+		if content("docs/c.txt") != "alpha" || content("docs/b.bin") != "\x00\x01\x02" {
+			t.Errorf("stored %q and %q", content("docs/c.txt"), content("docs/b.bin"))
+		}
+
+		// The metadata moved with the file.
+		var metadata common.FileMetadata
+		json.NewDecoder(do(http.MethodGet, "/v1/metadata/docs/c.txt", nil).Body).Decode(&metadata)
+		if metadata.Metadata["owner"] != "ops" {
+			t.Errorf("got %+v", metadata)
+		}
+		response := do(http.MethodPatch, "/v1/metadata/docs/c.txt", common.MetadataUpdate{
+			Metadata: map[string]*string{"owner": nil, "team": value("qa")},
+		})
+		metadata = common.FileMetadata{}
+		json.NewDecoder(response.Body).Decode(&metadata)
+		if response.Code != http.StatusOK || len(metadata.Metadata) != 1 || metadata.Metadata["team"] != "qa" {
+			t.Errorf("got %d %+v", response.Code, metadata)
+		}
+		if response := do(http.MethodGet, "/v1/metadata/docs/a.txt", nil); response.Code != http.StatusNotFound {
+			t.Errorf("got %d for a moved file", response.Code)
+		}
+	})
+
+	t.Run("atomic batch rolls back", func(t *testing.T) {
+		resp := batch(t, common.BatchRequest{Atomic: true, Operations: []common.BatchOperation{
+			{Op: common.BatchPut, Path: "docs/c.txt", Content: "changed"},
+			{Op: common.BatchSetMetadata, Path: "docs/c.txt", Metadata: map[string]*string{"team": value("dev")}},
+			{Op: common.BatchMove, From: "docs/b.bin", To: "docs/e.bin"},
+			{Op: common.BatchPut, Path: "docs/new.txt", Content: "new"},
+			{Op: common.BatchDelete, Path: "docs/missing.txt"},
+			{Op: common.BatchDelete, Path: "docs/c.txt"},
+		}})
+		want := []int{424, 424, 424, 424, 404, 424}
+		if got := statuses(resp); !slices.Equal(got, want) || !resp.RolledBack || resp.Succeeded != 0 {
+			t.Errorf("got %v, %+v", got, resp)
+		}
+		if content("docs/c.txt") != "alpha" || content("docs/b.bin") != "\x00\x01\x02" ||
+			content("docs/e.bin") != "<missing>" || content("docs/new.txt") != "<missing>" {
+			t.Errorf("not rolled back: %q %q %q %q",
+				content("docs/c.txt"), content("docs/b.bin"), content("docs/e.bin"), content("docs/new.txt"))
+		}
+		var metadata common.FileMetadata
+		json.NewDecoder(do(http.MethodGet, "/v1/metadata/docs/c.txt", nil).Body).Decode(&metadata)
+		if metadata.Metadata["team"] != "qa" {
+			t.Errorf("metadata not rolled back: %+v", metadata)
+		}
+	})
+
+	t.Run("invalid atomic batch does not run", func(t *testing.T) {
+		resp := batch(t, common.BatchRequest{Atomic: true, Operations: []common.BatchOperation{
+			{Op: common.BatchDelete, Path: "docs/c.txt"},
+			{Op: common.BatchPut, Path: "docs/.hidden", Content: "x"},
+		}})
+		if got := statuses(resp); !slices.Equal(got, []int{424, 400}) || resp.RolledBack || content("docs/c.txt") != "alpha" {
+			t.Errorf("got %v %+v", got, resp)
+		}
+		if response := do(http.MethodPost, "/v1/batch", common.BatchRequest{}); response.Code != http.StatusBadRequest {
+			t.Errorf("got %d for an empty batch", response.Code)
+		}
+	})
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// davPrefix is where the WebDAV view of the store is mounted.
+const davPrefix = "/dav"
+
+// davHandler serves the store over WebDAV. Every change goes through the
+// storage layer, so names are validated as for /files and reserved dot entries
+// are neither listed nor reachable. Locks are kept in memory.
+func davHandler(config ServerConfig) func(w http.ResponseWriter, r *http.Request) {
+	handler := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: davFS{config: config},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("Error in davHandler: %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > config.maxUploadBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := &davBody{ReadCloser: http.MaxBytesReader(w, r.Body, config.maxUploadBytes)}
+		r.Body = body
+		response := &davResponseWriter{ResponseWriter: w, body: body}
+		ctx := context.WithValue(r.Context(), davBodyKey{}, body)
+		r = r.WithContext(context.WithValue(ctx, davResponseKey{}, response))
+		handler.ServeHTTP(response, r)
+	}
+}
+
+type davBodyKey struct{}
+
+type davResponseKey struct{}
+
+// davBody remembers why reading a request body failed, so a PUT whose body
+// was cut short does not replace the stored file with part of it.
+type davBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// davResponseWriter reports bodies over the upload limit as 413, and changes
+// the caller has no rights for as 403; the webdav package answers every failed
+// PUT, MKCOL or DELETE with 405.
+type davResponseWriter struct {
+	http.ResponseWriter
+	body   *davBody
+	denied bool
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	var maxBytesErr *http.MaxBytesError
+	if status == http.StatusMethodNotAllowed && errors.As(w.body.err, &maxBytesErr) {
+		status = http.StatusRequestEntityTooLarge
+	} else if status == http.StatusMethodNotAllowed && w.denied {
+		status = http.StatusForbidden
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// davDenied returns the error for a change of name the caller has no rights
+// for, and has it answered with 403.
+func davDenied(ctx context.Context, op string, name string) error {
+	if response, ok := ctx.Value(davResponseKey{}).(*davResponseWriter); ok {
+		response.denied = true
+	}
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+}
+
+// davFS implements webdav.FileSystem over the storage layer. Directories only
+// exist on disk, files are read and written through the storage functions.
+// Every method first narrows config to the caller, as withConfig does.
+type davFS struct {
+	config ServerConfig
+}
+
+// resolve maps a WebDAV name to a stored path, "" being the storage root.
+// Invalid and reserved names do not exist.
+func (d davFS) resolve(op string, name string) (string, string, error) {
+	rel := strings.Trim(name, "/")
+	if rel == "" {
+		return "", filepath.Clean(d.config.filesStoragePath), nil
+	}
+	fullPath, err := storedFilePath(d.config, rel)
+	if err != nil {
+		return "", "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	cleaned, _ := validateFilePath(rel)
+	return cleaned, fullPath, nil
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	d.config = d.config.forContext(ctx)
+	rel, fullPath, err := d.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if rel == "" {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if d.config.access.checkWriteDir(rel) != nil {
+		return davDenied(ctx, "mkdir", name)
+	}
+	return os.Mkdir(fullPath, perm)
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	d.config = d.config.forContext(ctx)
+	rel, fullPath, err := d.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if rel != "" && !info.IsDir() && (!info.Mode().IsRegular() || !d.config.access.canRead(rel)) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	if rel != "" && info.IsDir() && !d.config.access.canSeeDir(rel) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.config.encryption.fileInfo(fullPath, info), nil
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	d.config = d.config.forContext(ctx)
+	info, err := d.Stat(ctx, name)
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		if err == nil && info.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+		rel, _, err := d.resolve("open", name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		if d.config.access.checkWrite(rel) != nil {
+			return nil, davDenied(ctx, "open", name)
+		}
+		return newDAVWriteFile(ctx, d.config, rel), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, fullPath, _ := d.resolve("open", name)
+	if info.IsDir() {
+		dir, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return davDir{File: dir, access: d.config.access, keys: d.config.encryption, rel: strings.Trim(name, "/")}, nil
+	}
+	file, _, err := openStoredFile(d.config, strings.Trim(name, "/"))
+	return file, err
+}
+
+// RemoveAll deletes a file, or a directory with every file under it. The
+// files are deleted with deleteStoredFile, after checking the caller may
+// delete all of them, and the directories once they are empty, so reserved
+// entries and files stored meanwhile are never lost.
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	d.config = d.config.forContext(ctx)
+	rel, fullPath, err := d.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	if rel == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	info, err := d.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if d.config.access.checkWrite(rel) != nil {
+			return davDenied(ctx, "remove", name)
+		}
+		return deleteStoredFile(d.config, rel)
+	}
+	files, dirs, err := d.walkDir(ctx, "remove", name, rel, fullPath, "")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := deleteStoredFile(d.config, path.Join(rel, file)); err != nil {
+			return err
+		}
+	}
+	// Children come after their parents in dirs. Deleting the files already
+	// removed those left empty.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	removeEmptyParents(d.config, fullPath)
+	return nil
+}
+
+// walkDir returns the stored files under the directory rel, at fullPath,
+// relative to it, and its directories, itself first. Unless the caller may
+// change every file, and create it below to when to is set, the walk is
+// refused. Reserved entries are left out.
+func (d davFS) walkDir(ctx context.Context, op string, name string, rel string, fullPath string, to string) ([]string, []string, error) {
+	files, dirs := make([]string, 0), make([]string, 0)
+	err := filepath.WalkDir(fullPath, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != fullPath && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(fullPath, p)
+		if err != nil {
+			return err
+		}
+		file := filepath.ToSlash(relPath)
+		if d.config.access.checkWrite(path.Join(rel, file)) != nil ||
+			to != "" && d.config.access.checkWrite(path.Join(to, file)) != nil {
+			return davDenied(ctx, op, name)
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, dirs, err
+}
+
+// Rename moves a file with renameStoredFile, or a directory with a single
+// rename, so everything in it moves along, once the caller may move every
+// file in it. The webdav package removes an existing destination first when
+// the client asked to overwrite it.
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	d.config = d.config.forContext(ctx)
+	from, fromPath, err := d.resolve("rename", oldName)
+	if err != nil {
+		return err
+	}
+	to, toPath, err := d.resolve("rename", newName)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrPermission}
+	}
+	if from == "" || to == "" || strings.HasPrefix(to+"/", from+"/") {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+	}
+	info, err := d.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return renameStoredFile(d.config, from, to, false)
+	}
+	if d.config.access.checkWriteDir(to) != nil {
+		return davDenied(ctx, "rename", newName)
+	}
+	if _, err := os.Stat(toPath); err == nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+	files, _, err := d.walkDir(ctx, "rename", oldName, from, fromPath, to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return err
+	}
+	removeEmptyParents(d.config, fromPath)
+	for _, file := range files {
+		d.config.auditEntry.addFile(path.Join(from, file))
+		d.config.auditEntry.addFile(path.Join(to, file))
+		storedFileRenamed(d.config, path.Join(from, file), path.Join(to, file), filepath.Join(toPath, filepath.FromSlash(file)))
+	}
+	return nil
+}
+
+// davDir is an open directory whose listing leaves out reserved dot entries,
+// anything that is neither a file nor a directory and files, or directories,
+// the caller cannot read. rel is its stored path.
+type davDir struct {
+	*os.File
+	access *accessPolicy
+	keys   *keyring
+	rel    string
+}
+
+func (d davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	res := make([]fs.FileInfo, 0)
+	for {
+		infos, err := d.File.Readdir(count)
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), ".") || !info.IsDir() && !info.Mode().IsRegular() {
+				continue
+			}
+			if !info.IsDir() && !d.access.canRead(path.Join(d.rel, info.Name())) ||
+				info.IsDir() && !d.access.canSeeDir(path.Join(d.rel, info.Name())) {
+				continue
+			}
+			res = append(res, d.keys.fileInfo(filepath.Join(d.Name(), info.Name()), info))
+		}
+		if err != nil || count <= 0 || len(res) > 0 {
+			return res, err
+		}
+	}
+}
+
+func (d davDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.Name(), Err: fs.ErrInvalid}
+}
+
+// davWriteFile streams what the webdav package writes into writeStoredFile.
+// The file is stored by the first Stat or Close, unless the request body
+// could not be read completely.
+type davWriteFile struct {
+	config ServerConfig
+	name   string
+	body   *davBody
+	pw     *io.PipeWriter
+	done   chan error
+
+	once sync.Once
+	err  error
+}
+
+func newDAVWriteFile(ctx context.Context, config ServerConfig, name string) *davWriteFile {
+	pr, pw := io.Pipe()
+	f := &davWriteFile{config: config, name: name, pw: pw, done: make(chan error, 1)}
+	f.body, _ = ctx.Value(davBodyKey{}).(*davBody)
+	go func() {
+		_, err := writeStoredFile(config, name, pr)
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *davWriteFile) Write(p []byte) (int, error) {
+	return f.pw.Write(p)
+}
+
+func (f *davWriteFile) commit() error {
+	f.once.Do(func() {
+		if f.body != nil && f.body.err != nil {
+			f.pw.CloseWithError(f.body.err)
+		} else {
+			f.pw.Close()
+		}
+		f.err = <-f.done
+	})
+	return f.err
+}
+
+func (f *davWriteFile) Stat() (fs.FileInfo, error) {
+	if err := f.commit(); err != nil {
+		return nil, err
+	}
+	return statStoredFile(f.config, f.name)
+}
+
+func (f *davWriteFile) Close() error {
+	return f.commit()
+}
+
+func (f *davWriteFile) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *davWriteFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *davWriteFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"file_store/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDAV(t *testing.T) {
+	storagePath := t.TempDir()
+	server := BuildServer(ServerConfig{filesStoragePath: storagePath, maxUploadBytes: 512})
+	if err := os.MkdirAll(filepath.Join(storagePath, defaultMetaDirName), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method string, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+		if body == nil {
+			body = http.NoBody
+		}
+		request, _ := http.NewRequest(method, target, body)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	readStored := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(storagePath, filepath.FromSlash(name)))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	t.Run("put and get nested files", func(t *testing.T) {
+		response := do(http.MethodPut, "/dav/docs/a.txt", strings.NewReader("alpha beta"), nil)
+		if response.Code != http.StatusCreated || response.Header().Get("ETag") == "" {
+			t.Fatalf("got %d %v", response.Code, response.Header())
+		}
+		if readStored("docs/a.txt") != "alpha beta" {
+			t.Errorf("stored %q", readStored("docs/a.txt"))
+		}
+		response = do(http.MethodGet, "/dav/docs/a.txt", nil, nil)
+		if response.Code != http.StatusOK || response.Body.String() != "alpha beta" {
+			t.Errorf("got %d %q", response.Code, response.Body.String())
+		}
+	})
+
+	t.Run("put over the limit", func(t *testing.T) {
+		// Hide the length, so the limit is only hit while reading.
+		body := io.MultiReader(strings.NewReader(strings.Repeat("x", 513)))
+		response := do(http.MethodPut, "/dav/docs/a.txt", body, nil)
+		if response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("got %d", response.Code)
+		}
+		if readStored("docs/a.txt") != "alpha beta" {
+			t.Errorf("partial upload replaced the file: %q", readStored("docs/a.txt"))
+		}
+	})
+
+	t.Run("propfind hides reserved entries", func(t *testing.T) {
+		response := do("PROPFIND", "/dav/", nil, http.Header{"Depth": {"1"}})
+		if response.Code != http.StatusMultiStatus {
+			t.Fatalf("got %d", response.Code)
+		}
+		if !strings.Contains(response.Body.String(), "/dav/docs/") || strings.Contains(response.Body.String(), defaultMetaDirName) {
+			t.Errorf("listing %s", response.Body.String())
+		}
+		response = do(http.MethodGet, "/dav/"+defaultMetaDirName, nil, nil)
+		if response.Code != http.StatusNotFound {
+			t.Errorf("got %d for the meta directory", response.Code)
+		}
+		response = do(http.MethodPut, "/dav/docs/.hidden", strings.NewReader("x"), nil)
+		if response.Code < 400 || readStored("docs/.hidden") != "" {
+			t.Errorf("got %d for a reserved name", response.Code)
+		}
+	})
+
+	t.Run("mkcol copy and move", func(t *testing.T) {
+		if response := do("MKCOL", "/dav/archive", nil, nil); response.Code != http.StatusCreated {
+			t.Fatalf("got %d on MKCOL", response.Code)
+		}
+		response := do("COPY", "/dav/docs/a.txt", nil, http.Header{"Destination": {"/dav/archive/a.txt"}})
+		if response.Code != http.StatusCreated || readStored("archive/a.txt") != "alpha beta" {
+			t.Fatalf("got %d on COPY", response.Code)
+		}
+		response = do("MOVE", "/dav/docs", nil, http.Header{"Destination": {"/dav/moved"}})
+		if response.Code != http.StatusCreated || readStored("moved/a.txt") != "alpha beta" {
+			t.Fatalf("got %d on MOVE", response.Code)
+		}
+		if _, err := os.Stat(filepath.Join(storagePath, "docs")); err == nil {
+			t.Errorf("source directory is left behind")
+		}
+		response = do("MOVE", "/dav/moved/a.txt", nil, http.Header{"Destination": {"/dav/archive/a.txt"}, "Overwrite": {"F"}})
+		if response.Code != http.StatusPreconditionFailed {
+			t.Errorf("got %d on MOVE without overwrite", response.Code)
+		}
+	})
+
+	t.Run("lock and unlock", func(t *testing.T) {
+		lockBody := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+		response := do("LOCK", "/dav/archive/a.txt", strings.NewReader(lockBody), nil)
+		token := response.Header().Get("Lock-Token")
+		if response.Code != http.StatusOK || token == "" {
+			t.Fatalf("got %d on LOCK", response.Code)
+		}
+		if response := do(http.MethodPut, "/dav/archive/a.txt", strings.NewReader("x"), nil); response.Code != http.StatusLocked {
+			t.Errorf("got %d on PUT to a locked file", response.Code)
+		}
+		if response := do("UNLOCK", "/dav/archive/a.txt", nil, http.Header{"Lock-Token": {token}}); response.Code != http.StatusNoContent {
+			t.Errorf("got %d on UNLOCK", response.Code)
+		}
+	})
+
+	t.Run("delete removes files and directories", func(t *testing.T) {
+		if response := do(http.MethodDelete, "/dav/archive", nil, nil); response.Code != http.StatusNoContent {
+			t.Fatalf("got %d", response.Code)
+		}
+		if _, err := os.Stat(filepath.Join(storagePath, "archive")); err == nil {
+			t.Errorf("directory still exists")
+		}
+		if response := do(http.MethodDelete, "/dav/", nil, nil); response.Code < 400 {
+			t.Errorf("got %d deleting the root", response.Code)
+		}
+		if response := do(http.MethodGet, "/v1/files?prefix=moved/", nil, nil); !strings.Contains(response.Body.String(), "moved/a.txt") {
+			t.Errorf("file written over WebDAV is not listed: %s", response.Body.String())
+		}
+	})
+
+	t.Run("reserved entries are moved, never deleted", func(t *testing.T) {
+		do(http.MethodPut, "/dav/drafts/b.txt", strings.NewReader("b"), nil)
+		if err := os.WriteFile(filepath.Join(storagePath, "drafts", ".upload-1"), []byte("partial"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if response := do("MOVE", "/dav/drafts", nil, http.Header{"Destination": {"/dav/kept"}}); response.Code != http.StatusCreated {
+			t.Fatalf("got %d on MOVE", response.Code)
+		}
+		if readStored("kept/b.txt") != "b" || readStored("kept/.upload-1") != "partial" {
+			t.Errorf("directory was not moved whole")
+		}
+		if response := do(http.MethodDelete, "/dav/kept", nil, nil); response.Code < 400 {
+			t.Errorf("got %d deleting a directory holding a reserved entry", response.Code)
+		}
+		if readStored("kept/b.txt") != "" || readStored("kept/.upload-1") != "partial" {
+			t.Errorf("got %q and %q after DELETE", readStored("kept/b.txt"), readStored("kept/.upload-1"))
+		}
+	})
+}
+
+func TestDAVAccess(t *testing.T) {
+	storagePath := t.TempDir()
+	for name, content := range map[string]string{"reports/secret.txt": "secret", "ci/a.txt": "a", "ci/sub/b.txt": "b", "ci/sub/.upload-1": "partial"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(storagePath, name)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(storagePath, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := ServerConfig{filesStoragePath: storagePath}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	server := BuildServer(config)
+	issue := func(grants ...common.Grant) string {
+		token, err := config.tokens.issue(common.TokenRequest{Name: "dav", Grants: grants}, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Token
+	}
+	ciOnly := issue(common.Grant{Prefix: "ci/", Role: common.RoleWriter})
+	readAll := issue(common.Grant{Role: common.RoleReader}, common.Grant{Prefix: "ci/", Role: common.RoleWriter})
+
+	do := func(token string, method string, target string, header http.Header) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, http.NoBody)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		request.SetBasicAuth("dav", token)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(storagePath, filepath.FromSlash(name)))
+		return err == nil
+	}
+
+	t.Run("directories outside the grants are hidden", func(t *testing.T) {
+		response := do(ciOnly, "PROPFIND", "/dav/", http.Header{"Depth": {"1"}})
+		if response.Code != http.StatusMultiStatus || strings.Contains(response.Body.String(), "reports") {
+			t.Errorf("got %d %s", response.Code, response.Body.String())
+		}
+		if response := do(ciOnly, http.MethodDelete, "/dav/reports", nil); response.Code != http.StatusNotFound || !exists("reports/secret.txt") {
+			t.Errorf("got %d deleting a hidden directory", response.Code)
+		}
+	})
+
+	t.Run("changes outside the grants are refused", func(t *testing.T) {
+		if response := do(readAll, http.MethodDelete, "/dav/reports", nil); response.Code != http.StatusForbidden {
+			t.Errorf("got %d on DELETE", response.Code)
+		}
+		if response := do(readAll, "MOVE", "/dav/reports", http.Header{"Destination": {"/dav/ci/reports"}}); response.Code != http.StatusForbidden {
+			t.Errorf("got %d on MOVE", response.Code)
+		}
+		if !exists("reports/secret.txt") {
+			t.Errorf("reports/secret.txt is gone")
+		}
+		if response := do(readAll, "MOVE", "/dav/ci/sub", http.Header{"Destination": {"/dav/sub"}}); response.Code != http.StatusForbidden || !exists("ci/sub/b.txt") {
+			t.Errorf("got %d on MOVE out of the grant", response.Code)
+		}
+		if response := do(readAll, "MKCOL", "/dav/other", nil); response.Code != http.StatusForbidden || exists("other") {
+			t.Errorf("got %d on MKCOL", response.Code)
+		}
+		if response := do(readAll, "MKCOL", "/dav/ci/new", nil); response.Code != http.StatusCreated {
+			t.Errorf("got %d on MKCOL inside the grant", response.Code)
+		}
+	})
+
+	t.Run("directories move with everything in them", func(t *testing.T) {
+		if response := do(ciOnly, "MOVE", "/dav/ci/sub", http.Header{"Destination": {"/dav/ci/moved"}}); response.Code != http.StatusCreated {
+			t.Fatalf("got %d on MOVE", response.Code)
+		}
+		if exists("ci/sub") || !exists("ci/moved/b.txt") || !exists("ci/moved/.upload-1") {
+			t.Errorf("directory was not moved whole")
+		}
+		if response := do(ciOnly, http.MethodDelete, "/dav/ci/moved", nil); response.Code < 400 || exists("ci/moved/b.txt") || !exists("ci/moved/.upload-1") {
+			t.Errorf("got %d deleting a directory holding a reserved entry", response.Code)
+		}
+	})
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Encryption at rest seals every stored file with its own random data key,
+// using AES-256-GCM over chunks of sealedChunkSize bytes so that files are
+// streamed and can be read from any offset. The data key is wrapped with the
+// active master key and kept in a fixed size header, so rotating master keys
+// only rewrites headers. A sealed file is laid out as
+//
+//	magic (8) | master key ID (8) | wrapped data key (60) | chunks...
+//
+// The nonce of a chunk holds its index and whether it is the last one, which
+// is the only chunk shorter than sealedChunkSize (and may be empty), so
+// reordered or truncated chunks fail to open. Files without the magic are read
+// as they are, such as those stored before a master key was configured.
+
+const (
+	sealedMagic         = "FSSEAL\x00\x01"
+	sealedChunkSize     = 64 << 10
+	sealedChunkOverhead = 16
+	masterKeyIDSize     = 8
+	dataKeySize         = 32
+	wrappedKeySize      = 12 + dataKeySize + 16
+	sealedHeaderSize    = len(sealedMagic) + masterKeyIDSize + wrappedKeySize
+)
+
+var (
+	errNoMasterKey       = errors.New("file is encrypted and no master key is configured")
+	errUnknownMasterKey  = errors.New("file is encrypted with an unknown master key")
+	errSealedFileCorrupt = errors.New("encrypted file is corrupt")
+)
+
+type masterKey struct {
+	id   [masterKeyIDSize]byte
+	aead cipher.AEAD
+}
+
+// keyring holds the master keys. The first one is active and wraps the data
+// keys of new files, the others only unwrap those of older files. A nil
+// keyring stores files in plaintext.
+type keyring struct {
+	active *masterKey
+	keys   map[[masterKeyIDSize]byte]*masterKey
+}
+
+func newKeyring(secrets [][]byte) (*keyring, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("no master key given")
+	}
+	k := &keyring{keys: make(map[[masterKeyIDSize]byte]*masterKey)}
+	for i, secret := range secrets {
+		if len(secret) != 32 {
+			return nil, fmt.Errorf("master key %d has %d bytes, not 32", i+1, len(secret))
+		}
+		aead, err := newGCM(secret)
+		if err != nil {
+			return nil, err
+		}
+		key := &masterKey{aead: aead}
+		sum := sha256.Sum256(append([]byte("file store master key id\x00"), secret...))
+		copy(key.id[:], sum[:])
+		if k.active == nil {
+			k.active = key
+		}
+		k.keys[key.id] = key
+	}
+	return k, nil
+}
+
+// parseMasterKeys reads base64 encoded 32 byte keys separated by commas or
+// white space, the active key first.
+func parseMasterKeys(text string) ([][]byte, error) {
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	secrets := make([][]byte, 0, len(fields))
+	for i, field := range fields {
+		secret, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("master key %d is not base64: %w", i+1, err)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// keyringFromEnv loads the master keys from STORE_MASTER_KEY or the file named
+// by STORE_MASTER_KEY_FILE. Without either files are not encrypted.
+func keyringFromEnv() *keyring {
+	text, keyFile := os.Getenv("STORE_MASTER_KEY"), os.Getenv("STORE_MASTER_KEY_FILE")
+	if text != "" && keyFile != "" {
+		log.Fatal("set STORE_MASTER_KEY or STORE_MASTER_KEY_FILE, not both")
+	}
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			log.Fatalf("reading STORE_MASTER_KEY_FILE: %v", err)
+		}
+		text = string(data)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	secrets, err := parseMasterKeys(text)
+	if err != nil {
+		log.Fatalf("invalid master key: %v", err)
+	}
+	k, err := newKeyring(secrets)
+	if err != nil {
+		log.Fatalf("invalid master key: %v", err)
+	}
+	log.Printf("Encrypting stored files with master key %s", k.activeID())
+	return k
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *keyring) activeID() string {
+	return hex.EncodeToString(k.active.id[:])
+}
+
+// header returns the header of a file sealed with a data key wrapped by the
+// active master key.
+func (k *keyring) header(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, sealedHeaderSize)
+	header = append(header, sealedMagic...)
+	header = append(header, k.active.id[:]...)
+	header = append(header, nonce...)
+	return k.active.aead.Seal(header, nonce, dataKey, k.active.id[:]), nil
+}
+
+// unwrap returns the data key of a sealed file from its header.
+func (k *keyring) unwrap(header []byte) ([]byte, error) {
+	id := [masterKeyIDSize]byte(header[len(sealedMagic):])
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %x", errUnknownMasterKey, id)
+	}
+	wrapped := header[len(sealedMagic)+masterKeyIDSize:]
+	dataKey, err := key.aead.Open(nil, wrapped[:12], wrapped[12:], id[:])
+	if err != nil {
+		return nil, errSealedFileCorrupt
+	}
+	return dataKey, nil
+}
+
+// readSealedHeader reads the header of file, returning nil for files that are
+// not sealed.
+func readSealedHeader(file io.ReaderAt) ([]byte, error) {
+	header := make([]byte, sealedHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if n < len(header) || !bytes.HasPrefix(header, []byte(sealedMagic)) {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return header, nil
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealedPlainSize returns the size of the plaintext of a sealed file of
+// sealedSize bytes.
+func sealedPlainSize(sealedSize int64) (int64, bool) {
+	body := sealedSize - int64(sealedHeaderSize)
+	full := body / (sealedChunkSize + sealedChunkOverhead)
+	rest := body - full*(sealedChunkSize+sealedChunkOverhead)
+	if body < 0 || rest < sealedChunkOverhead {
+		return 0, false
+	}
+	return full*sealedChunkSize + rest - sealedChunkOverhead, true
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// seal returns a writer encrypting what is written to it into w. Close writes
+// the last chunk but leaves w open. With a nil keyring it writes plaintext.
+func (k *keyring) seal(w io.Writer) (io.WriteCloser, error) {
+	if k == nil {
+		return nopWriteCloser{w}, nil
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header, err := k.header(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealingWriter{w: w, aead: aead, buf: make([]byte, 0, sealedChunkSize)}, nil
+}
+
+type sealingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	sealed []byte
+	index  int64
+}
+
+func (s *sealingWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+		if len(s.buf) == sealedChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *sealingWriter) flush(last bool) error {
+	s.sealed = s.aead.Seal(s.sealed[:0], chunkNonce(s.index, last), s.buf, nil)
+	s.index++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(s.sealed)
+	return err
+}
+
+func (s *sealingWriter) Close() error {
+	return s.flush(true)
+}
+
+// sealedReader decrypts a sealed file, one chunk at a time.
+type sealedReader struct {
+	mu     sync.Mutex
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	size   int64
+	offset int64
+	chunk  int64
+	plain  []byte
+	sealed []byte
+}
+
+func (s *sealedReader) readChunk(index int64) ([]byte, error) {
+	if index == s.chunk {
+		return s.plain, nil
+	}
+	last := index == s.size/sealedChunkSize
+	length := int64(sealedChunkSize)
+	if last {
+		length = s.size - index*sealedChunkSize
+	}
+	sealed := s.sealed[:length+sealedChunkOverhead]
+	offset := int64(sealedHeaderSize) + index*(sealedChunkSize+sealedChunkOverhead)
+	if n, err := s.r.ReadAt(sealed, offset); n < len(sealed) {
+		if err == io.EOF {
+			err = errSealedFileCorrupt
+		}
+		return nil, err
+	}
+	s.chunk = -1
+	plain, err := s.aead.Open(s.plain[:0], chunkNonce(index, last), sealed, nil)
+	if err != nil {
+		return nil, errSealedFileCorrupt
+	}
+	s.plain, s.chunk = plain, index
+	return plain, nil
+}
+
+func (s *sealedReader) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= s.size {
+			return n, io.EOF
+		}
+		index := off / sealedChunkSize
+		plain, err := s.readChunk(index)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], plain[off-index*sealedChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (s *sealedReader) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *sealedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+// storedFile is an open stored file, decrypted on the way when it is sealed.
+// It does not embed the os.File, whose WriteTo would bypass decryption in
+// io.Copy.
+type storedFile struct {
+	file   *os.File
+	sealed *sealedReader
+}
+
+// open opens a stored file for reading. Sealed files need the master key
+// their data key was wrapped with.
+func (k *keyring) open(fullPath string) (*storedFile, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := k.sealedReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &storedFile{file: file, sealed: sealed}, nil
+}
+
+func (k *keyring) sealedReader(file *os.File) (*sealedReader, error) {
+	header, err := readSealedHeader(file)
+	if err != nil || header == nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, errNoMasterKey
+	}
+	dataKey, err := k.unwrap(header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, ok := sealedPlainSize(info.Size())
+	if !ok {
+		return nil, errSealedFileCorrupt
+	}
+	r := &sealedReader{
+		r: file, aead: aead, size: size, chunk: -1,
+		sealed: make([]byte, sealedChunkSize+sealedChunkOverhead),
+	}
+	// Opening the last chunk catches truncated files, even when it is empty
+	// and reads would never get to it.
+	if _, err := r.readChunk(size / sealedChunkSize); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (f *storedFile) Read(p []byte) (int, error) {
+	if f.sealed != nil {
+		return f.sealed.Read(p)
+	}
+	return f.file.Read(p)
+}
+
+func (f *storedFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.sealed != nil {
+		return f.sealed.ReadAt(p, off)
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *storedFile) Seek(offset int64, whence int) (int64, error) {
+	if f.sealed != nil {
+		return f.sealed.Seek(offset, whence)
+	}
+	return f.file.Seek(offset, whence)
+}
+
+func (f *storedFile) Close() error {
+	return f.file.Close()
+}
+
+// Readdir and Write make a storedFile a webdav.File; both fail as the file
+// is neither a directory nor open for writing.
+func (f *storedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.file.Name(), Err: fs.ErrInvalid}
+}
+
+func (f *storedFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.file.Name(), Err: fs.ErrInvalid}
+}
+
+func (f *storedFile) Stat() (os.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil || f.sealed == nil {
+		return info, err
+	}
+	return sizedFileInfo{FileInfo: info, size: f.sealed.size}, nil
+}
+
+// sizedFileInfo reports the plaintext size of a sealed file.
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i sizedFileInfo) Size() int64 {
+	return i.size
+}
+
+// fileInfo returns info of the file at fullPath with the plaintext size when
+// the file is sealed.
+func (k *keyring) fileInfo(fullPath string, info os.FileInfo) os.FileInfo {
+	if k == nil || !info.Mode().IsRegular() || info.Size() < int64(sealedHeaderSize) {
+		return info
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return info
+	}
+	defer file.Close()
+	header, err := readSealedHeader(file)
+	if err != nil || header == nil {
+		return info
+	}
+	if size, ok := sealedPlainSize(info.Size()); ok {
+		return sizedFileInfo{FileInfo: info, size: size}
+	}
+	return info
+}
+
+// rewrap wraps the data key of a sealed file with the active master key. Like
+// writeStoredFile, it writes the new header and the unchanged chunks to a
+// temporary file and renames it into place, so a crash leaves either the old
+// or the new file, never a torn header. A file replaced meanwhile is left
+// alone, it is sealed with the active key. It reports whether the file is
+// sealed and whether its header changed.
+func (k *keyring) rewrap(fullPath string) (sealed bool, changed bool, err error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return false, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, false, err
+	}
+	header, err := readSealedHeader(file)
+	if err != nil || header == nil {
+		return false, false, err
+	}
+	if bytes.Equal(header[len(sealedMagic):len(sealedMagic)+masterKeyIDSize], k.active.id[:]) {
+		return true, false, nil
+	}
+	dataKey, err := k.unwrap(header)
+	if err != nil {
+		return true, false, err
+	}
+	header, err = k.header(dataKey)
+	if err != nil {
+		return true, false, err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(fullPath), ".rewrap-*")
+	if err != nil {
+		return true, false, err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(header)
+	if err == nil {
+		_, err = io.Copy(tmpFile, io.NewSectionReader(file, int64(sealedHeaderSize), info.Size()-int64(sealedHeaderSize)))
+	}
+	if err == nil {
+		err = tmpFile.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return true, false, err
+	}
+	// Keep the modification time, which the content did not change.
+	if err := os.Chtimes(tmpFile.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return true, false, err
+	}
+	if current, err := os.Stat(fullPath); err != nil || !os.SameFile(info, current) ||
+		current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+		return true, false, err
+	}
+	return true, true, os.Rename(tmpFile.Name(), fullPath)
+}
+
+// rotate rewraps every sealed file under root, the stored files of all tenants
+// as well as what the server keeps of them in the meta directories.
+func (k *keyring) rotate(root string) (common.KeyRotation, error) {
+	res := common.KeyRotation{ActiveKey: k.activeID(), Failed: make([]common.ErrorDetail, 0)}
+	err := filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		// Skip files being written, they are sealed with the active key.
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		sealed, changed, err := k.rewrap(fullPath)
+		switch {
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			relPath, _ := filepath.Rel(root, fullPath)
+			res.Failed = append(res.Failed, common.ErrorDetail{Item: filepath.ToSlash(relPath), Message: err.Error()})
+		case changed:
+			res.Rewrapped++
+		case sealed:
+			res.Unchanged++
+		}
+		return nil
+	})
+	return res, err
+}
+
+func handleRotateKeys(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleRotateKeys")
+	if config.encryption == nil {
+		writeError(w, http.StatusConflict, "encryption at rest is not enabled")
+		return
+	}
+	res, err := config.encryption.rotate(config.filesStoragePath)
+	if err != nil {
+		log.Printf("handleRotateKeys err: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("rewrapped %d files with master key %s, %d failed", res.Rewrapped, res.ActiveKey, len(res.Failed))
+	writeJSON(w, http.StatusOK, res)
+}
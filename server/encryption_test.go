@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, seeds ...byte) *keyring {
+	t.Helper()
+	secrets := make([][]byte, 0, len(seeds))
+	for _, seed := range seeds {
+		secrets = append(secrets, bytes.Repeat([]byte{seed}, 32))
+	}
+	k, err := newKeyring(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSealedFiles(t *testing.T) {
+	k := testKeyring(t, 1)
+	dir := t.TempDir()
+	for _, size := range []int{0, 1, sealedChunkSize - 1, sealedChunkSize, sealedChunkSize + 1, 3*sealedChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(plain)
+		path := filepath.Join(dir, "file")
+		var sealed bytes.Buffer
+		w, err := k.seal(&sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plain[:size/2])
+		w.Write(plain[size/2:])
+		w.Close()
+		if got, ok := sealedPlainSize(int64(sealed.Len())); !ok || got != int64(size) {
+			t.Errorf("size %d: plain size %d, %v", size, got, ok)
+		}
+		os.WriteFile(path, sealed.Bytes(), 0666)
+
+		file, err := k.open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(file)
+		if err != nil || !bytes.Equal(data, plain) {
+			t.Errorf("size %d: read %d bytes, %v", size, len(data), err)
+		}
+		if size > 10 {
+			off := int64(size - 10)
+			buf := make([]byte, 20)
+			n, err := file.ReadAt(buf, off)
+			if n != 10 || err != io.EOF || !bytes.Equal(buf[:n], plain[off:]) {
+				t.Errorf("size %d: read %d bytes at %d, %v", size, n, off, err)
+			}
+		}
+		info, _ := file.Stat()
+		file.Close()
+		if info.Size() != int64(size) {
+			t.Errorf("size %d: stat says %d", size, info.Size())
+		}
+
+		if size > sealedChunkSize {
+			// Dropping the last chunk makes the one before look last.
+			os.WriteFile(path, sealed.Bytes()[:sealedHeaderSize+sealedChunkSize+sealedChunkOverhead+sealedChunkOverhead], 0666)
+			if _, err := k.open(path); !errors.Is(err, errSealedFileCorrupt) {
+				t.Errorf("size %d: opened a truncated file, %v", size, err)
+			}
+		}
+	}
+
+	os.WriteFile(filepath.Join(dir, "plain"), []byte("not sealed"), 0666)
+	file, err := k.open(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(file); string(data) != "not sealed" {
+		t.Errorf("read %q from a plaintext file", data)
+	}
+	file.Close()
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	storagePath := t.TempDir()
+	config := ServerConfig{filesStoragePath: storagePath, encryption: testKeyring(t, 1)}.withDefaults()
+	do := func(config ServerConfig, method string, target string, body string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		BuildServer(config).Handler.ServeHTTP(response, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return response
+	}
+	content := strings.Repeat("the quick brown fox\n", 5000)
+	if response := do(config, http.MethodPut, "/v1/files/docs/fox.txt", content); response.Code != http.StatusCreated {
+		t.Fatalf("got %d %s", response.Code, response.Body.String())
+	}
+
+	t.Run("sealed on disk", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join(storagePath, "docs", "fox.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(sealedMagic)) || bytes.Contains(data, []byte("quick brown")) {
+			t.Errorf("stored %q...", data[:40])
+		}
+	})
+
+	t.Run("reads", func(t *testing.T) {
+		if response := do(config, http.MethodGet, "/v1/files/docs/fox.txt", ""); response.Body.String() != content {
+			t.Errorf("got %d, %d bytes", response.Code, response.Body.Len())
+		}
+		request := httptest.NewRequest(http.MethodGet, "/v1/files/docs/fox.txt", nil)
+		request.Header.Set("Range", "bytes=70000-70018")
+		response := httptest.NewRecorder()
+		BuildServer(config).Handler.ServeHTTP(response, request)
+		if response.Code != http.StatusPartialContent || response.Body.String() != content[70000:70019] {
+			t.Errorf("got %d %q for a range", response.Code, response.Body.String())
+		}
+		var list common.FileInfoList
+		json.NewDecoder(do(config, http.MethodGet, "/v1/files", "").Body).Decode(&list)
+		if len(list.Files) != 1 || list.Files[0].Size != int64(len(content)) {
+			t.Errorf("listed %+v", list.Files)
+		}
+		response = do(config, http.MethodGet, "/v1/analytics/grep?pattern=quick&file=docs/fox.txt&max=1", "")
+		if !strings.Contains(response.Body.String(), "the quick brown fox") {
+			t.Errorf("grep got %d %s", response.Code, response.Body.String())
+		}
+	})
+
+	t.Run("dedupe on plaintext hashes", func(t *testing.T) {
+		sum := sha256.Sum256([]byte(content))
+		body, _ := json.Marshal(common.TryWithSha256Request{FileSha256Pairs: []common.FileSha256Pair{
+			{FileName: "copies/fox.txt", FileHash: hex.EncodeToString(sum[:])},
+		}})
+		var res common.TryWithSha256Response
+		json.NewDecoder(do(config, http.MethodPost, "/v1/dedupe/match", string(body)).Body).Decode(&res)
+		if len(res.UnsuccessfulFileNames) != 0 {
+			t.Fatalf("unmatched %+v", res.UnsuccessfulFileNames)
+		}
+		if response := do(config, http.MethodGet, "/v1/files/copies/fox.txt", ""); response.Body.String() != content {
+			t.Errorf("the copy has %d bytes", response.Body.Len())
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		sealedBefore, _ := os.ReadFile(filepath.Join(storagePath, "docs", "fox.txt"))
+		infoBefore, _ := os.Stat(filepath.Join(storagePath, "docs", "fox.txt"))
+		rotated := config
+		rotated.encryption = testKeyring(t, 2, 1)
+		var res common.KeyRotation
+		json.NewDecoder(do(rotated, http.MethodPost, "/v1/admin/encryption/rotate", "").Body).Decode(&res)
+		if res.Rewrapped != 2 || res.Unchanged != 0 || len(res.Failed) != 0 || res.ActiveKey != rotated.encryption.activeID() {
+			t.Fatalf("rotation %+v", res)
+		}
+		sealedAfter, _ := os.ReadFile(filepath.Join(storagePath, "docs", "fox.txt"))
+		if !bytes.Equal(sealedBefore[sealedHeaderSize:], sealedAfter[sealedHeaderSize:]) {
+			t.Errorf("rotation re-encrypted the data")
+		}
+		// The file is replaced as a whole rather than written in place, and
+		// keeps its modification time.
+		infoAfter, _ := os.Stat(filepath.Join(storagePath, "docs", "fox.txt"))
+		if os.SameFile(infoBefore, infoAfter) || !infoAfter.ModTime().Equal(infoBefore.ModTime()) {
+			t.Errorf("rewrapped in place, or modified at %v instead of %v", infoAfter.ModTime(), infoBefore.ModTime())
+		}
+		if entries, _ := os.ReadDir(filepath.Join(storagePath, "docs")); len(entries) != 1 {
+			t.Errorf("left %d entries in docs", len(entries))
+		}
+		json.NewDecoder(do(rotated, http.MethodPost, "/v1/admin/encryption/rotate", "").Body).Decode(&res)
+		if res.Rewrapped != 0 || res.Unchanged != 2 {
+			t.Errorf("second rotation %+v", res)
+		}
+
+		rotated.encryption = testKeyring(t, 2)
+		if response := do(rotated, http.MethodGet, "/v1/files/docs/fox.txt", ""); response.Body.String() != content {
+			t.Errorf("got %d with just the new key", response.Code)
+		}
+		if response := do(config, http.MethodGet, "/v1/files/docs/fox.txt", ""); response.Code != http.StatusInternalServerError {
+			t.Errorf("got %d with just the old key", response.Code)
+		}
+		plain := config
+		plain.encryption = nil
+		if response := do(plain, http.MethodGet, "/v1/files/docs/fox.txt", ""); response.Code != http.StatusInternalServerError {
+			t.Errorf("got %d without keys", response.Code)
+		}
+		if response := do(plain, http.MethodPost, "/v1/admin/encryption/rotate", ""); response.Code != http.StatusConflict {
+			t.Errorf("got %d rotating without keys", response.Code)
+		}
+	})
+}
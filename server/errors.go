@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"file_store/common"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// errorCode turns an HTTP status into the code of common.ErrorResponse, e.g.
+// 404 into "not_found".
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+// writeJSON answers with body encoded as JSON.
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// writeError answers with a common.ErrorResponse. The request ID is taken from
+// the response header set by withRequestID.
+func writeError(w http.ResponseWriter, status int, message string, details ...common.ErrorDetail) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if status == http.StatusTooManyRequests && h.Get("Retry-After") == "" {
+		h.Set("Retry-After", "1")
+	}
+	writeJSON(w, status, common.ErrorResponse{
+		Status:    status,
+		Code:      errorCode(status),
+		Message:   message,
+		RequestID: h.Get(requestIDHeader),
+		Details:   details,
+	})
+}
+
+// withRequestID tags every request with an ID, taken from the client's
+// X-Request-ID header if it sent one, and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			buf := make([]byte, 8)
+			_, _ = rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withJSONErrors rewrites the plain text errors net/http writes on its own,
+// e.g. the 404 and 405 answers of the mux or a bad range in http.ServeContent,
+// into the JSON error shape, keeping their text as the message.
+func withJSONErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jw := &jsonErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(jw, r)
+		jw.finish()
+	})
+}
+
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	// status is set while a plain text error is being collected.
+	status  int
+	message strings.Builder
+}
+
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	if status < 400 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *jsonErrorWriter) Write(data []byte) (int, error) {
+	if w.status != 0 {
+		return w.message.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *jsonErrorWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+	message := strings.TrimSpace(w.message.String())
+	if message == "" {
+		message = strings.ToLower(http.StatusText(w.status))
+	}
+	writeError(w.ResponseWriter, w.status, message)
+	w.status = 0
+}
+
+func (w *jsonErrorWriter) Flush() {
+	w.finish()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
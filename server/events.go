@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultEventLogSize is how many events the log keeps for clients resuming
+	// with Last-Event-ID.
+	defaultEventLogSize = 10000
+	eventLogFileName    = "events.log"
+	// eventSubscriberBuffer is how far a client may fall behind before it is
+	// disconnected; it then resumes from the log.
+	eventSubscriberBuffer = 256
+	eventKeepAlive        = 30 * time.Second
+)
+
+// eventLog numbers the changes of the store, keeps the latest of them in
+// metaPath/events.log, one JSON object per line, and passes them on to the
+// subscribed /v1/events streams. The storage layer publishes every change.
+type eventLog struct {
+	mu          sync.Mutex
+	path        string
+	size        int
+	events      []common.FileEvent // the last size events, oldest first
+	lastSeq     int64
+	file        *os.File
+	fileLines   int
+	subscribers map[chan common.FileEvent]struct{}
+}
+
+func newEventLog(path string, size int) *eventLog {
+	l := &eventLog{path: path, size: size, subscribers: make(map[chan common.FileEvent]struct{})}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l
+	} else if err != nil {
+		log.Printf("newEventLog err: %v", err)
+		return l
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var event common.FileEvent
+		// A line cut short by a crash is skipped.
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || event.Seq <= l.lastSeq {
+			continue
+		}
+		l.fileLines++
+		l.lastSeq = event.Seq
+		l.events = append(l.events, event)
+		if len(l.events) > l.size {
+			l.events = l.events[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("newEventLog err reading %s: %v", path, err)
+	}
+	return l
+}
+
+// publish numbers event and records it. A nil log drops events, so the
+// storage functions work without one.
+func (l *eventLog) publish(event common.FileEvent) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastSeq++
+	event.Seq = l.lastSeq
+	event.Time = time.Now().UTC()
+	l.events = append(l.events, event)
+	if len(l.events) > l.size {
+		l.events = l.events[1:]
+	}
+	if err := l.writeLocked(event); err != nil {
+		log.Printf("eventLog err writing %s: %v", l.path, err)
+	}
+	for ch := range l.subscribers {
+		select {
+		case ch <- event:
+		default:
+			close(ch)
+			delete(l.subscribers, ch)
+		}
+	}
+}
+
+// writeLocked appends event to the file, rewriting the file with the
+// retained events once it holds twice as many lines.
+func (l *eventLog) writeLocked(event common.FileEvent) error {
+	if l.fileLines >= 2*l.size {
+		if err := l.compactLocked(); err != nil {
+			return err
+		}
+	}
+	if l.file == nil {
+		if err := os.MkdirAll(filepath.Dir(l.path), 0777); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		l.file = file
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.fileLines++
+	return nil
+}
+
+func (l *eventLog) compactLocked() error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(l.path), ".events-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	writer := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(writer)
+	// The event being published is already retained and written by the caller.
+	retained := l.events[:len(l.events)-1]
+	for _, event := range retained {
+		if err := encoder.Encode(event); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if err := os.Rename(tmpFile.Name(), l.path); err != nil {
+		return err
+	}
+	l.fileLines = len(retained)
+	return nil
+}
+
+// subscribe returns a channel receiving every event after lastSeq. The
+// channel is closed if the subscriber falls behind.
+func (l *eventLog) subscribe() (ch chan common.FileEvent, lastSeq int64, unsubscribe func()) {
+	ch = make(chan common.FileEvent, eventSubscriberBuffer)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers[ch] = struct{}{}
+	return ch, l.lastSeq, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.subscribers[ch]; ok {
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// since returns the retained events after seq. truncated is set when events
+// after seq were dropped from the log, or seq is from a log that was lost.
+func (l *eventLog) since(seq int64) (events []common.FileEvent, truncated bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	first := l.lastSeq + 1
+	if len(l.events) > 0 {
+		first = l.events[0].Seq
+	}
+	for _, event := range l.events {
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+	}
+	return events, seq < first-1 || seq > l.lastSeq
+}
+
+func writeEvent(w http.ResponseWriter, event common.FileEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Type == common.EventsTruncated {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	} else {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+	}
+	return err
+}
+
+// handleV1Events streams changes of the store as server-sent events. A client
+// resuming with Last-Event-ID first gets the events it missed, or a truncated
+// event if they are no longer in the log. Events of other tenants and of files
+// the caller cannot read are left out.
+func handleV1Events(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleV1Events")
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	resumeFrom := int64(-1)
+	if lastEventID != "" {
+		seq, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || seq < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid Last-Event-ID %q", lastEventID))
+			return
+		}
+		resumeFrom = seq
+	}
+
+	ch, sent, unsubscribe := config.events.subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	if resumeFrom >= 0 {
+		missed, truncated := config.events.since(resumeFrom)
+		if truncated {
+			upTo := sent
+			if len(missed) > 0 {
+				upTo = missed[0].Seq - 1
+			}
+			writeEvent(w, common.FileEvent{Seq: upTo, Type: common.EventsTruncated, Time: time.Now().UTC()})
+		}
+		for _, event := range missed {
+			if event.Seq > sent {
+				break
+			}
+			if event.Tenant != config.tenant || !config.access.canSeeEvent(event) {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		log.Printf("Error in handleV1Events: %v", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				log.Printf("handleV1Events: client fell behind, closing the stream")
+				return
+			}
+			if event.Seq <= sent {
+				continue
+			}
+			sent = event.Seq
+			if event.Tenant != config.tenant || !config.access.canSeeEvent(event) {
+				continue
+			}
+			if writeEvent(w, event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "meta", eventLogFileName)
+	events := newEventLog(logPath, 3)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		events.publish(common.FileEvent{Type: common.FileCreated, Name: name})
+	}
+
+	missed, truncated := events.since(5)
+	if truncated || len(missed) != 2 || missed[0].Name != "f" || missed[1].Seq != 7 {
+		t.Errorf("since(5) = %v, %v", missed, truncated)
+	}
+	if missed, truncated := events.since(1); !truncated || len(missed) != 3 {
+		t.Errorf("since(1) = %v, %v, want the last three events and truncated", missed, truncated)
+	}
+	if _, truncated := events.since(9); !truncated {
+		t.Errorf("since(9) is not truncated")
+	}
+
+	// The file was compacted on the way, but a new log resumes where it ended.
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > 6 {
+		t.Errorf("log file has %d lines", lines)
+	}
+	reloaded := newEventLog(logPath, 3)
+	reloaded.publish(common.FileEvent{Type: common.FileDeleted, Name: "a"})
+	if missed, truncated := reloaded.since(5); truncated || len(missed) != 3 || missed[2].Seq != 8 {
+		t.Errorf("after reload since(5) = %v, %v", missed, truncated)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	storagePath := t.TempDir()
+	config := ServerConfig{filesStoragePath: storagePath}.withDefaults()
+	server := BuildServer(config)
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+
+	if _, err := writeStoredFile(config, "docs/a.txt", strings.NewReader("alpha")); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(lastEventID string) (*bufio.Scanner, func()) {
+		request, _ := http.NewRequest(http.MethodGet, ts.URL+"/v1/events", http.NoBody)
+		if lastEventID != "" {
+			request.Header.Set("Last-Event-ID", lastEventID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("got %d %v", response.StatusCode, response.Header)
+		}
+		return bufio.NewScanner(response.Body), func() { response.Body.Close() }
+	}
+	next := func(scanner *bufio.Scanner) (string, common.FileEvent) {
+		var eventType string
+		var event common.FileEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+					t.Fatal(err)
+				}
+			case line == "" && eventType != "":
+				return eventType, event
+			}
+		}
+		t.Fatalf("stream ended: %v", scanner.Err())
+		return "", event
+	}
+
+	t.Run("live events", func(t *testing.T) {
+		scanner, closeStream := open("")
+		defer closeStream()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			writeStoredFile(config, "docs/a.txt", strings.NewReader("alpha beta"))
+			renameStoredFile(config, "docs/a.txt", "docs/b.txt", false)
+			deleteStoredFile(config, "docs/b.txt")
+		}()
+		eventType, event := next(scanner)
+		if eventType != common.FileUpdated || event.Seq != 2 || event.Size != 10 || event.SHA256 == "" {
+			t.Errorf("got %s %+v", eventType, event)
+		}
+		eventType, event = next(scanner)
+		if eventType != common.FileRenamed || event.Name != "docs/b.txt" || event.OldName != "docs/a.txt" {
+			t.Errorf("got %s %+v", eventType, event)
+		}
+		eventType, event = next(scanner)
+		if eventType != common.FileDeleted || event.Seq != 4 {
+			t.Errorf("got %s %+v", eventType, event)
+		}
+	})
+
+	t.Run("resume with Last-Event-ID", func(t *testing.T) {
+		scanner, closeStream := open("1")
+		defer closeStream()
+		for _, want := range []string{common.FileUpdated, common.FileRenamed, common.FileDeleted} {
+			if eventType, _ := next(scanner); eventType != want {
+				t.Errorf("got %s, want %s", eventType, want)
+			}
+		}
+	})
+
+	t.Run("resume after a lost log", func(t *testing.T) {
+		scanner, closeStream := open("100")
+		defer closeStream()
+		if eventType, event := next(scanner); eventType != common.EventsTruncated || event.Seq != 4 {
+			t.Errorf("got %s %+v", eventType, event)
+		}
+	})
+
+	t.Run("invalid Last-Event-ID", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/v1/events?last_event_id=x", nil)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("got %d", response.Code)
+		}
+	})
+}
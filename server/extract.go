@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"rsc.io/pdf"
+)
+
+const (
+	extractSniffLen = 512
+	// extractMaxDepth bounds nesting such as a zip inside a gzip file.
+	extractMaxDepth = 3
+	// extractMaxStreamSize caps how much decompressed data a single stream may
+	// produce, so a small compressed file cannot blow up the analytics.
+	extractMaxStreamSize = 256 << 20
+	// extractMaxBufferedSize caps formats which need random access (zip, pdf)
+	// when they are nested inside a compressed stream and have to be buffered.
+	extractMaxBufferedSize = 64 << 20
+)
+
+type contentKind int
+
+const (
+	contentText contentKind = iota
+	contentBinary
+	contentGzip
+	contentZstd
+	contentZip
+	contentPDF
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte("PK\x03\x04")
+	pdfMagic  = []byte("%PDF-")
+)
+
+// detectContentKind looks at the first bytes of a stream and decides how its
+// text can be extracted.
+func detectContentKind(head []byte) (contentKind, string) {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return contentGzip, "application/gzip"
+	case bytes.HasPrefix(head, zstdMagic):
+		return contentZstd, "application/zstd"
+	case bytes.HasPrefix(head, zipMagic):
+		return contentZip, "application/zip"
+	case bytes.HasPrefix(head, pdfMagic):
+		return contentPDF, "application/pdf"
+	}
+	mimeType := http.DetectContentType(head)
+	if strings.HasPrefix(mimeType, "text/") {
+		return contentText, mimeType
+	}
+	return contentBinary, mimeType
+}
+
+type textExtractor struct {
+	fileName string
+	onText   func(source string, r io.Reader) error
+	notes    []common.FileNote
+}
+
+// extractText calls onText with a reader over the plain text of every text
+// stream found in the stored file: the file itself, its decompressed content,
+// the members of a zip archive or the text of a PDF. The source passed to onText
+// names the stream, e.g. "logs.zip:app.log". Anything that is skipped or
+// transformed on the way is reported in the returned notes.
+//
+// Sealed files are decrypted with keys. Reading stops with ctx.Err() once ctx
+// is done.
+func extractText(
+	ctx context.Context, keys *keyring, path string, fileName string, onText func(source string, r io.Reader) error,
+) ([]common.FileNote, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := keys.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	extractor := textExtractor{fileName: fileName, onText: onText}
+	err = extractor.extract(fileName, &contextReader{ctx: ctx, r: file}, file, info.Size(), 0)
+	return extractor.notes, err
+}
+
+// contextReader fails reads once its context is done, so long scans of a single
+// large file can be cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (ex *textExtractor) note(source string, action string, reason string, args ...any) {
+	ex.notes = append(ex.notes, common.FileNote{
+		FileName: ex.fileName,
+		Source:   source,
+		Action:   action,
+		Reason:   fmt.Sprintf(reason, args...),
+	})
+}
+
+// extract handles one stream. readerAt and size are only known for the stored
+// file itself; nested streams are buffered when a format needs random access.
+func (ex *textExtractor) extract(source string, r io.Reader, readerAt io.ReaderAt, size int64, depth int) error {
+	buffered := bufio.NewReaderSize(r, extractSniffLen)
+	head, err := buffered.Peek(extractSniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if len(head) == 0 {
+		return nil
+	}
+
+	kind, mimeType := detectContentKind(head)
+	if kind != contentText && kind != contentBinary && depth >= extractMaxDepth {
+		ex.note(source, common.FileNoteSkipped, "%s nested more than %d levels deep", mimeType, extractMaxDepth)
+		return nil
+	}
+
+	switch kind {
+	case contentText:
+		return ex.onText(source, buffered)
+	case contentGzip:
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			ex.note(source, common.FileNoteSkipped, "unreadable gzip data: %v", err)
+			return nil
+		}
+		defer gzipReader.Close()
+		ex.note(source, common.FileNoteDecompressed, "gzip")
+		return ex.extractDecompressed(source, gzipReader, depth)
+	case contentZstd:
+		zstdReader, err := zstd.NewReader(buffered, zstd.WithDecoderMaxMemory(extractMaxStreamSize))
+		if err != nil {
+			ex.note(source, common.FileNoteSkipped, "unreadable zstd data: %v", err)
+			return nil
+		}
+		defer zstdReader.Close()
+		ex.note(source, common.FileNoteDecompressed, "zstd")
+		return ex.extractDecompressed(source, zstdReader, depth)
+	case contentZip:
+		readerAt, size, ok := ex.randomAccess(source, buffered, readerAt, size)
+		if !ok {
+			return nil
+		}
+		return ex.extractZip(source, readerAt, size, depth)
+	case contentPDF:
+		readerAt, size, ok := ex.randomAccess(source, buffered, readerAt, size)
+		if !ok {
+			return nil
+		}
+		return ex.extractPDF(source, readerAt, size)
+	default:
+		ex.note(source, common.FileNoteSkipped, "binary content (%s)", mimeType)
+		return nil
+	}
+}
+
+// decompressedReader remembers the first error the decompressor returned, so a
+// corrupt stream can be told apart from a failure of the caller.
+type decompressedReader struct {
+	r   io.Reader
+	err error
+}
+
+func (d *decompressedReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF && d.err == nil {
+		d.err = err
+	}
+	return n, err
+}
+
+func (ex *textExtractor) extractDecompressed(source string, r io.Reader, depth int) error {
+	limited := &io.LimitedReader{R: r, N: extractMaxStreamSize}
+	tracked := &decompressedReader{r: limited}
+	err := ex.extract(source, tracked, nil, -1, depth+1)
+	if errors.Is(tracked.err, context.Canceled) || errors.Is(tracked.err, context.DeadlineExceeded) {
+		return tracked.err
+	}
+	if tracked.err != nil {
+		// The stream was corrupt part way through; whatever was read so far still counts.
+		ex.note(source, common.FileNoteSkipped, "rest of stream unreadable: %v", tracked.err)
+		return nil
+	}
+	if limited.N <= 0 {
+		ex.note(source, common.FileNoteTruncated, "decompressed content larger than %d bytes", extractMaxStreamSize)
+	}
+	return err
+}
+
+// randomAccess returns a ReaderAt for the stream, buffering nested streams in
+// memory up to extractMaxBufferedSize.
+func (ex *textExtractor) randomAccess(
+	source string, r io.Reader, readerAt io.ReaderAt, size int64,
+) (io.ReaderAt, int64, bool) {
+	if readerAt != nil {
+		return readerAt, size, true
+	}
+	data, err := io.ReadAll(io.LimitReader(r, extractMaxBufferedSize+1))
+	if err != nil {
+		ex.note(source, common.FileNoteSkipped, "reading nested content: %v", err)
+		return nil, 0, false
+	}
+	if len(data) > extractMaxBufferedSize {
+		ex.note(source, common.FileNoteSkipped, "nested content larger than %d bytes", extractMaxBufferedSize)
+		return nil, 0, false
+	}
+	return bytes.NewReader(data), int64(len(data)), true
+}
+
+func (ex *textExtractor) extractZip(source string, readerAt io.ReaderAt, size int64, depth int) error {
+	archive, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		ex.note(source, common.FileNoteSkipped, "unreadable zip archive: %v", err)
+		return nil
+	}
+	for _, member := range archive.File {
+		if member.FileInfo().IsDir() {
+			continue
+		}
+		memberSource := source + ":" + member.Name
+		memberReader, err := member.Open()
+		if err != nil {
+			ex.note(memberSource, common.FileNoteSkipped, "unreadable zip member: %v", err)
+			continue
+		}
+		err = ex.extractDecompressed(memberSource, memberReader, depth)
+		memberReader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	ex.note(source, common.FileNoteDecompressed, "zip archive with %d members", len(archive.File))
+	return nil
+}
+
+func (ex *textExtractor) extractPDF(source string, readerAt io.ReaderAt, size int64) error {
+	text, pages, err := pdfText(readerAt, size)
+	if err != nil {
+		ex.note(source, common.FileNoteSkipped, "unreadable pdf: %v", err)
+		return nil
+	}
+	ex.note(source, common.FileNoteExtracted, "text from %d pdf pages", pages)
+	return ex.onText(source, strings.NewReader(text))
+}
+
+// pdfText returns the text of every page, one line of output per line of text
+// on the page. rsc.io/pdf panics on some malformed documents, so those are
+// turned into errors.
+func pdfText(readerAt io.ReaderAt, size int64) (text string, pages int, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+	reader, err := pdf.NewReader(readerAt, size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var builder strings.Builder
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		pages++
+		writePDFPageText(&builder, page.Content().Text)
+	}
+	return builder.String(), pages, nil
+}
+
+// writePDFPageText joins the positioned text runs of a page. Runs are often a
+// single glyph, so a space is only inserted where there is a visible gap.
+func writePDFPageText(builder *strings.Builder, runs []pdf.Text) {
+	runs = slices.Clone(runs)
+	slices.SortStableFunc(runs, func(a, b pdf.Text) int {
+		if a.Y != b.Y {
+			if a.Y > b.Y {
+				return -1
+			}
+			return 1
+		}
+		if a.X < b.X {
+			return -1
+		} else if a.X > b.X {
+			return 1
+		}
+		return 0
+	})
+	for i, run := range runs {
+		if i > 0 {
+			previous := runs[i-1]
+			if previous.Y != run.Y {
+				builder.WriteString("\n")
+			} else if run.X-(previous.X+previous.W) > run.FontSize*0.15 {
+				builder.WriteString(" ")
+			}
+		}
+		builder.WriteString(run.S)
+	}
+	builder.WriteString("\n")
+}
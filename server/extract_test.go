@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"file_store/common"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// buildTestPDF writes a single page PDF showing text in a fixed width font.
+func buildTestPDF(text string) []byte {
+	widths := strings.TrimSpace(strings.Repeat("600 ", 126-32+1))
+	content := fmt.Sprintf("BT /F1 12 Tf 72 712 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R " +
+			"/Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding " +
+			"/FirstChar 32 /LastChar 126 /Widths [" + widths + "] >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xrefOffset)
+	return buf.Bytes()
+}
+
+func TestExtractText(t *testing.T) {
+	storagePath := t.TempDir()
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(storagePath, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var gzipBuf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipBuf)
+	gzipWriter.Write([]byte("gzipped words here"))
+	gzipWriter.Close()
+	write("log.gz", gzipBuf.Bytes())
+
+	var zstdBuf bytes.Buffer
+	zstdWriter, _ := zstd.NewWriter(&zstdBuf)
+	zstdWriter.Write([]byte("zstd words"))
+	zstdWriter.Close()
+	write("log.zst", zstdBuf.Bytes())
+
+	var zipBuf bytes.Buffer
+	zipWriter := zip.NewWriter(&zipBuf)
+	member, _ := zipWriter.Create("inner.txt")
+	member.Write([]byte("zipped words"))
+	member, _ = zipWriter.Create("image.png")
+	member.Write([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	zipWriter.Close()
+	write("bundle.zip", zipBuf.Bytes())
+
+	write("doc.pdf", buildTestPDF("Hello PDF world"))
+	write("blob.bin", []byte{0x00, 0x01, 0x02, 0xff, 0x00})
+	write("plain.txt", []byte("plain text"))
+
+	t.Run("text streams", func(t *testing.T) {
+		cases := map[string]string{
+			"log.gz":     "log.gz=gzipped words here",
+			"log.zst":    "log.zst=zstd words",
+			"bundle.zip": "bundle.zip:inner.txt=zipped words",
+			"doc.pdf":    "doc.pdf=Hello PDF world\n",
+			"plain.txt":  "plain.txt=plain text",
+			"blob.bin":   "",
+		}
+		for name, want := range cases {
+			got := make([]string, 0)
+			_, err := extractText(context.Background(), nil, filepath.Join(storagePath, name), name, func(source string, r io.Reader) error {
+				data, err := io.ReadAll(r)
+				got = append(got, source+"="+string(data))
+				return err
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if strings.Join(got, ",") != want {
+				t.Errorf("%s: got %q, want %q", name, strings.Join(got, ","), want)
+			}
+		}
+	})
+
+	t.Run("word count skips binaries with notes", func(t *testing.T) {
+		res, err := wordCountOfAllFiles(context.Background(), ServerConfig{filesStoragePath: storagePath}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Count != 3+2+2+3+2 {
+			t.Errorf("got count %d", res.Count)
+		}
+		skipped := make([]string, 0)
+		for _, note := range res.Notes {
+			if note.Action == common.FileNoteSkipped {
+				skipped = append(skipped, note.Source)
+			}
+		}
+		if strings.Join(skipped, ",") != "blob.bin,bundle.zip:image.png" {
+			t.Errorf("unexpected skipped sources %v", skipped)
+		}
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const freqSnapshotsDirName = "freq_snapshots"
+
+var errFreqSourceNotFound = errors.New("not found")
+
+// A freq-diff side is described by a spec:
+//
+//	NAME or file:NAME    a single stored file
+//	prefix:PREFIX        every stored file whose name starts with PREFIX
+//	store                every stored file
+//	snapshot:NAME        a snapshot saved with action=freq-snapshot
+//	@TIME                the newest snapshot taken at or before TIME (RFC 3339 or YYYY-MM-DD)
+func resolveFreqSpec(
+	ctx context.Context, config ServerConfig, spec string, progress progressFunc,
+) (map[string]int, []common.FileNote, error) {
+	kind, value, hasKind := strings.Cut(spec, ":")
+	switch {
+	case spec == "":
+		return nil, nil, fmt.Errorf("empty freq-diff spec")
+	case spec == "store":
+		return countWordsInPrefix(ctx, config, "", progress)
+	case hasKind && kind == "prefix":
+		return countWordsInPrefix(ctx, config, value, progress)
+	case hasKind && kind == "snapshot":
+		snapshot, err := loadFreqSnapshot(config, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		return snapshot.WordCounts, nil, nil
+	case strings.HasPrefix(spec, "@"):
+		snapshot, err := findFreqSnapshotAt(config, spec[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return snapshot.WordCounts, nil, nil
+	}
+	if hasKind && kind == "file" {
+		spec = value
+	}
+	if _, err := statStoredFile(config, spec); errors.Is(err, errStoredFileNotFound) {
+		return nil, nil, fmt.Errorf("file %q: %w", spec, errFreqSourceNotFound)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return countWordsInFiles(ctx, config, []string{spec}, progress)
+}
+
+func countWordsInPrefix(
+	ctx context.Context, config ServerConfig, prefix string, progress progressFunc,
+) (map[string]int, []common.FileNote, error) {
+	list, err := getListOfFiles(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]string, 0)
+	for _, fileName := range list.Files {
+		if strings.HasPrefix(fileName, prefix) {
+			files = append(files, fileName)
+		}
+	}
+	return countWordsInFiles(ctx, config, files, progress)
+}
+
+// getFreqDiff compares the word frequencies of two specs. Words only in B are
+// gained, words only in A are lost, and words in both are ranked by how much
+// their count changed.
+func getFreqDiff(
+	ctx context.Context, config ServerConfig, specA string, specB string, top int, progress progressFunc,
+) (*common.FreqDiffResponse, error) {
+	log.Printf("In getFreqDiff %s vs %s", specA, specB)
+	countsA, notesA, err := resolveFreqSpec(ctx, config, specA, func(done int, total int) {
+		progress.report(done, 2*total)
+	})
+	if err != nil {
+		return nil, err
+	}
+	countsB, notesB, err := resolveFreqSpec(ctx, config, specB, func(done int, total int) {
+		progress.report(total+done, 2*total)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := common.FreqDiffResponse{
+		A:       specA,
+		B:       specB,
+		Gained:  make([]common.WordCountDelta, 0),
+		Lost:    make([]common.WordCountDelta, 0),
+		Changed: make([]common.WordCountDelta, 0),
+		Notes:   append(notesA, notesB...),
+	}
+	for word, countA := range countsA {
+		res.TotalA += countA
+		countB, ok := countsB[word]
+		delta := common.WordCountDelta{Word: word, CountA: countA, CountB: countB, Delta: countB - countA}
+		if !ok {
+			res.Lost = append(res.Lost, delta)
+		} else if delta.Delta != 0 {
+			res.Changed = append(res.Changed, delta)
+		}
+	}
+	for word, countB := range countsB {
+		res.TotalB += countB
+		if _, ok := countsA[word]; !ok {
+			res.Gained = append(res.Gained, common.WordCountDelta{Word: word, CountB: countB, Delta: countB})
+		}
+	}
+
+	byMagnitude := func(a, b common.WordCountDelta) int {
+		magnitudeA, magnitudeB := a.Delta, b.Delta
+		if magnitudeA < 0 {
+			magnitudeA = -magnitudeA
+		}
+		if magnitudeB < 0 {
+			magnitudeB = -magnitudeB
+		}
+		if magnitudeA != magnitudeB {
+			return magnitudeB - magnitudeA
+		}
+		return strings.Compare(a.Word, b.Word)
+	}
+	for _, deltas := range []*[]common.WordCountDelta{&res.Gained, &res.Lost, &res.Changed} {
+		slices.SortFunc(*deltas, byMagnitude)
+		if len(*deltas) > top {
+			*deltas = (*deltas)[:top]
+		}
+	}
+	return &res, nil
+}
+
+func handleFreqDiffAction(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleFreqDiffAction")
+	res, err := runFreqDiff(r.Context(), config, r.Form, nil)
+	if err != nil {
+		log.Printf("Error in handleFreqDiffAction: %v", err)
+		code := http.StatusBadRequest
+		if errors.Is(err, errFreqSourceNotFound) {
+			code = http.StatusNotFound
+		} else if errors.Is(err, errPermissionDenied) {
+			code = http.StatusForbidden
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// runFreqDiff reads the a, b and top parameters shared by the action and the job.
+func runFreqDiff(
+	ctx context.Context, config ServerConfig, params url.Values, progress progressFunc,
+) (*common.FreqDiffResponse, error) {
+	top := 10
+	if params.Has("top") {
+		value, err := strconv.Atoi(params.Get("top"))
+		if err != nil || value < 1 {
+			return nil, fmt.Errorf("invalid value for top: %q", params.Get("top"))
+		}
+		top = value
+	}
+	return getFreqDiff(ctx, config, params.Get("a"), params.Get("b"), top, progress)
+}
+
+func freqSnapshotsPath(config ServerConfig) string {
+	return config.metaPath + "/" + freqSnapshotsDirName
+}
+
+// saveFreqSnapshot records the current word frequencies of the whole store so
+// later diffs can compare against this point in time. Snapshots cover the
+// whole store, so only callers who may read all of it can save or read them.
+func saveFreqSnapshot(
+	ctx context.Context, config ServerConfig, name string, progress progressFunc,
+) (*common.FreqSnapshotInfo, error) {
+	createdAt := time.Now().UTC()
+	if name == "" {
+		name = createdAt.Format("20060102T150405Z")
+	}
+	if err := validateFileName(name); err != nil {
+		return nil, err
+	}
+	if err := config.access.checkReadAll(); err != nil {
+		return nil, err
+	}
+	list, err := getListOfFiles(config)
+	if err != nil {
+		return nil, err
+	}
+	counts, _, err := countWordsInFiles(ctx, config, list.Files, progress)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := common.FreqSnapshot{
+		FreqSnapshotInfo: common.FreqSnapshotInfo{Name: name, CreatedAt: createdAt, Files: list.Files},
+		WordCounts:       counts,
+	}
+
+	if err := os.MkdirAll(freqSnapshotsPath(config), 0777); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	// Write to a temporary file first so a crash never leaves half a snapshot.
+	path := filepath.Join(freqSnapshotsPath(config), name+".json")
+	if err := os.WriteFile(path+".tmp", data, 0666); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	log.Printf("saved freq snapshot %s with %d words", name, len(counts))
+	return &snapshot.FreqSnapshotInfo, nil
+}
+
+func loadFreqSnapshot(config ServerConfig, name string) (*common.FreqSnapshot, error) {
+	if err := validateFileName(name); err != nil {
+		return nil, err
+	}
+	if err := config.access.checkReadAll(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(freqSnapshotsPath(config), name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("snapshot %q: %w", name, errFreqSourceNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	var snapshot common.FreqSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// listFreqSnapshots returns the saved snapshots, oldest first.
+func listFreqSnapshots(config ServerConfig) ([]common.FreqSnapshotInfo, error) {
+	if err := config.access.checkReadAll(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(freqSnapshotsPath(config))
+	if errors.Is(err, os.ErrNotExist) {
+		return make([]common.FreqSnapshotInfo, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := make([]common.FreqSnapshotInfo, 0, len(entries))
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		snapshot, err := loadFreqSnapshot(config, name)
+		if err != nil {
+			log.Printf("Error reading freq snapshot %s: %v", name, err)
+			continue
+		}
+		res = append(res, snapshot.FreqSnapshotInfo)
+	}
+	slices.SortFunc(res, func(a, b common.FreqSnapshotInfo) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return res, nil
+}
+
+func findFreqSnapshotAt(config ServerConfig, at string) (*common.FreqSnapshot, error) {
+	when, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		day, dayErr := time.Parse(time.DateOnly, at)
+		if dayErr != nil {
+			return nil, fmt.Errorf("invalid time %q, want RFC 3339 or YYYY-MM-DD", at)
+		}
+		// A bare date means "as of the end of that day".
+		when = day.Add(24*time.Hour - time.Nanosecond)
+	}
+	snapshots, err := listFreqSnapshots(config)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].CreatedAt.After(when) {
+			return loadFreqSnapshot(config, snapshots[i].Name)
+		}
+	}
+	return nil, fmt.Errorf("snapshot at or before %s: %w", at, errFreqSourceNotFound)
+}
+
+func handleFreqSnapshotAction(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleFreqSnapshotAction")
+	info, err := saveFreqSnapshot(r.Context(), config, r.Form.Get("name"), nil)
+	if err != nil {
+		log.Printf("Error in handleFreqSnapshotAction: %v", err)
+		code := http.StatusBadRequest
+		if errors.Is(err, errPermissionDenied) {
+			code = http.StatusForbidden
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func handleListFreqSnapshotsAction(config ServerConfig, w http.ResponseWriter) {
+	log.Printf("In handleListFreqSnapshotsAction")
+	snapshots, err := listFreqSnapshots(config)
+	if err != nil {
+		log.Printf("Error in handleListFreqSnapshotsAction: %v", err)
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, common.FreqSnapshotList{Snapshots: snapshots})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFreqDiff(t *testing.T) {
+	storagePath := t.TempDir()
+	write := func(name string, content string) {
+		if err := os.WriteFile(filepath.Join(storagePath, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("old.txt", "apple apple banana cherry")
+	write("new.txt", "apple banana banana banana date")
+	server := BuildServer(ServerConfig{filesStoragePath: storagePath})
+
+	do := func(method string, query string, res any) int {
+		request, _ := http.NewRequest(method, "/files?"+query, http.NoBody)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		if res != nil && response.Code < 300 {
+			if err := json.NewDecoder(response.Body).Decode(res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return response.Code
+	}
+
+	t.Run("two files", func(t *testing.T) {
+		var res common.FreqDiffResponse
+		if code := do(http.MethodGet, "action=freq-diff&a=old.txt&b=file:new.txt", &res); code != http.StatusOK {
+			t.Fatalf("got status %d", code)
+		}
+		if len(res.Gained) != 1 || res.Gained[0].Word != "date" {
+			t.Errorf("unexpected gained %+v", res.Gained)
+		}
+		if len(res.Lost) != 1 || res.Lost[0].Word != "cherry" {
+			t.Errorf("unexpected lost %+v", res.Lost)
+		}
+		if len(res.Changed) != 2 || res.Changed[0].Word != "banana" || res.Changed[0].Delta != 2 {
+			t.Errorf("unexpected changed %+v", res.Changed)
+		}
+		if res.TotalA != 4 || res.TotalB != 5 {
+			t.Errorf("unexpected totals %d %d", res.TotalA, res.TotalB)
+		}
+	})
+
+	t.Run("store against snapshot", func(t *testing.T) {
+		var info common.FreqSnapshotInfo
+		if code := do(http.MethodPost, "action=freq-snapshot&name=before", &info); code != http.StatusCreated {
+			t.Fatalf("got status %d", code)
+		}
+		write("extra.txt", "elderberry")
+
+		var res common.FreqDiffResponse
+		at := time.Now().UTC().Format(time.RFC3339Nano)
+		if code := do(http.MethodGet, "action=freq-diff&a=@"+at+"&b=store", &res); code != http.StatusOK {
+			t.Fatalf("got status %d", code)
+		}
+		if len(res.Gained) != 1 || res.Gained[0].Word != "elderberry" || len(res.Lost) != 0 {
+			t.Errorf("unexpected diff %+v", res)
+		}
+
+		var list common.FreqSnapshotList
+		do(http.MethodGet, "action=freq-snapshot", &list)
+		if len(list.Snapshots) != 1 || list.Snapshots[0].Name != "before" {
+			t.Errorf("unexpected snapshots %+v", list)
+		}
+	})
+
+	t.Run("missing sources", func(t *testing.T) {
+		for _, query := range []string{"a=missing.txt&b=store", "a=snapshot:nope&b=store", "a=@2000-01-01&b=store"} {
+			if code := do(http.MethodGet, "action=freq-diff&"+query, nil); code != http.StatusNotFound {
+				t.Errorf("%s: got status %d", query, code)
+			}
+		}
+		if code := do(http.MethodGet, "action=freq-diff&a=../x&b=store", nil); code != http.StatusBadRequest {
+			t.Errorf("got status %d for bad name", code)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"file_store/common"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+const (
+	grepMaxLineSize = 1024 * 1024
+	// grepJobMaxMatches bounds the result of a grep job without max.
+	grepJobMaxMatches = 10000
+)
+
+type grepOptions struct {
+	pattern      *regexp.Regexp
+	files        []string
+	beforeLines  int
+	afterLines   int
+	invertMatch  bool
+	maxMatches   int
+	matchesFound int
+}
+
+// handleGrepAction runs a regular expression over the stored files and streams
+// matching lines (plus any requested context lines) back as newline delimited JSON.
+func handleGrepAction(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleGrepAction")
+	opts, err := parseGrepOptions(r.Form)
+	if err != nil {
+		log.Printf("Error in handleGrepAction: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	files, invalid := validateFilePaths(opts.files)
+	if len(invalid) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid file names", invalid...)
+		return
+	}
+	opts.files = files
+
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	wroteHeader := false
+	emit := func(line common.GrepLine) error {
+		if !wroteHeader {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			wroteHeader = true
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	err = grepFiles(r.Context(), config, opts, emit, nil)
+	if err != nil && !wroteHeader {
+		log.Printf("Error in handleGrepAction: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !wroteHeader {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	log.Printf("handleGrepAction found %d matching lines", opts.matchesFound)
+}
+
+// grepFiles greps opts.files, or every stored file if there are none, passing
+// each line to emit. Files that cannot be searched are reported through emit
+// too; an error is only returned if emit or listing the store fails.
+func grepFiles(
+	ctx context.Context, config ServerConfig, opts *grepOptions, emit func(common.GrepLine) error, progress progressFunc,
+) error {
+	files := opts.files
+	if len(files) == 0 {
+		list, err := getListOfFiles(config)
+		if err != nil {
+			return err
+		}
+		files = list.Files
+	}
+	for i, fileName := range files {
+		if opts.maxMatches > 0 && opts.matchesFound >= opts.maxMatches {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.report(i, len(files))
+		fullPath, err := readableFilePath(config, fileName)
+		if err == nil {
+			err = grepFile(ctx, config.encryption, fullPath, fileName, opts, emit)
+		}
+		if err != nil {
+			log.Printf("Error in grepFiles for %s: %v", fileName, err)
+			if emitErr := emit(common.GrepLine{FileName: fileName, ErrorMsg: err.Error()}); emitErr != nil {
+				return emitErr
+			}
+		}
+	}
+	progress.report(len(files), len(files))
+	return nil
+}
+
+// grepJob runs grep as a job, collecting the lines into a common.GrepResult.
+// Without max, it stops after grepJobMaxMatches matches.
+func grepJob(ctx context.Context, config ServerConfig, params url.Values, progress progressFunc) (any, error) {
+	opts, err := parseGrepOptions(params)
+	if err != nil {
+		return nil, err
+	}
+	files, invalid := validateFilePaths(opts.files)
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("%s", invalid[0].Message)
+	}
+	opts.files = files
+	if opts.maxMatches == 0 {
+		opts.maxMatches = grepJobMaxMatches
+	}
+	res := common.GrepResult{Lines: make([]common.GrepLine, 0)}
+	err = grepFiles(ctx, config, opts, func(line common.GrepLine) error {
+		res.Lines = append(res.Lines, line)
+		return nil
+	}, progress)
+	if err != nil {
+		return nil, err
+	}
+	res.Truncated = opts.matchesFound >= opts.maxMatches
+	return res, nil
+}
+
+func parseGrepOptions(form url.Values) (*grepOptions, error) {
+	expr := form.Get("pattern")
+	if form.Has("i") && form.Get("i") != "false" {
+		expr = "(?i)" + expr
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	opts := &grepOptions{
+		pattern:     pattern,
+		files:       form["file"],
+		invertMatch: form.Has("v") && form.Get("v") != "false",
+	}
+	intParams := []struct {
+		name string
+		dst  *int
+	}{
+		{"C", &opts.beforeLines},
+		{"C", &opts.afterLines},
+		{"B", &opts.beforeLines},
+		{"A", &opts.afterLines},
+		{"max", &opts.maxMatches},
+	}
+	for _, param := range intParams {
+		if !form.Has(param.name) {
+			continue
+		}
+		value, err := strconv.Atoi(form.Get(param.name))
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q", param.name, form.Get(param.name))
+		}
+		*param.dst = value
+	}
+	return opts, nil
+}
+
+// grepFile greps every text stream extractText finds in the stored file, so
+// compressed logs and PDFs are searched too. Streams that had to be skipped are
+// reported with a note line.
+func grepFile(
+	ctx context.Context, keys *keyring, path string, fileName string, opts *grepOptions, emit func(common.GrepLine) error,
+) error {
+	notes, err := extractText(ctx, keys, path, fileName, func(source string, r io.Reader) error {
+		return grepStream(r, source, opts, emit)
+	})
+	if err != nil {
+		return err
+	}
+	for _, note := range notes {
+		if note.Action != common.FileNoteSkipped && note.Action != common.FileNoteTruncated {
+			continue
+		}
+		if err := emit(common.GrepLine{FileName: note.Source, Note: note.Action + ": " + note.Reason}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grepStream scans a stream line by line, emitting matches and their context
+// the same way grep does: context lines are emitted once even if they belong to
+// several matches.
+func grepStream(r io.Reader, source string, opts *grepOptions, emit func(common.GrepLine) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), grepMaxLineSize)
+
+	before := make([]common.GrepLine, 0, opts.beforeLines)
+	afterRemaining := 0
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := common.GrepLine{FileName: source, LineNumber: lineNumber, Text: scanner.Text()}
+		isMatch := opts.pattern.MatchString(line.Text) != opts.invertMatch
+		limitReached := opts.maxMatches > 0 && opts.matchesFound >= opts.maxMatches
+
+		switch {
+		case isMatch && !limitReached:
+			for _, contextLine := range before {
+				if err := emit(contextLine); err != nil {
+					return err
+				}
+			}
+			before = before[:0]
+			line.Match = true
+			if err := emit(line); err != nil {
+				return err
+			}
+			opts.matchesFound++
+			afterRemaining = opts.afterLines
+		case afterRemaining > 0:
+			if err := emit(line); err != nil {
+				return err
+			}
+			afterRemaining--
+		case limitReached:
+			return nil
+		case opts.beforeLines > 0:
+			if len(before) == opts.beforeLines {
+				before = append(before[:0], before[1:]...)
+			}
+			before = append(before, line)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func grepRequest(t *testing.T, storagePath string, query string) ([]common.GrepLine, int) {
+	t.Helper()
+	request, _ := http.NewRequest(http.MethodGet, "/files?action=grep&"+query, nil)
+	response := httptest.NewRecorder()
+	server := BuildServer(ServerConfig{filesStoragePath: storagePath})
+	server.Handler.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		return nil, response.Code
+	}
+
+	lines := make([]common.GrepLine, 0)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var line common.GrepLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("bad grep line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, response.Code
+}
+
+func TestGrepAction(t *testing.T) {
+	storagePath := t.TempDir()
+	content := "alpha\nbeta\nGamma\ndelta\nepsilon\ngamma ray\nzeta\n"
+	if err := os.WriteFile(filepath.Join(storagePath, "greek.txt"), []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(storagePath, "other.txt"), []byte("nothing here\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("case sensitive match", func(t *testing.T) {
+		lines, code := grepRequest(t, storagePath, "pattern=gamma")
+		if code != http.StatusOK {
+			t.Fatalf("got status %d", code)
+		}
+		if len(lines) != 1 || lines[0].LineNumber != 6 || !lines[0].Match {
+			t.Errorf("unexpected lines %+v", lines)
+		}
+	})
+
+	t.Run("case insensitive with context", func(t *testing.T) {
+		lines, _ := grepRequest(t, storagePath, "pattern=gamma&i=true&C=1&file=greek.txt")
+		got := make([]int, 0)
+		for _, line := range lines {
+			got = append(got, line.LineNumber)
+		}
+		want := []int{2, 3, 4, 5, 6, 7}
+		if len(got) != len(want) {
+			t.Fatalf("got line numbers %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got line numbers %v, want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("invert match with limit", func(t *testing.T) {
+		lines, _ := grepRequest(t, storagePath, "pattern=a&v=true&file=greek.txt")
+		if len(lines) != 1 || lines[0].Text != "epsilon" {
+			t.Errorf("unexpected lines %+v", lines)
+		}
+		lines, _ = grepRequest(t, storagePath, "pattern=a&max=2&file=greek.txt")
+		if len(lines) != 2 || lines[1].Text != "beta" {
+			t.Errorf("unexpected lines %+v", lines)
+		}
+	})
+
+	t.Run("bad pattern and file name", func(t *testing.T) {
+		if _, code := grepRequest(t, storagePath, "pattern=("); code != http.StatusBadRequest {
+			t.Errorf("got status %d for bad pattern", code)
+		}
+		if _, code := grepRequest(t, storagePath, "pattern=a&file=../greek.txt"); code != http.StatusBadRequest {
+			t.Errorf("got status %d for bad file name", code)
+		}
+	})
+}
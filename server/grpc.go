@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"file_store/common"
+	"file_store/storepb"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// defaultGRPCAddr is where the gRPC service listens unless STORE_GRPC_ADDR
+	// says otherwise; STORE_GRPC_ADDR=off disables it.
+	defaultGRPCAddr = ":9090"
+	// grpcChunkSize is the size of the content chunks sent by Download.
+	grpcChunkSize = 64 * 1024
+)
+
+// grpcServer implements storepb.FileStoreServer on top of the same storage
+// layer and analytics as the HTTP handlers.
+type grpcServer struct {
+	storepb.UnimplementedFileStoreServer
+	config ServerConfig
+}
+
+// BuildGRPCServer is the gRPC counterpart of BuildServer.
+func BuildGRPCServer(config ServerConfig) *grpc.Server {
+	config = config.withDefaults()
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(auditUnaryRPC(config.audit), logUnaryRPC, authUnaryRPC(config), rateLimitUnaryRPC(config)),
+		grpc.ChainStreamInterceptor(auditStreamRPC(config.audit), logStreamRPC, authStreamRPC(config), rateLimitStreamRPC(config)),
+	}
+	if config.tls != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(config.tls.serverConfig())))
+	}
+	server := grpc.NewServer(options...)
+	storepb.RegisterFileStoreServer(server, &grpcServer{config: config})
+	return server
+}
+
+func serveGRPC(config ServerConfig, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("gRPC server listening on %s", addr)
+	log.Fatal(BuildGRPCServer(config).Serve(listener))
+}
+
+func logUnaryRPC(
+	ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+) (any, error) {
+	log.Printf("[gRPC] [%s]", info.FullMethod)
+	res, err := handler(ctx, req)
+	log.Printf("[gRPC] [%s] Done [%v]", info.FullMethod, status.Code(err))
+	return res, err
+}
+
+func logStreamRPC(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	log.Printf("[gRPC] [%s]", info.FullMethod)
+	err := handler(srv, stream)
+	log.Printf("[gRPC] [%s] Done [%v]", info.FullMethod, status.Code(err))
+	return err
+}
+
+// grpcError maps an error the way storageErrorStatus does for HTTP.
+func grpcError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errInvalidFileName), errors.Is(err, errFileInfected):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errStoredFileNotFound), errors.Is(err, errFreqSourceNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errStoredFileExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, errPermissionDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.As(err, &maxBytesErr), errors.Is(err, errFileOverQuota), errors.Is(err, errQuotaExceeded),
+		errors.Is(err, errFileTooLarge), errors.Is(err, errTooManyUploads), errors.Is(err, errTooManyFiles):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, errScanFailed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func fileInfoToProto(info common.FileInfo) *storepb.FileInfo {
+	return &storepb.FileInfo{Name: info.Name, Size: info.Size, ModTime: timestamppb.New(info.ModTime)}
+}
+
+func fileNotesToProto(notes []common.FileNote) []*storepb.FileNote {
+	res := make([]*storepb.FileNote, 0, len(notes))
+	for _, note := range notes {
+		res = append(res, &storepb.FileNote{
+			FileName: note.FileName, Source: note.Source, Action: note.Action, Reason: note.Reason,
+		})
+	}
+	return res
+}
+
+// uploadReader reads the content chunks of an Upload stream.
+type uploadReader struct {
+	stream storepb.FileStore_UploadServer
+	buf    []byte
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if req.GetHeader() != nil {
+			return 0, status.Error(codes.InvalidArgument, "upload header sent twice")
+		}
+		r.buf = req.GetChunk()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (s *grpcServer) Upload(stream storepb.FileStore_UploadServer) error {
+	config := s.config.forContext(stream.Context())
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := first.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "first upload message must be the header")
+	}
+	name, err := validateFilePath(header.Name)
+	if err != nil {
+		return grpcError(err)
+	}
+	if header.IfNotExists {
+		if _, err := statStoredFile(config, name); err == nil {
+			return grpcError(fmt.Errorf("%s: %w", name, errStoredFileExists))
+		}
+	}
+	content := http.MaxBytesReader(nil, io.NopCloser(&uploadReader{stream: stream}), config.maxUploadBytes)
+	created, err := writeStoredFile(config, name, content)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return grpcError(err)
+	}
+	info, err := statStoredFile(config, name)
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(&storepb.UploadResponse{
+		File:    fileInfoToProto(common.FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime().UTC()}),
+		Created: created,
+	})
+}
+
+func (s *grpcServer) Download(req *storepb.DownloadRequest, stream storepb.FileStore_DownloadServer) error {
+	config := s.config.forContext(stream.Context())
+	file, info, err := openStoredFile(config, req.Name)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer file.Close()
+	name, _ := validateFilePath(req.Name)
+	res := &storepb.DownloadResponse{
+		File: fileInfoToProto(common.FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime().UTC()}),
+	}
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			res.Chunk = buf[:n]
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+			res = &storepb.DownloadResponse{}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return grpcError(err)
+		}
+	}
+	if res.File != nil {
+		// Empty files still send their info.
+		return stream.Send(res)
+	}
+	return nil
+}
+
+func (s *grpcServer) List(ctx context.Context, req *storepb.ListRequest) (*storepb.ListResponse, error) {
+	config := s.config.forContext(ctx)
+	files, err := listStoredFiles(config, req.Prefix)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &storepb.ListResponse{Files: make([]*storepb.FileInfo, 0, len(files))}
+	for _, file := range files {
+		res.Files = append(res.Files, fileInfoToProto(file))
+	}
+	return res, nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *storepb.DeleteRequest) (*storepb.DeleteResponse, error) {
+	config := s.config.forContext(ctx)
+	if err := deleteStoredFile(config, req.Name); err != nil {
+		return nil, grpcError(err)
+	}
+	return &storepb.DeleteResponse{}, nil
+}
+
+func (s *grpcServer) MatchHashes(ctx context.Context, req *storepb.MatchHashesRequest) (*storepb.MatchHashesResponse, error) {
+	config := s.config.forContext(ctx)
+	pairs := make([]common.FileSha256Pair, 0, len(req.Files))
+	for _, file := range req.Files {
+		pairs = append(pairs, common.FileSha256Pair{FileName: file.Name, FileHash: file.Sha256})
+	}
+	matched, err := matchFilesByHash(config, pairs)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &storepb.MatchHashesResponse{Unmatched: make([]*storepb.FileHash, 0)}
+	for _, pair := range matched.UnsuccessfulFileNames {
+		res.Unmatched = append(res.Unmatched, &storepb.FileHash{Name: pair.FileName, Sha256: pair.FileHash})
+	}
+	return res, nil
+}
+
+func (s *grpcServer) WordCount(ctx context.Context, req *storepb.WordCountRequest) (*storepb.WordCountResponse, error) {
+	config := s.config.forContext(ctx)
+	count, err := wordCountOfAllFiles(ctx, config, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &storepb.WordCountResponse{Count: int64(count.Count), Notes: fileNotesToProto(count.Notes)}, nil
+}
+
+func (s *grpcServer) FrequentWords(
+	ctx context.Context, req *storepb.FrequentWordsRequest,
+) (*storepb.FrequentWordsResponse, error) {
+	config := s.config.forContext(ctx)
+	words, err := getFrequentWords(ctx, config, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &storepb.FrequentWordsResponse{Notes: fileNotesToProto(words.Notes)}
+	for _, pair := range words.WordCountPairs {
+		res.Words = append(res.Words, &storepb.WordCount{Word: pair.Word, Count: int64(pair.Count)})
+	}
+	return res, nil
+}
+
+// The remaining analytics take their options as query parameters over HTTP, so
+// the requests are turned into the same url.Values and parsed the same way.
+
+// setInt sets name in params unless value is the proto default.
+func setInt(params url.Values, name string, value int32) {
+	if value != 0 {
+		params.Set(name, strconv.Itoa(int(value)))
+	}
+}
+
+func (s *grpcServer) Ngrams(ctx context.Context, req *storepb.NgramsRequest) (*storepb.NgramsResponse, error) {
+	config := s.config.forContext(ctx)
+	params := url.Values{"file": req.Files}
+	setInt(params, "n", req.N)
+	setInt(params, "top", req.Top)
+	setInt(params, "min_count", req.MinCount)
+	if req.Sort != "" {
+		params.Set("sort", req.Sort)
+	}
+	opts, err := parseNgramsOptions(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ngrams, err := getFrequentNgrams(ctx, config, opts, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &storepb.NgramsResponse{N: int32(ngrams.N), Notes: fileNotesToProto(ngrams.Notes)}
+	for _, pair := range ngrams.NgramCountPairs {
+		res.Ngrams = append(res.Ngrams, &storepb.NgramCount{Words: pair.Words, Count: int64(pair.Count), Score: pair.Score})
+	}
+	return res, nil
+}
+
+func (s *grpcServer) Grep(req *storepb.GrepRequest, stream storepb.FileStore_GrepServer) error {
+	config := s.config.forContext(stream.Context())
+	params := url.Values{"pattern": {req.Pattern}, "file": req.Files}
+	setInt(params, "B", req.Before)
+	setInt(params, "A", req.After)
+	setInt(params, "max", req.MaxMatches)
+	if req.IgnoreCase {
+		params.Set("i", "true")
+	}
+	if req.InvertMatch {
+		params.Set("v", "true")
+	}
+	opts, err := parseGrepOptions(params)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	files, invalid := validateFilePaths(opts.files)
+	if len(invalid) > 0 {
+		return status.Error(codes.InvalidArgument, invalid[0].Message)
+	}
+	opts.files = files
+	err = grepFiles(stream.Context(), config, opts, func(line common.GrepLine) error {
+		return stream.Send(&storepb.GrepLine{
+			FileName:   line.FileName,
+			LineNumber: int64(line.LineNumber),
+			Text:       line.Text,
+			Match:      line.Match,
+			ErrorMsg:   line.ErrorMsg,
+			Note:       line.Note,
+		})
+	}, nil)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return grpcError(err)
+	}
+	return nil
+}
+
+func wordCountDeltasToProto(deltas []common.WordCountDelta) []*storepb.WordCountDelta {
+	res := make([]*storepb.WordCountDelta, 0, len(deltas))
+	for _, delta := range deltas {
+		res = append(res, &storepb.WordCountDelta{
+			Word: delta.Word, CountA: int64(delta.CountA), CountB: int64(delta.CountB), Delta: int64(delta.Delta),
+		})
+	}
+	return res
+}
+
+func (s *grpcServer) FreqDiff(ctx context.Context, req *storepb.FreqDiffRequest) (*storepb.FreqDiffResponse, error) {
+	config := s.config.forContext(ctx)
+	params := url.Values{"a": {req.A}, "b": {req.B}}
+	setInt(params, "top", req.Top)
+	diff, err := runFreqDiff(ctx, config, params, nil)
+	if errors.Is(err, errFreqSourceNotFound) {
+		return nil, grpcError(err)
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &storepb.FreqDiffResponse{
+		TotalA:  int64(diff.TotalA),
+		TotalB:  int64(diff.TotalB),
+		Gained:  wordCountDeltasToProto(diff.Gained),
+		Lost:    wordCountDeltasToProto(diff.Lost),
+		Changed: wordCountDeltasToProto(diff.Changed),
+		Notes:   fileNotesToProto(diff.Notes),
+	}, nil
+}
+
+func (s *grpcServer) IntegrityScan(
+	ctx context.Context, req *storepb.IntegrityScanRequest,
+) (*storepb.IntegrityScanResponse, error) {
+	config := s.config.forContext(ctx)
+	scan, err := integrityScan(ctx, config, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &storepb.IntegrityScanResponse{FilesScanned: int64(scan.FilesScanned)}
+	for _, file := range scan.UnreadableFiles {
+		res.UnreadableFiles = append(res.UnreadableFiles, &storepb.UnreadableFile{Name: file.FileName, ErrorMsg: file.ErrorMsg})
+	}
+	for _, group := range scan.DuplicateGroups {
+		res.DuplicateGroups = append(res.DuplicateGroups, &storepb.DuplicateGroup{Names: group})
+	}
+	return res, nil
+}
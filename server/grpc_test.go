@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"file_store/storepb"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCService(t *testing.T) {
+	storagePath := t.TempDir()
+	listener := bufconn.Listen(1 << 20)
+	server := BuildGRPCServer(ServerConfig{filesStoragePath: storagePath, maxUploadBytes: 1 << 20})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := storepb.NewFileStoreClient(conn)
+	ctx := context.Background()
+
+	upload := func(name string, ifNotExists bool, chunks ...string) (*storepb.UploadResponse, error) {
+		stream, err := client.Upload(ctx)
+		if err != nil {
+			return nil, err
+		}
+		header := &storepb.UploadHeader{Name: name, IfNotExists: ifNotExists}
+		stream.Send(&storepb.UploadRequest{Part: &storepb.UploadRequest_Header{Header: header}})
+		for _, chunk := range chunks {
+			stream.Send(&storepb.UploadRequest{Part: &storepb.UploadRequest_Chunk{Chunk: []byte(chunk)}})
+		}
+		return stream.CloseAndRecv()
+	}
+
+	t.Run("upload in chunks", func(t *testing.T) {
+		res, err := upload("logs/app.log", false, "first line\n", "second ", "line\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Created || res.File.Name != "logs/app.log" || res.File.Size != 23 {
+			t.Errorf("unexpected response %v", res)
+		}
+		data, _ := os.ReadFile(filepath.Join(storagePath, "logs", "app.log"))
+		if string(data) != "first line\nsecond line\n" {
+			t.Errorf("stored %q", data)
+		}
+		if _, err := upload("logs/app.log", true, "x"); status.Code(err) != codes.AlreadyExists {
+			t.Errorf("got %v for if_not_exists", err)
+		}
+		if _, err := upload("../escape", false, "x"); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v for invalid name", err)
+		}
+		if _, err := upload("big", false, strings.Repeat("x", 1<<20+1)); status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("got %v for too large upload", err)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		stream, err := client.Download(ctx, &storepb.DownloadRequest{Name: "logs/app.log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content strings.Builder
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			content.Write(res.Chunk)
+		}
+		if content.String() != "first line\nsecond line\n" {
+			t.Errorf("downloaded %q", content.String())
+		}
+
+		stream, _ = client.Download(ctx, &storepb.DownloadRequest{Name: "missing"})
+		if _, err := stream.Recv(); status.Code(err) != codes.NotFound {
+			t.Errorf("got %v for missing file", err)
+		}
+	})
+
+	t.Run("list and analytics", func(t *testing.T) {
+		list, err := client.List(ctx, &storepb.ListRequest{Prefix: "logs/"})
+		if err != nil || len(list.Files) != 1 || list.Files[0].Name != "logs/app.log" {
+			t.Fatalf("got %v, %v", list, err)
+		}
+		count, err := client.WordCount(ctx, &storepb.WordCountRequest{})
+		if err != nil || count.Count != 4 {
+			t.Errorf("got %v, %v", count, err)
+		}
+
+		grep, err := client.Grep(ctx, &storepb.GrepRequest{Pattern: "SECOND", IgnoreCase: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := make([]string, 0)
+		for {
+			line, err := grep.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line.Text)
+		}
+		if strings.Join(lines, ",") != "second line" {
+			t.Errorf("grep got %v", lines)
+		}
+
+		if _, err := client.Ngrams(ctx, &storepb.NgramsRequest{N: 9}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v for invalid n", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if _, err := client.Delete(ctx, &storepb.DeleteRequest{Name: "logs/app.log"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Delete(ctx, &storepb.DeleteRequest{Name: "logs/app.log"}); status.Code(err) != codes.NotFound {
+			t.Errorf("got %v on second delete", err)
+		}
+	})
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRunningJobs bounds how many analytics jobs scan the store at once; the
+	// rest wait in the queued state.
+	maxRunningJobs = 2
+	// maxPendingJobs bounds the jobs queued or running at once, and
+	// maxPendingJobsPerOwner those of one token, so submitting cannot grow
+	// the queue without limit.
+	maxPendingJobs         = 64
+	maxPendingJobsPerOwner = 8
+	// finishedJobRetention is how long results of finished jobs can be fetched.
+	finishedJobRetention = time.Hour
+	// maxFinishedJobs is how many finished jobs are kept within
+	// finishedJobRetention; the oldest are dropped first.
+	maxFinishedJobs = 1000
+)
+
+var (
+	errJobQueueFull = errors.New("too many jobs queued, try again later")
+	errTooManyJobs  = errors.New("too many of your jobs are queued or running, wait for one to finish")
+)
+
+// jobRunner does the actual work of a job kind. It must stop early once ctx is
+// done and should report progress as it goes.
+type jobRunner func(ctx context.Context, config ServerConfig, params url.Values, progress progressFunc) (any, error)
+
+// jobRunners are the job kinds. Searching runs as a grep job; there is no
+// search reindex kind, as grep scans the stored files on every request and the
+// store keeps no search index to rebuild.
+var jobRunners = map[string]jobRunner{
+	"wc": func(ctx context.Context, config ServerConfig, _ url.Values, progress progressFunc) (any, error) {
+		return wordCountOfAllFiles(ctx, config, progress)
+	},
+	"freq-words": func(ctx context.Context, config ServerConfig, _ url.Values, progress progressFunc) (any, error) {
+		return getFrequentWords(ctx, config, progress)
+	},
+	"ngrams": func(ctx context.Context, config ServerConfig, params url.Values, progress progressFunc) (any, error) {
+		opts, err := parseNgramsOptions(params)
+		if err != nil {
+			return nil, err
+		}
+		return getFrequentNgrams(ctx, config, opts, progress)
+	},
+	"freq-diff": func(ctx context.Context, config ServerConfig, params url.Values, progress progressFunc) (any, error) {
+		return runFreqDiff(ctx, config, params, progress)
+	},
+	"freq-snapshot": func(ctx context.Context, config ServerConfig, params url.Values, progress progressFunc) (any, error) {
+		return saveFreqSnapshot(ctx, config, params.Get("name"), progress)
+	},
+	"integrity-scan": func(ctx context.Context, config ServerConfig, _ url.Values, progress progressFunc) (any, error) {
+		return integrityScan(ctx, config, progress)
+	},
+	"grep": grepJob,
+}
+
+// writingJobKinds change the store, so they are only submitted by POST
+// requests, never by GET ones with async=true.
+var writingJobKinds = map[string]bool{"freq-snapshot": true}
+
+type job struct {
+	status common.JobStatus
+	cancel context.CancelFunc
+	// owner is the ID of the token that submitted the job. Only its owner and
+	// admins can see or cancel a job.
+	owner string
+}
+
+type jobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	running chan struct{}
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		jobs:    make(map[string]*job),
+		running: make(chan struct{}, maxRunningJobs),
+	}
+}
+
+func newJobID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// submit queues a job and returns its initial status right away. The job runs
+// in the background with its own context, independent of the request.
+func (m *jobManager) submit(config ServerConfig, kind string, params url.Values) (common.JobStatus, error) {
+	runner, ok := jobRunners[kind]
+	if !ok {
+		return common.JobStatus{}, fmt.Errorf("unknown job kind %q", kind)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status: common.JobStatus{
+			ID:        newJobID(),
+			Kind:      kind,
+			State:     common.JobQueued,
+			CreatedAt: time.Now().UTC(),
+		},
+		cancel: cancel,
+		owner:  config.access.id(),
+	}
+
+	m.mu.Lock()
+	m.removeExpiredLocked()
+	pending, pendingOfOwner := 0, 0
+	for _, other := range m.jobs {
+		if other.status.FinishedAt == nil {
+			pending++
+			if other.owner == j.owner {
+				pendingOfOwner++
+			}
+		}
+	}
+	if pending >= maxPendingJobs || pendingOfOwner >= maxPendingJobsPerOwner {
+		m.mu.Unlock()
+		cancel()
+		if pendingOfOwner >= maxPendingJobsPerOwner {
+			return common.JobStatus{}, errTooManyJobs
+		}
+		return common.JobStatus{}, errJobQueueFull
+	}
+	m.jobs[j.status.ID] = j
+	status := j.status
+	m.mu.Unlock()
+
+	log.Printf("job %s (%s) submitted", status.ID, kind)
+	go m.run(ctx, config, j, runner, params)
+	return status, nil
+}
+
+func (m *jobManager) run(ctx context.Context, config ServerConfig, j *job, runner jobRunner, params url.Values) {
+	defer j.cancel()
+	select {
+	case m.running <- struct{}{}:
+		defer func() { <-m.running }()
+	case <-ctx.Done():
+		m.finish(j, nil, ctx.Err())
+		return
+	}
+
+	m.update(j, func(status *common.JobStatus) {
+		now := time.Now().UTC()
+		status.State = common.JobRunning
+		status.StartedAt = &now
+	})
+	result, err := runner(ctx, config, params, func(done int, total int) {
+		m.update(j, func(status *common.JobStatus) {
+			status.Progress = common.JobProgress{Done: done, Total: total}
+		})
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	m.finish(j, result, err)
+}
+
+func (m *jobManager) update(j *job, change func(status *common.JobStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	change(&j.status)
+}
+
+func (m *jobManager) finish(j *job, result any, err error) {
+	var encoded json.RawMessage
+	if err == nil {
+		encoded, err = json.Marshal(result)
+	}
+	m.update(j, func(status *common.JobStatus) {
+		now := time.Now().UTC()
+		status.FinishedAt = &now
+		switch {
+		case errors.Is(err, context.Canceled):
+			status.State = common.JobCancelled
+		case err != nil:
+			status.State = common.JobFailed
+			status.ErrorMsg = err.Error()
+		default:
+			status.State = common.JobSucceeded
+			status.Result = encoded
+		}
+	})
+	log.Printf("job %s (%s) finished: %v", j.status.ID, j.status.Kind, err)
+}
+
+func (m *jobManager) get(id string, access *accessPolicy) (common.JobStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok || !access.owns(j.owner) {
+		return common.JobStatus{}, false
+	}
+	return j.status, true
+}
+
+// list returns the jobs visible with access, newest first, without their
+// results.
+func (m *jobManager) list(access *accessPolicy) []common.JobStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeExpiredLocked()
+	res := make([]common.JobStatus, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		if !access.owns(j.owner) {
+			continue
+		}
+		status := j.status
+		status.Result = nil
+		res = append(res, status)
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].CreatedAt.After(res[b].CreatedAt)
+	})
+	return res
+}
+
+// cancel stops a queued or running job. Finished jobs are left alone.
+func (m *jobManager) cancel(id string, access *accessPolicy) (common.JobStatus, bool) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok || !access.owns(j.owner) {
+		return common.JobStatus{}, false
+	}
+	j.cancel()
+	return m.get(id, access)
+}
+
+// removeExpiredLocked drops the finished jobs older than
+// finishedJobRetention, and the oldest beyond maxFinishedJobs.
+func (m *jobManager) removeExpiredLocked() {
+	finished := make([]*job, 0)
+	for id, j := range m.jobs {
+		if j.status.FinishedAt == nil {
+			continue
+		}
+		if time.Since(*j.status.FinishedAt) > finishedJobRetention {
+			delete(m.jobs, id)
+			continue
+		}
+		finished = append(finished, j)
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	slices.SortFunc(finished, func(a, b *job) int {
+		return a.status.FinishedAt.Compare(*b.status.FinishedAt)
+	})
+	for _, j := range finished[:len(finished)-maxFinishedJobs] {
+		delete(m.jobs, j.status.ID)
+	}
+}
+
+// handleSubmitJob accepts a common.JobRequest and answers 202 with the status
+// of the queued job.
+func handleSubmitJob(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleSubmitJob")
+	var reqBody common.JobRequest
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		log.Printf("handleSubmitJob err json Decoder: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	submitJob(config, w, r, strings.ToLower(reqBody.Kind), url.Values(reqBody.Params))
+}
+
+func submitJob(config ServerConfig, w http.ResponseWriter, r *http.Request, kind string, params url.Values) {
+	status, err := config.jobs.submit(config, kind, params)
+	if err != nil {
+		log.Printf("Error submitting job: %v", err)
+		code := http.StatusBadRequest
+		if errors.Is(err, errTooManyJobs) {
+			code = http.StatusTooManyRequests
+		} else if errors.Is(err, errJobQueueFull) {
+			code = http.StatusServiceUnavailable
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	location := "/jobs/" + status.ID
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		location = "/v1" + location
+	}
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// asyncJob tells whether an analytics request asks to run kind as a job.
+// Kinds that change the store are left to POST requests.
+func asyncJob(r *http.Request, kind string) bool {
+	if _, ok := jobRunners[kind]; !ok || r.Form.Get("async") != "true" {
+		return false
+	}
+	return r.Method == http.MethodPost || !writingJobKinds[kind]
+}
+
+func handleListJobs(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, common.JobList{Jobs: config.jobs.list(config.access)})
+}
+
+func handleGetJob(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	status, ok := config.jobs.get(r.PathValue("id"), config.access)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func handleCancelJob(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleCancelJob %s", r.PathValue("id"))
+	status, ok := config.jobs.cancel(r.PathValue("id"), config.access)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// integrityScan hashes every stored file, reporting files that cannot be read
+// and groups of files with identical content.
+func integrityScan(ctx context.Context, config ServerConfig, progress progressFunc) (*common.IntegrityScanResponse, error) {
+	log.Printf("In integrityScan")
+	list, err := getListOfFiles(config)
+	if err != nil {
+		return nil, err
+	}
+	res := common.IntegrityScanResponse{
+		UnreadableFiles: make([]common.FileNameErrorPair, 0),
+		DuplicateGroups: make([][]string, 0),
+	}
+	hashToFilesMap := make(map[string][]string)
+	for i, fileName := range list.Files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress.report(i, len(list.Files))
+		hash, err := hashStoredPath(config, config.filesStoragePath+"/"+fileName)
+		if err != nil {
+			res.UnreadableFiles = append(res.UnreadableFiles, common.FileNameErrorPair{
+				FileName: fileName,
+				ErrorMsg: err.Error(),
+			})
+			continue
+		}
+		res.FilesScanned++
+		hashToFilesMap[hash] = append(hashToFilesMap[hash], fileName)
+	}
+	progress.report(len(list.Files), len(list.Files))
+
+	for _, files := range hashToFilesMap {
+		if len(files) > 1 {
+			slices.Sort(files)
+			res.DuplicateGroups = append(res.DuplicateGroups, files)
+		}
+	}
+	slices.SortFunc(res.DuplicateGroups, func(a, b []string) int {
+		return strings.Compare(a[0], b[0])
+	})
+	return &res, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"file_store/common"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	storagePath := t.TempDir()
+	for name, content := range map[string]string{"a.txt": "one two three", "b.txt": "one two three", "c.txt": "four"} {
+		if err := os.WriteFile(filepath.Join(storagePath, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := BuildServer(ServerConfig{filesStoragePath: storagePath})
+
+	do := func(method string, target string, body []byte) (common.JobStatus, int) {
+		request, _ := http.NewRequest(method, target, bytes.NewReader(body))
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		var status common.JobStatus
+		_ = json.NewDecoder(response.Body).Decode(&status)
+		return status, response.Code
+	}
+	wait := func(id string) common.JobStatus {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			status, code := do(http.MethodGet, "/jobs/"+id, nil)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d for job %s", code, id)
+			}
+			if status.Finished() {
+				return status
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("job %s did not finish", id)
+		return common.JobStatus{}
+	}
+
+	t.Run("async action returns job with result", func(t *testing.T) {
+		status, code := do(http.MethodGet, "/files?action=wc&async=true", nil)
+		if code != http.StatusAccepted || status.ID == "" {
+			t.Fatalf("got status %d, job %+v", code, status)
+		}
+		status = wait(status.ID)
+		var res common.WordCountServerResponse
+		if err := json.Unmarshal(status.Result, &res); err != nil {
+			t.Fatal(err)
+		}
+		if status.State != common.JobSucceeded || res.Count != 7 || status.Progress.Done != 3 {
+			t.Errorf("unexpected job %+v with result %+v", status, res)
+		}
+	})
+
+	t.Run("integrity scan job", func(t *testing.T) {
+		status, code := do(http.MethodPost, "/jobs", []byte(`{"kind":"integrity-scan"}`))
+		if code != http.StatusAccepted {
+			t.Fatalf("got status %d", code)
+		}
+		status = wait(status.ID)
+		var res common.IntegrityScanResponse
+		if err := json.Unmarshal(status.Result, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.FilesScanned != 3 || len(res.DuplicateGroups) != 1 || res.DuplicateGroups[0][1] != "b.txt" {
+			t.Errorf("unexpected result %+v", res)
+		}
+	})
+
+	t.Run("grep job", func(t *testing.T) {
+		status, code := do(http.MethodGet, "/v1/analytics/grep?pattern=two&async=true", nil)
+		if code != http.StatusAccepted {
+			t.Fatalf("got status %d", code)
+		}
+		status = wait(status.ID)
+		var res common.GrepResult
+		if err := json.Unmarshal(status.Result, &res); err != nil {
+			t.Fatal(err)
+		}
+		if status.State != common.JobSucceeded || len(res.Lines) != 2 || res.Lines[0].FileName != "a.txt" || res.Truncated {
+			t.Errorf("unexpected job %+v with result %+v", status, res)
+		}
+		status, _ = do(http.MethodPost, "/jobs", []byte(`{"kind":"grep","params":{"pattern":["o"],"max":["1"]}}`))
+		status = wait(status.ID)
+		if err := json.Unmarshal(status.Result, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Lines) != 1 || !res.Truncated {
+			t.Errorf("unexpected result %+v", res)
+		}
+	})
+
+	t.Run("cancel running job", func(t *testing.T) {
+		started := make(chan struct{})
+		jobRunners["test-block"] = func(ctx context.Context, _ ServerConfig, _ url.Values, _ progressFunc) (any, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		defer delete(jobRunners, "test-block")
+
+		status, _ := do(http.MethodPost, "/jobs", []byte(`{"kind":"test-block"}`))
+		<-started
+		if _, code := do(http.MethodDelete, "/jobs/"+status.ID, nil); code != http.StatusAccepted {
+			t.Fatalf("got status %d on cancel", code)
+		}
+		if status = wait(status.ID); status.State != common.JobCancelled {
+			t.Errorf("unexpected job %+v", status)
+		}
+	})
+
+	t.Run("queue cap", func(t *testing.T) {
+		jobRunners["test-block"] = func(ctx context.Context, _ ServerConfig, _ url.Values, _ progressFunc) (any, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		defer delete(jobRunners, "test-block")
+
+		var ids []string
+		for range maxPendingJobsPerOwner {
+			status, code := do(http.MethodPost, "/jobs", []byte(`{"kind":"test-block"}`))
+			if code != http.StatusAccepted {
+				t.Fatalf("got status %d", code)
+			}
+			ids = append(ids, status.ID)
+		}
+		if _, code := do(http.MethodPost, "/jobs", []byte(`{"kind":"test-block"}`)); code != http.StatusTooManyRequests {
+			t.Errorf("got status %d over the cap", code)
+		}
+		for _, id := range ids {
+			do(http.MethodDelete, "/jobs/"+id, nil)
+			wait(id)
+		}
+		if status, code := do(http.MethodPost, "/jobs", []byte(`{"kind":"wc"}`)); code != http.StatusAccepted {
+			t.Errorf("got status %d once jobs finished", code)
+		} else {
+			wait(status.ID)
+		}
+	})
+
+	t.Run("GET does not submit writing jobs", func(t *testing.T) {
+		if _, code := do(http.MethodGet, "/files?action=freq-snapshot&async=true", nil); code != http.StatusBadRequest {
+			t.Errorf("got status %d", code)
+		}
+		status, code := do(http.MethodPost, "/files?action=freq-snapshot&async=true", nil)
+		if code != http.StatusAccepted {
+			t.Fatalf("got status %d on POST", code)
+		}
+		if status = wait(status.ID); status.State != common.JobSucceeded {
+			t.Errorf("unexpected job %+v", status)
+		}
+	})
+
+	t.Run("unknown jobs", func(t *testing.T) {
+		if _, code := do(http.MethodPost, "/jobs", []byte(`{"kind":"nope"}`)); code != http.StatusBadRequest {
+			t.Errorf("got status %d for unknown kind", code)
+		}
+		if _, code := do(http.MethodGet, "/jobs/missing", nil); code != http.StatusNotFound {
+			t.Errorf("got status %d for unknown job", code)
+		}
+	})
+}
+
+func TestJobManagerPrunesFinishedJobs(t *testing.T) {
+	m := newJobManager()
+	now := time.Now()
+	for i := range maxFinishedJobs + 5 {
+		finishedAt := now.Add(time.Duration(i) * time.Second)
+		id := fmt.Sprintf("job-%d", i)
+		m.jobs[id] = &job{status: common.JobStatus{ID: id, FinishedAt: &finishedAt}}
+	}
+	expired := now.Add(-2 * finishedJobRetention)
+	m.jobs["expired"] = &job{status: common.JobStatus{ID: "expired", FinishedAt: &expired}}
+	m.jobs["running"] = &job{status: common.JobStatus{ID: "running"}}
+
+	m.removeExpiredLocked()
+	if len(m.jobs) != maxFinishedJobs+1 {
+		t.Errorf("got %d jobs", len(m.jobs))
+	}
+	for _, id := range []string{"expired", "job-0", "job-4"} {
+		if _, ok := m.jobs[id]; ok {
+			t.Errorf("job %s was kept", id)
+		}
+	}
+	for _, id := range []string{"running", "job-5"} {
+		if _, ok := m.jobs[id]; !ok {
+			t.Errorf("job %s was dropped", id)
+		}
+	}
+}
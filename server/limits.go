@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultMaxFilesPerRequest caps the files of a multipart form, the
+	// operations of a batch and the names of a delete or hash match unless
+	// STORE_MAX_FILES_PER_REQUEST says otherwise.
+	defaultMaxFilesPerRequest = 1000
+	// maxIdleBuckets is how many clients the rate limiter tracks before it
+	// forgets those whose bucket has filled up again.
+	maxIdleBuckets = 10000
+	// authFailureRate and authFailureBurst limit the failed authentications
+	// of every client address, whatever the rate limits: after
+	// authFailureBurst failures it may fail once every 1/authFailureRate
+	// seconds, and is refused with 429 in between without its credentials
+	// being checked.
+	authFailureRate  = 0.2
+	authFailureBurst = 10
+)
+
+var (
+	errTooManyAuthFailures = errors.New("too many failed authentication attempts")
+	errTooManyFiles        = errors.New("too many files in one request")
+	errFileTooLarge        = errors.New("file too large")
+	errTooManyUploads      = errors.New("too many concurrent uploads, try again later")
+)
+
+// limitsFromEnv reads the limits of config from STORE_MAX_FILE_BYTES,
+// STORE_MAX_FILES_PER_REQUEST, STORE_MAX_CONCURRENT_UPLOADS, STORE_RATE_LIMIT
+// (requests per second) and STORE_RATE_BURST.
+func limitsFromEnv(config ServerConfig) ServerConfig {
+	if value := os.Getenv("STORE_MAX_FILE_BYTES"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid STORE_MAX_FILE_BYTES %q", value)
+		}
+		config.maxFileBytes = n
+	}
+	if value := os.Getenv("STORE_MAX_FILES_PER_REQUEST"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid STORE_MAX_FILES_PER_REQUEST %q", value)
+		}
+		config.maxFilesPerRequest = n
+	}
+	if value := os.Getenv("STORE_MAX_CONCURRENT_UPLOADS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid STORE_MAX_CONCURRENT_UPLOADS %q", value)
+		}
+		config.uploadSlots = make(chan struct{}, n)
+	}
+	var rate float64
+	var burst int
+	if value := os.Getenv("STORE_RATE_LIMIT"); value != "" {
+		var err error
+		if rate, err = strconv.ParseFloat(value, 64); err != nil || rate < 0 {
+			log.Fatalf("invalid STORE_RATE_LIMIT %q", value)
+		}
+	}
+	if value := os.Getenv("STORE_RATE_BURST"); value != "" {
+		var err error
+		if burst, err = strconv.Atoi(value); err != nil || burst < 1 {
+			log.Fatalf("invalid STORE_RATE_BURST %q", value)
+		}
+	}
+	config.rateLimits = newRateLimiter(rate, burst)
+	return config
+}
+
+// rateLimiter gives every client a token bucket holding up to burst requests
+// and refilled with rate requests per second. Clients are tokens, or remote
+// addresses for requests without one. A token with its own rate limit gets
+// that rate instead. A zero rate is unlimited.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: float64(max(burst, 1)), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a request from the bucket of key, or else tells how long until
+// the next one is available.
+func (l *rateLimiter) allow(key string, rate float64, now time.Time) (bool, time.Duration) {
+	return l.take(key, rate, now, true)
+}
+
+// wait tells how long until the bucket of key has a request left, 0 if it
+// has one now, without taking it.
+func (l *rateLimiter) wait(key string, now time.Time) time.Duration {
+	_, wait := l.take(key, 0, now, false)
+	return wait
+}
+
+func (l *rateLimiter) take(key string, rate float64, now time.Time, consume bool) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	if rate <= 0 {
+		rate = l.rate
+	}
+	if rate <= 0 {
+		return true, 0
+	}
+	burst := max(l.burst, math.Ceil(rate))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) > maxIdleBuckets {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if !ok && !consume {
+		return true, 0
+	} else if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	if consume {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// checkAuthFailures fails with errTooManyAuthFailures while the client at
+// remoteAddr has used up its failed authentications, telling how long to
+// wait.
+func checkAuthFailures(config ServerConfig, remoteAddr string) (time.Duration, error) {
+	key, _ := rateLimitKey(context.Background(), remoteAddr)
+	if wait := config.authFailures.wait(key, time.Now()); wait > 0 {
+		log.Printf("refusing %s after too many failed authentications", key)
+		return wait, errTooManyAuthFailures
+	}
+	return 0, nil
+}
+
+// recordAuthFailure counts a failed authentication of the client at
+// remoteAddr.
+func recordAuthFailure(config ServerConfig, remoteAddr string) {
+	key, _ := rateLimitKey(context.Background(), remoteAddr)
+	config.authFailures.allow(key, 0, time.Now())
+}
+
+// rateLimitKey returns the client of a request and its own rate limit.
+func rateLimitKey(ctx context.Context, remoteAddr string) (string, float64) {
+	if token, ok := callerToken(ctx); ok {
+		return "token:" + token.ID, token.RateLimit
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "addr:" + host, 0
+}
+
+// retryAfter is the Retry-After value for a wait, in whole seconds.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(wait.Seconds()))))
+}
+
+// withLimits answers 429 once the client of a request is over its rate
+// limit, and 413 for bodies larger than maxUploadBytes.
+func withLimits(config ServerConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, rate := rateLimitKey(r.Context(), r.RemoteAddr)
+		if ok, wait := config.rateLimits.allow(key, rate, time.Now()); !ok {
+			log.Printf("[%s] [%s] rate limited %s", r.Method, r.URL.Path, key)
+			w.Header().Set("Retry-After", retryAfter(wait))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		if r.ContentLength > config.maxUploadBytes {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, config.maxUploadBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func grpcRateLimit(config ServerConfig, ctx context.Context) error {
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	key, rate := rateLimitKey(ctx, addr)
+	if ok, wait := config.rateLimits.allow(key, rate, time.Now()); !ok {
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %ss", retryAfter(wait))
+	}
+	return nil
+}
+
+// rateLimitUnaryRPC and rateLimitStreamRPC apply the rate limits to gRPC
+// calls; they run after authentication, so calls count against their token.
+func rateLimitUnaryRPC(config ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := grpcRateLimit(config, ctx); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func rateLimitStreamRPC(config ServerConfig) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := grpcRateLimit(config, stream.Context()); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// acquireUploadSlot takes one of the uploadSlots for writing a file, failing
+// right away when all are taken. A nil uploadSlots is unlimited.
+func acquireUploadSlot(config ServerConfig) (release func(), err error) {
+	if config.uploadSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case config.uploadSlots <- struct{}{}:
+		return func() { <-config.uploadSlots }, nil
+	default:
+		return nil, errTooManyUploads
+	}
+}
+
+// checkFileCount tells whether a request naming n files is within
+// maxFilesPerRequest.
+func checkFileCount(config ServerConfig, n int) error {
+	if n > config.maxFilesPerRequest {
+		return fmt.Errorf("%w: %d, at most %d", errTooManyFiles, n, config.maxFilesPerRequest)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"file_store/common"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(2, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow("a", 0, now); !ok {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+	ok, wait := limiter.allow("a", 0, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("got %v, wait %v over the burst", ok, wait)
+	}
+	if ok, _ := limiter.allow("b", 0, now); !ok {
+		t.Errorf("another client was limited")
+	}
+	if ok, _ := limiter.allow("a", 0, now.Add(wait)); !ok {
+		t.Errorf("refused after waiting")
+	}
+	if ok, _ := newRateLimiter(0, 0).allow("a", 0, now); !ok {
+		t.Errorf("a zero rate limited")
+	}
+	unlimited := newRateLimiter(0, 0)
+	unlimited.allow("token", 1, now)
+	if ok, _ := unlimited.allow("token", 1, now); ok {
+		t.Errorf("the rate of a token was not applied")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	config := ServerConfig{filesStoragePath: t.TempDir(), maxFileBytes: 8, maxFilesPerRequest: 2}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	config.rateLimits = newRateLimiter(0, 0)
+	server := BuildServer(config)
+
+	do := func(request *http.Request, token string) *httptest.ResponseRecorder {
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	put := func(name string, body string) *httptest.ResponseRecorder {
+		return do(httptest.NewRequest(http.MethodPut, "/v1/files/"+name, strings.NewReader(body)), "root-secret")
+	}
+
+	t.Run("file size", func(t *testing.T) {
+		if response := put("small.txt", "12345678"); response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		if response := put("big.txt", "123456789"); response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("got %d above the file limit", response.Code)
+		}
+	})
+
+	t.Run("files per request", func(t *testing.T) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			part, _ := form.CreateFormFile(name, name)
+			part.Write([]byte("x"))
+		}
+		form.Close()
+		request := httptest.NewRequest(http.MethodPost, "/files", &body)
+		request.Header.Set("Content-Type", form.FormDataContentType())
+		if response := do(request, "root-secret"); response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("got %d uploading 3 files", response.Code)
+		}
+		if _, err := os.Stat(filepath.Join(config.filesStoragePath, "c.txt")); err == nil {
+			t.Errorf("stored the file over the limit")
+		}
+		data, _ := json.Marshal(common.BatchRequest{Operations: []common.BatchOperation{
+			{Op: common.BatchDelete, Path: "a"}, {Op: common.BatchDelete, Path: "b"}, {Op: common.BatchDelete, Path: "c"},
+		}})
+		if response := do(httptest.NewRequest(http.MethodPost, "/v1/batch", bytes.NewReader(data)), "root-secret"); response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("got %d for a batch of 3", response.Code)
+		}
+		hash := sha256.Sum256([]byte("12345678"))
+		data, _ = json.Marshal(common.TryWithSha256Request{FileSha256Pairs: []common.FileSha256Pair{
+			{FileName: "d.txt", FileHash: hex.EncodeToString(hash[:])},
+			{FileName: "e.txt", FileHash: hex.EncodeToString(hash[:])},
+			{FileName: "f.txt", FileHash: hex.EncodeToString(hash[:])},
+		}})
+		for _, target := range []string{"/files?action=try_with_sha256", "/v1/dedupe/match"} {
+			if response := do(httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data)), "root-secret"); response.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("got %d matching 3 files on %s", response.Code, target)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(config.filesStoragePath, "d.txt")); err == nil {
+			t.Errorf("copied a file over the limit")
+		}
+	})
+
+	t.Run("concurrent uploads", func(t *testing.T) {
+		config := config
+		config.uploadSlots = make(chan struct{}, 1)
+		config.uploadSlots <- struct{}{}
+		response := httptest.NewRecorder()
+		BuildServer(config).Handler.ServeHTTP(response, func() *http.Request {
+			request := httptest.NewRequest(http.MethodPut, "/v1/files/busy.txt", strings.NewReader("x"))
+			request.Header.Set("Authorization", "Bearer root-secret")
+			return request
+		}())
+		if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") == "" {
+			t.Errorf("got %d, Retry-After %q with no slot free", response.Code, response.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("failed authentications", func(t *testing.T) {
+		from := func(addr string) *http.Request {
+			request := httptest.NewRequest(http.MethodGet, "/v1/files", nil)
+			request.RemoteAddr = addr
+			return request
+		}
+		for i := 0; i < authFailureBurst; i++ {
+			if response := do(from("203.0.113.9:1234"), "guess"); response.Code != http.StatusUnauthorized {
+				t.Fatalf("got %d for failure %d", response.Code, i)
+			}
+		}
+		response := do(from("203.0.113.9:4321"), "root-secret")
+		if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "5" {
+			t.Errorf("got %d, Retry-After %q after %d failures", response.Code, response.Header().Get("Retry-After"), authFailureBurst)
+		}
+		if response := do(from("198.51.100.7:1234"), "root-secret"); response.Code != http.StatusOK {
+			t.Errorf("got %d from another address", response.Code)
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		body, _ := json.Marshal(common.TokenRequest{Name: "slow", RateLimit: 0.5})
+		var token common.APIToken
+		json.NewDecoder(do(httptest.NewRequest(http.MethodPost, "/v1/admin/tokens", bytes.NewReader(body)), "root-secret").Body).Decode(&token)
+		if token.RateLimit != 0.5 {
+			t.Fatalf("issued %+v", token)
+		}
+		if response := do(httptest.NewRequest(http.MethodGet, "/v1/files", nil), token.Token); response.Code != http.StatusOK {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		response := do(httptest.NewRequest(http.MethodGet, "/v1/files", nil), token.Token)
+		if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "2" {
+			t.Errorf("got %d, Retry-After %q over the rate of the token", response.Code, response.Header().Get("Retry-After"))
+		}
+		if response := do(httptest.NewRequest(http.MethodGet, "/v1/files", nil), "root-secret"); response.Code != http.StatusOK {
+			t.Errorf("got %d for another token", response.Code)
+		}
+		body, _ = json.Marshal(common.TokenRequest{Name: "bad", RateLimit: -1})
+		if response := do(httptest.NewRequest(http.MethodPost, "/v1/admin/tokens", bytes.NewReader(body)), "root-secret"); response.Code != http.StatusBadRequest {
+			t.Errorf("got %d for a negative rate limit", response.Code)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	metadataFileName      = "metadata.json"
+	maxMetadataKeys       = 64
+	maxMetadataKeyBytes   = 128
+	maxMetadataValueBytes = 1024
+)
+
+var errInvalidMetadata = errors.New("invalid metadata")
+
+// metadataStore keeps the user metadata of stored files in
+// metaPath/metadata.json. The storage functions move, copy and drop it along
+// with the files.
+type metadataStore struct {
+	mu    sync.Mutex
+	path  string
+	files map[string]map[string]string
+}
+
+func newMetadataStore(metaPath string) *metadataStore {
+	s := &metadataStore{path: filepath.Join(metaPath, metadataFileName), files: make(map[string]map[string]string)}
+	if err := readJSONFile(s.path, &s.files); err != nil {
+		log.Printf("newMetadataStore err: %v", err)
+	}
+	return s
+}
+
+// get returns a copy of the metadata of name, empty if it has none. A nil
+// store has no metadata, so the storage functions work without one.
+func (s *metadataStore) get(name string) map[string]string {
+	if s == nil {
+		return map[string]string{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata := maps.Clone(s.files[path.Clean(name)])
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	return metadata
+}
+
+// update applies changes to the metadata of name and returns the result.
+func (s *metadataStore) update(name string, changes map[string]*string) (map[string]string, error) {
+	if s == nil {
+		return nil, fmt.Errorf("%w: no metadata store", errInvalidMetadata)
+	}
+	name = path.Clean(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata := maps.Clone(s.files[name])
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(metadata, key)
+			continue
+		}
+		if key == "" || len(key) > maxMetadataKeyBytes || len(*value) > maxMetadataValueBytes {
+			return nil, fmt.Errorf("%w: keys must have 1 to %d bytes and values at most %d",
+				errInvalidMetadata, maxMetadataKeyBytes, maxMetadataValueBytes)
+		}
+		metadata[key] = *value
+	}
+	if len(metadata) > maxMetadataKeys {
+		return nil, fmt.Errorf("%w: more than %d keys", errInvalidMetadata, maxMetadataKeys)
+	}
+	if err := s.setLocked(name, metadata); err != nil {
+		return nil, err
+	}
+	return maps.Clone(metadata), nil
+}
+
+// replace sets the metadata of name to metadata, dropping it when empty.
+func (s *metadataStore) replace(name string, metadata map[string]string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setLocked(path.Clean(name), maps.Clone(metadata))
+}
+
+// rename moves the metadata of from to to, replacing that of to.
+func (s *metadataStore) rename(from string, to string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, to = path.Clean(from), path.Clean(to)
+	metadata := s.files[from]
+	if _, ok := s.files[to]; !ok && metadata == nil {
+		return nil
+	}
+	delete(s.files, from)
+	return s.setLocked(to, metadata)
+}
+
+func (s *metadataStore) setLocked(name string, metadata map[string]string) error {
+	_, had := s.files[name]
+	if len(metadata) == 0 {
+		if !had {
+			return nil
+		}
+		delete(s.files, name)
+	} else {
+		s.files[name] = metadata
+	}
+	return writeJSONFile(s.path, s.files)
+}
+
+func handleGetMetadata(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	log.Printf("In handleGetMetadata %s", name)
+	if _, err := statStoredFile(config, name); err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, common.FileMetadata{Name: path.Clean(name), Metadata: config.metadata.get(name)})
+}
+
+// handleUpdateMetadata merges the keys of a common.MetadataUpdate into the
+// metadata of a file.
+func handleUpdateMetadata(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("path")
+	log.Printf("In handleUpdateMetadata %s", name)
+	var update common.MetadataUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	metadata, err := updateStoredMetadata(config, name, update.Metadata)
+	if err != nil {
+		log.Printf("Error in handleUpdateMetadata: %v", err)
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, common.FileMetadata{Name: path.Clean(name), Metadata: metadata})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"file_store/common"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	ngramsDefaultN   = 2
+	ngramsMaxN       = 5
+	ngramsDefaultTop = 10
+)
+
+type ngramsOptions struct {
+	n        int
+	top      int
+	minCount int
+	sortBy   string
+	files    []string
+}
+
+func handleNgramsAction(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleNgramsAction")
+	opts, err := parseNgramsOptions(r.Form)
+	if err != nil {
+		log.Printf("Error in handleNgramsAction: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res, err := getFrequentNgrams(r.Context(), config, opts, nil)
+	if err != nil {
+		log.Printf("Error in handleNgramsAction: %v", err)
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func parseNgramsOptions(form url.Values) (ngramsOptions, error) {
+	opts := ngramsOptions{
+		n:      ngramsDefaultN,
+		top:    ngramsDefaultTop,
+		sortBy: strings.ToLower(form.Get("sort")),
+		files:  form["file"],
+	}
+	intParams := []struct {
+		name string
+		dst  *int
+		min  int
+		max  int
+	}{
+		{"n", &opts.n, 1, ngramsMaxN},
+		{"top", &opts.top, 1, math.MaxInt},
+		{"min_count", &opts.minCount, 0, math.MaxInt},
+	}
+	for _, param := range intParams {
+		if !form.Has(param.name) {
+			continue
+		}
+		value, err := strconv.Atoi(form.Get(param.name))
+		if err != nil || value < param.min || value > param.max {
+			return opts, fmt.Errorf("invalid value for %s: %q", param.name, form.Get(param.name))
+		}
+		*param.dst = value
+	}
+	switch opts.sortBy {
+	case "", "count":
+		opts.sortBy = "count"
+	case "pmi":
+		if opts.n < 2 {
+			return opts, fmt.Errorf("sort=pmi needs n of at least 2")
+		}
+		if !form.Has("min_count") {
+			// PMI heavily favours n-grams seen once, which are rarely real collocations.
+			opts.minCount = 2
+		}
+	default:
+		return opts, fmt.Errorf("unknown sort %q", opts.sortBy)
+	}
+	for i, fileName := range opts.files {
+		cleaned, err := validateFilePath(fileName)
+		if err != nil {
+			return opts, err
+		}
+		opts.files[i] = cleaned
+	}
+	return opts, nil
+}
+
+// getFrequentNgrams counts n-grams with the same tokenizer as getFrequentWords.
+// N-grams never span two files or two members of an archive. Each pair also carries its pointwise mutual
+// information score, which ranks collocations when sorting by "pmi".
+func getFrequentNgrams(
+	ctx context.Context, config ServerConfig, opts ngramsOptions, progress progressFunc,
+) (*common.NgramCountServerResponse, error) {
+	log.Printf("In getFrequentNgrams n=%d top=%d sort=%s", opts.n, opts.top, opts.sortBy)
+	files := opts.files
+	if len(files) == 0 {
+		list, err := getListOfFiles(config)
+		if err != nil {
+			return nil, err
+		}
+		files = list.Files
+	}
+
+	ngramToCountMap := make(map[string]int)
+	wordToCountMap := make(map[string]int)
+	allNotes := make([]common.FileNote, 0)
+	totalWords := 0
+	totalNgrams := 0
+	for i, fileName := range files {
+		progress.report(i, len(files))
+		path, err := readableFilePath(config, fileName)
+		if err != nil {
+			return nil, err
+		}
+		notes, err := extractText(ctx, config.encryption, path, fileName, func(source string, r io.Reader) error {
+			window := make([]string, 0, opts.n)
+			return scanWords(r, func(word string) {
+				wordToCountMap[word]++
+				totalWords++
+				if len(window) == opts.n {
+					window = append(window[:0], window[1:]...)
+				}
+				window = append(window, word)
+				if len(window) == opts.n {
+					ngramToCountMap[strings.Join(window, " ")]++
+					totalNgrams++
+				}
+			})
+		})
+		if err != nil {
+			log.Printf("Error in getFrequentNgrams for %s: %v", fileName, err)
+			return nil, err
+		}
+		allNotes = append(allNotes, notes...)
+	}
+	progress.report(len(files), len(files))
+
+	pairs := make([]common.NgramCountPair, 0)
+	for ngram, count := range ngramToCountMap {
+		if count < opts.minCount {
+			continue
+		}
+		words := strings.Split(ngram, " ")
+		pair := common.NgramCountPair{Ngram: ngram, Words: words, Count: count}
+		if opts.n > 1 {
+			pair.Score = pointwiseMutualInformation(count, totalNgrams, words, wordToCountMap, totalWords)
+		}
+		pairs = append(pairs, pair)
+	}
+	slices.SortFunc(pairs, func(a, b common.NgramCountPair) int {
+		if opts.sortBy == "pmi" && a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Ngram, b.Ngram)
+	})
+	if len(pairs) > opts.top {
+		pairs = pairs[:opts.top]
+	}
+	return &common.NgramCountServerResponse{N: opts.n, NgramCountPairs: pairs, Notes: allNotes}, nil
+}
+
+func pointwiseMutualInformation(
+	count int, totalNgrams int, words []string, wordToCountMap map[string]int, totalWords int,
+) float64 {
+	score := math.Log2(float64(count) / float64(totalNgrams))
+	for _, word := range words {
+		score -= math.Log2(float64(wordToCountMap[word]) / float64(totalWords))
+	}
+	return math.Round(score*1000) / 1000
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNgramsAction(t *testing.T) {
+	storagePath := t.TempDir()
+	files := map[string]string{
+		"a.txt": "new york is big and new york is busy",
+		"b.txt": "york new",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(storagePath, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := BuildServer(ServerConfig{filesStoragePath: storagePath})
+
+	get := func(query string) (*common.NgramCountServerResponse, int) {
+		request, _ := http.NewRequest(http.MethodGet, "/files?action=ngrams&"+query, nil)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		if response.Code != http.StatusOK {
+			return nil, response.Code
+		}
+		var res common.NgramCountServerResponse
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return &res, response.Code
+	}
+
+	t.Run("bigrams across the store", func(t *testing.T) {
+		res, _ := get("n=2&top=2")
+		if len(res.NgramCountPairs) != 2 {
+			t.Fatalf("unexpected pairs %+v", res.NgramCountPairs)
+		}
+		top := res.NgramCountPairs[0]
+		if top.Count != 2 || (top.Ngram != "new york" && top.Ngram != "york is") {
+			t.Errorf("unexpected top bigram %+v", top)
+		}
+	})
+
+	t.Run("ngrams do not span files", func(t *testing.T) {
+		res, _ := get("n=2&top=100&file=b.txt")
+		if len(res.NgramCountPairs) != 1 || res.NgramCountPairs[0].Ngram != "york new" {
+			t.Errorf("unexpected pairs %+v", res.NgramCountPairs)
+		}
+	})
+
+	t.Run("trigrams", func(t *testing.T) {
+		res, _ := get("n=3&top=1")
+		if res.NgramCountPairs[0].Ngram != "new york is" || res.NgramCountPairs[0].Count != 2 {
+			t.Errorf("unexpected pairs %+v", res.NgramCountPairs)
+		}
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"n=0", "n=9", "top=x", "sort=pmi&n=1", "sort=other", "file=../a.txt"} {
+			if _, code := get(query); code != http.StatusBadRequest {
+				t.Errorf("%s: got status %d", query, code)
+			}
+		}
+	})
+}
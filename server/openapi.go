@@ -0,0 +1,256 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiRoute is one operation of the /v1 API together with what the OpenAPI
+// document says about it. Path parameters are taken from the pattern.
+type apiRoute struct {
+	method    string
+	path      string
+	id        string
+	summary   string
+	handler   func(config ServerConfig, w http.ResponseWriter, r *http.Request)
+	params    []apiParam
+	body      *apiBody
+	responses []apiResponse
+	// public routes are served without a token.
+	public bool
+}
+
+type apiParam struct {
+	name string
+	// in is "query" unless set.
+	in          string
+	description string
+	// schema is "string" unless set.
+	schema   string
+	required bool
+	repeated bool
+}
+
+// apiBody is a request or response body. schema is a value of the Go type the
+// body encodes, or nil for raw content.
+type apiBody struct {
+	contentType string
+	schema      any
+}
+
+type apiResponse struct {
+	status int
+	// description defaults to the status text.
+	description string
+	body        *apiBody
+}
+
+func jsonBody(schema any) *apiBody {
+	return &apiBody{contentType: "application/json", schema: schema}
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildOpenAPI(v1Routes))
+}
+
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
+
+// buildOpenAPI describes routes as an OpenAPI 3 document. Schemas of the
+// request and response bodies are derived from the common types by
+// reflection, following their json tags.
+func buildOpenAPI(routes []apiRoute) map[string]any {
+	schemas := &schemaBuilder{components: make(map[string]any)}
+	errorSchema := schemas.schema(reflect.TypeOf(common.ErrorResponse{}))
+	paths := make(map[string]any)
+	for _, route := range routes {
+		path := strings.ReplaceAll(route.path, "...}", "}")
+		operation := map[string]any{
+			"operationId": route.id,
+			"summary":     route.summary,
+		}
+
+		params := make([]any, 0)
+		for _, segment := range strings.Split(path, "/") {
+			if name, ok := strings.CutPrefix(segment, "{"); ok {
+				params = append(params, map[string]any{
+					"name": strings.TrimSuffix(name, "}"), "in": "path", "required": true,
+					"schema": map[string]any{"type": "string"},
+				})
+			}
+		}
+		for _, param := range route.params {
+			in, schemaType := param.in, param.schema
+			if in == "" {
+				in = "query"
+			}
+			if schemaType == "" {
+				schemaType = "string"
+			}
+			schema := map[string]any{"type": schemaType}
+			if param.repeated {
+				schema = map[string]any{"type": "array", "items": schema}
+			}
+			params = append(params, map[string]any{
+				"name": param.name, "in": in, "required": param.required,
+				"description": param.description, "schema": schema,
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if route.public {
+			operation["security"] = []any{}
+		}
+		if route.body != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  schemas.content(route.body),
+			}
+		}
+
+		responses := map[string]any{
+			"default": map[string]any{
+				"description": "error",
+				"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+			},
+		}
+		for _, response := range route.responses {
+			description := response.description
+			if description == "" {
+				description = http.StatusText(response.status)
+			}
+			res := map[string]any{"description": description}
+			if response.body != nil {
+				res["content"] = schemas.content(response.body)
+			} else if response.status >= 400 {
+				res["content"] = map[string]any{"application/json": map[string]any{"schema": errorSchema}}
+			}
+			responses[strconv.Itoa(response.status)] = res
+		}
+		operation["responses"] = responses
+
+		methods, ok := paths[path].(map[string]any)
+		if !ok {
+			methods = make(map[string]any)
+			paths[path] = methods
+		}
+		methods[strings.ToLower(route.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "File store",
+			"version": "1",
+			"description": "Versioned API of the file store. Every error answers with an ErrorResponse. " +
+				"Requests need an API token as bearer token unless the server runs with STORE_AUTH=off; " +
+				"share links under /v1/shared are signed instead. " +
+				"The older /files and /jobs routes are kept for existing clients and are not described here.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string]any{"bearerAuth": []any{}}},
+	}
+}
+
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func (b *schemaBuilder) content(body *apiBody) map[string]any {
+	schema := map[string]any{"type": "string", "format": "binary"}
+	if body.schema != nil {
+		schema = b.schema(reflect.TypeOf(body.schema))
+	}
+	return map[string]any{body.contentType: map[string]any{"schema": schema}}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of t. Named structs become components and are
+// referenced.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.components[t.Name()]; !ok {
+			// Claim the name first so recursive types terminate.
+			b.components[t.Name()] = nil
+			properties := make(map[string]any)
+			required := make([]string, 0)
+			b.addFields(t, properties, &required)
+			component := map[string]any{"type": "object", "properties": properties}
+			if len(required) > 0 {
+				component["required"] = required
+			}
+			b.components[t.Name()] = component
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// addFields adds the json fields of struct t, including those of embedded
+// structs, to properties.
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(field.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var updateOpenAPI = flag.Bool("update", false, "rewrite api/openapi.json from the routes")
+
+const openAPIPath = "../api/openapi.json"
+
+// TestOpenAPIUpToDate fails when the routes or the common types changed without
+// regenerating the committed document with
+//
+//	go test ./server -run TestOpenAPIUpToDate -update
+func TestOpenAPIUpToDate(t *testing.T) {
+	got, err := json.MarshalIndent(buildOpenAPI(v1Routes), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *updateOpenAPI {
+		if err := os.WriteFile(openAPIPath, got, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(openAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s is out of date, run: go test ./server -run TestOpenAPIUpToDate -update", openAPIPath)
+	}
+}
+
+// TestOpenAPIMatchesMux checks every documented operation reaches a handler of
+// the running server.
+func TestOpenAPIMatchesMux(t *testing.T) {
+	server := BuildServer(ServerConfig{filesStoragePath: t.TempDir()})
+	mux := server.Handler
+
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var doc struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+		} `json:"paths"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Paths) == 0 {
+		t.Fatal("no paths in the served document")
+	}
+
+	// A cancelled context ends streams such as /v1/events right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	operations := 0
+	for path, methods := range doc.Paths {
+		target := strings.NewReplacer("{path}", "a/b.txt", "{id}", "unknown").Replace(path)
+		for method := range methods {
+			operations++
+			response := httptest.NewRecorder()
+			request := httptest.NewRequest(strings.ToUpper(method), target, http.NoBody).WithContext(ctx)
+			mux.ServeHTTP(response, request)
+			if response.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: not routed", method, path)
+			}
+			var errResp struct {
+				Message string `json:"message"`
+			}
+			_ = json.NewDecoder(response.Body).Decode(&errResp)
+			if response.Code == http.StatusNotFound && errResp.Message == "404 page not found" {
+				t.Errorf("%s %s: not routed", method, path)
+			}
+		}
+	}
+	if operations != len(v1Routes) {
+		t.Errorf("served %d operations, want %d", operations, len(v1Routes))
+	}
+
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "/openapi.json") {
+		t.Errorf("got %d for /docs", response.Code)
+	}
+}
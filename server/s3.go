@@ -0,0 +1,780 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultS3Addr is where the S3 compatible API listens unless STORE_S3_ADDR
+	// says otherwise; STORE_S3_ADDR=off disables it.
+	defaultS3Addr  = ":9000"
+	s3XMLNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat   = "2006-01-02T15:04:05.000Z"
+	// s3MaxListKeys is the default and the largest page of ListObjectsV2.
+	s3MaxListKeys = 1000
+	s3MaxParts    = 10000
+	// s3MaxXMLBody limits the XML bodies of DeleteObjects and
+	// CompleteMultipartUpload.
+	s3MaxXMLBody = 4 << 20
+	// s3UploadsDirName holds multipart uploads in progress under metaPath.
+	s3UploadsDirName = "s3-uploads"
+	// s3UploadExpiry is how long a multipart upload that is neither completed
+	// nor aborted is kept after its last part.
+	s3UploadExpiry = 7 * 24 * time.Hour
+)
+
+// The S3 compatible API maps a bucket to a top-level directory of the store
+// and an object key to the path below it, so "s3://reports/2024/q1.txt" is the
+// stored file "reports/2024/q1.txt". Keys follow the same rules as other
+// stored paths. Like any directory of the store, a bucket exists while it
+// holds files: every valid bucket name can be written to.
+
+// s3Server serves the S3 API over the storage layer. ETags are the MD5 of the
+// content, or for multipart uploads what S3 would return, and are cached by
+// size and modification time until the file is deleted or renamed.
+type s3Server struct {
+	config ServerConfig
+	etags  sync.Map // stored name -> s3ETag
+}
+
+type s3ETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// s3Error is an S3 error response.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+// BuildS3Server is the S3 counterpart of BuildServer. Requests must be signed
+// with the configured s3AccessKey and s3SecretKey.
+func BuildS3Server(config ServerConfig) http.Server {
+	config = config.withDefaults()
+	s := &s3Server{config: config}
+	s.removeStaleUploads(time.Now())
+	if config.events != nil {
+		ch, _, _ := config.events.subscribe()
+		go s.watchEvents(ch)
+	}
+	return http.Server{
+		Addr:    defaultS3Addr,
+		Handler: withRequestID(withAudit(config.audit, "s3", Log(s.serveHTTP))),
+	}
+}
+
+func serveS3(config ServerConfig, addr string) {
+	server := BuildS3Server(config)
+	server.Addr = addr
+	log.Printf("S3 API listening on %s", addr)
+	if config.tls != nil {
+		server.TLSConfig = config.tls.serverConfig()
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+func writeS3XML(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("writeS3XML err: %v", err)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err *s3Error) {
+	log.Printf("S3 error: %s %s: %v", r.Method, r.URL.Path, err)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(err.status)
+		return
+	}
+	writeS3XML(w, err.status, s3ErrorResponse{
+		Code:      err.code,
+		Message:   err.message,
+		Resource:  r.URL.Path,
+		RequestId: w.Header().Get(requestIDHeader),
+	})
+}
+
+// s3StorageError maps errors of the storage layer to S3 errors.
+func s3StorageError(err error) *s3Error {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errInvalidFileName), errors.Is(err, errStoredFileExists), errors.Is(err, errFileInfected):
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", err.Error()}
+	case errors.Is(err, errStoredFileNotFound):
+		return &s3Error{http.StatusNotFound, "NoSuchKey", err.Error()}
+	case errors.As(err, &maxBytesErr):
+		return &s3Error{http.StatusBadRequest, "EntityTooLarge", "object is larger than the upload limit"}
+	case errors.Is(err, errFileTooLarge):
+		return &s3Error{http.StatusBadRequest, "EntityTooLarge", err.Error()}
+	case errors.Is(err, errTooManyUploads):
+		return errS3SlowDown
+	case errors.Is(err, errScanFailed):
+		return &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", err.Error()}
+	case errors.Is(err, errS3PayloadMismatch):
+		return &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error()}
+	default:
+		return &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+}
+
+var errS3NoSuchBucket = &s3Error{http.StatusNotFound, "NoSuchBucket", "the bucket does not exist"}
+
+var errS3NotImplemented = &s3Error{http.StatusNotImplemented, "NotImplemented", "this operation is not supported"}
+
+// errS3SlowDown is how S3 asks clients to back off; SDKs retry it.
+var errS3SlowDown = &s3Error{http.StatusServiceUnavailable, "SlowDown", "please reduce your request rate"}
+
+func (s *s3Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Amz-Request-Id", w.Header().Get(requestIDHeader))
+	key, _ := rateLimitKey(r.Context(), r.RemoteAddr)
+	if ok, wait := s.config.rateLimits.allow(key, 0, time.Now()); !ok {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		writeS3Error(w, r, errS3SlowDown)
+		return
+	}
+	if wait, err := checkAuthFailures(s.config, r.RemoteAddr); err != nil {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		writeS3Error(w, r, errS3SlowDown)
+		return
+	}
+	if err := verifySigV4(s.config, r, time.Now()); err != nil {
+		recordAuthFailure(s.config, r.RemoteAddr)
+		writeS3Error(w, r, err)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	entry := auditEntryFrom(r.Context())
+	entry.setCaller(common.APIToken{ID: "s3", Name: s.config.s3AccessKey})
+	if key != "" {
+		entry.addFile(bucket + "/" + key)
+	}
+	query := r.URL.Query()
+	var err *s3Error
+	switch {
+	case bucket == "":
+		err = errS3NotImplemented
+		if r.Method == http.MethodGet {
+			err = s.listBuckets(w)
+		}
+	case key == "":
+		if _, validErr := validateFilePath(bucket); validErr != nil {
+			err = &s3Error{http.StatusBadRequest, "InvalidBucketName", validErr.Error()}
+			break
+		}
+		err = s.serveBucket(w, r, bucket, query)
+	default:
+		name := bucket + "/" + key
+		if cleaned, validErr := validateFilePath(name); validErr != nil || cleaned != name {
+			err = &s3Error{http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("invalid key %q", key)}
+			break
+		}
+		err = s.serveObject(w, r, bucket, key, query)
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+	}
+}
+
+func (s *s3Server) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) *s3Error {
+	switch {
+	case r.Method == http.MethodGet && query.Has("location"):
+		writeS3XML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			XMLNS   string   `xml:"xmlns,attr"`
+		}{XMLNS: s3XMLNamespace})
+		return nil
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		return s.listObjectsV2(w, bucket, query)
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case r.Method == http.MethodPut && len(query) == 0:
+		if err := os.Mkdir(filepath.Join(s.config.filesStoragePath, bucket), 0777); err != nil && !errors.Is(err, fs.ErrExist) {
+			return s3StorageError(err)
+		}
+		w.Header().Set("Location", "/"+bucket)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case r.Method == http.MethodDelete && len(query) == 0:
+		// Only a directory is a bucket; a top-level file of the same name is
+		// left alone. Remove fails on directories still holding anything,
+		// including hidden entries such as uploads in progress.
+		dir := filepath.Join(s.config.filesStoragePath, bucket)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return errS3NoSuchBucket
+		}
+		if err := os.Remove(dir); errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			return &s3Error{http.StatusConflict, "BucketNotEmpty", "the bucket still holds files"}
+		} else if err != nil {
+			return s3StorageError(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case r.Method == http.MethodPost && query.Has("delete"):
+		return s.deleteObjects(w, r, bucket)
+	}
+	return errS3NotImplemented
+}
+
+func (s *s3Server) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) *s3Error {
+	name := bucket + "/" + key
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if query.Has("uploadId") {
+			return errS3NotImplemented
+		}
+		return s.getObject(w, r, name)
+	case http.MethodPut:
+		if query.Has("uploadId") {
+			return s.uploadPart(w, r, name, query)
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s.copyObject(w, r, name)
+		}
+		return s.putObject(w, r, name)
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			return s.abortMultipartUpload(w, name, query.Get("uploadId"))
+		}
+		if err := deleteStoredFile(s.config, name); err != nil && !errors.Is(err, errStoredFileNotFound) {
+			return s3StorageError(err)
+		}
+		s.etags.Delete(name)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodPost:
+		if query.Has("uploads") {
+			return s.createMultipartUpload(w, bucket, key)
+		}
+		if query.Has("uploadId") {
+			return s.completeMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+		}
+	}
+	return errS3NotImplemented
+}
+
+// etag returns the ETag of a stored file, computing its MD5 unless it is
+// cached for the file's current size and modification time.
+func (s *s3Server) etag(name string, info os.FileInfo) (string, error) {
+	if cached, ok := s.etags.Load(name); ok {
+		c := cached.(s3ETag)
+		if c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+			return c.etag, nil
+		}
+	}
+	file, _, err := openStoredFile(s.config, name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+	s.etags.Store(name, s3ETag{size: info.Size(), modTime: info.ModTime(), etag: etag})
+	return etag, nil
+}
+
+// watchEvents drops the cached ETags of files deleted or renamed through any
+// API. Falling behind the events drops the whole cache.
+func (s *s3Server) watchEvents(ch chan common.FileEvent) {
+	for {
+		event, ok := <-ch
+		if !ok {
+			s.etags.Clear()
+			ch, _, _ = s.config.events.subscribe()
+			continue
+		}
+		if event.Tenant != "" {
+			continue
+		}
+		switch event.Type {
+		case common.FileDeleted:
+			s.etags.Delete(event.Name)
+		case common.FileRenamed:
+			s.etags.Delete(event.OldName)
+			s.etags.Delete(event.Name)
+		}
+	}
+}
+
+// storeETag caches the ETag of a file that was just written.
+func (s *s3Server) storeETag(name string, etag string) (os.FileInfo, error) {
+	info, err := statStoredFile(s.config, name)
+	if err != nil {
+		return nil, err
+	}
+	s.etags.Store(name, s3ETag{size: info.Size(), modTime: info.ModTime(), etag: etag})
+	return info, nil
+}
+
+func (s *s3Server) listBuckets(w http.ResponseWriter) *s3Error {
+	entries, err := os.ReadDir(s.config.filesStoragePath)
+	if err != nil {
+		return s3StorageError(err)
+	}
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	res := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{XMLNS: s3XMLNamespace}
+	res.Owner.ID, res.Owner.DisplayName = "file-store", "file-store"
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		res.Buckets = append(res.Buckets, bucket{Name: entry.Name(), CreationDate: info.ModTime().UTC().Format(s3TimeFormat)})
+	}
+	writeS3XML(w, http.StatusOK, res)
+	return nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+func (s *s3Server) listObjectsV2(w http.ResponseWriter, bucket string, query url.Values) *s3Error {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := s3MaxListKeys
+	if query.Has("max-keys") {
+		n, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || n < 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid max-keys"}
+		}
+		maxKeys = min(n, s3MaxListKeys)
+	}
+	// Continue after the later of start-after and the continuation token,
+	// which is the last key or common prefix of the previous page.
+	marker := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid continuation-token"}
+		}
+		marker = max(marker, string(decoded))
+	}
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = func(s string) string { return s3URIEncode(s, true) }
+	}
+
+	files, err := listStoredFiles(s.config, bucket+"/"+prefix)
+	if err != nil {
+		return s3StorageError(err)
+	}
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		XMLNS                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		EncodingType          string `xml:",omitempty"`
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		Contents              []s3Object
+		CommonPrefixes        []s3CommonPrefix
+	}{
+		XMLNS:             s3XMLNamespace,
+		Name:              bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		StartAfter:        encode(query.Get("start-after")),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType:      query.Get("encoding-type"),
+		MaxKeys:           maxKeys,
+	}
+	last := ""
+	for _, file := range files {
+		key := strings.TrimPrefix(file.Name, bucket+"/")
+		entry := key
+		if i := strings.Index(strings.TrimPrefix(key, prefix), delimiter); delimiter != "" && i >= 0 {
+			entry = key[:len(prefix)+i+len(delimiter)]
+		}
+		if entry <= marker || entry == last {
+			continue
+		}
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+			break
+		}
+		last = entry
+		res.KeyCount++
+		if entry != key {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry)})
+			continue
+		}
+		info, err := statStoredFile(s.config, file.Name)
+		if err != nil {
+			// Deleted since it was listed.
+			continue
+		}
+		etag, err := s.etag(file.Name, info)
+		if err != nil {
+			return s3StorageError(err)
+		}
+		res.Contents = append(res.Contents, s3Object{
+			Key:          encode(key),
+			LastModified: file.ModTime.Format(s3TimeFormat),
+			ETag:         etag,
+			Size:         file.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	writeS3XML(w, http.StatusOK, res)
+	return nil
+}
+
+func (s *s3Server) getObject(w http.ResponseWriter, r *http.Request, name string) *s3Error {
+	file, info, err := openStoredFile(s.config, name)
+	if err != nil {
+		return s3StorageError(err)
+	}
+	defer file.Close()
+	etag, err := s.etag(name, info)
+	if err != nil {
+		return s3StorageError(err)
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), file)
+	return nil
+}
+
+// limitBody applies the upload limit to an object or part body.
+func (s *s3Server) limitBody(w http.ResponseWriter, r *http.Request) *s3Error {
+	if r.ContentLength > s.config.maxUploadBytes {
+		return &s3Error{http.StatusBadRequest, "EntityTooLarge", "object is larger than the upload limit"}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.maxUploadBytes)
+	return nil
+}
+
+func (s *s3Server) putObject(w http.ResponseWriter, r *http.Request, name string) *s3Error {
+	if err := s.limitBody(w, r); err != nil {
+		return err
+	}
+	h := md5.New()
+	if _, err := writeStoredFile(s.config, name, io.TeeReader(r.Body, h)); err != nil {
+		return s3StorageError(err)
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+	if _, err := s.storeETag(name, etag); err != nil {
+		return s3StorageError(err)
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *s3Server) copyObject(w http.ResponseWriter, r *http.Request, name string) *s3Error {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid x-amz-copy-source"}
+	}
+	source, _, _ = strings.Cut(strings.TrimPrefix(source, "/"), "?")
+	if cleaned, err := validateFilePath(source); err != nil || cleaned != source || !strings.Contains(source, "/") {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("invalid copy source %q", source)}
+	}
+	if err := copyStoredFile(s.config, source, name, true); err != nil {
+		return s3StorageError(err)
+	}
+	info, err := statStoredFile(s.config, name)
+	if err != nil {
+		return s3StorageError(err)
+	}
+	etag, err := s.etag(name, info)
+	if err != nil {
+		return s3StorageError(err)
+	}
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		XMLNS        string   `xml:"xmlns,attr"`
+		LastModified string
+		ETag         string
+	}{XMLNS: s3XMLNamespace, LastModified: info.ModTime().UTC().Format(s3TimeFormat), ETag: etag})
+	return nil
+}
+
+func (s *s3Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) *s3Error {
+	var req struct {
+		Quiet   bool
+		Objects []struct{ Key string } `xml:"Object"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, s3MaxXMLBody)).Decode(&req); err != nil {
+		return &s3Error{http.StatusBadRequest, "MalformedXML", err.Error()}
+	}
+	type deleteError struct {
+		Key, Code, Message string
+	}
+	res := struct {
+		XMLName xml.Name               `xml:"DeleteResult"`
+		XMLNS   string                 `xml:"xmlns,attr"`
+		Deleted []struct{ Key string } `xml:"Deleted"`
+		Errors  []deleteError          `xml:"Error"`
+	}{XMLNS: s3XMLNamespace}
+	for _, object := range req.Objects {
+		name := bucket + "/" + object.Key
+		if cleaned, err := validateFilePath(name); err != nil || cleaned != name {
+			res.Errors = append(res.Errors, deleteError{object.Key, "InvalidArgument", "invalid key"})
+			continue
+		}
+		if err := deleteStoredFile(s.config, name); err != nil && !errors.Is(err, errStoredFileNotFound) {
+			s3Err := s3StorageError(err)
+			res.Errors = append(res.Errors, deleteError{object.Key, s3Err.code, s3Err.message})
+			continue
+		}
+		s.etags.Delete(name)
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, struct{ Key string }{object.Key})
+		}
+	}
+	writeS3XML(w, http.StatusOK, res)
+	return nil
+}
+
+// Multipart uploads keep their parts in metaPath/s3-uploads/ID, next to a
+// "target" file naming the object they will become. Uploads idle for
+// s3UploadExpiry are removed on start and whenever an upload is created.
+
+func (s *s3Server) uploadDir(uploadID string) string {
+	return filepath.Join(s.config.metaPath, s3UploadsDirName, uploadID)
+}
+
+// openUpload checks that uploadID is an upload in progress for name.
+func (s *s3Server) openUpload(name string, uploadID string) (string, *s3Error) {
+	noSuchUpload := &s3Error{http.StatusNotFound, "NoSuchUpload", "the upload does not exist"}
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", noSuchUpload
+	}
+	dir := s.uploadDir(uploadID)
+	target, err := os.ReadFile(filepath.Join(dir, "target"))
+	if err != nil || string(target) != name {
+		return "", noSuchUpload
+	}
+	return dir, nil
+}
+
+// removeStaleUploads removes the uploads whose directory did not change for
+// s3UploadExpiry; adding a part changes it.
+func (s *s3Server) removeStaleUploads(now time.Time) {
+	dir := filepath.Join(s.config.metaPath, s3UploadsDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("removeStaleUploads err: %v", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || now.Sub(info.ModTime()) < s3UploadExpiry {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("removeStaleUploads err removing %s: %v", entry.Name(), err)
+			continue
+		}
+		log.Printf("removed stale multipart upload %s", entry.Name())
+	}
+}
+
+func (s *s3Server) createMultipartUpload(w http.ResponseWriter, bucket, key string) *s3Error {
+	s.removeStaleUploads(time.Now())
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	uploadID := hex.EncodeToString(buf)
+	dir := s.uploadDir(uploadID)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return s3StorageError(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "target"), []byte(bucket+"/"+key), 0666); err != nil {
+		return s3StorageError(err)
+	}
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{XMLNS: s3XMLNamespace, Bucket: bucket, Key: key, UploadId: uploadID})
+	return nil
+}
+
+func (s *s3Server) uploadPart(w http.ResponseWriter, r *http.Request, name string, query url.Values) *s3Error {
+	dir, s3Err := s.openUpload(name, query.Get("uploadId"))
+	if s3Err != nil {
+		return s3Err
+	}
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "partNumber must be between 1 and 10000"}
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return errS3NotImplemented
+	}
+	if s3Err := s.limitBody(w, r); s3Err != nil {
+		return s3Err
+	}
+	tmpFile, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return s3StorageError(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	h := md5.New()
+	sealed, err := s.config.encryption.seal(tmpFile)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(sealed, h), r.Body)
+	}
+	if err == nil {
+		err = sealed.Close()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return s3StorageError(err)
+	}
+	partPath := filepath.Join(dir, strconv.Itoa(partNumber))
+	if err := os.WriteFile(partPath+".md5", h.Sum(nil), 0666); err != nil {
+		return s3StorageError(err)
+	}
+	if err := os.Rename(tmpFile.Name(), partPath); err != nil {
+		return s3StorageError(err)
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(h.Sum(nil))+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *s3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) *s3Error {
+	name := bucket + "/" + key
+	dir, s3Err := s.openUpload(name, uploadID)
+	if s3Err != nil {
+		return s3Err
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, s3MaxXMLBody)).Decode(&req); err != nil {
+		return &s3Error{http.StatusBadRequest, "MalformedXML", err.Error()}
+	}
+	if len(req.Parts) == 0 {
+		return &s3Error{http.StatusBadRequest, "MalformedXML", "no parts given"}
+	}
+	invalidPart := &s3Error{http.StatusBadRequest, "InvalidPart", "a part was not uploaded or its ETag does not match"}
+	readers := make([]io.Reader, 0, len(req.Parts))
+	sums := make([]byte, 0, len(req.Parts)*md5.Size)
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			return &s3Error{http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order"}
+		}
+		partPath := filepath.Join(dir, strconv.Itoa(part.PartNumber))
+		sum, err := os.ReadFile(partPath + ".md5")
+		if err != nil || hex.EncodeToString(sum) != strings.Trim(part.ETag, `"`) {
+			return invalidPart
+		}
+		file, err := s.config.encryption.open(partPath)
+		if err != nil {
+			return invalidPart
+		}
+		defer file.Close()
+		readers = append(readers, file)
+		sums = append(sums, sum...)
+	}
+	if _, err := writeStoredFile(s.config, name, io.MultiReader(readers...)); err != nil {
+		return s3StorageError(err)
+	}
+	sum := md5.Sum(sums)
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(req.Parts))
+	if _, err := s.storeETag(name, etag); err != nil {
+		return s3StorageError(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("completeMultipartUpload err removing %s: %v", dir, err)
+	}
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{XMLNS: s3XMLNamespace, Location: "/" + name, Bucket: bucket, Key: key, ETag: etag})
+	return nil
+}
+
+func (s *s3Server) abortMultipartUpload(w http.ResponseWriter, name string, uploadID string) *s3Error {
+	dir, s3Err := s.openUpload(name, uploadID)
+	if s3Err != nil {
+		return s3Err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return s3StorageError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, as S3 clients sign requests. Both the
+// Authorization header and presigned URLs (query parameters) are accepted.
+// Bodies are either covered by the signed x-amz-content-sha256, unsigned, or
+// sent in aws-chunked encoding with a signature per chunk.
+
+const (
+	sigV4Algorithm        = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat       = "20060102T150405Z"
+	sigV4MaxSkew          = 15 * time.Minute
+	s3UnsignedPayload     = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3StreamingUnsigned   = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	s3EmptyPayloadSHA256  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3MaxPresignedExpires = 7 * 24 * time.Hour
+	// s3MaxChunkSize bounds the chunks of aws-chunked bodies; clients send
+	// 64 KiB or a few MiB.
+	s3MaxChunkSize = 16 << 20
+)
+
+// sigV4Request is what a request says about its signature.
+type sigV4Request struct {
+	accessKey     string
+	date          string // yyyymmdd of the credential scope
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	time          time.Time
+	payloadHash   string
+	presigned     bool
+}
+
+func (s sigV4Request) scope() string {
+	return s.date + "/" + s.region + "/" + s.service + "/aws4_request"
+}
+
+// parseSigV4 reads the signature of r from its Authorization header or, for
+// presigned URLs, from its query.
+func parseSigV4(r *http.Request, now time.Time) (sigV4Request, *s3Error) {
+	var req sigV4Request
+	var credential, signedHeaders, amzDate string
+	query := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		rest, ok := strings.CutPrefix(auth, sigV4Algorithm+" ")
+		if !ok {
+			return req, &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "only " + sigV4Algorithm + " is supported"}
+		}
+		for _, field := range strings.Split(rest, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				req.signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			amzDate = r.Header.Get("Date")
+		}
+		req.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if req.payloadHash == "" {
+			return req, &s3Error{http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256"}
+		}
+	} else if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return req, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "only " + sigV4Algorithm + " is supported"}
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		req.signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		req.payloadHash = s3UnsignedPayload
+		req.presigned = true
+	} else {
+		return req, &s3Error{http.StatusForbidden, "AccessDenied", "request is not signed"}
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || signedHeaders == "" || req.signature == "" {
+		return req, &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed credential or signature"}
+	}
+	req.accessKey, req.date, req.region, req.service = parts[0], parts[1], parts[2], parts[3]
+	req.signedHeaders = strings.Split(signedHeaders, ";")
+	if !slices.Contains(req.signedHeaders, "host") {
+		return req, &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "the host header must be signed"}
+	}
+
+	t, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		t, err = http.ParseTime(amzDate)
+	}
+	if err != nil || t.UTC().Format("20060102") != req.date {
+		return req, &s3Error{http.StatusForbidden, "AccessDenied", "missing or invalid request date"}
+	}
+	req.time = t.UTC()
+	if req.presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || time.Duration(expires)*time.Second > s3MaxPresignedExpires {
+			return req, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "invalid X-Amz-Expires"}
+		}
+		if now.Before(req.time.Add(-sigV4MaxSkew)) || now.After(req.time.Add(time.Duration(expires)*time.Second)) {
+			return req, &s3Error{http.StatusForbidden, "AccessDenied", "request has expired"}
+		}
+	} else if now.Sub(req.time) > sigV4MaxSkew || req.time.Sub(now) > sigV4MaxSkew {
+		return req, &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "request time is too far from the server time"}
+	}
+	return req, nil
+}
+
+// s3URIEncode encodes s the way SigV4 expects: everything but unreserved
+// characters is percent encoded, and so is '/' unless keepSlash is set.
+func s3URIEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func sigV4CanonicalRequest(r *http.Request, req sigV4Request) string {
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		if req.presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(name, false)+"="+s3URIEncode(value, false))
+		}
+	}
+	slices.Sort(pairs)
+
+	var headers strings.Builder
+	for _, name := range req.signedHeaders {
+		var values []string
+		switch {
+		case name == "host":
+			values = []string{r.Host}
+		case name == "content-length" && r.Header.Get("Content-Length") == "":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		default:
+			for _, value := range r.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(value), " "))
+			}
+		}
+		headers.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	uri := r.URL.Path
+	if uri == "" {
+		uri = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		s3URIEncode(uri, true),
+		strings.Join(pairs, "&"),
+		headers.String(),
+		strings.Join(req.signedHeaders, ";"),
+		req.payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sigV4SigningKey(secretKey string, req sigV4Request) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), req.date)
+	key = hmacSHA256(key, req.region)
+	key = hmacSHA256(key, req.service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sigV4Signature computes the signature r should carry.
+func sigV4Signature(r *http.Request, req sigV4Request, secretKey string) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		req.time.Format(sigV4TimeFormat),
+		req.scope(),
+		sha256Hex([]byte(sigV4CanonicalRequest(r, req))),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(sigV4SigningKey(secretKey, req), stringToSign))
+}
+
+// verifySigV4 checks the signature of r against the configured credentials
+// and replaces r.Body by a reader that checks the payload as it is read.
+func verifySigV4(config ServerConfig, r *http.Request, now time.Time) *s3Error {
+	req, s3Err := parseSigV4(r, now)
+	if s3Err != nil {
+		return s3Err
+	}
+	if req.accessKey != config.s3AccessKey || config.s3AccessKey == "" {
+		return &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "unknown access key"}
+	}
+	expected := sigV4Signature(r, req, config.s3SecretKey)
+	if !hmac.Equal([]byte(expected), []byte(req.signature)) {
+		return &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match"}
+	}
+
+	switch req.payloadHash {
+	case s3UnsignedPayload:
+	case s3StreamingPayload:
+		r.Body = &awsChunkedReader{
+			r:             bufio.NewReader(r.Body),
+			closer:        r.Body,
+			signingKey:    sigV4SigningKey(config.s3SecretKey, req),
+			req:           req,
+			prevSignature: req.signature,
+		}
+	case s3StreamingUnsigned:
+		r.Body = &awsChunkedReader{r: bufio.NewReader(r.Body), closer: r.Body}
+	default:
+		if len(req.payloadHash) != sha256.Size*2 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "unsupported x-amz-content-sha256"}
+		}
+		r.Body = &sha256CheckingReader{ReadCloser: r.Body, hash: sha256.New(), expected: req.payloadHash}
+	}
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		r.ContentLength, _ = strconv.ParseInt(decoded, 10, 64)
+	}
+	return nil
+}
+
+var errS3PayloadMismatch = errors.New("payload does not match its signature")
+
+// sha256CheckingReader fails at the end of the body if its SHA-256 is not the
+// signed one, so a tampered body is never stored.
+type sha256CheckingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (s *sha256CheckingReader) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(s.hash.Sum(nil)) != s.expected {
+		return n, errS3PayloadMismatch
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes an aws-chunked body, "SIZE;chunk-signature=SIG"
+// lines each followed by SIZE bytes, ending with an empty chunk and optional
+// trailers. With a signingKey every chunk signature is checked.
+type awsChunkedReader struct {
+	r             *bufio.Reader
+	closer        io.Closer
+	signingKey    []byte
+	req           sigV4Request
+	prevSignature string
+
+	chunk []byte
+	err   error
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 && c.err == nil {
+		c.err = c.nextChunk()
+	}
+	if len(c.chunk) > 0 {
+		n := copy(p, c.chunk)
+		c.chunk = c.chunk[n:]
+		return n, nil
+	}
+	return 0, c.err
+}
+
+func (c *awsChunkedReader) Close() error {
+	return c.closer.Close()
+}
+
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("aws-chunked: %w", io.ErrUnexpectedEOF)
+	}
+	sizeText, extension, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeText, 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return fmt.Errorf("aws-chunked: invalid chunk size %q", sizeText)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return fmt.Errorf("aws-chunked: %w", io.ErrUnexpectedEOF)
+	}
+	if c.signingKey != nil {
+		signature, _ := strings.CutPrefix(extension, "chunk-signature=")
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD",
+			c.req.time.Format(sigV4TimeFormat),
+			c.req.scope(),
+			c.prevSignature,
+			s3EmptyPayloadSHA256,
+			sha256Hex(data),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.signingKey, stringToSign))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errS3PayloadMismatch
+		}
+		c.prevSignature = signature
+	}
+	if size == 0 {
+		// Trailers (e.g. checksums) end with an empty line.
+		for {
+			line, err := c.r.ReadString('\n')
+			if err != nil || strings.TrimSpace(line) == "" {
+				return io.EOF
+			}
+		}
+	}
+	if crlf, err := c.r.ReadString('\n'); err != nil || strings.TrimSpace(crlf) != "" {
+		return fmt.Errorf("aws-chunked: %w", io.ErrUnexpectedEOF)
+	}
+	c.chunk = data
+	return nil
+}
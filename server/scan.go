@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Uploads are scanned after they are written to their temporary file and
+// before they are renamed into place, so listings and downloads never see a
+// file that was not scanned. A clean file gets its scan status in its
+// metadata; an infected one is rejected or, with the quarantine policy, moved
+// to the quarantine directory of metaPath where admins can look at it,
+// release it or drop it.
+
+const (
+	// scanMetadataPrefix starts the metadata keys the scanner sets. Users
+	// cannot change them.
+	scanMetadataPrefix = "scan."
+	scanStatusKey      = scanMetadataPrefix + "status"
+	scanSignatureKey   = scanMetadataPrefix + "signature"
+	scanTimeKey        = scanMetadataPrefix + "time"
+	scanStatusClean    = "clean"
+	scanStatusReleased = "released"
+
+	quarantineDirName = "quarantine"
+	// defaultClamdTimeout bounds a scan by clamd unless STORE_SCAN_TIMEOUT
+	// says otherwise.
+	defaultClamdTimeout = 2 * time.Minute
+	// clamdChunkSize is the size of the chunks of an INSTREAM command.
+	clamdChunkSize = 64 << 10
+)
+
+var (
+	errFileInfected       = errors.New("file is infected")
+	errScanFailed         = errors.New("virus scan failed")
+	errQuarantineNotFound = errors.New("quarantined file not found")
+)
+
+// scanner scans the content of a file for malware.
+type scanner interface {
+	scan(r io.Reader) (scanResult, error)
+}
+
+// scanResult is what a scanner found, signature naming the malware of an
+// infected file.
+type scanResult struct {
+	infected  bool
+	signature string
+}
+
+type scanPolicy string
+
+const (
+	scanReject     scanPolicy = "reject"
+	scanQuarantine scanPolicy = "quarantine"
+)
+
+// uploadScanner scans every stored file and applies policy to infected ones.
+// A nil uploadScanner stores files without scanning them.
+type uploadScanner struct {
+	scanner scanner
+	policy  scanPolicy
+}
+
+// scanFromEnv sets up scanning with the clamd at STORE_SCAN_CLAMD, host:port
+// or the path of its unix socket, and the policy of STORE_SCAN_POLICY.
+func scanFromEnv() *uploadScanner {
+	addr := os.Getenv("STORE_SCAN_CLAMD")
+	if addr == "" {
+		return nil
+	}
+	policy := scanPolicy(os.Getenv("STORE_SCAN_POLICY"))
+	if policy == "" {
+		policy = scanReject
+	}
+	if policy != scanReject && policy != scanQuarantine {
+		log.Fatalf("invalid STORE_SCAN_POLICY %q, want reject or quarantine", policy)
+	}
+	timeout := defaultClamdTimeout
+	if value := os.Getenv("STORE_SCAN_TIMEOUT"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			log.Fatalf("invalid STORE_SCAN_TIMEOUT %q", value)
+		}
+	}
+	clamd := newClamdScanner(addr, timeout)
+	if err := clamd.ping(); err != nil {
+		log.Printf("clamd at %s does not answer yet, uploads fail until it does: %v", addr, err)
+	}
+	log.Printf("Scanning uploads with clamd at %s, infected files are %sed", addr, policy)
+	return &uploadScanner{scanner: clamd, policy: policy}
+}
+
+// check scans the file of name written to tmpPath. It returns the metadata
+// to give the stored file, or errFileInfected after rejecting or quarantining
+// it, or errScanFailed when the file could not be scanned, which keeps it out
+// too.
+func (s *uploadScanner) check(config ServerConfig, name string, tmpPath string, size int64) (map[string]*string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	file, err := config.encryption.open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.scanner.scan(file)
+	file.Close()
+	if err != nil {
+		log.Printf("scanning %s failed: %v", name, err)
+		return nil, fmt.Errorf("%s: %w: %v", name, errScanFailed, err)
+	}
+	if !res.infected {
+		return scanMetadata(scanStatusClean, ""), nil
+	}
+	if s.policy != scanQuarantine {
+		log.Printf("rejected infected file %s: %s", name, res.signature)
+		return nil, fmt.Errorf("%s: %w with %s", name, errFileInfected, res.signature)
+	}
+	id, err := quarantineFile(config, common.QuarantinedFile{
+		Name: path.Clean(name), Size: size, Signature: res.signature, QuarantinedAt: time.Now().UTC(),
+	}, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("quarantined infected file %s as %s: %s", name, id, res.signature)
+	return nil, fmt.Errorf("%s: %w with %s, quarantined as %s", name, errFileInfected, res.signature, id)
+}
+
+func scanMetadata(status string, signature string) map[string]*string {
+	now := time.Now().UTC().Format(time.RFC3339)
+	metadata := map[string]*string{scanStatusKey: &status, scanTimeKey: &now, scanSignatureKey: nil}
+	if signature != "" {
+		metadata[scanSignatureKey] = &signature
+	}
+	return metadata
+}
+
+// withScanMetadata returns metadata with the scan keys of scanned in place of
+// its own.
+func withScanMetadata(metadata map[string]string, scanned map[string]string) map[string]string {
+	for key := range metadata {
+		if strings.HasPrefix(key, scanMetadataPrefix) {
+			delete(metadata, key)
+		}
+	}
+	for key, value := range scanned {
+		if strings.HasPrefix(key, scanMetadataPrefix) {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// clamdScanner scans with a clamd daemon over its INSTREAM command.
+type clamdScanner struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+func newClamdScanner(addr string, timeout time.Duration) *clamdScanner {
+	if strings.HasPrefix(addr, "/") {
+		return &clamdScanner{network: "unix", addr: addr, timeout: timeout}
+	}
+	return &clamdScanner{network: "tcp", addr: addr, timeout: timeout}
+}
+
+// command sends a null terminated command to clamd, lets send write what
+// follows it and returns the reply.
+func (c *clamdScanner) command(name string, send func(conn net.Conn) error) (string, error) {
+	conn, err := net.DialTimeout(c.network, c.addr, c.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := io.WriteString(conn, "z"+name+"\x00"); err != nil {
+		return "", err
+	}
+	if send != nil {
+		if err := send(conn); err != nil {
+			return "", err
+		}
+	}
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+func (c *clamdScanner) ping() error {
+	reply, err := c.command("PING", nil)
+	if err == nil && reply != "PONG" {
+		err = fmt.Errorf("clamd answered %q to PING", reply)
+	}
+	return err
+}
+
+// scan streams r to clamd in length prefixed chunks, ended by an empty one.
+// clamd answers "stream: OK", "stream: SIGNATURE FOUND" or a message ending
+// in ERROR, e.g. when the file is over its StreamMaxLength.
+func (c *clamdScanner) scan(r io.Reader) (scanResult, error) {
+	reply, err := c.command("INSTREAM", func(conn net.Conn) error {
+		buf := make([]byte, 4+clamdChunkSize)
+		for {
+			n, err := io.ReadFull(r, buf[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(buf, uint32(n))
+				if _, err := conn.Write(buf[:4+n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		_, err := conn.Write([]byte{0, 0, 0, 0})
+		return err
+	})
+	if err != nil {
+		return scanResult{}, err
+	}
+	result, _ := strings.CutPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return scanResult{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return scanResult{infected: true, signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return scanResult{}, fmt.Errorf("clamd answered %q", reply)
+	}
+}
+
+// Quarantined files are kept in metaPath/quarantine as ID, as they were
+// written and so sealed with encryption at rest, next to ID.json holding
+// their common.QuarantinedFile. Tenants share the quarantine of the whole
+// store, so admins see every quarantined upload; each records its tenant.
+
+func quarantineDir(config ServerConfig) string {
+	if config.tenant != "" {
+		return filepath.Join(filepath.Dir(config.tenants.path), quarantineDirName)
+	}
+	return filepath.Join(config.metaPath, quarantineDirName)
+}
+
+// quarantineFile moves the upload at tmpPath into the quarantine and returns
+// its ID.
+func quarantineFile(config ServerConfig, file common.QuarantinedFile, tmpPath string) (string, error) {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	file.ID = hex.EncodeToString(buf)
+	file.Tenant = config.tenant
+	dir := quarantineDir(config)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	if err := moveFile(tmpPath, filepath.Join(dir, file.ID)); err != nil {
+		return "", err
+	}
+	if err := writeJSONFile(filepath.Join(dir, file.ID+".json"), file); err != nil {
+		os.Remove(filepath.Join(dir, file.ID))
+		return "", err
+	}
+	return file.ID, nil
+}
+
+// moveFile renames from to to, copying it when they are on different file
+// systems, as the meta directory may be.
+func moveFile(from string, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+func listQuarantine(config ServerConfig) ([]common.QuarantinedFile, error) {
+	entries, err := os.ReadDir(quarantineDir(config))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	res := make([]common.QuarantinedFile, 0)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		file, err := getQuarantined(config, id)
+		if err != nil {
+			log.Printf("listQuarantine err for %s: %v", id, err)
+			continue
+		}
+		res = append(res, file)
+	}
+	slices.SortFunc(res, func(a, b common.QuarantinedFile) int {
+		return a.QuarantinedAt.Compare(b.QuarantinedAt)
+	})
+	return res, nil
+}
+
+func getQuarantined(config ServerConfig, id string) (common.QuarantinedFile, error) {
+	var file common.QuarantinedFile
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return file, fmt.Errorf("%s: %w", id, errQuarantineNotFound)
+	}
+	if _, err := os.Stat(filepath.Join(quarantineDir(config), id+".json")); errors.Is(err, os.ErrNotExist) {
+		return file, fmt.Errorf("%s: %w", id, errQuarantineNotFound)
+	}
+	err := readJSONFile(filepath.Join(quarantineDir(config), id+".json"), &file)
+	return file, err
+}
+
+func removeQuarantined(config ServerConfig, id string) error {
+	os.Remove(filepath.Join(quarantineDir(config), id))
+	return os.Remove(filepath.Join(quarantineDir(config), id+".json"))
+}
+
+// releaseQuarantined stores a quarantined file under its name, in its
+// tenant, without scanning it again, marked as released. It returns config
+// for that tenant.
+func releaseQuarantined(config ServerConfig, id string) (common.QuarantinedFile, ServerConfig, error) {
+	file, err := getQuarantined(config, id)
+	if err != nil {
+		return file, config, err
+	}
+	content, err := config.encryption.open(filepath.Join(quarantineDir(config), id))
+	if err != nil {
+		return file, config, err
+	}
+	if file.Tenant != "" {
+		if _, ok := config.tenants.get(file.Tenant); !ok {
+			content.Close()
+			return file, config, fmt.Errorf("tenant %q of %s: %w", file.Tenant, id, errTenantNotFound)
+		}
+		config = config.forTenant(file.Tenant)
+	}
+	unscanned := config
+	unscanned.scan = nil
+	_, err = writeStoredFile(unscanned, file.Name, content)
+	content.Close()
+	if err != nil {
+		return file, config, err
+	}
+	if _, err := config.metadata.update(file.Name, scanMetadata(scanStatusReleased, file.Signature)); err != nil {
+		log.Printf("releaseQuarantined err setting the scan status of %s: %v", file.Name, err)
+	}
+	log.Printf("released quarantined file %s as %s", id, file.Name)
+	return file, config, removeQuarantined(config, id)
+}
+
+func handleListQuarantine(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleListQuarantine")
+	files, err := listQuarantine(config)
+	if err != nil {
+		log.Printf("Error in handleListQuarantine: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, common.QuarantineList{Files: files})
+}
+
+func handleReleaseQuarantined(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleReleaseQuarantined %s", r.PathValue("id"))
+	file, config, err := releaseQuarantined(config, r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error in handleReleaseQuarantined: %v", err)
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	info, err := statStoredFile(config, file.Name)
+	if err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, common.FileInfo{Name: file.Name, Size: info.Size(), ModTime: info.ModTime().UTC()})
+}
+
+func handleDeleteQuarantined(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleDeleteQuarantined %s", r.PathValue("id"))
+	if _, err := getQuarantined(config, r.PathValue("id")); err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	if err := removeQuarantined(config, r.PathValue("id")); err != nil {
+		log.Printf("Error in handleDeleteQuarantined: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
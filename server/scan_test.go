@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"file_store/common"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers the PING and INSTREAM commands of clamd, finding the
+// EICAR test string and refusing streams over maxStream bytes.
+func fakeClamd(t *testing.T, maxStream int) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				command, err := r.ReadString(0)
+				if err != nil {
+					return
+				}
+				switch command {
+				case "zPING\x00":
+					conn.Write([]byte("PONG\x00"))
+					return
+				case "zINSTREAM\x00":
+				default:
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var stream []byte
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					stream = append(stream, chunk...)
+					if len(stream) > maxStream {
+						conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+						return
+					}
+				}
+				if bytes.Contains(stream, []byte(eicar)) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	clamd := newClamdScanner(fakeClamd(t, 1<<20), time.Second)
+	if err := clamd.ping(); err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("a"), 3*clamdChunkSize+7)
+	if res, err := clamd.scan(bytes.NewReader(big)); err != nil || res.infected {
+		t.Errorf("clean file: %+v, %v", res, err)
+	}
+	if res, err := clamd.scan(strings.NewReader("")); err != nil || res.infected {
+		t.Errorf("empty file: %+v, %v", res, err)
+	}
+	res, err := clamd.scan(io.MultiReader(bytes.NewReader(big), strings.NewReader(eicar)))
+	if err != nil || !res.infected || res.signature != "Eicar-Test-Signature" {
+		t.Errorf("infected file: %+v, %v", res, err)
+	}
+	if _, err := clamd.scan(bytes.NewReader(make([]byte, 2<<20))); err == nil {
+		t.Errorf("no error over the stream limit")
+	}
+	down := newClamdScanner("127.0.0.1:1", time.Second)
+	if _, err := down.scan(strings.NewReader("x")); err == nil {
+		t.Errorf("no error without clamd")
+	}
+}
+
+func TestUploadScanning(t *testing.T) {
+	storagePath := t.TempDir()
+	config := ServerConfig{filesStoragePath: storagePath, encryption: testKeyring(t, 1)}.withDefaults()
+	config.scan = &uploadScanner{scanner: newClamdScanner(fakeClamd(t, 1<<20), time.Second), policy: scanReject}
+	do := func(config ServerConfig, method string, target string, body string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		BuildServer(config).Handler.ServeHTTP(response, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return response
+	}
+	listed := func() []string {
+		var list common.FileInfoList
+		json.NewDecoder(do(config, http.MethodGet, "/v1/files", "").Body).Decode(&list)
+		names := make([]string, 0)
+		for _, file := range list.Files {
+			names = append(names, file.Name)
+		}
+		return names
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		if response := do(config, http.MethodPut, "/v1/files/docs/a.txt", "hello"); response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var metadata common.FileMetadata
+		json.NewDecoder(do(config, http.MethodGet, "/v1/metadata/docs/a.txt", "").Body).Decode(&metadata)
+		if metadata.Metadata[scanStatusKey] != scanStatusClean || metadata.Metadata[scanTimeKey] == "" {
+			t.Errorf("metadata %+v", metadata.Metadata)
+		}
+		response := do(config, http.MethodPatch, "/v1/metadata/docs/a.txt", `{"metadata": {"scan.status": "clean"}}`)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("got %d setting the scan status", response.Code)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		response := do(config, http.MethodPut, "/v1/files/docs/virus.txt", "hi "+eicar)
+		if response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), "Eicar-Test-Signature") {
+			t.Errorf("got %d %s", response.Code, response.Body.String())
+		}
+		response = do(config, http.MethodPut, "/v1/files/docs/a.txt", eicar)
+		if response.Code != http.StatusUnprocessableEntity {
+			t.Errorf("got %d replacing a file", response.Code)
+		}
+		if response := do(config, http.MethodGet, "/v1/files/docs/a.txt", ""); response.Body.String() != "hello" {
+			t.Errorf("the replaced file holds %q", response.Body.String())
+		}
+		if names := listed(); len(names) != 1 {
+			t.Errorf("listed %v", names)
+		}
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		config := config
+		config.scan = &uploadScanner{scanner: config.scan.scanner, policy: scanQuarantine}
+		if response := do(config, http.MethodPut, "/v1/files/docs/virus.txt", eicar); response.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		if names := listed(); len(names) != 1 {
+			t.Errorf("listed %v", names)
+		}
+		var list common.QuarantineList
+		json.NewDecoder(do(config, http.MethodGet, "/v1/admin/quarantine", "").Body).Decode(&list)
+		if len(list.Files) != 1 || list.Files[0].Name != "docs/virus.txt" || list.Files[0].Signature != "Eicar-Test-Signature" ||
+			list.Files[0].Size != int64(len(eicar)) {
+			t.Fatalf("quarantine %+v", list.Files)
+		}
+		data, _ := os.ReadFile(filepath.Join(config.metaPath, quarantineDirName, list.Files[0].ID))
+		if !bytes.HasPrefix(data, []byte(sealedMagic)) {
+			t.Errorf("the quarantined file is not sealed")
+		}
+
+		if response := do(config, http.MethodPost, "/v1/admin/quarantine/"+list.Files[0].ID+"/release", ""); response.Code != http.StatusOK {
+			t.Fatalf("got %d %s releasing", response.Code, response.Body.String())
+		}
+		if response := do(config, http.MethodGet, "/v1/files/docs/virus.txt", ""); response.Body.String() != eicar {
+			t.Errorf("got %d %q after releasing", response.Code, response.Body.String())
+		}
+		var metadata common.FileMetadata
+		json.NewDecoder(do(config, http.MethodGet, "/v1/metadata/docs/virus.txt", "").Body).Decode(&metadata)
+		if metadata.Metadata[scanStatusKey] != scanStatusReleased || metadata.Metadata[scanSignatureKey] != "Eicar-Test-Signature" {
+			t.Errorf("metadata %+v", metadata.Metadata)
+		}
+
+		do(config, http.MethodPut, "/v1/files/docs/virus2.txt", eicar)
+		json.NewDecoder(do(config, http.MethodGet, "/v1/admin/quarantine", "").Body).Decode(&list)
+		if len(list.Files) != 1 {
+			t.Fatalf("quarantine %+v", list.Files)
+		}
+		if response := do(config, http.MethodDelete, "/v1/admin/quarantine/"+list.Files[0].ID, ""); response.Code != http.StatusNoContent {
+			t.Errorf("got %d dropping", response.Code)
+		}
+		if response := do(config, http.MethodDelete, "/v1/admin/quarantine/"+list.Files[0].ID, ""); response.Code != http.StatusNotFound {
+			t.Errorf("got %d dropping twice", response.Code)
+		}
+		if entries, _ := os.ReadDir(filepath.Join(config.metaPath, quarantineDirName)); len(entries) != 0 {
+			t.Errorf("left %d entries in the quarantine", len(entries))
+		}
+	})
+
+	t.Run("quarantine in a tenant", func(t *testing.T) {
+		if _, err := config.tenants.put(common.Tenant{Name: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		red := config.forTenant("red")
+		red.scan = &uploadScanner{scanner: config.scan.scanner, policy: scanQuarantine}
+		if response := do(red, http.MethodPut, "/v1/files/docs/virus.txt", eicar); response.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var list common.QuarantineList
+		json.NewDecoder(do(config, http.MethodGet, "/v1/admin/quarantine", "").Body).Decode(&list)
+		if len(list.Files) != 1 || list.Files[0].Tenant != "red" || list.Files[0].Name != "docs/virus.txt" {
+			t.Fatalf("quarantine %+v", list.Files)
+		}
+		if response := do(config, http.MethodPost, "/v1/admin/quarantine/"+list.Files[0].ID+"/release", ""); response.Code != http.StatusOK {
+			t.Fatalf("got %d %s releasing", response.Code, response.Body.String())
+		}
+		data, err := os.ReadFile(filepath.Join(red.filesStoragePath, "docs", "virus.txt"))
+		if err != nil || !bytes.HasPrefix(data, []byte(sealedMagic)) {
+			t.Errorf("released file %q, %v", data, err)
+		}
+		if response := do(red, http.MethodGet, "/v1/files/docs/virus.txt", ""); response.Body.String() != eicar {
+			t.Errorf("got %d %q from the tenant", response.Code, response.Body.String())
+		}
+		if entries, _ := os.ReadDir(filepath.Join(config.metaPath, quarantineDirName)); len(entries) != 0 {
+			t.Errorf("left %d entries in the quarantine", len(entries))
+		}
+	})
+
+	t.Run("scanner down", func(t *testing.T) {
+		config := config
+		config.scan = &uploadScanner{scanner: newClamdScanner("127.0.0.1:1", time.Second), policy: scanReject}
+		if response := do(config, http.MethodPut, "/v1/files/docs/b.txt", "fine"); response.Code != http.StatusServiceUnavailable {
+			t.Errorf("got %d", response.Code)
+		}
+		if _, err := os.Stat(filepath.Join(storagePath, "docs", "b.txt")); err == nil {
+			t.Errorf("stored a file that was not scanned")
+		}
+	})
+}
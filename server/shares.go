@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sharesFileName   = "shares.json"
+	shareKeyFileName = "share.key"
+	defaultShareTTL  = 24 * time.Hour
+	// sharedPrefix is where share links are used. Its routes are public: the
+	// signature in the link stands in for a token.
+	sharedPrefix = "/v1/shared/"
+)
+
+var (
+	errInvalidShareRequest = errors.New("invalid share request")
+	errShareNotFound       = errors.New("no such share link")
+	errShareExpired        = errors.New("share link expired or used up")
+	errShareMode           = errors.New("share link does not allow this")
+)
+
+// shareStore keeps the share links in metaPath/shares.json and signs them
+// with the key in metaPath/share.key, created on first use, or the key set
+// with STORE_SHARE_KEY. Like tokens.json, the file is read again when it
+// changes, so replicas sharing the meta directory honour each other's links.
+type shareStore struct {
+	mu      sync.Mutex
+	path    string
+	keyPath string
+	key     []byte
+	links   []common.ShareLink
+	modTime time.Time
+}
+
+func newShareStore(metaPath string, key []byte) *shareStore {
+	s := &shareStore{
+		path:    filepath.Join(metaPath, sharesFileName),
+		keyPath: filepath.Join(metaPath, shareKeyFileName),
+		key:     key,
+		links:   make([]common.ShareLink, 0),
+	}
+	s.refreshLocked()
+	return s
+}
+
+func (s *shareStore) refreshLocked() {
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	links := make([]common.ShareLink, 0)
+	if err := readJSONFile(s.path, &links); err != nil {
+		log.Printf("shareStore err reading %s: %v", s.path, err)
+		return
+	}
+	s.links = links
+	s.modTime = info.ModTime()
+}
+
+func (s *shareStore) writeLocked(links []common.ShareLink) error {
+	if err := writeJSONFile(s.path, links); err != nil {
+		return err
+	}
+	s.links = links
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// keyLocked returns the signing key, creating the key file if there is none.
+// Replicas racing to create it all end up with the first one written.
+func (s *shareStore) keyLocked() ([]byte, error) {
+	if s.key != nil {
+		return s.key, nil
+	}
+	if key, err := os.ReadFile(s.keyPath); err == nil && len(key) > 0 {
+		s.key = key
+		return key, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encoded := []byte(hex.EncodeToString(key))
+	if err := os.MkdirAll(filepath.Dir(s.keyPath), 0777); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(s.keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		if encoded, err = os.ReadFile(s.keyPath); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		_, err = file.Write(encoded)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.key = encoded
+	return s.key, nil
+}
+
+// signLocked returns the signature of a link, covering everything the link
+// allows so none of it can be changed.
+func (s *shareStore) signLocked(link common.ShareLink) (string, error) {
+	key, err := s.keyLocked()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%d\n%d", link.ID, link.Mode, link.Tenant, link.Name, link.MaxUses, link.ExpiresAt.Unix())
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// create stores link under a new ID and returns it with its signature.
+// Expired links are dropped on the way.
+func (s *shareStore) create(link common.ShareLink, now time.Time) (common.ShareLink, string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return common.ShareLink{}, "", err
+	}
+	link.ID = hex.EncodeToString(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	signature, err := s.signLocked(link)
+	if err != nil {
+		return common.ShareLink{}, "", err
+	}
+	links := slices.DeleteFunc(slices.Clone(s.links), func(l common.ShareLink) bool { return !now.Before(l.ExpiresAt) })
+	if err := s.writeLocked(append(links, link)); err != nil {
+		return common.ShareLink{}, "", err
+	}
+	return link, signature, nil
+}
+
+// verify checks the signature of the link id and that it can still be used
+// for mode, without counting a use.
+func (s *shareStore) verify(id string, signature string, mode string, now time.Time) (common.ShareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	i, err := s.usableLocked(id, now)
+	if err != nil {
+		return common.ShareLink{}, err
+	}
+	link := s.links[i]
+	expected, err := s.signLocked(link)
+	if err != nil {
+		return common.ShareLink{}, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return common.ShareLink{}, fmt.Errorf("%w %q", errShareNotFound, id)
+	}
+	if link.Mode != mode {
+		return common.ShareLink{}, fmt.Errorf("%q: %w, it is for %s", id, errShareMode, link.Mode)
+	}
+	return link, nil
+}
+
+// usableLocked returns the index of the link id, unless it expired or has no
+// uses left.
+func (s *shareStore) usableLocked(id string, now time.Time) (int, error) {
+	i := slices.IndexFunc(s.links, func(l common.ShareLink) bool { return l.ID == id })
+	if i < 0 {
+		return -1, fmt.Errorf("%w %q", errShareNotFound, id)
+	}
+	link := s.links[i]
+	if !now.Before(link.ExpiresAt) || link.MaxUses > 0 && link.Uses >= link.MaxUses {
+		return -1, fmt.Errorf("%q: %w", id, errShareExpired)
+	}
+	return i, nil
+}
+
+// use counts a use of the link id, verified before, once its transfer starts.
+// It fails if the link was revoked or ran out of uses in between.
+func (s *shareStore) use(id string, now time.Time) (common.ShareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	i, err := s.usableLocked(id, now)
+	if err != nil {
+		return common.ShareLink{}, err
+	}
+	link := s.links[i]
+	link.Uses++
+	links := slices.Clone(s.links)
+	links[i] = link
+	if err := s.writeLocked(links); err != nil {
+		return common.ShareLink{}, err
+	}
+	return link, nil
+}
+
+func (s *shareStore) list() []common.ShareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	return slices.Clone(s.links)
+}
+
+// revoke removes the link id if access owns it.
+func (s *shareStore) revoke(id string, access *accessPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	i := slices.IndexFunc(s.links, func(l common.ShareLink) bool { return l.ID == id && access.owns(l.CreatedBy) })
+	if i < 0 {
+		return fmt.Errorf("%w %q", errShareNotFound, id)
+	}
+	return s.writeLocked(slices.Delete(slices.Clone(s.links), i, i+1))
+}
+
+// sharePrefix turns the name of an upload link into a directory prefix.
+func sharePrefix(name string) (string, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return "", nil
+	}
+	cleaned, err := validateFilePath(name)
+	if err != nil {
+		return "", err
+	}
+	return cleaned + "/", nil
+}
+
+// newShareLink checks req against what the caller of config may do.
+func newShareLink(config ServerConfig, req common.ShareRequest, now time.Time) (common.ShareLink, error) {
+	ttl := defaultShareTTL
+	if req.Expires != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.Expires); err != nil || ttl <= 0 {
+			return common.ShareLink{}, fmt.Errorf("%w: expires %q is not a positive duration", errInvalidShareRequest, req.Expires)
+		}
+	}
+	if req.MaxUses < 0 {
+		return common.ShareLink{}, fmt.Errorf("%w: negative max_uses", errInvalidShareRequest)
+	}
+	link := common.ShareLink{
+		Mode:      req.Mode,
+		MaxUses:   req.MaxUses,
+		Tenant:    config.tenant,
+		CreatedBy: config.access.id(),
+		CreatedAt: now.UTC(),
+		ExpiresAt: now.UTC().Add(ttl).Truncate(time.Second),
+	}
+	switch req.Mode {
+	case "", common.ShareDownload:
+		link.Mode = common.ShareDownload
+		if _, err := statStoredFile(config, req.Name); err != nil {
+			return common.ShareLink{}, err
+		}
+		link.Name, _ = validateFilePath(req.Name)
+	case common.ShareUpload:
+		prefix, err := sharePrefix(req.Name)
+		if err != nil {
+			return common.ShareLink{}, fmt.Errorf("%w: %w", errInvalidShareRequest, err)
+		}
+		if err := config.access.checkWrite(prefix); err != nil {
+			return common.ShareLink{}, err
+		}
+		link.Name = prefix
+	default:
+		return common.ShareLink{}, fmt.Errorf("%w: unknown mode %q", errInvalidShareRequest, req.Mode)
+	}
+	return link, nil
+}
+
+// shareURL is the URL of a link on the server r was sent to.
+func shareURL(r *http.Request, link common.ShareLink, signature string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + sharedPrefix + link.ID + "?sig=" + signature
+}
+
+// handleCreateShare answers 201 with the link, including its signed URL.
+func handleCreateShare(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleCreateShare")
+	var req common.ShareRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	link, err := newShareLink(config, req, time.Now())
+	if errors.Is(err, errInvalidShareRequest) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	link, signature, err := config.shares.create(link, time.Now())
+	if err != nil {
+		log.Printf("Error in handleCreateShare: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("created %s link %s for %q", link.Mode, link.ID, link.Name)
+	link.URL = shareURL(r, link, signature)
+	w.Header().Set("Location", "/v1/shares/"+link.ID)
+	writeJSON(w, http.StatusCreated, link)
+}
+
+// handleListShares lists the links of the caller, or every link for admins.
+func handleListShares(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleListShares")
+	res := common.ShareLinkList{Links: make([]common.ShareLink, 0)}
+	for _, link := range config.shares.list() {
+		if config.access.owns(link.CreatedBy) {
+			res.Links = append(res.Links, link)
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func handleRevokeShare(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	log.Printf("In handleRevokeShare %s", id)
+	if err := config.shares.revoke(id, config.access); errors.Is(err, errShareNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Error in handleRevokeShare: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeShareError answers a request whose link cannot be used.
+func writeShareError(w http.ResponseWriter, err error) {
+	log.Printf("Error using share link: %v", err)
+	switch {
+	case errors.Is(err, errShareNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errShareExpired):
+		writeError(w, http.StatusGone, err.Error())
+	case errors.Is(err, errShareMode):
+		writeError(w, http.StatusForbidden, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// useShare verifies the link of r and returns config limited to what the link
+// allows: reading its file, or writing below its prefix. The use is counted by
+// the handler once the transfer starts.
+func useShare(config ServerConfig, w http.ResponseWriter, r *http.Request, mode string) (common.ShareLink, ServerConfig, bool) {
+	link, err := config.shares.verify(r.PathValue("id"), r.URL.Query().Get("sig"), mode, time.Now())
+	if err != nil {
+		writeShareError(w, err)
+		return link, config, false
+	}
+	if link.Tenant != "" {
+		config = config.forTenant(link.Tenant)
+	}
+	config.auditEntry.setCaller(common.APIToken{ID: "share:" + link.ID, Name: "share link", Tenant: link.Tenant})
+	role := common.RoleReader
+	if mode == common.ShareUpload {
+		role = common.RoleWriter
+	}
+	config.access = &accessPolicy{tokenID: "share:" + link.ID, grants: []common.Grant{{Prefix: link.Name, Role: role}}}
+	return link, config, true
+}
+
+func handleSharedDownload(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleSharedDownload %s", r.PathValue("id"))
+	link, config, ok := useShare(config, w, r, common.ShareDownload)
+	if !ok {
+		return
+	}
+	file, info, err := openStoredFile(config, link.Name)
+	if err != nil {
+		log.Printf("Error in handleSharedDownload: %v", err)
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(link.Name)))
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+		return
+	}
+	http.ServeContent(&shareDownloadWriter{ResponseWriter: w, config: config, id: link.ID}, r, info.Name(), info.ModTime(), file)
+}
+
+// shareDownloadWriter counts a use of a download link when the file starts
+// being sent, so answers without the file, like 304 or 416, leave it alone.
+type shareDownloadWriter struct {
+	http.ResponseWriter
+	config      ServerConfig
+	id          string
+	wroteHeader bool
+	failed      bool
+}
+
+func (w *shareDownloadWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK || code == http.StatusPartialContent {
+		if _, err := w.config.shares.use(w.id, time.Now()); err != nil {
+			w.failed = true
+			h := w.Header()
+			h.Del("Content-Range")
+			h.Del("Content-Disposition")
+			writeShareError(w.ResponseWriter, err)
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *shareDownloadWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		return 0, errShareExpired
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// handleSharedUpload stores the request body below the prefix of an upload
+// link. Existing files are never replaced, so one partner cannot overwrite
+// what another dropped off.
+func handleSharedUpload(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleSharedUpload %s %s", r.PathValue("id"), r.PathValue("path"))
+	if r.ContentLength > config.maxUploadBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	rel, err := validateFilePath(r.PathValue("path"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	link, config, ok := useShare(config, w, r, common.ShareUpload)
+	if !ok {
+		return
+	}
+	name := link.Name + rel
+	if _, err := statStoredFile(config, name); err == nil {
+		writeError(w, http.StatusConflict, name+": "+errStoredFileExists.Error())
+		return
+	}
+	if _, err := config.shares.use(link.ID, time.Now()); err != nil {
+		writeShareError(w, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, config.maxUploadBytes)
+	if _, err := writeStoredFile(config, name, r.Body); err != nil {
+		log.Printf("Error in handleSharedUpload: %v", err)
+		writeError(w, uploadErrorStatus(err), err.Error())
+		return
+	}
+	info, err := statStoredFile(config, name)
+	if err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, common.FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime().UTC()})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShares(t *testing.T) {
+	storagePath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(storagePath, "report.txt"), []byte("quarterly numbers"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	config := ServerConfig{filesStoragePath: storagePath}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	server := BuildServer(config)
+
+	do := func(method string, target string, token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	share := func(t *testing.T, token string, req common.ShareRequest) common.ShareLink {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		response := do(http.MethodPost, "/v1/shares", token, string(body))
+		if response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var link common.ShareLink
+		json.NewDecoder(response.Body).Decode(&link)
+		return link
+	}
+	// path returns the path and query of the URL of a link.
+	path := func(t *testing.T, link common.ShareLink) string {
+		t.Helper()
+		u, err := url.Parse(link.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.RequestURI()
+	}
+	body, _ := json.Marshal(common.TokenRequest{Name: "partner desk", Grants: []common.Grant{{Prefix: "inbox/", Role: common.RoleWriter}}})
+	var desk common.APIToken
+	json.NewDecoder(do(http.MethodPost, "/v1/admin/tokens", "root-secret", string(body)).Body).Decode(&desk)
+
+	t.Run("download", func(t *testing.T) {
+		link := share(t, "root-secret", common.ShareRequest{Name: "report.txt", Expires: "1h", MaxUses: 2})
+		if !strings.HasPrefix(link.URL, "http://example.com/v1/shared/"+link.ID+"?sig=") {
+			t.Errorf("url %s", link.URL)
+		}
+		for i := 0; i < 2; i++ {
+			response := do(http.MethodGet, path(t, link), "", "")
+			if response.Code != http.StatusOK || response.Body.String() != "quarterly numbers" {
+				t.Fatalf("got %d %s", response.Code, response.Body.String())
+			}
+		}
+		if response := do(http.MethodGet, path(t, link), "", ""); response.Code != http.StatusGone {
+			t.Errorf("got %d after the last download", response.Code)
+		}
+	})
+
+	t.Run("uses are counted once the download starts", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(storagePath, "draft.txt"), []byte("draft"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		link := share(t, "root-secret", common.ShareRequest{Name: "draft.txt", Expires: "1h", MaxUses: 1})
+		if err := os.Remove(filepath.Join(storagePath, "draft.txt")); err != nil {
+			t.Fatal(err)
+		}
+		if response := do(http.MethodGet, path(t, link), "", ""); response.Code != http.StatusNotFound {
+			t.Fatalf("got %d for a missing file", response.Code)
+		}
+		if err := os.WriteFile(filepath.Join(storagePath, "draft.txt"), []byte("draft"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if response := do(http.MethodHead, path(t, link), "", ""); response.Code != http.StatusOK {
+			t.Errorf("got %d on HEAD", response.Code)
+		}
+		request := httptest.NewRequest(http.MethodGet, path(t, link), nil)
+		request.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		if response.Code != http.StatusNotModified {
+			t.Errorf("got %d for an unmodified file", response.Code)
+		}
+		if response := do(http.MethodGet, path(t, link), "", ""); response.Code != http.StatusOK || response.Body.String() != "draft" {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		if response := do(http.MethodGet, path(t, link), "", ""); response.Code != http.StatusGone {
+			t.Errorf("got %d after the only download", response.Code)
+		}
+	})
+
+	t.Run("invalid links", func(t *testing.T) {
+		link := share(t, "root-secret", common.ShareRequest{Name: "report.txt"})
+		tampered := strings.Replace(path(t, link), "sig=", "sig=0", 1)
+		for _, target := range []string{tampered, sharedPrefix + link.ID, sharedPrefix + "nope?sig=x"} {
+			if response := do(http.MethodGet, target, "", ""); response.Code != http.StatusNotFound {
+				t.Errorf("got %d for %s", response.Code, target)
+			}
+		}
+		if response := do(http.MethodPut, sharedPrefix+link.ID+"/x.txt?"+strings.SplitN(path(t, link), "?", 2)[1], "", "x"); response.Code != http.StatusForbidden {
+			t.Errorf("got %d uploading to a download link", response.Code)
+		}
+		for _, req := range []common.ShareRequest{{Name: "report.txt", Expires: "-1h"}, {Name: "report.txt", Mode: "edit"}, {Name: "../x", Mode: common.ShareUpload}} {
+			body, _ := json.Marshal(req)
+			if response := do(http.MethodPost, "/v1/shares", "root-secret", string(body)); response.Code != http.StatusBadRequest {
+				t.Errorf("got %d for %+v", response.Code, req)
+			}
+		}
+		body, _ := json.Marshal(common.ShareRequest{Name: "report.txt"})
+		if response := do(http.MethodPost, "/v1/shares", desk.Token, string(body)); response.Code != http.StatusForbidden {
+			t.Errorf("got %d sharing a file the token cannot read", response.Code)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		link := share(t, "root-secret", common.ShareRequest{Name: "report.txt"})
+		if _, err := config.shares.verify(link.ID, strings.SplitN(path(t, link), "sig=", 2)[1], common.ShareDownload, time.Now().Add(25*time.Hour)); err == nil {
+			t.Errorf("used a link after it expired")
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		link := share(t, desk.Token, common.ShareRequest{Name: "inbox/acme", Mode: common.ShareUpload})
+		query := "?" + strings.SplitN(path(t, link), "?", 2)[1]
+		if response := do(http.MethodPut, sharedPrefix+link.ID+"/invoice.pdf"+query, "", "%PDF"); response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		data, err := os.ReadFile(filepath.Join(storagePath, "inbox", "acme", "invoice.pdf"))
+		if err != nil || string(data) != "%PDF" {
+			t.Errorf("stored %q, %v", data, err)
+		}
+		if response := do(http.MethodPut, sharedPrefix+link.ID+"/invoice.pdf"+query, "", "other"); response.Code != http.StatusConflict {
+			t.Errorf("got %d replacing a dropped file", response.Code)
+		}
+		if response := do(http.MethodGet, path(t, link), "", ""); response.Code != http.StatusForbidden {
+			t.Errorf("got %d downloading with an upload link", response.Code)
+		}
+		body, _ := json.Marshal(common.ShareRequest{Name: "", Mode: common.ShareUpload})
+		if response := do(http.MethodPost, "/v1/shares", desk.Token, string(body)); response.Code != http.StatusForbidden {
+			t.Errorf("got %d for uploads outside the grants of the token", response.Code)
+		}
+	})
+
+	t.Run("list and revoke", func(t *testing.T) {
+		var list common.ShareLinkList
+		json.NewDecoder(do(http.MethodGet, "/v1/shares", desk.Token, "").Body).Decode(&list)
+		if len(list.Links) != 1 || list.Links[0].Uses != 1 || list.Links[0].URL != "" {
+			t.Fatalf("listed %+v", list.Links)
+		}
+		link := list.Links[0]
+		json.NewDecoder(do(http.MethodGet, "/v1/shares", "root-secret", "").Body).Decode(&list)
+		if len(list.Links) != 5 {
+			t.Errorf("admin listed %d links", len(list.Links))
+		}
+		link2 := share(t, "root-secret", common.ShareRequest{Name: "report.txt"})
+		if response := do(http.MethodDelete, "/v1/shares/"+link2.ID, desk.Token, ""); response.Code != http.StatusNotFound {
+			t.Errorf("got %d revoking the link of another token", response.Code)
+		}
+		if response := do(http.MethodDelete, "/v1/shares/"+link.ID, desk.Token, ""); response.Code != http.StatusNoContent {
+			t.Errorf("got %d revoking", response.Code)
+		}
+		if response := do(http.MethodDelete, "/v1/shares/"+link2.ID, "root-secret", ""); response.Code != http.StatusNoContent {
+			t.Errorf("got %d revoking as admin", response.Code)
+		}
+		if response := do(http.MethodGet, path(t, link2), "", ""); response.Code != http.StatusNotFound {
+			t.Errorf("got %d with a revoked link", response.Code)
+		}
+	})
+}
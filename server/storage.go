@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The storage layer is shared by every API that reads or changes stored files,
+// so validation and side effects stay the same however a file arrives.
+//
+// Stored files are addressed by slash separated paths relative to
+// filesStoragePath, e.g. "reports/2024/q1.txt". Path elements starting with a
+// dot are reserved for the server (the meta directory, uploads in progress).
+
+var (
+	errInvalidFileName    = errors.New("invalid file name")
+	errStoredFileNotFound = errors.New("file not found")
+	errStoredFileExists   = errors.New("file already exists")
+)
+
+// validateFilePath checks a stored file path and returns it cleaned.
+func validateFilePath(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("%w %q", errInvalidFileName, name)
+	}
+	cleaned := path.Clean(name)
+	for _, element := range strings.Split(cleaned, "/") {
+		if element == "" || element == "." || element == ".." || strings.HasPrefix(element, ".") {
+			return "", fmt.Errorf("%w %q", errInvalidFileName, name)
+		}
+	}
+	return cleaned, nil
+}
+
+// validateFilePaths cleans names, returning a detail for each invalid one.
+func validateFilePaths(names []string) ([]string, []common.ErrorDetail) {
+	cleaned := make([]string, 0, len(names))
+	invalid := make([]common.ErrorDetail, 0)
+	for _, name := range names {
+		c, err := validateFilePath(name)
+		if err != nil {
+			invalid = append(invalid, common.ErrorDetail{Item: name, Message: err.Error()})
+			continue
+		}
+		cleaned = append(cleaned, c)
+	}
+	return cleaned, invalid
+}
+
+// storageErrorStatus maps errors of the storage layer to HTTP status codes.
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidFileName), errors.Is(err, errInvalidMetadata):
+		return http.StatusBadRequest
+	case errors.Is(err, errPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, errFileOverQuota), errors.Is(err, errFileTooLarge), errors.Is(err, errTooManyFiles):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errTooManyUploads):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errFileInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errScanFailed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errStoredFileNotFound), errors.Is(err, errQuarantineNotFound), errors.Is(err, errTenantNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errStoredFileExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// storedFilePath validates name and returns where it lives on disk.
+func storedFilePath(config ServerConfig, name string) (string, error) {
+	cleaned, err := validateFilePath(name)
+	if err != nil {
+		return "", err
+	}
+	return config.filesStoragePath + "/" + cleaned, nil
+}
+
+// readableFilePath is storedFilePath for files the caller reads.
+func readableFilePath(config ServerConfig, name string) (string, error) {
+	fullPath, err := storedFilePath(config, name)
+	if err != nil {
+		return "", err
+	}
+	if err := config.access.checkRead(name); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
+
+func statStoredFile(config ServerConfig, name string) (os.FileInfo, error) {
+	config.auditEntry.addFile(name)
+	fullPath, err := readableFilePath(config, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if errors.Is(err, os.ErrNotExist) || err == nil && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: %w", name, errStoredFileNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	return config.encryption.fileInfo(fullPath, info), nil
+}
+
+// openStoredFile opens a file for reading, decrypting it if it is sealed.
+func openStoredFile(config ServerConfig, name string) (*storedFile, os.FileInfo, error) {
+	info, err := statStoredFile(config, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fullPath, _ := storedFilePath(config, name)
+	file, err := config.encryption.open(fullPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// hashStoredPath returns the SHA-256 of the plaintext of the stored file at
+// fullPath.
+func hashStoredPath(config ServerConfig, fullPath string) (string, error) {
+	file, err := config.encryption.open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeStoredFile stores the content of r under name, creating parent
+// directories as needed. The content is written to a temporary file first and
+// renamed into place, so readers never see a partially written file. With
+// encryption at rest it is sealed on the way, and with scanning it is scanned
+// before it is renamed. It reports whether the file did not exist before.
+func writeStoredFile(config ServerConfig, name string, r io.Reader) (created bool, err error) {
+	config.auditEntry.addFile(name)
+	fullPath, err := storedFilePath(config, name)
+	if err != nil {
+		return false, err
+	}
+	if err := config.access.checkWrite(name); err != nil {
+		return false, err
+	}
+	if info, err := os.Stat(fullPath); err == nil && !info.Mode().IsRegular() {
+		return false, fmt.Errorf("%s: %w", name, errStoredFileExists)
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0777); err != nil {
+		return false, err
+	}
+	release, err := acquireUploadSlot(config)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	tmpFile, err := os.CreateTemp(filepath.Dir(fullPath), ".upload-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpFile.Name())
+	tenant, hasQuota := config.tenants.get(config.tenant)
+	if hasQuota && tenant.MaxBytes > 0 {
+		// Stop reading once the file cannot fit whatever else is stored.
+		r = io.LimitReader(r, tenant.MaxBytes+1)
+	}
+	if config.maxFileBytes > 0 {
+		r = io.LimitReader(r, config.maxFileBytes+1)
+	}
+	sealed, err := config.encryption.seal(tmpFile)
+	if err != nil {
+		tmpFile.Close()
+		return false, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(sealed, io.TeeReader(r, h))
+	if err == nil {
+		err = sealed.Close()
+	}
+	if err != nil {
+		tmpFile.Close()
+		return false, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return false, err
+	}
+	if config.maxFileBytes > 0 && size > config.maxFileBytes {
+		return false, fmt.Errorf("%s: %w, at most %d bytes", name, errFileTooLarge, config.maxFileBytes)
+	}
+	scanned, err := config.scan.check(config, name, tmpFile.Name(), size)
+	if err != nil {
+		return false, err
+	}
+	if hasQuota {
+		config.tenants.quotaMu.Lock()
+		defer config.tenants.quotaMu.Unlock()
+		if err := checkQuota(config, tenant, name, fullPath, size); err != nil {
+			return false, err
+		}
+	}
+
+	_, statErr := os.Stat(fullPath)
+	created = errors.Is(statErr, os.ErrNotExist)
+	if err := os.Rename(tmpFile.Name(), fullPath); err != nil {
+		return false, err
+	}
+	log.Printf("stored file %s (created: %v)", name, created)
+	if scanned != nil {
+		if _, err := config.metadata.update(name, scanned); err != nil {
+			log.Printf("writeStoredFile err setting the scan status of %s: %v", name, err)
+		}
+	}
+	eventType := common.FileUpdated
+	if created {
+		eventType = common.FileCreated
+	}
+	publishStoredEvent(config, common.FileEvent{
+		Type: eventType, Name: path.Clean(name), Size: size, SHA256: hex.EncodeToString(h.Sum(nil)),
+	})
+	return created, nil
+}
+
+// deleteStoredFile removes a file and any parent directories it leaves empty.
+func deleteStoredFile(config ServerConfig, name string) error {
+	config.auditEntry.addFile(name)
+	if err := config.access.checkWrite(name); err != nil {
+		return err
+	}
+	info, err := statStoredFile(config, name)
+	if err != nil {
+		return err
+	}
+	fullPath, _ := storedFilePath(config, name)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	removeEmptyParents(config, fullPath)
+	if err := config.metadata.replace(name, nil); err != nil {
+		log.Printf("deleteStoredFile err dropping metadata of %s: %v", name, err)
+	}
+	log.Printf("deleted file %s", name)
+	publishStoredEvent(config, common.FileEvent{Type: common.FileDeleted, Name: path.Clean(name), Size: info.Size()})
+	return nil
+}
+
+func removeEmptyParents(config ServerConfig, fullPath string) {
+	root := filepath.Clean(config.filesStoragePath)
+	for dir := filepath.Dir(fullPath); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// copyStoredFile copies from, with its metadata, to to. Unless overwrite is
+// set an existing destination is an errStoredFileExists error. The copy keeps
+// its own scan status.
+func copyStoredFile(config ServerConfig, from string, to string, overwrite bool) error {
+	config.auditEntry.addFile(from)
+	config.auditEntry.addFile(to)
+	if err := config.access.checkWrite(to); err != nil {
+		return err
+	}
+	if !overwrite {
+		if _, err := statStoredFile(config, to); err == nil {
+			return fmt.Errorf("%s: %w", to, errStoredFileExists)
+		}
+	}
+	src, _, err := openStoredFile(config, from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err = writeStoredFile(config, to, src); err != nil {
+		return err
+	}
+	return config.metadata.replace(to, withScanMetadata(config.metadata.get(from), config.metadata.get(to)))
+}
+
+// renameStoredFile moves from, with its metadata, to to. Unless overwrite is set an existing
+// destination is an errStoredFileExists error.
+func renameStoredFile(config ServerConfig, from string, to string, overwrite bool) error {
+	for _, name := range []string{from, to} {
+		config.auditEntry.addFile(name)
+		if err := config.access.checkWrite(name); err != nil {
+			return err
+		}
+	}
+	if _, err := statStoredFile(config, from); err != nil {
+		return err
+	}
+	toPath, err := storedFilePath(config, to)
+	if err != nil {
+		return err
+	}
+	if _, err := statStoredFile(config, to); err == nil && !overwrite {
+		return fmt.Errorf("%s: %w", to, errStoredFileExists)
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), 0777); err != nil {
+		return err
+	}
+	fromPath, _ := storedFilePath(config, from)
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return err
+	}
+	removeEmptyParents(config, fromPath)
+	storedFileRenamed(config, from, to, toPath)
+	return nil
+}
+
+// storedFileRenamed moves the metadata of a file renamed from from to to,
+// now at toPath, and publishes the change.
+func storedFileRenamed(config ServerConfig, from string, to string, toPath string) {
+	if err := config.metadata.rename(from, to); err != nil {
+		log.Printf("renameStoredFile err moving metadata of %s: %v", from, err)
+	}
+	log.Printf("renamed file %s to %s", from, to)
+	event := common.FileEvent{Type: common.FileRenamed, Name: path.Clean(to), OldName: path.Clean(from)}
+	if info, err := os.Stat(toPath); err == nil {
+		event.Size = config.encryption.fileInfo(toPath, info).Size()
+	}
+	if hash, err := hashStoredPath(config, toPath); err == nil {
+		event.SHA256 = hash
+	}
+	publishStoredEvent(config, event)
+}
+
+// publishStoredEvent records a change of a file of the tenant of config.
+func publishStoredEvent(config ServerConfig, event common.FileEvent) {
+	event.Tenant = config.tenant
+	config.events.publish(event)
+}
+
+// updateStoredMetadata applies changes to the metadata of an existing file.
+// The scan keys are left to the scanner.
+func updateStoredMetadata(config ServerConfig, name string, changes map[string]*string) (map[string]string, error) {
+	config.auditEntry.addFile(name)
+	if err := config.access.checkWrite(name); err != nil {
+		return nil, err
+	}
+	for key := range changes {
+		if strings.HasPrefix(key, scanMetadataPrefix) {
+			return nil, fmt.Errorf("%w: keys starting with %q are set by the virus scanner", errInvalidMetadata, scanMetadataPrefix)
+		}
+	}
+	if _, err := statStoredFile(config, name); err != nil {
+		return nil, err
+	}
+	return config.metadata.update(name, changes)
+}
+
+// listStoredFiles walks the store and returns every file whose path starts
+// with prefix and the caller may read, sorted by name. Reserved dot entries
+// are skipped.
+func listStoredFiles(config ServerConfig, prefix string) ([]common.FileInfo, error) {
+	res := make([]common.FileInfo, 0)
+	root := filepath.Clean(config.filesStoragePath)
+	err := filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullPath == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(root, fullPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relPath)
+		if d.IsDir() {
+			// Only descend into directories which can contain matching files.
+			if !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(name, prefix) || !config.access.canRead(name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		info = config.encryption.fileInfo(fullPath, info)
+		res = append(res, common.FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(res, func(a, b common.FileInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res, nil
+}
+
+// hashStoredFiles maps the SHA-256 of every stored file to one file with that
+// content.
+func hashStoredFiles(config ServerConfig) (map[string]string, error) {
+	files, err := listStoredFiles(config, "")
+	if err != nil {
+		return nil, err
+	}
+	hashToFileMap := make(map[string]string)
+	for _, file := range files {
+		hash, err := hashStoredPath(config, config.filesStoragePath+"/"+file.Name)
+		if err != nil {
+			log.Printf("hashStoredFiles err for %s : %v", file.Name, err)
+			continue
+		}
+		if _, ok := hashToFileMap[hash]; !ok {
+			hashToFileMap[hash] = file.Name
+		}
+	}
+	return hashToFileMap, nil
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"file_store/common"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -19,6 +20,68 @@ import (
 
 type ServerConfig struct {
 	filesStoragePath string
+	// metaPath holds server side state such as word frequency snapshots.
+	// Defaults to a hidden directory inside filesStoragePath.
+	metaPath string
+
+	// maxUploadBytes limits the body of every request. Defaults to
+	// defaultMaxUploadBytes.
+	maxUploadBytes int64
+	// maxFileBytes limits each stored file, 0 leaving it to maxUploadBytes.
+	maxFileBytes int64
+	// maxFilesPerRequest limits the files one request names. Defaults to
+	// defaultMaxFilesPerRequest.
+	maxFilesPerRequest int
+	// uploadSlots holds a value per file being stored, limiting concurrent
+	// uploads to its capacity. Nil is unlimited.
+	uploadSlots chan struct{}
+	// rateLimits limits the request rate of each client.
+	rateLimits *rateLimiter
+	// authFailures limits the failed authentications of each client address.
+	authFailures *rateLimiter
+	// encryption seals stored files with its master keys. Nil stores them in
+	// plaintext.
+	encryption *keyring
+	// scan scans uploads before they are stored. Nil stores them unscanned.
+	scan *uploadScanner
+
+	// jobs is set up by BuildServer and shared by all handlers.
+	jobs *jobManager
+	// events records every change of the stored files for /v1/events.
+	events *eventLog
+	// webhooks calls the registered webhooks with those changes.
+	webhooks *webhookManager
+	// metadata holds the user metadata of the stored files.
+	metadata *metadataStore
+	// tokens authenticates requests. Without it, as in tests, every request
+	// is let through.
+	tokens *tokenStore
+	// tenants holds the tenants and their quotas.
+	tenants *tenantStore
+	// shares holds the share links.
+	shares *shareStore
+	// audit records every request; auditEntry is the entry of the current
+	// one, set by forContext.
+	audit      *auditLog
+	auditEntry *auditEntry
+	// access is what the caller of the current request may do, nil when
+	// authentication is off. withConfig and forContext set it, and tenant
+	// when the caller belongs to one, whose storage root is then used.
+	access *accessPolicy
+	tenant string
+	// topLevelOnly is set for the legacy /files routes, whose listings and
+	// analytics only see the files at the top of the store, as before
+	// nested paths.
+	topLevelOnly bool
+
+	// tls, when set, serves HTTPS, gRPC and S3 over TLS, optionally verifying
+	// client certificates.
+	tls *tlsReloader
+
+	// s3AccessKey and s3SecretKey are the credentials S3 clients sign their
+	// requests with. The S3 API only runs when they are set.
+	s3AccessKey string
+	s3SecretKey string
 }
 
 func main() {
@@ -42,11 +105,95 @@ func main() {
 	if strings.HasSuffix(config.filesStoragePath, "/") {
 		config.filesStoragePath = config.filesStoragePath[:len(config.filesStoragePath)-1]
 	}
+	config.metaPath = os.Getenv("STORE_META_PATH")
+	if os.Getenv("STORE_MAX_UPLOAD_BYTES") != "" {
+		maxUploadBytes, err := strconv.ParseInt(os.Getenv("STORE_MAX_UPLOAD_BYTES"), 10, 64)
+		if err != nil || maxUploadBytes < 1 {
+			log.Fatalf("invalid STORE_MAX_UPLOAD_BYTES %q", os.Getenv("STORE_MAX_UPLOAD_BYTES"))
+		}
+		config.maxUploadBytes = maxUploadBytes
+	}
+	config = limitsFromEnv(config)
+	config.encryption = keyringFromEnv()
+	config.scan = scanFromEnv()
+	config = config.withDefaults()
+	if os.Getenv("STORE_SHARE_KEY") != "" {
+		config.shares = newShareStore(config.metaPath, []byte(os.Getenv("STORE_SHARE_KEY")))
+	}
+	config.audit = auditLogFromEnv(config.metaPath)
+
+	if os.Getenv("STORE_AUTH") != "off" {
+		config.tokens = newTokenStore(config.metaPath, os.Getenv("STORE_ADMIN_TOKEN"))
+		if os.Getenv("STORE_ADMIN_TOKEN") == "" && !config.tokens.hasAdmin(time.Now()) {
+			token, err := config.tokens.issue(common.TokenRequest{Name: "bootstrap admin", Admin: true}, nil, time.Now())
+			if err != nil {
+				log.Fatal(err)
+			}
+			path, err := writeBootstrapToken(config.metaPath, token.Token)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("No admin token found, created one valid until %s and saved it in %s; delete the file once it is copied",
+				token.ExpiresAt.Format(time.RFC3339), path)
+		}
+	} else {
+		log.Printf("Authentication disabled by STORE_AUTH=off")
+	}
+
+	certFile, keyFile := os.Getenv("STORE_TLS_CERT"), os.Getenv("STORE_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("STORE_TLS_CERT and STORE_TLS_KEY must be set together")
+	}
+	if certFile != "" {
+		clientCAFile := os.Getenv("STORE_TLS_CLIENT_CA")
+		clientAuth := os.Getenv("STORE_TLS_CLIENT_AUTH")
+		if clientAuth != "" && clientAuth != "optional" && clientAuth != "require" {
+			log.Fatalf("invalid STORE_TLS_CLIENT_AUTH %q, want optional or require", clientAuth)
+		}
+		if clientAuth == "require" && clientCAFile == "" {
+			log.Fatal("STORE_TLS_CLIENT_AUTH=require needs STORE_TLS_CLIENT_CA")
+		}
+		reloader, err := newTLSReloader(certFile, keyFile, clientCAFile, clientAuth == "require")
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.tls = reloader
+	}
+
+	grpcAddr := defaultGRPCAddr
+	if os.Getenv("STORE_GRPC_ADDR") != "" {
+		grpcAddr = os.Getenv("STORE_GRPC_ADDR")
+	}
+	if grpcAddr != "off" {
+		go serveGRPC(config, grpcAddr)
+	}
+
+	config.s3AccessKey = os.Getenv("STORE_S3_ACCESS_KEY")
+	config.s3SecretKey = os.Getenv("STORE_S3_SECRET_KEY")
+	if (config.s3AccessKey == "") != (config.s3SecretKey == "") {
+		log.Fatal("STORE_S3_ACCESS_KEY and STORE_S3_SECRET_KEY must be set together")
+	}
+	s3Addr := defaultS3Addr
+	if os.Getenv("STORE_S3_ADDR") != "" {
+		s3Addr = os.Getenv("STORE_S3_ADDR")
+	}
+	if s3Addr != "off" && config.s3AccessKey != "" {
+		go serveS3(config, s3Addr)
+	} else if s3Addr != "off" {
+		log.Printf("S3 API disabled, STORE_S3_ACCESS_KEY is not set")
+	}
 	server := BuildServer(config)
+	if config.tls != nil {
+		log.Printf("Server started with TLS")
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Printf("Server started")
 	log.Fatal(server.ListenAndServe())
 }
 
+// defaultMetaDirName is skipped by listings since they only return regular files.
+const defaultMetaDirName = ".store_meta"
+
 func IsWritableDir(path string) bool {
 	tmpFile := "tmpfile"
 
@@ -64,21 +211,90 @@ func IsWritableDir(path string) bool {
 func Log(nextHandlerFunc func(writer http.ResponseWriter, req *http.Request)) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
 		startTime := time.Now()
-		log.Printf("[%s] [%s]", req.Method, req.URL.Path)
+		log.Printf("[%s] [%s] [%s]", req.Method, req.URL.Path, writer.Header().Get(requestIDHeader))
 		nextHandlerFunc(writer, req)
 		elapsedTime := time.Since(startTime)
 		log.Printf("[%s] [%s] Done [%s] \n\n", req.Method, req.URL.Path, elapsedTime)
 	})
 }
 
+// validateFileName rejects names that would escape the flat storage directory.
+func validateFileName(name string) error {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// withConfig adapts a handler taking the server config to Log.
+func withConfig(
+	config ServerConfig, handler func(config ServerConfig, w http.ResponseWriter, r *http.Request),
+) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		handler(config.forContext(req.Context()), writer, req)
+	}
+}
+
+// withDefaults fills in the settings left unset. BuildServer and
+// BuildGRPCServer both apply it, so they can share one config.
+func (config ServerConfig) withDefaults() ServerConfig {
+	if config.metaPath == "" {
+		config.metaPath = config.filesStoragePath + "/" + defaultMetaDirName
+	}
+	if config.maxUploadBytes == 0 {
+		config.maxUploadBytes = defaultMaxUploadBytes
+	}
+	if config.maxFilesPerRequest == 0 {
+		config.maxFilesPerRequest = defaultMaxFilesPerRequest
+	}
+	if config.rateLimits == nil {
+		config.rateLimits = newRateLimiter(0, 0)
+	}
+	if config.authFailures == nil {
+		config.authFailures = newRateLimiter(authFailureRate, authFailureBurst)
+	}
+	if config.jobs == nil {
+		config.jobs = newJobManager()
+	}
+	if config.events == nil {
+		config.events = newEventLog(config.metaPath+"/"+eventLogFileName, defaultEventLogSize)
+	}
+	if config.webhooks == nil {
+		config.webhooks = newWebhookManager(config.metaPath, config.events)
+	}
+	if config.metadata == nil {
+		config.metadata = newMetadataStore(config.metaPath)
+	}
+	if config.tenants == nil {
+		config.tenants = newTenantStore(config.metaPath, config.filesStoragePath)
+	}
+	if config.shares == nil {
+		config.shares = newShareStore(config.metaPath, nil)
+	}
+	if config.audit == nil {
+		config.audit = newAuditLog(config.metaPath+"/"+auditFileName, defaultAuditMaxBytes, defaultAuditKeep)
+	}
+	return config
+}
+
 func BuildServer(config ServerConfig) http.Server {
-	http.Handle("/files", Log(
-		func(writer http.ResponseWriter, req *http.Request) {
-			rootHandler(config, writer, req)
-		}))
+	config = config.withDefaults()
+	mux := http.NewServeMux()
+	legacy := config
+	legacy.topLevelOnly = true
+	mux.Handle("/files", Log(withConfig(legacy, rootHandler)))
+	mux.Handle("GET /jobs", Log(withConfig(config, handleListJobs)))
+	mux.Handle("POST /jobs", Log(withConfig(config, handleSubmitJob)))
+	mux.Handle("GET /jobs/{id}", Log(withConfig(config, handleGetJob)))
+	mux.Handle("DELETE /jobs/{id}", Log(withConfig(config, handleCancelJob)))
+	registerV1Routes(mux, config)
+	mux.Handle("GET /openapi.json", Log(handleOpenAPI))
+	mux.Handle("GET /docs", Log(handleDocs))
+	mux.Handle(davPrefix+"/", Log(davHandler(config)))
 	return http.Server{
-		Addr:    ":8080",
-		Handler: http.DefaultServeMux,
+		Addr:      ":8080",
+		Handler:   withRequestID(withAudit(config.audit, "http", withJSONErrors(Auth(config, withLimits(config, mux))))),
+		TLSConfig: config.tls.serverConfig(),
 	}
 }
 
@@ -86,21 +302,39 @@ func rootHandler(config ServerConfig, w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Printf("Failure to parse form %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	switch r.Method {
 	case "GET":
 		if r.Form.Has(strings.ToLower("action")) {
 			log.Printf("GET; action: %s", strings.ToLower(r.Form.Get("action")))
+			if asyncJob(r, strings.ToLower(r.Form.Get("action"))) {
+				submitJob(config, w, r, strings.ToLower(r.Form.Get("action")), r.Form)
+				return
+			}
+			if writingJobKinds[strings.ToLower(r.Form.Get("action"))] && r.Form.Get("async") == "true" {
+				writeError(w, http.StatusBadRequest, "a "+strings.ToLower(r.Form.Get("action"))+" job changes the store, submit it with POST")
+				return
+			}
 			switch strings.ToLower(r.Form.Get("action")) {
 			case "freq-words":
-				handleFrequentWordsAction(config, w)
+				handleFrequentWordsAction(config, w, r)
 			case "wc":
-				handleWordCountAction(config, w)
+				handleWordCountAction(config, w, r)
+			case "grep":
+				handleGrepAction(config, w, r)
+			case "ngrams":
+				handleNgramsAction(config, w, r)
+			case "integrity-scan":
+				handleIntegrityScanAction(config, w, r)
+			case "freq-diff":
+				handleFreqDiffAction(config, w, r)
+			case "freq-snapshot":
+				handleListFreqSnapshotsAction(config, w)
 			default:
 				log.Printf("Unknown action: %s", r.Form.Get("action"))
-				w.WriteHeader(http.StatusBadRequest)
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown action %q", r.Form.Get("action")))
 			}
 		} else {
 			handleListFilesActions(config, w)
@@ -108,11 +342,18 @@ func rootHandler(config ServerConfig, w http.ResponseWriter, r *http.Request) {
 	case "POST", "PUT":
 		if r.Form.Has(strings.ToLower("action")) && strings.ToLower(r.Form.Get("action")) == "try_with_sha256" {
 			tryFileUploadWithHashMatch(config, w, r)
+		} else if strings.ToLower(r.Form.Get("action")) == "freq-snapshot" && asyncJob(r, "freq-snapshot") {
+			submitJob(config, w, r, "freq-snapshot", r.Form)
+		} else if strings.ToLower(r.Form.Get("action")) == "freq-snapshot" {
+			handleFreqSnapshotAction(config, w, r)
 		} else {
 			handleFileUpload(config, w, r)
 		}
 	case "DELETE":
 		handleFileDelete(config, w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
@@ -122,24 +363,20 @@ func handleFileDelete(config ServerConfig, w http.ResponseWriter, r *http.Reques
 	err := json.NewDecoder(r.Body).Decode(&reqBody)
 	if err != nil {
 		log.Printf("handleFileDelete err json Decoder: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkFileCount(config, len(reqBody.Files)); err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
 		return
 	}
 
 	filesToBeDeleted := reqBody.Files
 	resp := common.FileDeletionResponse{UnsuccessfulFileNames: make([]common.FileNameErrorPair, 0)}
 	for _, fileToBeDeleted := range filesToBeDeleted {
-		if _, err := os.Stat(config.filesStoragePath + "/" + fileToBeDeleted); errors.Is(err, os.ErrNotExist) {
-			log.Printf("Error in handleFileDelete: for %s: %v", filesToBeDeleted, err)
-			resp.UnsuccessfulFileNames = append(resp.UnsuccessfulFileNames, common.FileNameErrorPair{
-				FileName: fileToBeDeleted,
-				ErrorMsg: err.Error(),
-			})
-			continue
-		}
-		err := os.Remove(config.filesStoragePath + "/" + fileToBeDeleted)
+		err := deleteStoredFile(config, fileToBeDeleted)
 		if err != nil {
-			log.Printf("Error in handleFileDelete: for %s: %v", filesToBeDeleted, err)
+			log.Printf("Error in handleFileDelete: for %s: %v", fileToBeDeleted, err)
 			resp.UnsuccessfulFileNames = append(resp.UnsuccessfulFileNames, common.FileNameErrorPair{
 				FileName: fileToBeDeleted,
 				ErrorMsg: err.Error(),
@@ -147,12 +384,7 @@ func handleFileDelete(config ServerConfig, w http.ResponseWriter, r *http.Reques
 			continue
 		}
 	}
-	err = json.NewEncoder(w).Encode(resp)
-	if err != nil {
-		log.Printf("handleFileDelete err json Decoder: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func tryFileUploadWithHashMatch(config ServerConfig, w http.ResponseWriter, r *http.Request) {
@@ -162,188 +394,155 @@ func tryFileUploadWithHashMatch(config ServerConfig, w http.ResponseWriter, r *h
 	err := json.NewDecoder(r.Body).Decode(&reqBody)
 	if err != nil {
 		log.Printf("tryFileUploadWithHashMatch err json Decoder: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkFileCount(config, len(reqBody.FileSha256Pairs)); err != nil {
+		writeError(w, storageErrorStatus(err), err.Error())
 		return
 	}
 
-	entries, err := os.ReadDir(config.filesStoragePath)
-	hashExistingFileMap := make(map[string]string)
+	unSuccessfulFilesResp, err := matchFilesByHash(config, reqBody.FileSha256Pairs)
 	if err != nil {
-		log.Printf("tryFileUploadWithHashMatch err readdir: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("tryFileUploadWithHashMatch err: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	for _, e := range entries {
-		log.Printf("tryFileUploadWithHashMatch entry: %s, isRegular: %v",
-			e.Name(), os.FileMode.IsRegular(e.Type()))
-		if !os.FileMode.IsRegular(e.Type()) {
-			continue
-		}
-		sha256OfFileExisting, err := common.CalculateSha256ForFile(config.filesStoragePath + "/" + e.Name())
-		if err != nil {
-			log.Printf("tryFileUploadWithHashMatch err for %s : %v", e.Name(), err)
-			continue
-		}
-		hashExistingFileMap[sha256OfFileExisting] = e.Name()
-	}
+	writeJSON(w, http.StatusOK, unSuccessfulFilesResp)
+	log.Printf("resp for unsuccessful files: %v", unSuccessfulFilesResp)
+}
 
-	for s, s2 := range hashExistingFileMap {
-		log.Printf("hashExistingFileMap item %s %v", s, s2)
+// matchFilesByHash creates every requested file whose content already exists in
+// the store under another name by copying that file. Pairs without a match, or
+// whose copy failed, are returned so the client uploads them instead.
+func matchFilesByHash(config ServerConfig, pairs []common.FileSha256Pair) (*common.TryWithSha256Response, error) {
+	hashExistingFileMap, err := hashStoredFiles(config)
+	if err != nil {
+		return nil, err
 	}
 
 	unSuccessfulFilesResp := common.TryWithSha256Response{UnsuccessfulFileNames: make([]common.FileSha256Pair, 0)}
-	for index, item := range reqBody.FileSha256Pairs {
+	for index, item := range pairs {
 		log.Printf("index %d start file:%s", index, item.FileName)
-		fileNameItem := item.FileName
-		fileHashItem := item.FileHash
-		existingFileName, ok := hashExistingFileMap[fileHashItem]
-		log.Printf("hash for %s : %v", fileNameItem, fileHashItem)
+		existingFileName, ok := hashExistingFileMap[item.FileHash]
 		log.Printf("existingFileName: %s, ok: %v", existingFileName, ok)
-		if ok {
-			log.Printf("found existing matching hash file %s for %s", existingFileName, fileNameItem)
-			for _, value := range hashExistingFileMap {
-				if value == fileNameItem {
-					log.Printf("found existing file  %s ", fileNameItem)
-					continue
-				}
-			}
-			if existingFileName == fileNameItem {
-				log.Printf("found existing file  %s ", fileNameItem)
-				continue
-			} else {
-				dst, err := os.Create(config.filesStoragePath + "/" + fileNameItem)
-				defer dst.Close()
-				if err != nil {
-					log.Printf("added %s to unSuccessfulFilesResp", fileNameItem)
-					unSuccessfulFilesResp.UnsuccessfulFileNames = append(
-						unSuccessfulFilesResp.UnsuccessfulFileNames,
-						item,
-					)
-					continue
-				}
-				log.Printf("creating dest file succecss %s", fileNameItem)
-				fromFile, err := os.Open(config.filesStoragePath + "/" + existingFileName)
-				defer fromFile.Close()
-				if err != nil {
-					log.Printf("added %s to unSuccessfulFilesResp", fileNameItem)
-					unSuccessfulFilesResp.UnsuccessfulFileNames = append(
-						unSuccessfulFilesResp.UnsuccessfulFileNames,
-						item,
-					)
-					continue
-				}
-				_, err = io.Copy(dst, fromFile)
-				if err != nil {
-					log.Printf("added %s to unSuccessfulFilesResp", fileNameItem)
-					unSuccessfulFilesResp.UnsuccessfulFileNames = append(
-						unSuccessfulFilesResp.UnsuccessfulFileNames,
-						item,
-					)
-					continue
-				}
-				log.Printf("file %s has been copied from  %s becauase hash match", fileNameItem, existingFileName)
-			}
-		} else {
-			log.Printf("added %s to unSuccessfulFilesResp", fileNameItem)
-			unSuccessfulFilesResp.UnsuccessfulFileNames = append(
-				unSuccessfulFilesResp.UnsuccessfulFileNames,
-				item,
-			)
+		if !ok {
+			log.Printf("added %s to unSuccessfulFilesResp", item.FileName)
+			unSuccessfulFilesResp.UnsuccessfulFileNames = append(unSuccessfulFilesResp.UnsuccessfulFileNames, item)
+			continue
 		}
-
-		log.Printf("index %d end file:%s", index, item.FileName)
-	}
-	err = json.NewEncoder(w).Encode(unSuccessfulFilesResp)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		if existingFileName == item.FileName {
+			log.Printf("found existing file  %s ", item.FileName)
+			continue
+		}
+		err := copyStoredFile(config, existingFileName, item.FileName, true)
+		if err != nil {
+			log.Printf("added %s to unSuccessfulFilesResp: %v", item.FileName, err)
+			unSuccessfulFilesResp.UnsuccessfulFileNames = append(unSuccessfulFilesResp.UnsuccessfulFileNames, item)
+			continue
+		}
+		log.Printf("file %s has been copied from  %s becauase hash match", item.FileName, existingFileName)
 	}
-	log.Printf("resp for unsuccessful files: %v", unSuccessfulFilesResp)
+	return &unSuccessfulFilesResp, nil
 }
 
 func handleFileUpload(config ServerConfig, w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handling file upload with multipart request")
-	err := r.ParseMultipartForm(32 << 20) //32MB max mem
+	r.Body = http.MaxBytesReader(w, r.Body, config.maxUploadBytes)
+	stored, err := storeFormFiles(config, r)
 	if err != nil {
-		log.Printf("Error in handleFileUpload's ParseMultipartForm: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("error storing file %v", err)
+		writeError(w, uploadErrorStatus(err), err.Error())
 		return
 	}
-	for key := range r.MultipartForm.File {
-		log.Printf("file %s getting processed", key)
-		file, header, err := r.FormFile(key)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	writeJSON(w, http.StatusOK, common.FileInfoList{Files: stored})
+}
+
+// storeFormFiles streams every file of a multipart request into the store
+// under its file name, in order, and returns what was stored. Files are
+// counted as they arrive, so a form naming more than maxFilesPerRequest is
+// refused before the extra files are read; the files before them stay
+// stored.
+func storeFormFiles(config ServerConfig, r *http.Request) ([]common.FileInfo, error) {
+	stored := make([]common.FileInfo, 0)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return stored, fmt.Errorf("%w: %w", errInvalidMultipart, err)
+	}
+	for count := 0; ; {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return stored, nil
+		} else if err != nil {
+			return stored, fmt.Errorf("%w: %w", errInvalidMultipart, err)
 		}
-		defer func(file multipart.File) {
-			err := file.Close()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-		}(file)
-		dst, err := os.Create(config.filesStoragePath + "/" + header.Filename)
+		fileName := part.FileName()
+		if fileName == "" {
+			part.Close()
+			continue
+		}
+		count++
+		if err := checkFileCount(config, count); err != nil {
+			return stored, err
+		}
+		log.Printf("file %s getting processed", fileName)
+		_, err = writeStoredFile(config, fileName, part)
+		part.Close()
 		if err != nil {
-			log.Printf("error creating file %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return stored, err
 		}
-		defer func(dst *os.File) {
-			err := dst.Close()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-		}(dst)
-		if _, err := io.Copy(dst, file); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		info, err := statStoredFile(config, fileName)
+		if err != nil {
+			return stored, err
 		}
-		log.Printf("file %s processing done", key)
+		name, _ := validateFilePath(fileName)
+		stored = append(stored, common.FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime().UTC()})
+		log.Printf("file %s processing done", fileName)
 	}
 }
 
 func handleListFilesActions(config ServerConfig, w http.ResponseWriter) {
 	log.Printf("In handleListFilesActions")
-	w.Header().Set("Content-Type", "application/json")
 	res, err := getListOfFiles(config)
 	if err != nil {
 		log.Printf("Error in handleListFilesActions: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	} else {
-		err = json.NewEncoder(w).Encode(res)
-		if err != nil {
-			log.Printf("Error in handleListFilesActions: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	writeJSON(w, http.StatusOK, res)
 }
 
-func handleWordCountAction(config ServerConfig, w http.ResponseWriter) {
+func handleWordCountAction(config ServerConfig, w http.ResponseWriter, r *http.Request) {
 	log.Printf("In handleWordCountAction")
-	res, err := wordCountOfAllFiles(config)
+	res, err := wordCountOfAllFiles(r.Context(), config, nil)
 	if err != nil {
 		log.Printf("Error in handleWordCountAction: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	} else {
-		w.Write([]byte(res))
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	writeJSON(w, http.StatusOK, res)
 }
 
-func handleFrequentWordsAction(config ServerConfig, w http.ResponseWriter) {
+func handleFrequentWordsAction(config ServerConfig, w http.ResponseWriter, r *http.Request) {
 	log.Printf("In handleFrequentWordsAction")
-	frequentWords, err := getFrequentWords(config)
+	frequentWords, err := getFrequentWords(r.Context(), config, nil)
 	if err != nil {
 		log.Printf("Error getting frequent words: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(*frequentWords)
-		if err != nil {
-			log.Printf("Error encoding frequent words: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	writeJSON(w, http.StatusOK, *frequentWords)
+}
+
+func handleIntegrityScanAction(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleIntegrityScanAction")
+	res, err := integrityScan(r.Context(), config, nil)
+	if err != nil {
+		log.Printf("Error in handleIntegrityScanAction: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
 }
 
 func getListOfFiles(config ServerConfig) (res common.FileList, err error) {
@@ -352,69 +551,121 @@ func getListOfFiles(config ServerConfig) (res common.FileList, err error) {
 		Files: make([]string, 0),
 	}
 
-	entries, err := os.ReadDir(config.filesStoragePath)
+	files, err := listStoredFiles(config, "")
 	if err != nil {
 		log.Printf("Error in getListOfFiles: %v", err)
 		return
 	}
 
-	for _, e := range entries {
-		if os.FileMode.IsRegular(e.Type()) {
-			res.Files = append(res.Files, e.Name())
+	for _, file := range files {
+		if config.topLevelOnly && strings.Contains(file.Name, "/") {
+			continue
 		}
+		res.Files = append(res.Files, file.Name)
 	}
 	log.Printf("getListOfFiles res %v", res)
 	return
 }
 
-func wordCountOfAllFiles(config ServerConfig) (string, error) {
-	log.Printf("In wordCountOfAllFiles")
-	wcCount := 0
-	path := config.filesStoragePath
+// scanWords is the tokenizer shared by all word based analytics: it splits the
+// text on white space and calls onWord for every token in order.
+func scanWords(r io.Reader, onWord func(word string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		onWord(scanner.Text())
+	}
+	return scanner.Err()
+}
 
-	entries, err := os.ReadDir(path)
+// scanWordsInFile runs scanWords over the text extracted from a stored file,
+// see extractText for what is skipped or decompressed on the way.
+func scanWordsInFile(
+	ctx context.Context, keys *keyring, path string, fileName string, onWord func(word string),
+) ([]common.FileNote, error) {
+	return extractText(ctx, keys, path, fileName, func(source string, r io.Reader) error {
+		return scanWords(r, onWord)
+	})
+}
+
+// progressFunc is told how many of the files an analytics run has finished.
+// It may be nil.
+type progressFunc func(done int, total int)
+
+func (progress progressFunc) report(done int, total int) {
+	if progress != nil {
+		progress(done, total)
+	}
+}
+
+func wordCountOfAllFiles(
+	ctx context.Context, config ServerConfig, progress progressFunc,
+) (*common.WordCountServerResponse, error) {
+	log.Printf("In wordCountOfAllFiles")
+	res := common.WordCountServerResponse{Notes: make([]common.FileNote, 0)}
+	list, err := getListOfFiles(config)
 	if err != nil {
-		log.Printf("Error in wordCountOfAllFiles; reading dir %s: %v", path, err)
-		return "", err
+		log.Printf("Error in wordCountOfAllFiles: %v", err)
+		return nil, err
 	}
 
-	for _, e := range entries {
-		file, err := os.Open(path + "/" + e.Name())
+	for i, fileName := range list.Files {
+		progress.report(i, len(list.Files))
+		fullPath, err := readableFilePath(config, fileName)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		scanner := bufio.NewScanner(file)
-		scanner.Split(bufio.ScanWords)
-		for scanner.Scan() {
-			wcCount++
+		notes, err := scanWordsInFile(ctx, config.encryption, fullPath, fileName, func(string) {
+			res.Count++
+		})
+		if err != nil {
+			return nil, err
 		}
+		res.Notes = append(res.Notes, notes...)
 	}
-	log.Printf("wordCountOfAllFiles found %d", wcCount)
-	return strconv.Itoa(wcCount), nil
+	progress.report(len(list.Files), len(list.Files))
+	log.Printf("wordCountOfAllFiles found %d", res.Count)
+	return &res, nil
 }
 
-func getFrequentWords(config ServerConfig) (*common.WcCountServerResponse, error) {
-	log.Printf("Om getFrequentWords")
+// countWordsInFiles is the counting logic behind getFrequentWords: it returns
+// how often every token occurs across the given stored files.
+func countWordsInFiles(
+	ctx context.Context, config ServerConfig, files []string, progress progressFunc,
+) (map[string]int, []common.FileNote, error) {
 	wordToCountMap := make(map[string]int)
-	path := config.filesStoragePath
+	allNotes := make([]common.FileNote, 0)
+	for i, fileName := range files {
+		progress.report(i, len(files))
+		fullPath, err := readableFilePath(config, fileName)
+		if err != nil {
+			return nil, nil, err
+		}
+		notes, err := scanWordsInFile(ctx, config.encryption, fullPath, fileName, func(word string) {
+			wordToCountMap[word]++
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		allNotes = append(allNotes, notes...)
+	}
+	progress.report(len(files), len(files))
+	return wordToCountMap, allNotes, nil
+}
 
-	entries, err := os.ReadDir(path)
+func getFrequentWords(
+	ctx context.Context, config ServerConfig, progress progressFunc,
+) (*common.WcCountServerResponse, error) {
+	log.Printf("Om getFrequentWords")
+	list, err := getListOfFiles(config)
 	if err != nil {
 		log.Printf("Error getting frequent words: %v", err)
 		return nil, err
 	}
-
-	for _, e := range entries {
-		file, err := os.Open(path + "/" + e.Name())
-		if err != nil {
-			log.Printf("Error getting frequent words: %v", err)
-			return nil, err
-		}
-		scanner := bufio.NewScanner(file)
-		scanner.Split(bufio.ScanWords)
-		for scanner.Scan() {
-			wordToCountMap[scanner.Text()]++
-		}
+	wordToCountMap, allNotes, err := countWordsInFiles(ctx, config, list.Files, progress)
+	if err != nil {
+		log.Printf("Error getting frequent words: %v", err)
+		return nil, err
 	}
 
 	top10Words := make([]common.WordCountPair, 0)
@@ -437,6 +688,6 @@ func getFrequentWords(config ServerConfig) (*common.WcCountServerResponse, error
 		log.Printf("top10Words sliced: %v", top10Words)
 	}
 
-	return &common.WcCountServerResponse{WordCountPairs: top10Words}, nil
+	return &common.WcCountServerResponse{WordCountPairs: top10Words, Notes: allNotes}, nil
 
 }
@@ -14,6 +14,7 @@ func TestServerResp(t *testing.T) {
 
 		server := BuildServer(ServerConfig{
 			filesStoragePath: "../test_files",
+			metaPath:         t.TempDir(),
 		})
 		server.Handler.ServeHTTP(response, request)
 		got := response.Body.String()
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tenantsFileName = "tenants.json"
+	// tenantsDirName holds a storage root per tenant. Like every dot entry it
+	// is invisible through the shared store.
+	tenantsDirName = ".tenants"
+)
+
+var (
+	errInvalidTenant  = errors.New("invalid tenant")
+	errTenantNotFound = errors.New("no such tenant")
+	// errQuotaExceeded is answered with 507, errFileOverQuota, for a file
+	// larger than the whole quota, with 413.
+	errQuotaExceeded = errors.New("tenant quota exceeded")
+	errFileOverQuota = errors.New("file larger than the tenant quota")
+)
+
+// tenantStore keeps the tenants and their quotas in metaPath/tenants.json.
+// Like tokens.json, the file is read again when it changes. Each tenant has
+// its storage root under filesStoragePath/.tenants, with its own meta
+// directory, so its files, metadata and snapshots are apart from the others.
+type tenantStore struct {
+	mu       sync.Mutex
+	path     string
+	root     string
+	tenants  map[string]common.Tenant
+	modTime  time.Time
+	metadata map[string]*metadataStore
+	// quotaMu makes checking the usage and storing a file one step, so
+	// concurrent uploads cannot overrun a quota together.
+	quotaMu sync.Mutex
+}
+
+func newTenantStore(metaPath string, filesStoragePath string) *tenantStore {
+	s := &tenantStore{
+		path:     filepath.Join(metaPath, tenantsFileName),
+		root:     filepath.Join(filesStoragePath, tenantsDirName),
+		tenants:  make(map[string]common.Tenant),
+		metadata: make(map[string]*metadataStore),
+	}
+	s.refreshLocked()
+	return s
+}
+
+func (s *tenantStore) refreshLocked() {
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	tenants := make(map[string]common.Tenant)
+	if err := readJSONFile(s.path, &tenants); err != nil {
+		log.Printf("tenantStore err reading %s: %v", s.path, err)
+		return
+	}
+	s.tenants = tenants
+	s.modTime = info.ModTime()
+}
+
+func validateTenantName(name string) error {
+	if _, err := validateFilePath(name); err != nil || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: name %q", errInvalidTenant, name)
+	}
+	return nil
+}
+
+// get returns the tenant called name. A nil store has no tenants.
+func (s *tenantStore) get(name string) (common.Tenant, bool) {
+	if s == nil {
+		return common.Tenant{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	tenant, ok := s.tenants[name]
+	return tenant, ok
+}
+
+func (s *tenantStore) list() []common.Tenant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	res := make([]common.Tenant, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		res = append(res, tenant)
+	}
+	slices.SortFunc(res, func(a, b common.Tenant) int { return strings.Compare(a.Name, b.Name) })
+	return res
+}
+
+// put creates or updates a tenant, reporting whether it is new.
+func (s *tenantStore) put(tenant common.Tenant) (bool, error) {
+	if err := validateTenantName(tenant.Name); err != nil {
+		return false, err
+	}
+	if tenant.MaxBytes < 0 || tenant.MaxFiles < 0 {
+		return false, fmt.Errorf("%w: negative quota", errInvalidTenant)
+	}
+	if err := os.MkdirAll(filepath.Join(s.root, tenant.Name), 0777); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshLocked()
+	_, exists := s.tenants[tenant.Name]
+	tenants := make(map[string]common.Tenant, len(s.tenants)+1)
+	for name, t := range s.tenants {
+		tenants[name] = t
+	}
+	tenants[tenant.Name] = tenant
+	if err := writeJSONFile(s.path, tenants); err != nil {
+		return false, err
+	}
+	s.tenants = tenants
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return !exists, nil
+}
+
+// metadataFor returns the metadata store of a tenant, kept in its meta
+// directory.
+func (s *tenantStore) metadataFor(name string, metaPath string) *metadataStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.metadata[name]; !ok {
+		s.metadata[name] = newMetadataStore(metaPath)
+	}
+	return s.metadata[name]
+}
+
+// forTenant returns config for the storage root of a tenant.
+func (config ServerConfig) forTenant(name string) ServerConfig {
+	config.tenant = name
+	config.filesStoragePath = filepath.Join(config.tenants.root, name)
+	config.metaPath = config.filesStoragePath + "/" + defaultMetaDirName
+	config.metadata = config.tenants.metadataFor(name, config.metaPath)
+	return config
+}
+
+// storageUsage adds up the stored files under filesStoragePath, skipping
+// reserved dot entries as listings do.
+func storageUsage(config ServerConfig) (bytes int64, files int64, err error) {
+	root := filepath.Clean(config.filesStoragePath)
+	err = filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && fullPath == root {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if fullPath != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		bytes += info.Size()
+		files++
+		return nil
+	})
+	return bytes, files, err
+}
+
+// checkQuota tells whether storing size bytes at fullPath keeps the tenant of
+// config within its quotas. The caller holds quotaMu until the file is in
+// place.
+func checkQuota(config ServerConfig, tenant common.Tenant, name string, fullPath string, size int64) error {
+	if tenant.MaxBytes > 0 && size > tenant.MaxBytes {
+		return fmt.Errorf("%s: %w of %d bytes", name, errFileOverQuota, tenant.MaxBytes)
+	}
+	bytes, files, err := storageUsage(config)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(fullPath); err == nil {
+		bytes -= info.Size()
+	} else {
+		files++
+	}
+	if tenant.MaxBytes > 0 && bytes+size > tenant.MaxBytes {
+		return fmt.Errorf("%s: %w, %d of %d bytes used", name, errQuotaExceeded, bytes, tenant.MaxBytes)
+	}
+	if tenant.MaxFiles > 0 && files > tenant.MaxFiles {
+		return fmt.Errorf("%s: %w, %d of %d files used", name, errQuotaExceeded, files-1, tenant.MaxFiles)
+	}
+	return nil
+}
+
+func tenantUsage(config ServerConfig, tenant common.Tenant) (common.TenantUsage, error) {
+	bytes, files, err := storageUsage(config)
+	return common.TenantUsage{Tenant: tenant, Bytes: bytes, Files: files}, err
+}
+
+// handleUsage answers with the usage and quotas of the tenant of the caller,
+// or of the shared store, which has no quotas.
+func handleUsage(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleUsage")
+	tenant, _ := config.tenants.get(config.tenant)
+	usage, err := tenantUsage(config, tenant)
+	if err != nil {
+		log.Printf("Error in handleUsage: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+func handleListTenants(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleListTenants")
+	if !requireAdmin(config, w, r) {
+		return
+	}
+	res := common.TenantList{Tenants: make([]common.TenantUsage, 0)}
+	for _, tenant := range config.tenants.list() {
+		usage, err := tenantUsage(config.forTenant(tenant.Name), tenant)
+		if err != nil {
+			log.Printf("Error in handleListTenants for %s: %v", tenant.Name, err)
+		}
+		res.Tenants = append(res.Tenants, usage)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handlePutTenant creates a tenant (201) or changes its quotas (200).
+func handlePutTenant(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	log.Printf("In handlePutTenant %s", name)
+	if !requireAdmin(config, w, r) {
+		return
+	}
+	var tenant common.Tenant
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&tenant); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tenant.Name = name
+	created, err := config.tenants.put(tenant)
+	if errors.Is(err, errInvalidTenant) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Error in handlePutTenant: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	writeJSON(w, code, tenant)
+}
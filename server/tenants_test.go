@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"file_store/common"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	config := ServerConfig{filesStoragePath: t.TempDir()}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	server := BuildServer(config)
+
+	do := func(method string, target string, token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, request)
+		return response
+	}
+	doJSON := func(method string, target string, token string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		return do(method, target, token, string(data))
+	}
+	issue := func(t *testing.T, tenant string) string {
+		t.Helper()
+		response := doJSON(http.MethodPost, "/v1/admin/tokens", "root-secret", common.TokenRequest{Name: tenant, Tenant: tenant})
+		if response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		var token common.APIToken
+		json.NewDecoder(response.Body).Decode(&token)
+		return token.Token
+	}
+
+	if response := doJSON(http.MethodPut, "/v1/admin/tenants/red", "root-secret", common.Tenant{MaxBytes: 10, MaxFiles: 2}); response.Code != http.StatusCreated {
+		t.Fatalf("got %d %s creating a tenant", response.Code, response.Body.String())
+	}
+	if response := doJSON(http.MethodPut, "/v1/admin/tenants/blue", "root-secret", common.Tenant{}); response.Code != http.StatusCreated {
+		t.Fatalf("got %d creating a tenant", response.Code)
+	}
+	red, blue := issue(t, "red"), issue(t, "blue")
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, req := range []common.TokenRequest{{Name: "x", Tenant: "green"}, {Name: "x", Tenant: "red", Admin: true}} {
+			if response := doJSON(http.MethodPost, "/v1/admin/tokens", "root-secret", req); response.Code != http.StatusBadRequest {
+				t.Errorf("got %d for %+v", response.Code, req)
+			}
+		}
+		if response := doJSON(http.MethodPut, "/v1/admin/tenants/.x", "root-secret", common.Tenant{}); response.Code != http.StatusBadRequest {
+			t.Errorf("got %d for a reserved name", response.Code)
+		}
+		if response := doJSON(http.MethodPut, "/v1/admin/tenants/x", red, common.Tenant{}); response.Code != http.StatusForbidden {
+			t.Errorf("got %d from a tenant token", response.Code)
+		}
+	})
+
+	t.Run("isolation", func(t *testing.T) {
+		if response := do(http.MethodPut, "/v1/files/a.txt", red, "hello"); response.Code != http.StatusCreated {
+			t.Fatalf("got %d %s", response.Code, response.Body.String())
+		}
+		for _, token := range []string{blue, "root-secret"} {
+			var list common.FileInfoList
+			json.NewDecoder(do(http.MethodGet, "/v1/files", token, "").Body).Decode(&list)
+			if len(list.Files) != 0 {
+				t.Errorf("listed %+v of another tenant", list.Files)
+			}
+			if response := do(http.MethodGet, "/v1/files/a.txt", token, ""); response.Code != http.StatusNotFound {
+				t.Errorf("got %d reading the file of another tenant", response.Code)
+			}
+		}
+		hash, _ := common.CalculateSha256ForFile(filepath.Join(config.filesStoragePath, tenantsDirName, "red", "a.txt"))
+		var res common.TryWithSha256Response
+		body := common.TryWithSha256Request{FileSha256Pairs: []common.FileSha256Pair{{FileName: "b.txt", FileHash: hash}}}
+		json.NewDecoder(doJSON(http.MethodPost, "/v1/dedupe/match", blue, body).Body).Decode(&res)
+		if len(res.UnsuccessfulFileNames) != 1 {
+			t.Errorf("hash matched the file of another tenant: %+v", res)
+		}
+		events, _ := config.events.since(0)
+		if len(events) == 0 || events[len(events)-1].Tenant != "red" {
+			t.Errorf("events %+v", events)
+		}
+	})
+
+	t.Run("quotas", func(t *testing.T) {
+		for _, c := range []struct {
+			name    string
+			content string
+			code    int
+		}{
+			{"big.txt", "01234567890", http.StatusRequestEntityTooLarge},
+			{"b.txt", "123456", http.StatusInsufficientStorage},
+			{"b.txt", "12345", http.StatusCreated},
+			{"c.txt", "", http.StatusInsufficientStorage},
+			{"a.txt", "hi", http.StatusNoContent},
+		} {
+			if response := do(http.MethodPut, "/v1/files/"+c.name, red, c.content); response.Code != c.code {
+				t.Errorf("got %d storing %d bytes in %s, want %d", response.Code, len(c.content), c.name, c.code)
+			}
+		}
+		if response := do(http.MethodPut, "/v1/files/c.txt", blue, strings.Repeat("x", 100)); response.Code != http.StatusCreated {
+			t.Errorf("got %d without quotas", response.Code)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		var usage common.TenantUsage
+		json.NewDecoder(do(http.MethodGet, "/v1/usage", red, "").Body).Decode(&usage)
+		if usage.Name != "red" || usage.Bytes != 7 || usage.Files != 2 || usage.MaxBytes != 10 {
+			t.Errorf("usage %+v", usage)
+		}
+		var list common.TenantList
+		json.NewDecoder(do(http.MethodGet, "/v1/admin/tenants", "root-secret", "").Body).Decode(&list)
+		if len(list.Tenants) != 2 || list.Tenants[0].Name != "blue" || list.Tenants[0].Bytes != 100 || list.Tenants[1].Files != 2 {
+			t.Errorf("tenants %+v", list.Tenants)
+		}
+		if response := do(http.MethodGet, "/v1/admin/tenants", red, ""); response.Code != http.StatusForbidden {
+			t.Errorf("got %d listing tenants", response.Code)
+		}
+	})
+}
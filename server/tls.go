@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsCheckInterval is how often, at most, the certificate files are checked
+// for changes.
+const tlsCheckInterval = time.Second
+
+// tlsReloader serves the certificate and key in certFile and keyFile, and
+// verifies client certificates against the CA bundle in clientCAFile if set.
+// The files are read again when they change, so renewed certificates are
+// picked up without a restart.
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+// newTLSReloader loads the files once, failing if they cannot be used.
+// requireClientCert rejects connections without a valid client certificate
+// instead of only verifying certificates that are sent.
+func newTLSReloader(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tlsReloader, error) {
+	r := &tlsReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile, clientAuth: tls.NoClientCert}
+	if clientCAFile != "" {
+		r.clientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			r.clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) fileModTimes() []time.Time {
+	res := make([]time.Time, 0, 3)
+	for _, file := range r.files() {
+		var modTime time.Time
+		if info, err := os.Stat(file); err == nil {
+			modTime = info.ModTime()
+		}
+		res = append(res, modTime)
+	}
+	return res
+}
+
+// load reads the files into a new config. The caller holds mu, or has not
+// shared r yet.
+func (r *tlsReloader) load() error {
+	modTimes := r.fileModTimes()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", r.clientCAFile)
+		}
+	}
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
+
+// current returns the config of the files as they are now. A failed reload,
+// e.g. while a new certificate is half written, keeps the previous one.
+func (r *tlsReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < tlsCheckInterval {
+		return r.config
+	}
+	r.checkedAt = time.Now()
+	modTimes := r.fileModTimes()
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			if err := r.load(); err != nil {
+				log.Printf("tlsReloader err reloading %v: %v", r.files(), err)
+			} else {
+				log.Printf("reloaded TLS certificates")
+			}
+			break
+		}
+	}
+	return r.config
+}
+
+// serverConfig is the config for listeners, handing out the current files for
+// every connection. A nil reloader, without TLS, has none.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	if r == nil {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// clientCertIdentity returns the common name of the verified client
+// certificate of a connection, if it has one.
+func clientCertIdentity(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cn := state.VerifiedChains[0][0].Subject.CommonName
+	return cn, cn != ""
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"file_store/common"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for cn, valid for localhost.
+func (ca *testCA) issue(t *testing.T, cn string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeServerCert := func(t *testing.T, cn string, serial int64) {
+		t.Helper()
+		certPEM, keyPEM := ca.issue(t, cn, serial, x509.ExtKeyUsageServerAuth)
+		if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeServerCert(t, "server one", 2)
+	if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := ServerConfig{filesStoragePath: t.TempDir()}.withDefaults()
+	config.tokens = newTokenStore(config.metaPath, "root-secret")
+	reloader, err := newTLSReloader(certFile, keyFile, caFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.tls = reloader
+	ts := httptest.NewUnstartedServer(BuildServer(config).Handler)
+	ts.TLS = config.tls.serverConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientCertPEM, clientKeyPEM := ca.issue(t, "ci-bot", 3, x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+
+	body := strings.NewReader(`{"name": "ci", "client_cn": "ci-bot", "grants": [{"prefix": "ci/", "role": "writer"}]}`)
+	request, _ := http.NewRequest(http.MethodPost, ts.URL+"/v1/admin/tokens", body)
+	request.Header.Set("Authorization", "Bearer root-secret")
+	response, err := newClient().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token common.APIToken
+	json.NewDecoder(response.Body).Decode(&token)
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated || token.ClientCN != "ci-bot" {
+		t.Fatalf("got %d %+v", response.StatusCode, token)
+	}
+
+	t.Run("client certificate", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPut, ts.URL+"/v1/files/ci/out.txt", strings.NewReader("built"))
+		response, err := newClient(clientCert).Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusCreated {
+			t.Errorf("got %d with a client certificate", response.StatusCode)
+		}
+		request, _ = http.NewRequest(http.MethodPut, ts.URL+"/v1/files/other.txt", strings.NewReader("x"))
+		response, err = newClient(clientCert).Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusForbidden {
+			t.Errorf("got %d outside the grants of the mapped token", response.StatusCode)
+		}
+		response, err = newClient().Get(ts.URL + "/v1/files")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got %d without a certificate or token", response.StatusCode)
+		}
+	})
+
+	t.Run("duplicate client_cn", func(t *testing.T) {
+		_, err := config.tokens.issue(common.TokenRequest{Name: "other", ClientCN: "ci-bot"}, nil, time.Now())
+		if err == nil {
+			t.Errorf("issued a second token for the same client_cn")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		serverCN := func() string {
+			conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		if cn := serverCN(); cn != "server one" {
+			t.Fatalf("served %q", cn)
+		}
+		writeServerCert(t, "server two", 4)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+		reloader.mu.Lock()
+		reloader.checkedAt = time.Time{}
+		reloader.mu.Unlock()
+		if cn := serverCN(); cn != "server two" {
+			t.Errorf("served %q after the certificate changed", cn)
+		}
+
+		os.WriteFile(certFile, []byte("garbage"), 0600)
+		os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute))
+		reloader.mu.Lock()
+		reloader.checkedAt = time.Time{}
+		reloader.mu.Unlock()
+		if cn := serverCN(); cn != "server two" {
+			t.Errorf("served %q after a broken certificate", cn)
+		}
+	})
+}
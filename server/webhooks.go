@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file_store/common"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhooksFileName           = "webhooks.json"
+	webhookDeadLettersFileName = "webhook-dead-letters.json"
+	// webhookMaxAttempts is how often a delivery is tried before it goes to the
+	// dead letters; the wait doubles from webhookInitialBackoff after each try.
+	webhookMaxAttempts    = 6
+	webhookInitialBackoff = time.Second
+	webhookTimeout        = 10 * time.Second
+	maxWebhookDeadLetters = 1000
+
+	// webhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+	// body, keyed with the webhook's secret.
+	webhookSignatureHeader = "X-Store-Signature"
+	webhookEventHeader     = "X-Store-Event"
+	webhookDeliveryHeader  = "X-Store-Delivery"
+)
+
+var (
+	errInvalidWebhook     = errors.New("invalid webhook")
+	errWebhookNotFound    = errors.New("no such webhook")
+	errDeadLetterNotFound = errors.New("no such dead letter")
+)
+
+// webhookManager calls the registered webhooks for every change of the store.
+// Webhooks and dead letters are kept in the meta directory.
+type webhookManager struct {
+	mu          sync.Mutex
+	dir         string
+	webhooks    []common.Webhook
+	deadLetters []common.WebhookDelivery
+
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+func newWebhookManager(metaPath string, events *eventLog) *webhookManager {
+	m := &webhookManager{
+		dir:            metaPath,
+		webhooks:       make([]common.Webhook, 0),
+		deadLetters:    make([]common.WebhookDelivery, 0),
+		client:         &http.Client{Timeout: webhookTimeout},
+		maxAttempts:    webhookMaxAttempts,
+		initialBackoff: webhookInitialBackoff,
+	}
+	var list common.WebhookList
+	if err := readJSONFile(filepath.Join(m.dir, webhooksFileName), &list); err != nil {
+		log.Printf("newWebhookManager err: %v", err)
+	} else if list.Webhooks != nil {
+		m.webhooks = list.Webhooks
+	}
+	var deadLetters common.WebhookDeliveryList
+	if err := readJSONFile(filepath.Join(m.dir, webhookDeadLettersFileName), &deadLetters); err != nil {
+		log.Printf("newWebhookManager err: %v", err)
+	} else if deadLetters.Deliveries != nil {
+		m.deadLetters = deadLetters.Deliveries
+	}
+	ch, sent, _ := events.subscribe()
+	go m.watch(events, ch, sent)
+	return m
+}
+
+// readJSONFile decodes a file written by writeJSONFile; a missing file leaves
+// v unchanged.
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces path with v as JSON, through a temporary file so a
+// crash never leaves half a file.
+func writeJSONFile(path string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// watch dispatches every event of the log. If it falls behind, it catches up
+// from the log instead of dropping events.
+func (m *webhookManager) watch(events *eventLog, ch chan common.FileEvent, sent int64) {
+	for {
+		event, ok := <-ch
+		if ok {
+			if event.Seq > sent {
+				sent = event.Seq
+				m.dispatch(event)
+			}
+			continue
+		}
+		var lastSeq int64
+		ch, lastSeq, _ = events.subscribe()
+		missed, _ := events.since(sent)
+		for _, event := range missed {
+			if event.Seq <= lastSeq {
+				m.dispatch(event)
+			}
+		}
+		sent = lastSeq
+	}
+}
+
+func webhookMatches(webhook common.Webhook, event common.FileEvent) bool {
+	if len(webhook.Types) > 0 && !slices.Contains(webhook.Types, event.Type) {
+		return false
+	}
+	return strings.HasPrefix(event.Name, webhook.Prefix) ||
+		event.OldName != "" && strings.HasPrefix(event.OldName, webhook.Prefix)
+}
+
+func (m *webhookManager) dispatch(event common.FileEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, webhook := range m.webhooks {
+		if webhookMatches(webhook, event) {
+			go m.deliver(common.WebhookDelivery{ID: newJobID(), WebhookID: webhook.ID, Event: event})
+		}
+	}
+}
+
+// deliver calls the webhook until it answers with a 2xx status, waiting
+// longer after each failure. Deliveries that fail every attempt become dead
+// letters; they are dropped when the webhook is deleted meanwhile.
+func (m *webhookManager) deliver(delivery common.WebhookDelivery) {
+	backoff := m.initialBackoff
+	for {
+		webhook, ok := m.get(delivery.WebhookID)
+		if !ok {
+			return
+		}
+		delivery.Attempts++
+		err := m.send(webhook, delivery)
+		if err == nil {
+			return
+		}
+		log.Printf("webhook %s delivery %s attempt %d failed: %v", webhook.ID, delivery.ID, delivery.Attempts, err)
+		if delivery.Attempts >= m.maxAttempts {
+			delivery.LastError = err.Error()
+			delivery.FailedAt = time.Now().UTC()
+			m.addDeadLetter(delivery)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *webhookManager) send(webhook common.Webhook, delivery common.WebhookDelivery) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.Event.Type)
+	req.Header.Set(webhookDeliveryHeader, delivery.ID)
+	req.Header.Set(webhookSignatureHeader, signWebhookBody(webhook.Secret, body))
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("bad status %s", res.Status)
+	}
+	return nil
+}
+
+func (m *webhookManager) get(id string) (common.Webhook, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.webhooks, func(w common.Webhook) bool { return w.ID == id })
+	if i < 0 {
+		return common.Webhook{}, false
+	}
+	return m.webhooks[i], true
+}
+
+func (m *webhookManager) list() []common.Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]common.Webhook, 0, len(m.webhooks))
+	for _, webhook := range m.webhooks {
+		webhook.Secret = ""
+		res = append(res, webhook)
+	}
+	return res
+}
+
+func validateWebhookRequest(req common.WebhookRequest) error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url %q must be an absolute http or https URL", errInvalidWebhook, req.URL)
+	}
+	for _, eventType := range req.Types {
+		if !slices.Contains([]string{common.FileCreated, common.FileUpdated, common.FileDeleted, common.FileRenamed}, eventType) {
+			return fmt.Errorf("%w: unknown event type %q", errInvalidWebhook, eventType)
+		}
+	}
+	return nil
+}
+
+func (m *webhookManager) add(req common.WebhookRequest) (common.Webhook, error) {
+	if err := validateWebhookRequest(req); err != nil {
+		return common.Webhook{}, err
+	}
+	if req.Secret == "" {
+		buf := make([]byte, 32)
+		_, _ = rand.Read(buf)
+		req.Secret = hex.EncodeToString(buf)
+	}
+	webhook := common.Webhook{ID: newJobID(), WebhookRequest: req, CreatedAt: time.Now().UTC()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhooks := append(slices.Clip(m.webhooks), webhook)
+	if err := writeJSONFile(filepath.Join(m.dir, webhooksFileName), common.WebhookList{Webhooks: webhooks}); err != nil {
+		return common.Webhook{}, err
+	}
+	m.webhooks = webhooks
+	log.Printf("webhook %s added for %s", webhook.ID, webhook.URL)
+	return webhook, nil
+}
+
+func (m *webhookManager) remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.webhooks, func(w common.Webhook) bool { return w.ID == id })
+	if i < 0 {
+		return errWebhookNotFound
+	}
+	webhooks := slices.Delete(slices.Clone(m.webhooks), i, i+1)
+	if err := writeJSONFile(filepath.Join(m.dir, webhooksFileName), common.WebhookList{Webhooks: webhooks}); err != nil {
+		return err
+	}
+	m.webhooks = webhooks
+	log.Printf("webhook %s removed", id)
+	return nil
+}
+
+func (m *webhookManager) addDeadLetter(delivery common.WebhookDelivery) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadLetters = append(m.deadLetters, delivery)
+	if len(m.deadLetters) > maxWebhookDeadLetters {
+		m.deadLetters = slices.Clone(m.deadLetters[len(m.deadLetters)-maxWebhookDeadLetters:])
+	}
+	m.saveDeadLettersLocked()
+}
+
+func (m *webhookManager) saveDeadLettersLocked() {
+	path := filepath.Join(m.dir, webhookDeadLettersFileName)
+	if err := writeJSONFile(path, common.WebhookDeliveryList{Deliveries: m.deadLetters}); err != nil {
+		log.Printf("webhookManager err writing %s: %v", path, err)
+	}
+}
+
+func (m *webhookManager) listDeadLetters() []common.WebhookDelivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.deadLetters)
+}
+
+// takeDeadLetter removes a dead letter and returns it.
+func (m *webhookManager) takeDeadLetter(id string) (common.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.deadLetters, func(d common.WebhookDelivery) bool { return d.ID == id })
+	if i < 0 {
+		return common.WebhookDelivery{}, errDeadLetterNotFound
+	}
+	delivery := m.deadLetters[i]
+	m.deadLetters = slices.Delete(slices.Clone(m.deadLetters), i, i+1)
+	m.saveDeadLettersLocked()
+	return delivery, nil
+}
+
+func handleListWebhooks(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, common.WebhookList{Webhooks: config.webhooks.list()})
+}
+
+func handleCreateWebhook(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleCreateWebhook")
+	var reqBody common.WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		log.Printf("handleCreateWebhook err json Decoder: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	webhook, err := config.webhooks.add(reqBody)
+	if err != nil {
+		log.Printf("Error in handleCreateWebhook: %v", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errInvalidWebhook) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/v1/webhooks/"+webhook.ID)
+	writeJSON(w, http.StatusCreated, webhook)
+}
+
+func handleGetWebhook(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	webhook, ok := config.webhooks.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errWebhookNotFound.Error())
+		return
+	}
+	webhook.Secret = ""
+	writeJSON(w, http.StatusOK, webhook)
+}
+
+func handleDeleteWebhook(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleDeleteWebhook %s", r.PathValue("id"))
+	err := config.webhooks.remove(r.PathValue("id"))
+	if errors.Is(err, errWebhookNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("Error in handleDeleteWebhook: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleListWebhookDeadLetters(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, common.WebhookDeliveryList{Deliveries: config.webhooks.listDeadLetters()})
+}
+
+// handleRedeliverWebhook takes a dead letter off the list and delivers it
+// again, with a fresh set of attempts.
+func handleRedeliverWebhook(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleRedeliverWebhook %s", r.PathValue("id"))
+	delivery, err := config.webhooks.takeDeadLetter(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	delivery.Attempts, delivery.LastError, delivery.FailedAt = 0, "", time.Time{}
+	go config.webhooks.deliver(delivery)
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+func handleDeleteWebhookDeadLetter(config ServerConfig, w http.ResponseWriter, r *http.Request) {
+	log.Printf("In handleDeleteWebhookDeadLetter %s", r.PathValue("id"))
+	if _, err := config.webhooks.takeDeadLetter(r.PathValue("id")); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
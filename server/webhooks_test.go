@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"file_store/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	storagePath := t.TempDir()
+	config := ServerConfig{filesStoragePath: storagePath}.withDefaults()
+	config.webhooks.initialBackoff = time.Millisecond
+	config.webhooks.maxAttempts = 3
+	server := BuildServer(config)
+
+	type received struct {
+		event     common.FileEvent
+		signature string
+	}
+	var mu sync.Mutex
+	var deliveries []received
+	failing := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasSuffix(r.URL.Path, "/failing") && failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event common.FileEvent
+		json.Unmarshal(body, &event)
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries = append(deliveries, received{event, r.Header.Get(webhookSignatureHeader)})
+		if r.Header.Get(webhookSignatureHeader) != signWebhookBody("s3cret", body) {
+			t.Errorf("bad signature %q", r.Header.Get(webhookSignatureHeader))
+		}
+	}))
+	defer receiver.Close()
+
+	do := func(method string, target string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader = http.NoBody
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		response := httptest.NewRecorder()
+		server.Handler.ServeHTTP(response, httptest.NewRequest(method, target, reader))
+		return response
+	}
+	waitFor := func(t *testing.T, what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			ok := cond()
+			mu.Unlock()
+			if ok {
+				return
+			}
+		}
+		t.Fatalf("timed out waiting for %s", what)
+	}
+
+	response := do(http.MethodPost, "/v1/webhooks", common.WebhookRequest{
+		URL: receiver.URL + "/hook", Secret: "s3cret", Types: []string{common.FileCreated, common.FileRenamed}, Prefix: "docs/",
+	})
+	if response.Code != http.StatusCreated {
+		t.Fatalf("got %d %s", response.Code, response.Body.String())
+	}
+	var webhook common.Webhook
+	json.NewDecoder(response.Body).Decode(&webhook)
+	if response := do(http.MethodPost, "/v1/webhooks", common.WebhookRequest{URL: "ftp://x"}); response.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid url", response.Code)
+	}
+	response = do(http.MethodGet, "/v1/webhooks", nil)
+	if !strings.Contains(response.Body.String(), webhook.ID) || strings.Contains(response.Body.String(), "s3cret") {
+		t.Errorf("list %s", response.Body.String())
+	}
+
+	t.Run("filtered and signed deliveries", func(t *testing.T) {
+		writeStoredFile(config, "docs/a.txt", strings.NewReader("alpha"))
+		writeStoredFile(config, "other/b.txt", strings.NewReader("beta"))
+		writeStoredFile(config, "docs/a.txt", strings.NewReader("alpha beta"))
+		if err := renameStoredFile(config, "docs/a.txt", "docs/c.txt", false); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "two deliveries", func() bool { return len(deliveries) >= 2 })
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if len(deliveries) != 2 {
+			t.Fatalf("got %d deliveries: %+v", len(deliveries), deliveries)
+		}
+		types := []string{deliveries[0].event.Type, deliveries[1].event.Type}
+		if !strings.Contains(strings.Join(types, ","), common.FileCreated) || !strings.Contains(strings.Join(types, ","), common.FileRenamed) {
+			t.Errorf("delivered %v", types)
+		}
+	})
+
+	t.Run("retries end in dead letters", func(t *testing.T) {
+		response := do(http.MethodPost, "/v1/webhooks", common.WebhookRequest{URL: receiver.URL + "/failing", Secret: "s3cret", Types: []string{common.FileDeleted}})
+		if response.Code != http.StatusCreated {
+			t.Fatalf("got %d", response.Code)
+		}
+		deleteStoredFile(config, "other/b.txt")
+		var deadLetters common.WebhookDeliveryList
+		waitFor(t, "a dead letter", func() bool {
+			json.NewDecoder(do(http.MethodGet, "/v1/webhooks/dead-letters", nil).Body).Decode(&deadLetters)
+			return len(deadLetters.Deliveries) == 1
+		})
+		if deadLetter := deadLetters.Deliveries[0]; deadLetter.Attempts != 3 || deadLetter.Event.Name != "other/b.txt" {
+			t.Errorf("dead letter %+v", deadLetter)
+		}
+
+		mu.Lock()
+		failing = false
+		mu.Unlock()
+		response = do(http.MethodPost, "/v1/webhooks/dead-letters/"+deadLetters.Deliveries[0].ID+"/redeliver", nil)
+		if response.Code != http.StatusAccepted {
+			t.Fatalf("got %d on redeliver", response.Code)
+		}
+		waitFor(t, "the redelivery", func() bool {
+			return deliveries[len(deliveries)-1].event.Type == common.FileDeleted
+		})
+		if response := do(http.MethodGet, "/v1/webhooks/dead-letters", nil); strings.Contains(response.Body.String(), "other/b.txt") {
+			t.Errorf("dead letter still listed: %s", response.Body.String())
+		}
+	})
+
+	t.Run("webhooks persist", func(t *testing.T) {
+		if response := do(http.MethodDelete, "/v1/webhooks/"+webhook.ID, nil); response.Code != http.StatusNoContent {
+			t.Errorf("got %d on delete", response.Code)
+		}
+		if response := do(http.MethodGet, "/v1/webhooks/"+webhook.ID, nil); response.Code != http.StatusNotFound {
+			t.Errorf("got %d after delete", response.Code)
+		}
+		reloaded := newWebhookManager(config.metaPath, newEventLog(t.TempDir()+"/events.log", 10))
+		if webhooks := reloaded.list(); len(webhooks) != 1 || webhooks[0].URL != receiver.URL+"/failing" {
+			t.Errorf("reloaded %+v", webhooks)
+		}
+	})
+}
@@ -0,0 +1,517 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: store/v1/store.proto
+
+package storepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	FileStore_Upload_FullMethodName        = "/store.v1.FileStore/Upload"
+	FileStore_Download_FullMethodName      = "/store.v1.FileStore/Download"
+	FileStore_List_FullMethodName          = "/store.v1.FileStore/List"
+	FileStore_Delete_FullMethodName        = "/store.v1.FileStore/Delete"
+	FileStore_MatchHashes_FullMethodName   = "/store.v1.FileStore/MatchHashes"
+	FileStore_WordCount_FullMethodName     = "/store.v1.FileStore/WordCount"
+	FileStore_FrequentWords_FullMethodName = "/store.v1.FileStore/FrequentWords"
+	FileStore_Ngrams_FullMethodName        = "/store.v1.FileStore/Ngrams"
+	FileStore_Grep_FullMethodName          = "/store.v1.FileStore/Grep"
+	FileStore_FreqDiff_FullMethodName      = "/store.v1.FileStore/FreqDiff"
+	FileStore_IntegrityScan_FullMethodName = "/store.v1.FileStore/IntegrityScan"
+)
+
+// FileStoreClient is the client API for FileStore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// FileStore is the gRPC form of the /v1 HTTP API. Both share the server's
+// storage layer, so files are addressed by the same slash separated paths.
+type FileStoreClient interface {
+	// Upload stores a file. The first message carries the header, the rest
+	// carry the content.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadResponse], error)
+	// Download streams a file. The first message carries its info.
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error)
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// MatchHashes creates files from stored files with the same SHA-256 and
+	// returns the ones the client has to upload.
+	MatchHashes(ctx context.Context, in *MatchHashesRequest, opts ...grpc.CallOption) (*MatchHashesResponse, error)
+	WordCount(ctx context.Context, in *WordCountRequest, opts ...grpc.CallOption) (*WordCountResponse, error)
+	FrequentWords(ctx context.Context, in *FrequentWordsRequest, opts ...grpc.CallOption) (*FrequentWordsResponse, error)
+	Ngrams(ctx context.Context, in *NgramsRequest, opts ...grpc.CallOption) (*NgramsResponse, error)
+	Grep(ctx context.Context, in *GrepRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GrepLine], error)
+	FreqDiff(ctx context.Context, in *FreqDiffRequest, opts ...grpc.CallOption) (*FreqDiffResponse, error)
+	IntegrityScan(ctx context.Context, in *IntegrityScanRequest, opts ...grpc.CallOption) (*IntegrityScanResponse, error)
+}
+
+type fileStoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFileStoreClient(cc grpc.ClientConnInterface) FileStoreClient {
+	return &fileStoreClient{cc}
+}
+
+func (c *fileStoreClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileStore_ServiceDesc.Streams[0], FileStore_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, UploadResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileStore_UploadClient = grpc.ClientStreamingClient[UploadRequest, UploadResponse]
+
+func (c *fileStoreClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileStore_ServiceDesc.Streams[1], FileStore_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadRequest, DownloadResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileStore_DownloadClient = grpc.ServerStreamingClient[DownloadResponse]
+
+func (c *fileStoreClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, FileStore_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStoreClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, FileStore_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStoreClient) MatchHashes(ctx context.Context, in *MatchHashesRequest, opts ...grpc.CallOption) (*MatchHashesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MatchHashesResponse)
+	err := c.cc.Invoke(ctx, FileStore_MatchHashes_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStoreClient) WordCount(ctx context.Context, in *WordCountRequest, opts ...grpc.CallOption) (*WordCountResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(WordCountResponse)
+	err := c.cc.Invoke(ctx, FileStore_WordCount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStoreClient) FrequentWords(ctx context.Context, in *FrequentWordsRequest, opts ...grpc.CallOption) (*FrequentWordsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FrequentWordsResponse)
+	err := c.cc.Invoke(ctx, FileStore_FrequentWords_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStoreClient) Ngrams(ctx context.Context, in *NgramsRequest, opts ...grpc.CallOption) (*NgramsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(NgramsResponse)
+	err := c.cc.Invoke(ctx, FileStore_Ngrams_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStoreClient) Grep(ctx context.Context, in *GrepRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GrepLine], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileStore_ServiceDesc.Streams[2], FileStore_Grep_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GrepRequest, GrepLine]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileStore_GrepClient = grpc.ServerStreamingClient[GrepLine]
+
+func (c *fileStoreClient) FreqDiff(ctx context.Context, in *FreqDiffRequest, opts ...grpc.CallOption) (*FreqDiffResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FreqDiffResponse)
+	err := c.cc.Invoke(ctx, FileStore_FreqDiff_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileStoreClient) IntegrityScan(ctx context.Context, in *IntegrityScanRequest, opts ...grpc.CallOption) (*IntegrityScanResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(IntegrityScanResponse)
+	err := c.cc.Invoke(ctx, FileStore_IntegrityScan_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FileStoreServer is the server API for FileStore service.
+// All implementations must embed UnimplementedFileStoreServer
+// for forward compatibility.
+//
+// FileStore is the gRPC form of the /v1 HTTP API. Both share the server's
+// storage layer, so files are addressed by the same slash separated paths.
+type FileStoreServer interface {
+	// Upload stores a file. The first message carries the header, the rest
+	// carry the content.
+	Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error
+	// Download streams a file. The first message carries its info.
+	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// MatchHashes creates files from stored files with the same SHA-256 and
+	// returns the ones the client has to upload.
+	MatchHashes(context.Context, *MatchHashesRequest) (*MatchHashesResponse, error)
+	WordCount(context.Context, *WordCountRequest) (*WordCountResponse, error)
+	FrequentWords(context.Context, *FrequentWordsRequest) (*FrequentWordsResponse, error)
+	Ngrams(context.Context, *NgramsRequest) (*NgramsResponse, error)
+	Grep(*GrepRequest, grpc.ServerStreamingServer[GrepLine]) error
+	FreqDiff(context.Context, *FreqDiffRequest) (*FreqDiffResponse, error)
+	IntegrityScan(context.Context, *IntegrityScanRequest) (*IntegrityScanResponse, error)
+	mustEmbedUnimplementedFileStoreServer()
+}
+
+// UnimplementedFileStoreServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFileStoreServer struct{}
+
+func (UnimplementedFileStoreServer) Upload(grpc.ClientStreamingServer[UploadRequest, UploadResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedFileStoreServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedFileStoreServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedFileStoreServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedFileStoreServer) MatchHashes(context.Context, *MatchHashesRequest) (*MatchHashesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MatchHashes not implemented")
+}
+func (UnimplementedFileStoreServer) WordCount(context.Context, *WordCountRequest) (*WordCountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WordCount not implemented")
+}
+func (UnimplementedFileStoreServer) FrequentWords(context.Context, *FrequentWordsRequest) (*FrequentWordsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FrequentWords not implemented")
+}
+func (UnimplementedFileStoreServer) Ngrams(context.Context, *NgramsRequest) (*NgramsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ngrams not implemented")
+}
+func (UnimplementedFileStoreServer) Grep(*GrepRequest, grpc.ServerStreamingServer[GrepLine]) error {
+	return status.Errorf(codes.Unimplemented, "method Grep not implemented")
+}
+func (UnimplementedFileStoreServer) FreqDiff(context.Context, *FreqDiffRequest) (*FreqDiffResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FreqDiff not implemented")
+}
+func (UnimplementedFileStoreServer) IntegrityScan(context.Context, *IntegrityScanRequest) (*IntegrityScanResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IntegrityScan not implemented")
+}
+func (UnimplementedFileStoreServer) mustEmbedUnimplementedFileStoreServer() {}
+func (UnimplementedFileStoreServer) testEmbeddedByValue()                   {}
+
+// UnsafeFileStoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FileStoreServer will
+// result in compilation errors.
+type UnsafeFileStoreServer interface {
+	mustEmbedUnimplementedFileStoreServer()
+}
+
+func RegisterFileStoreServer(s grpc.ServiceRegistrar, srv FileStoreServer) {
+	// If the following call pancis, it indicates UnimplementedFileStoreServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&FileStore_ServiceDesc, srv)
+}
+
+func _FileStore_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileStoreServer).Upload(&grpc.GenericServerStream[UploadRequest, UploadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileStore_UploadServer = grpc.ClientStreamingServer[UploadRequest, UploadResponse]
+
+func _FileStore_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileStoreServer).Download(m, &grpc.GenericServerStream[DownloadRequest, DownloadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileStore_DownloadServer = grpc.ServerStreamingServer[DownloadResponse]
+
+func _FileStore_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStore_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStore_MatchHashes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MatchHashesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).MatchHashes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_MatchHashes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).MatchHashes(ctx, req.(*MatchHashesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStore_WordCount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WordCountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).WordCount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_WordCount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).WordCount(ctx, req.(*WordCountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStore_FrequentWords_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FrequentWordsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).FrequentWords(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_FrequentWords_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).FrequentWords(ctx, req.(*FrequentWordsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStore_Ngrams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NgramsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).Ngrams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_Ngrams_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).Ngrams(ctx, req.(*NgramsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStore_Grep_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GrepRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileStoreServer).Grep(m, &grpc.GenericServerStream[GrepRequest, GrepLine]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileStore_GrepServer = grpc.ServerStreamingServer[GrepLine]
+
+func _FileStore_FreqDiff_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FreqDiffRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).FreqDiff(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_FreqDiff_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).FreqDiff(ctx, req.(*FreqDiffRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileStore_IntegrityScan_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IntegrityScanRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileStoreServer).IntegrityScan(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileStore_IntegrityScan_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileStoreServer).IntegrityScan(ctx, req.(*IntegrityScanRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// FileStore_ServiceDesc is the grpc.ServiceDesc for FileStore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FileStore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "store.v1.FileStore",
+	HandlerType: (*FileStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "List",
+			Handler:    _FileStore_List_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _FileStore_Delete_Handler,
+		},
+		{
+			MethodName: "MatchHashes",
+			Handler:    _FileStore_MatchHashes_Handler,
+		},
+		{
+			MethodName: "WordCount",
+			Handler:    _FileStore_WordCount_Handler,
+		},
+		{
+			MethodName: "FrequentWords",
+			Handler:    _FileStore_FrequentWords_Handler,
+		},
+		{
+			MethodName: "Ngrams",
+			Handler:    _FileStore_Ngrams_Handler,
+		},
+		{
+			MethodName: "FreqDiff",
+			Handler:    _FileStore_FreqDiff_Handler,
+		},
+		{
+			MethodName: "IntegrityScan",
+			Handler:    _FileStore_IntegrityScan_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _FileStore_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Download",
+			Handler:       _FileStore_Download_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Grep",
+			Handler:       _FileStore_Grep_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "store/v1/store.proto",
+}